@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+	"github.com/rabin-nyaundi/shared/config"
+	"github.com/rabin-nyaundi/shared/cors"
+)
+
+// envPrefix prefixes the environment variables of the settings, AUTH_DB_DSN
+// for -db-dsn
+const envPrefix = "AUTH"
+
+// loadConfig reads the configuration from args, the environment, secret
+// files and the config file. The older unprefixed variables, DATABASE_DSN
+// and the like, are still read as defaults.
+func loadConfig(args []string) (Config, *config.Loader, error) {
+	var cfg Config
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loader := config.New(fs, envPrefix)
+
+	fs.IntVar(&cfg.port, "port", 80, "Authentication server port")
+	fs.IntVar(&cfg.grpcPort, "grpc-port", 50051, "gRPC server port (0 disables the gRPC API)")
+	fs.DurationVar(&cfg.configWatchInterval, "config-watch-interval", 5*time.Second, "How often the config file is checked for changes to reload (0 reloads on SIGHUP only)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DATABASE_DSN"), "Database connection string")
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL maximum open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL maximum idle connections")
+	fs.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "10m", "PostgreSQL maximum idle time")
+	fs.BoolVar(&cfg.migrateOnStart, "migrate-on-start", os.Getenv("MIGRATE_ON_START") == "true", "Apply pending database migrations before serving")
+	fs.StringVar(&cfg.mailServiceURL, "mail-service-url", "http://mail-service", "Base URL of the mail-service")
+	fs.StringVar(&cfg.mailServiceToken, "mail-service-token", "", "Service token sent to the mail-service, one of its -service-tokens")
+	fs.Var(&cfg.serviceTokens, "service-tokens", "Comma separated tokens services send in the X-Service-Token header to look up users and introspect tokens, with or instead of a client certificate")
+	fs.BoolVar(&cfg.echoTokens, "echo-tokens", os.Getenv("ECHO_TOKENS") == "true", "Also return activation and password reset tokens in responses (development only)")
+	fs.DurationVar(&cfg.tokens.activationTTL, "activation-token-ttl", 24*time.Hour, "Lifetime of account activation tokens")
+	fs.DurationVar(&cfg.tokens.authenticationTTL, "auth-token-ttl", 24*time.Hour, "Lifetime of authentication tokens")
+	fs.DurationVar(&cfg.tokens.passwordResetTTL, "password-reset-token-ttl", 45*time.Minute, "Lifetime of password reset tokens")
+	fs.IntVar(&cfg.bcryptCost, "bcrypt-cost", data.PasswordCost, "bcrypt cost of password hashes")
+	fs.Var(&cfg.cors.allowedOrigins, "cors-allowed-origins", "Comma separated origins allowed to make cross-origin requests, exact or wildcard subdomains as https://*.example.com")
+	fs.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", true, "Allow cross-origin requests with credentials from allowed origins")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", 5*time.Minute, "How long browsers may cache preflight responses (0 leaves it to the browser, negative disables caching)")
+	cfg.cors.routes = config.List{"/openapi.json=*", "/docs=*", "/health=*"}
+	fs.Var(&cfg.cors.routes, "cors-routes", "Comma separated PATH=ORIGIN ORIGIN... overrides of the allowed origins, PATH exact or a prefix ending in /*")
+	fs.StringVar(&cfg.tls.certFile, "tls-cert-file", "", "PEM certificate chain to serve HTTPS and gRPC over TLS with, reloaded when it changes (empty serves plain text)")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key-file", "", "PEM private key of -tls-cert-file")
+	fs.StringVar(&cfg.tls.clientCAFile, "tls-client-ca-file", "", "PEM CA certificates client certificates must be signed by; every client must present one (mutual TLS)")
+	fs.Var(&cfg.tls.clientSANs, "tls-client-sans", "Comma separated DNS names, URIs, emails or IP addresses of the client certificates allowed to call, matched against their SANs (empty allows every certificate of the CA)")
+	fs.StringVar(&cfg.outbox.publisher, "outbox-publisher", envOr("OUTBOX_PUBLISHER", "log"), "Where outbox events are published (log|amqp)")
+	fs.StringVar(&cfg.outbox.amqpURL, "outbox-amqp-url", os.Getenv("AMQP_URL"), "AMQP URL for the amqp publisher")
+	fs.StringVar(&cfg.outbox.exchange, "outbox-exchange", "broker.events", "AMQP topic exchange events are published to")
+	fs.DurationVar(&cfg.outbox.interval, "outbox-interval", time.Second, "How often the outbox is polled for pending events")
+	fs.IntVar(&cfg.outbox.batchSize, "outbox-batch-size", 100, "Maximum events published per outbox poll")
+	fs.DurationVar(&cfg.outbox.retention, "outbox-retention", 7*24*time.Hour, "How long published events are kept (0 keeps them)")
+	fs.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "Timeout of a single webhook delivery")
+	fs.IntVar(&cfg.webhooks.batchSize, "webhook-batch-size", 20, "Maximum webhook deliveries sent per poll")
+	fs.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 8, "Attempts before a webhook delivery is marked failed")
+	fs.IntVar(&cfg.webhooks.disableAfter, "webhook-disable-after", 20, "Consecutive failed attempts after which a webhook is disabled")
+
+	loader.Secret("db-dsn", "service-tokens", "mail-service-token")
+
+	err := loader.Load(args)
+	return cfg, loader, err
+}
+
+// validate reports every invalid setting
+func (cfg Config) validate() error {
+	var p config.Problems
+
+	p.Check(cfg.port > 0 && cfg.port < 65536, "port must be between 1 and 65535")
+	p.Check(cfg.grpcPort >= 0 && cfg.grpcPort < 65536, "grpc-port must be between 0 and 65535")
+	p.Check(cfg.grpcPort != cfg.port, "grpc-port must differ from port")
+	p.Check(cfg.configWatchInterval >= 0, "config-watch-interval must not be negative")
+
+	p.Check(cfg.db.dsn != "", "db-dsn must be provided, with -db-dsn, %s_DB_DSN or %s_DB_DSN_FILE", envPrefix, envPrefix)
+	p.Check(cfg.db.maxOpenConns > 0, "db-max-open-conns must be positive")
+	p.Check(cfg.db.maxIdleConns >= 0, "db-max-idle-conns must not be negative")
+	_, err := time.ParseDuration(cfg.db.maxIdleTime)
+	p.Check(err == nil, "db-max-idle-time %q is not a duration", cfg.db.maxIdleTime)
+
+	u, err := url.Parse(cfg.mailServiceURL)
+	p.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "mail-service-url must be an http or https URL")
+
+	p.Check(cfg.tokens.activationTTL > 0, "activation-token-ttl must be positive")
+	p.Check(cfg.tokens.authenticationTTL > 0, "auth-token-ttl must be positive")
+	p.Check(cfg.tokens.passwordResetTTL > 0, "password-reset-token-ttl must be positive")
+	p.Check(cfg.bcryptCost >= bcrypt.MinCost && cfg.bcryptCost <= bcrypt.MaxCost, "bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	_, err = cfg.corsHandler()
+	p.Check(err == nil, "cors: %v", err)
+
+	p.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-cert-file and tls-key-file must be provided together")
+	p.Check(cfg.tls.clientCAFile == "" || cfg.tls.certFile != "", "tls-client-ca-file needs tls-cert-file and tls-key-file")
+	p.Check(len(cfg.tls.clientSANs) == 0 || cfg.tls.clientCAFile != "", "tls-client-sans needs tls-client-ca-file")
+
+	switch cfg.outbox.publisher {
+	case "log":
+	case "amqp":
+		p.Check(cfg.outbox.amqpURL != "", "outbox-amqp-url must be provided for the amqp publisher")
+	default:
+		p.Check(false, "outbox-publisher must be log or amqp, not %q", cfg.outbox.publisher)
+	}
+	p.Check(cfg.outbox.interval > 0, "outbox-interval must be positive")
+	p.Check(cfg.outbox.batchSize > 0, "outbox-batch-size must be positive")
+	p.Check(cfg.outbox.retention >= 0, "outbox-retention must not be negative")
+
+	p.Check(cfg.webhooks.timeout > 0, "webhook-timeout must be positive")
+	p.Check(cfg.webhooks.batchSize > 0, "webhook-batch-size must be positive")
+	p.Check(cfg.webhooks.maxAttempts > 0, "webhook-max-attempts must be positive")
+	p.Check(cfg.webhooks.disableAfter > 0, "webhook-disable-after must be positive")
+
+	return p.Err()
+}
+
+// corsHandler builds the CORS handler of the settings
+func (cfg Config) corsHandler() (*cors.Handler, error) {
+	policy := cors.Policy{
+		AllowedOrigins:   cfg.cors.allowedOrigins,
+		AllowedMethods:   []string{"POST", "PUT", "GET", "DELETE"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: cfg.cors.allowCredentials,
+		MaxAge:           cfg.cors.maxAge,
+	}
+
+	routes, err := cors.ParseRoutes(cfg.cors.routes, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return cors.New(policy, routes, corsMetrics)
+}
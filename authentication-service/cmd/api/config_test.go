@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAMQPPublisherNeedsURL(t *testing.T) {
+	t.Setenv("AMQP_URL", "")
+
+	cfg, _, err := loadConfig([]string{"-outbox-publisher=amqp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.validate()
+	if err == nil || !strings.Contains(err.Error(), "outbox-amqp-url must be provided") {
+		t.Errorf("amqp publisher without a url: %v, want outbox-amqp-url to be required", err)
+	}
+}
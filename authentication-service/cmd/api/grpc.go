@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+	authv1 "github.com/rabin-nyaundi/authentication-service/internal/pb/auth/v1"
+)
+
+// authServer implements the gRPC AuthService on top of the application's models
+type authServer struct {
+	authv1.UnimplementedAuthServiceServer
+	app *application
+}
+
+// grpcServer returns the gRPC server with the AuthService, the health service
+// and server reflection registered, serving TLS when tlsConfig is not nil
+func (app *application) grpcServer(tlsConfig *tls.Config) (*grpc.Server, *health.Server) {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(recoverUnary, logUnary)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	srv := grpc.NewServer(opts...)
+
+	authv1.RegisterAuthServiceServer(srv, &authServer{app: app})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(authv1.AuthService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, healthServer)
+
+	reflection.Register(srv)
+
+	return srv, healthServer
+}
+
+// recoverUnary turns a panicking handler into an Internal error instead of
+// crashing the process
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("grpc %s panicked: %v\n%s", info.FullMethod, p, debug.Stack())
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// logUnary logs failed calls
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if err != nil {
+		log.Printf("grpc %s %s in %s: %v", info.FullMethod, status.Code(err), time.Since(start), err)
+	}
+	return resp, err
+}
+
+// toProtoUser converts a user to its protobuf message
+func toProtoUser(user *data.User) *authv1.User {
+	u := &authv1.User{
+		Id:        user.ID,
+		Firstname: user.FirstName,
+		Lastname:  user.LastName,
+		Email:     user.Email,
+		Active:    user.Active,
+		Role:      int32(user.Role),
+	}
+	if !user.CreatedAt.IsZero() {
+		u.CreatedAt = timestamppb.New(user.CreatedAt)
+	}
+	if !user.UpdatedAt.IsZero() {
+		u.UpdatedAt = timestamppb.New(user.UpdatedAt)
+	}
+	return u
+}
+
+func (s *authServer) CreateUser(ctx context.Context, req *authv1.CreateUserRequest) (*authv1.CreateUserResponse, error) {
+	if req.GetEmail() == "" || len(req.GetPassword()) < 8 {
+		return nil, status.Error(codes.InvalidArgument, "email and a password of at least 8 characters must be provided")
+	}
+
+	user := &data.User{
+		FirstName: req.GetFirstname(),
+		LastName:  req.GetLastname(),
+		Email:     req.GetEmail(),
+	}
+
+	err := user.Password.Set(req.GetPassword())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = s.app.models.User.Insert(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.DuplicateEmail):
+			return nil, status.Error(codes.AlreadyExists, "user with email already exists")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	token, err := s.app.models.Token.New(user.ID, s.app.config().tokens.activationTTL, data.ScopeActivation)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	s.app.sendWelcomeEmail(user, token)
+
+	return &authv1.CreateUserResponse{User: toProtoUser(user)}, nil
+}
+
+func (s *authServer) Authenticate(ctx context.Context, req *authv1.AuthenticateRequest) (*authv1.AuthenticateResponse, error) {
+	user, err := s.app.models.User.GetByEmail(req.GetEmail())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, errInvalidCredentials.Error())
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	valid, err := user.Password.MatchesPassword(req.GetPassword())
+	if err != nil || !valid {
+		return nil, status.Error(codes.Unauthenticated, errInvalidCredentials.Error())
+	}
+
+	if user.Locked {
+		return nil, status.Error(codes.PermissionDenied, errAccountLocked.Error())
+	}
+
+	err = s.app.models.Outbox.Add(user.ID, data.EventUserLoggedIn, map[string]interface{}{"user_id": user.ID})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &authv1.AuthenticateResponse{User: toProtoUser(user)}, nil
+}
+
+func (s *authServer) GetUser(ctx context.Context, req *authv1.GetUserRequest) (*authv1.GetUserResponse, error) {
+	err := s.requireServiceOrAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetId() < 1 {
+		return nil, status.Error(codes.InvalidArgument, "invalid id")
+	}
+
+	user, err := s.app.models.User.GetOneUser(int(req.GetId()))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	user.ID = req.GetId()
+
+	return &authv1.GetUserResponse{User: toProtoUser(user)}, nil
+}
+
+func (s *authServer) ValidateToken(ctx context.Context, req *authv1.ValidateTokenRequest) (*authv1.ValidateTokenResponse, error) {
+	err := s.requireServiceOrAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, token, err := s.app.models.Token.GetForToken(data.ScopeAuthentication, req.GetToken())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return &authv1.ValidateTokenResponse{Active: false}, nil
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &authv1.ValidateTokenResponse{
+		Active: true,
+		UserId: user.ID,
+		Email:  user.Email,
+		Scopes: user.Scopes(),
+		Exp:    token.Expiry.Unix(),
+	}, nil
+}
+
+func (s *authServer) ListUsers(ctx context.Context, req *authv1.ListUsersRequest) (*authv1.ListUsersResponse, error) {
+	err := s.requireServiceOrAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(req.GetPageSize())
+	switch {
+	case size <= 0:
+		size = 50
+	case size > 500:
+		size = 500
+	}
+
+	var after int64
+	if req.GetPageToken() != "" {
+		after, err = strconv.ParseInt(req.GetPageToken(), 10, 64)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page_token")
+		}
+	}
+
+	// one extra row tells whether there is a next page
+	users, err := s.app.models.User.List(after, size+1)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := &authv1.ListUsersResponse{}
+	if len(users) > size {
+		users = users[:size]
+		resp.NextPageToken = strconv.FormatInt(users[size-1].ID, 10)
+	}
+
+	for _, user := range users {
+		resp.Users = append(resp.Users, toProtoUser(user))
+	}
+
+	return resp, nil
+}
+
+// requireAdmin checks the bearer token in the authorization metadata belongs
+// to an admin
+func (s *authServer) requireAdmin(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		token = strings.TrimPrefix(values[0], "Bearer ")
+	}
+	if token == "" {
+		return status.Error(codes.Unauthenticated, errInvalidToken.Error())
+	}
+
+	user, _, err := s.app.models.Token.GetForToken(data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			return status.Error(codes.Unauthenticated, errInvalidToken.Error())
+		default:
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if user.Role < data.RoleAdmin {
+		return status.Error(codes.PermissionDenied, errAdminRequired.Error())
+	}
+	return nil
+}
+
+// requireServiceOrAdmin lets through calls from other services, over a
+// connection with a verified client certificate or with one of the
+// service-tokens in the x-service-token metadata, and calls of admins
+func (s *authServer) requireServiceOrAdmin(ctx context.Context) error {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+			return nil
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("x-service-token"); len(values) > 0 && s.app.config().isServiceToken(values[0]) {
+		return nil
+	}
+
+	return s.requireAdmin(ctx)
+}
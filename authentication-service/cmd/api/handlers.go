@@ -1,14 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+
 	"github.com/rabin-nyaundi/authentication-service/internal/data"
 )
 
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errInvalidToken       = errors.New("invalid or expired token")
+	errAccountLocked      = errors.New("this account is locked")
+)
+
 // createUserHandeler adds a user to the database and a tokn to the tokens table
 func (app *application) createUserHandeler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
@@ -54,19 +67,30 @@ func (app *application) createUserHandeler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	duration := 1 * 24 * time.Hour
-	token, err := app.models.Token.New(user.ID, duration, data.ScopeActivation)
+	token, err := app.models.Token.New(user.ID, app.config().tokens.activationTTL, data.ScopeActivation)
 
 	if err != nil {
 		log.Panic(err)
 		return
 	}
 
+	app.sendWelcomeEmail(user, token)
+
+	var response struct {
+		User            *data.User  `json:"user"`
+		ActivationToken *data.Token `json:"activation_token,omitempty"`
+	}
+	response.User = user
+
+	if app.config().echoTokens {
+		response.ActivationToken = token
+	}
+
 	err = app.writeJSON(w, http.StatusCreated,
 		JSONResponse{
 			Success: true,
 			Message: "user creation success",
-			Data:    token,
+			Data:    response,
 		})
 
 	if err != nil {
@@ -76,6 +100,160 @@ func (app *application) createUserHandeler(w http.ResponseWriter, r *http.Reques
 
 }
 
+// sendWelcomeEmail emails the activation token to a new user in the background
+func (app *application) sendWelcomeEmail(user *data.User, token *data.Token) {
+	app.background(func() {
+		err := app.mailer.Send(context.Background(), user.Email, "welcome", map[string]interface{}{
+			"firstname":       user.FirstName,
+			"activationToken": token.Plaintext,
+		})
+		if err != nil {
+			log.Printf("sending welcome email to user %d: %v", user.ID, err)
+		}
+	})
+}
+
+// activateUserHandler activates the user owning a valid activation token
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, _, err := app.models.Token.GetForToken(data.ScopeActivation, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, errInvalidToken, http.StatusUnprocessableEntity)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.models.User.Activate(user)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.models.Token.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "user activated",
+		Data:    user,
+	})
+}
+
+// createPasswordResetTokenHandler emails a password reset token to the user.
+// The response is the same whether or not the email exists.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	response := JSONResponse{
+		Success: true,
+		Message: "an email will be sent to you containing password reset instructions",
+	}
+
+	user, err := app.models.User.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.writeJSON(w, http.StatusAccepted, response)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	token, err := app.models.Token.New(user.ID, app.config().tokens.passwordResetTTL, data.ScopePasswordReset)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(context.Background(), user.Email, "password_reset", map[string]interface{}{
+			"firstname":          user.FirstName,
+			"passwordResetToken": token.Plaintext,
+		})
+		if err != nil {
+			log.Printf("sending password reset email to user %d: %v", user.ID, err)
+		}
+	})
+
+	if app.config().echoTokens {
+		response.Data = map[string]*data.Token{"password_reset_token": token}
+	}
+
+	app.writeJSON(w, http.StatusAccepted, response)
+}
+
+// updateUserPasswordHandler sets a new password using a password reset token
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(input.Password) < 8 {
+		app.JSONEror(w, errors.New("password must be at least 8 characters long"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	user, _, err := app.models.Token.GetForToken(data.ScopePasswordReset, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, errInvalidToken, http.StatusUnprocessableEntity)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	err = app.models.User.ResetPassword(input.Password, user)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.models.Token.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "your password was successfully reset",
+	})
+}
+
 // authenticateHandler checks the given user details against the databse if the match and return json response
 func (app *application) authenticateHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
@@ -90,18 +268,31 @@ func (app *application) authenticateHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	user, err := app.models.User.GetByEmail(input.Email)
-
-	log.Println(user)
-
 	if err != nil {
-		app.JSONEror(w, err, http.StatusBadRequest)
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, errInvalidCredentials, http.StatusUnauthorized)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
 		return
 	}
 
 	valid, err := user.Password.MatchesPassword(input.Password)
 
 	if err != nil || !valid {
-		app.JSONEror(w, err, http.StatusUnauthorized)
+		app.JSONEror(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	if user.Locked {
+		app.JSONEror(w, errAccountLocked, http.StatusForbidden)
+		return
+	}
+
+	err = app.models.Outbox.Add(user.ID, data.EventUserLoggedIn, map[string]interface{}{"user_id": user.ID})
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -113,26 +304,333 @@ func (app *application) authenticateHandler(w http.ResponseWriter, r *http.Reque
 
 }
 
+// createAuthenticationTokenHandler issues a bearer token for valid credentials
+func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.models.User.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, errInvalidCredentials, http.StatusUnauthorized)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	valid, err := user.Password.MatchesPassword(input.Password)
+	if err != nil || !valid {
+		app.JSONEror(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
+	}
+
+	if user.Locked {
+		app.JSONEror(w, errAccountLocked, http.StatusForbidden)
+		return
+	}
+
+	token, err := app.models.Token.New(user.ID, app.config().tokens.authenticationTTL, data.ScopeAuthentication)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, JSONResponse{
+		Success: true,
+		Message: "authentication token created",
+		Data:    token,
+	})
+}
+
+// introspectTokenHandler reports whether an authentication token is active and
+// who it belongs to, so other services can validate bearer tokens. UserActive
+// tells whether the owner has activated their account.
+func (app *application) introspectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	type introspection struct {
+		Active     bool     `json:"active"`
+		UserID     int64    `json:"user_id,omitempty"`
+		Email      string   `json:"email,omitempty"`
+		UserActive bool     `json:"user_active,omitempty"`
+		Scopes     []string `json:"scopes,omitempty"`
+		Expiry     int64    `json:"exp,omitempty"`
+	}
+
+	user, token, err := app.models.Token.GetForToken(data.ScopeAuthentication, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.writeJSON(w, http.StatusOK, JSONResponse{
+				Success: true,
+				Message: "token introspection",
+				Data:    introspection{Active: false},
+			})
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "token introspection",
+		Data: introspection{
+			Active:     true,
+			UserID:     user.ID,
+			Email:      user.Email,
+			UserActive: user.Active,
+			Scopes:     user.Scopes(),
+			Expiry:     token.Expiry.Unix(),
+		},
+	})
+}
+
 // fetchUserHandler returns a singl user from database
 func (app *application) fetchUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	id, err := app.readIDParams(w, r)
-
+	id, err := app.readIDParams(r)
 	if err != nil {
-		log.Panic(err)
+		app.JSONEror(w, err, http.StatusBadRequest)
 		return
 	}
 
 	user, err := app.models.User.GetOneUser(int(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, err, http.StatusNotFound)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "success",
+		Data:    user,
+	})
+}
 
+// listUsersHandler returns the users whose ids are given as ?ids=1,2,3 so
+// callers can fetch several users in one request
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []int64
+
+	for _, v := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 1 {
+			app.JSONEror(w, fmt.Errorf("invalid id %q", v), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 || len(ids) > 100 {
+		app.JSONEror(w, errors.New("ids must contain between 1 and 100 user ids"), http.StatusBadRequest)
+		return
+	}
+
+	users, err := app.models.User.GetMany(ids)
 	if err != nil {
-		log.Panic(err)
+		app.JSONEror(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	app.writeJSON(w, http.StatusOK, JSONResponse{
 		Success: true,
 		Message: "success",
+		Data:    users,
+	})
+}
+
+// listRolesHandler returns every role and the scopes it grants
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "roles",
+		Data:    data.Roles,
+	})
+}
+
+// readUserForAdmin returns the user named by the id in the URL, writing the
+// error response when there is none
+func (app *application) readUserForAdmin(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		app.JSONEror(w, data.ErrorRecordNotFound, http.StatusNotFound)
+		return nil, false
+	}
+
+	user, err := app.models.User.GetOneUser(int(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, err, http.StatusNotFound)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+
+	user.ID = id
+	return user, true
+}
+
+// updateUserRoleHandler changes the role of a user
+func (app *application) updateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserForAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Role *int `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if input.Role == nil || *input.Role < 0 || *input.Role >= len(data.Roles) {
+		app.JSONEror(w, fmt.Errorf("role must be between 0 and %d", len(data.Roles)-1), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if *input.Role != user.Role {
+		err = app.models.User.SetRole(user, *input.Role)
+		if err != nil {
+			app.JSONEror(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "role updated",
+		Data:    user,
+	})
+}
+
+// lockUserHandler locks or unlocks a user. A locked user cannot log in and
+// their sessions are ended.
+func (app *application) lockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserForAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Locked *bool `json:"locked"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if input.Locked == nil {
+		app.JSONEror(w, errors.New("locked must be provided"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if *input.Locked != user.Locked {
+		err = app.models.User.SetLocked(user, *input.Locked)
+		if err != nil {
+			app.JSONEror(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	message := "user unlocked"
+	if user.Locked {
+		message = "user locked"
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: message,
 		Data:    user,
 	})
 }
+
+// session is an unexpired authentication token of a user
+type session struct {
+	ID      string    `json:"id"`
+	Expiry  time.Time `json:"expiry"`
+	Current bool      `json:"current"`
+}
+
+// listSessionsHandler returns the sessions of the bearer token's user
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, current, ok := app.bearerUser(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := app.models.Token.ListForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	sessions := make([]session, 0, len(tokens))
+	for _, token := range tokens {
+		sessions = append(sessions, session{
+			ID:      data.SessionID(token.Hash),
+			Expiry:  token.Expiry,
+			Current: bytes.Equal(token.Hash, current.Hash),
+		})
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "sessions",
+		Data:    sessions,
+	})
+}
+
+// deleteAuthenticationTokenHandler logs out by deleting the bearer token
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	_, token, ok := app.bearerUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Token.Delete(data.ScopeAuthentication, token.Plaintext)
+	if err != nil && !errors.Is(err, data.ErrorRecordNotFound) {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "logged out",
+	})
+}
@@ -16,18 +16,13 @@ import (
 // JSONResponse structure holds response sent to a clint
 
 // readIDParams returns the id from the get request
-func (app *application) readIDParams(w http.ResponseWriter, r *http.Request) (int64, error) {
-	userID := chi.URLParam(r, "id")
-	id, err := strconv.ParseInt(userID, 10, 12)
-
-	if err != nil {
-		log.Panic(err)
-		return 0, err
+func (app *application) readIDParams(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id parameter")
 	}
 
-	fmt.Println(r.URL)
 	return id, nil
-
 }
 
 // writeJSON converts data provided to jon format
@@ -41,7 +36,7 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data any) e
 
 	jsonObject = append(jsonObject, '\n')
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(jsonObject)
 	return nil
 }
@@ -115,3 +110,21 @@ func (app *application) JSONEror(w http.ResponseWriter, err error, status ...int
 	return app.writeJSON(w, statusCode, payload)
 
 }
+
+// background runs fn in a goroutine tracked by the application's WaitGroup so
+// graceful shutdown waits for it, recovering and logging any panic
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("background task panicked: %v", err)
+			}
+		}()
+
+		fn()
+	}()
+}
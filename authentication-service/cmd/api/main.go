@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"database/sql"
-	"flag"
-	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rabin-nyaundi/authentication-service/internal/data"
+	"github.com/rabin-nyaundi/authentication-service/internal/events"
+	"github.com/rabin-nyaundi/authentication-service/internal/mailer"
+	"github.com/rabin-nyaundi/shared/certs"
+	"github.com/rabin-nyaundi/shared/config"
+	"github.com/rabin-nyaundi/shared/openapi"
 
 	_ "github.com/lib/pq"
 )
@@ -27,29 +31,94 @@ type JSONResponse struct {
 // }
 
 type Config struct {
-	port int
-	db   struct {
+	port                int
+	grpcPort            int
+	migrateOnStart      bool
+	configWatchInterval time.Duration
+	db                  struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
 	}
+	mailServiceURL   string
+	mailServiceToken string
+	// serviceTokens are the credentials other services send in the
+	// X-Service-Token header
+	serviceTokens config.List
+	tokens        struct {
+		activationTTL     time.Duration
+		authenticationTTL time.Duration
+		passwordResetTTL  time.Duration
+	}
+	bcryptCost int
+	cors       struct {
+		allowedOrigins   config.List
+		allowCredentials bool
+		maxAge           time.Duration
+		routes           config.List
+	}
+	tls struct {
+		certFile     string
+		keyFile      string
+		clientCAFile string
+		clientSANs   config.List
+	}
+	// echoTokens returns activation and password reset tokens in responses,
+	// for development environments without a mail sink
+	echoTokens bool
+	outbox     struct {
+		publisher string
+		amqpURL   string
+		exchange  string
+		interval  time.Duration
+		batchSize int
+		retention time.Duration
+	}
+	webhooks struct {
+		timeout      time.Duration
+		batchSize    int
+		maxAttempts  int
+		disableAfter int
+	}
 }
 
 type application struct {
-	config Config
-	models data.Models
+	settings  atomic.Pointer[settings]
+	models    data.Models
+	mailer    *mailer.Mailer
+	publisher events.Publisher
+	spec      *openapi.Document
+	// certs serves TLS, nil for plain text
+	certs *certs.Store
+	wg    sync.WaitGroup
+	// done is closed when the server starts shutting down
+	done chan struct{}
 }
 
 func main() {
-	var cfg Config
+	cfg, loader, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if loader.PrintRequested() {
+		err = loader.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	flag.IntVar(&cfg.port, "port", 80, "Authentication server port")
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DATABASE_DSN"), "Database connection string")
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL maximum open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL maximum idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "10m", "PostgreSQL maximum idle time")
-	flag.Parse()
+	if loader.PrintRequested() {
+		return
+	}
+
+	data.PasswordCost = cfg.bcryptCost
 
 	db, err := OpenDB(cfg)
 	if err != nil {
@@ -58,25 +127,76 @@ func main() {
 	}
 	defer db.Close()
 
-	app := &application{
-		config: cfg,
-		models: data.NewModel(db),
+	// authApp migrate <command> manages the schema instead of serving
+	if args := loader.Args(); len(args) > 0 && args[0] == "migrate" {
+		err = runMigrate(db, args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if args := loader.Args(); len(args) > 0 {
+		log.Fatalf("unknown command %q", args[0])
 	}
 
-	log.Printf("Starting server at port:%d", cfg.port)
-	svr := &http.Server{
-		Addr:    fmt.Sprintf(":%d", app.config.port),
-		Handler: app.routes(),
+	if cfg.migrateOnStart {
+		err = migrateOnStart(db)
+		if err != nil {
+			log.Panic(err)
+			return
+		}
 	}
 
-	err = svr.ListenAndServe()
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		log.Panic(err)
+		return
+	}
 
+	publisher, err := openPublisher(cfg)
 	if err != nil {
 		log.Panic(err)
 		return
 	}
+	defer publisher.Close()
 
-	log.Printf("server started at port:%d", cfg.port)
+	tlsCerts, err := openCertificates(cfg)
+	if err != nil {
+		log.Panic(err)
+		return
+	}
+
+	app := &application{
+		models:    data.NewModel(db),
+		mailer:    mailer.New(cfg.mailServiceURL, cfg.mailServiceToken),
+		publisher: publisher,
+		spec:      spec,
+		certs:     tlsCerts,
+		done:      make(chan struct{}),
+	}
+
+	current, err := newSettings(cfg, loader)
+	if err != nil {
+		log.Panic(err)
+		return
+	}
+	app.settings.Store(current)
+	app.watchConfig(os.Args[1:], loader)
+
+	app.startOutboxRelay()
+	app.startWebhookDispatcher()
+
+	if cfg.echoTokens {
+		log.Printf("echo-tokens is enabled, tokens are returned in responses")
+	}
+
+	err = app.serve()
+
+	if err != nil {
+		log.Panic(err)
+		return
+	}
 }
 
 func OpenDB(cfg Config) (*sql.DB, error) {
@@ -110,3 +230,11 @@ func OpenDB(cfg Config) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// envOr returns the environment variable or the fallback when it is unset
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+)
+
+var errAdminRequired = errors.New("this resource requires an admin authentication token")
+
+// serviceTokenHeader carries the service-tokens credential
+const serviceTokenHeader = "X-Service-Token"
+
+// bearerUser returns the user and token of the request's bearer
+// authentication token, writing the error response when there is none
+func (app *application) bearerUser(w http.ResponseWriter, r *http.Request) (*data.User, *data.Token, bool) {
+	w.Header().Add("Vary", "Authorization")
+
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if header == "" || token == header {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		app.JSONEror(w, errInvalidToken, http.StatusUnauthorized)
+		return nil, nil, false
+	}
+
+	user, t, err := app.models.Token.GetForToken(data.ScopeAuthentication, token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			app.JSONEror(w, errInvalidToken, http.StatusUnauthorized)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return nil, nil, false
+	}
+
+	return user, t, true
+}
+
+// requireAdmin only lets through requests bearing an authentication token of
+// an admin user
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, ok := app.bearerUser(w, r)
+		if !ok {
+			return
+		}
+
+		if user.Role < data.RoleAdmin {
+			app.JSONEror(w, errAdminRequired, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireServiceOrAdmin lets through requests from other services, see
+// isService, and requests bearing an authentication token of an admin user
+func (app *application) requireServiceOrAdmin(next http.Handler) http.Handler {
+	admin := app.requireAdmin(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", serviceTokenHeader)
+
+		if app.isService(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// isService reports whether a request comes from another service, either
+// over a connection with a client certificate, which the TLS handshake only
+// accepts once verified and authorized, or with one of the service-tokens
+func (app *application) isService(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return true
+	}
+
+	return app.config().isServiceToken(r.Header.Get(serviceTokenHeader))
+}
+
+// isServiceToken reports whether token is one of the service-tokens
+func (cfg *settings) isServiceToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	found := 0
+	for _, t := range cfg.serviceTokens {
+		found |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	return found == 1
+}
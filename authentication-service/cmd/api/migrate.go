@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/rabin-nyaundi/authentication-service/migrations"
+	"github.com/rabin-nyaundi/shared/migrate"
+)
+
+const migrateUsage = `usage: authApp [flags] migrate <command>
+
+Commands:
+  up               apply every pending migration
+  down [n]         revert the last n migrations, 1 by default
+  goto <version>   apply or revert migrations until the database is at version
+  version          print the version of the database
+  force <version>  set the version without migrating, after repairing a failed migration (-1 for none)`
+
+// newMigrator returns a migrator of the embedded migrations
+func newMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+
+	migrator.Logf = log.Printf
+	return migrator, nil
+}
+
+// migrateOnStart applies pending migrations before the server starts.
+// Replicas starting together wait for the one holding the migration lock
+// and then find nothing left to apply.
+func migrateOnStart(db *sql.DB) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("database is at version %d, %d migrations applied", migrator.Latest(), applied)
+	return nil
+}
+
+// runMigrate runs the migrate subcommand
+func runMigrate(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "up" && len(args) == 0:
+		_, err = migrator.Up(ctx)
+
+	case cmd == "down" && len(args) <= 1:
+		n := 1
+		if len(args) == 1 {
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[0])
+			}
+		}
+		_, err = migrator.Down(ctx, n)
+
+	case cmd == "goto" && len(args) == 1:
+		var version int64
+		version, err = parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		_, err = migrator.Goto(ctx, version)
+
+	case cmd == "force" && len(args) == 1:
+		var version int64
+		version, err = parseVersion(args[0])
+		if err != nil {
+			return err
+		}
+		err = migrator.Force(ctx, version)
+
+	case cmd == "version" && len(args) == 0:
+	default:
+		return errors.New(migrateUsage)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, dirty, err := migrator.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		fmt.Printf("%d (dirty)\n", version)
+	} else {
+		fmt.Println(version)
+	}
+	return nil
+}
+
+func parseVersion(s string) (int64, error) {
+	version, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || version < migrate.NoVersion {
+		return 0, fmt.Errorf("invalid version %q", s)
+	}
+	return version, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openapiDocument describes every route of the service. The routes test
+// fails when it and the routes disagree, so both are changed together, and
+// the server logs the differences at startup.
+//
+//go:embed openapi.json
+var openapiDocument []byte
+
+// validationError writes a request the document rejects in the response envelope
+func (app *application) validationError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	app.JSONEror(w, err, status)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+	"github.com/rabin-nyaundi/authentication-service/internal/events"
+)
+
+// openPublisher returns the publisher the outbox relay hands events to
+func openPublisher(cfg Config) (events.Publisher, error) {
+	switch cfg.outbox.publisher {
+	case "log":
+		return events.LogPublisher{}, nil
+	case "amqp":
+		return events.DialAMQP(cfg.outbox.amqpURL, cfg.outbox.exchange)
+	default:
+		return nil, fmt.Errorf("unknown outbox publisher %q", cfg.outbox.publisher)
+	}
+}
+
+// startOutboxRelay publishes pending outbox events every interval until the
+// server shuts down. Events that fail to publish are retried with backoff.
+func (app *application) startOutboxRelay() {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config().outbox.interval)
+		defer ticker.Stop()
+
+		lastPurge := time.Now()
+
+		for {
+			select {
+			case <-app.done:
+				// one last round so events of requests finished during
+				// shutdown are not left waiting for the next start
+				app.relayOutbox()
+				return
+			case <-ticker.C:
+			}
+
+			app.relayOutbox()
+
+			if app.config().outbox.retention > 0 && time.Since(lastPurge) > time.Hour {
+				lastPurge = time.Now()
+
+				n, err := app.models.Outbox.DeletePublishedBefore(time.Now().Add(-app.config().outbox.retention))
+				if err != nil {
+					log.Printf("outbox: purging published events: %v", err)
+				} else if n > 0 {
+					log.Printf("outbox: purged %d published events", n)
+				}
+			}
+		}
+	}()
+}
+
+// relayOutbox publishes batches until no pending event is left
+func (app *application) relayOutbox() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		n, err := app.models.Outbox.Relay(ctx, app.config().outbox.batchSize, func(ctx context.Context, event *data.OutboxEvent) error {
+			return relayEvent(ctx, app.publisher, app.models.Webhooks, event)
+		})
+		cancel()
+
+		if err != nil {
+			log.Printf("outbox: %v", err)
+			return
+		}
+
+		if n < app.config().outbox.batchSize {
+			return
+		}
+	}
+}
+
+// webhookQueue queues the webhook deliveries of an event, so tests can stand
+// in for the database
+type webhookQueue interface {
+	Enqueue(ctx context.Context, event *data.OutboxEvent) error
+}
+
+// relayEvent publishes the event, then queues its webhook deliveries. An
+// event that fails to publish is retried without having queued any, so
+// partners only hear of events the broker was told about.
+func relayEvent(ctx context.Context, publisher events.Publisher, webhooks webhookQueue, event *data.OutboxEvent) error {
+	err := publisher.Publish(ctx, event)
+	if err != nil {
+		log.Printf("outbox: publishing %s %s: %v", event.Type, event.IdempotencyKey, err)
+		return err
+	}
+
+	// when enqueuing fails the event is published again on the next attempt,
+	// which consumers drop by its idempotency key
+	err = webhooks.Enqueue(ctx, event)
+	if err != nil {
+		log.Printf("outbox: enqueuing webhooks for %s %s: %v", event.Type, event.IdempotencyKey, err)
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+)
+
+// flakyPublisher fails as many publishes as failures before accepting events
+type flakyPublisher struct {
+	failures  int
+	published []string
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, event *data.OutboxEvent) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unreachable")
+	}
+	p.published = append(p.published, event.IdempotencyKey)
+	return nil
+}
+
+func (p *flakyPublisher) Close() error {
+	return nil
+}
+
+// recordingQueue records enqueued events after failing as many times as failures
+type recordingQueue struct {
+	failures int
+	enqueued []string
+}
+
+func (q *recordingQueue) Enqueue(ctx context.Context, event *data.OutboxEvent) error {
+	if q.failures > 0 {
+		q.failures--
+		return errors.New("database unreachable")
+	}
+	q.enqueued = append(q.enqueued, event.IdempotencyKey)
+	return nil
+}
+
+func TestRelayEventQueuesWebhooksOncePublished(t *testing.T) {
+	event := &data.OutboxEvent{Type: data.EventSessionRevoked, IdempotencyKey: "a1b2c3", Payload: []byte(`{"user_id":7}`)}
+	publisher := &flakyPublisher{failures: 2}
+	queue := &recordingQueue{}
+
+	// the relay retries the event until it is relayed
+	for attempt := 1; attempt <= 2; attempt++ {
+		err := relayEvent(context.Background(), publisher, queue, event)
+		if err == nil {
+			t.Fatalf("attempt %d relayed while the publisher fails", attempt)
+		}
+		if len(queue.enqueued) != 0 {
+			t.Fatalf("attempt %d: webhooks queued for an event that was not published", attempt)
+		}
+	}
+
+	err := relayEvent(context.Background(), publisher, queue, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.published) != 1 || len(queue.enqueued) != 1 {
+		t.Errorf("published %v and queued %v, want the event once each", publisher.published, queue.enqueued)
+	}
+}
+
+func TestRelayEventRetriesFailedEnqueue(t *testing.T) {
+	event := &data.OutboxEvent{Type: data.EventUserLocked, IdempotencyKey: "d4e5f6", Payload: []byte(`{"user_id":7}`)}
+	publisher := &flakyPublisher{}
+	queue := &recordingQueue{failures: 1}
+
+	err := relayEvent(context.Background(), publisher, queue, event)
+	if err == nil {
+		t.Fatal("relayed although the webhooks could not be queued")
+	}
+
+	err = relayEvent(context.Background(), publisher, queue, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// consumers drop the second publish by its idempotency key
+	if len(publisher.published) != 2 || len(queue.enqueued) != 1 {
+		t.Errorf("published %v and queued %v, want two publishes and one enqueue", publisher.published, queue.enqueued)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rabin-nyaundi/shared/config"
+	"github.com/rabin-nyaundi/shared/cors"
+)
+
+// reloadable names the settings a reload applies. The others are read once
+// at startup, so a reload changing them is rejected.
+var reloadable = map[string]bool{
+	"cors-allowed-origins":     true,
+	"cors-allow-credentials":   true,
+	"cors-max-age":             true,
+	"cors-routes":              true,
+	"activation-token-ttl":     true,
+	"auth-token-ttl":           true,
+	"password-reset-token-ttl": true,
+	"echo-tokens":              true,
+	"webhook-batch-size":       true,
+	"webhook-max-attempts":     true,
+	"webhook-disable-after":    true,
+	"tls-client-sans":          true,
+	"service-tokens":           true,
+}
+
+// settings is the configuration in effect. It is never modified once
+// published, so a request keeps the settings it started with when a reload
+// swaps them.
+type settings struct {
+	Config
+	hash     string
+	loadedAt time.Time
+	cors     *cors.Handler
+}
+
+// corsMetrics counts cross-origin requests across reloads
+var corsMetrics = cors.NewMetrics("cors")
+
+func newSettings(cfg Config, loader *config.Loader) (*settings, error) {
+	corsHandler, err := cfg.corsHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings{
+		Config:   cfg,
+		hash:     loader.Hash(),
+		loadedAt: time.Now(),
+		cors:     corsHandler,
+	}, nil
+}
+
+// config returns the settings in effect
+func (app *application) config() *settings {
+	return app.settings.Load()
+}
+
+// watchConfig reloads the configuration on SIGHUP and when the config file
+// changes, until the server shuts down
+func (app *application) watchConfig(args []string, loader *config.Loader) {
+	var files []string
+	if loader.File() != "" {
+		files = append(files, loader.File())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-app.done
+		cancel()
+	}()
+
+	go config.Watch(ctx, app.config().configWatchInterval, files, func() {
+		next, err := app.reload(args, loader)
+		if err != nil {
+			log.Printf("config: keeping configuration %s: %v", app.config().hash, err)
+			return
+		}
+		loader = next
+	})
+}
+
+// reload loads the configuration again and publishes it, unless it is
+// invalid or changes settings that need a restart
+func (app *application) reload(args []string, current *config.Loader) (*config.Loader, error) {
+	cfg, loader, err := loadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var restart []string
+	for _, name := range loader.Changed(current) {
+		if !reloadable[name] {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("%s cannot change without a restart", strings.Join(restart, ", "))
+	}
+
+	next, err := newSettings(cfg, loader)
+	if err != nil {
+		return nil, err
+	}
+
+	if next.hash == app.config().hash {
+		log.Printf("config: configuration %s is unchanged", next.hash)
+		return loader, nil
+	}
+
+	app.settings.Store(next)
+	log.Printf("config: configuration %s loaded", next.hash)
+
+	return loader, nil
+}
+
+// corsHandler applies the CORS settings in effect
+func (app *application) corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.config().cors.Wrap(next).ServeHTTP(w, r)
+	})
+}
+
+// healthHandler reports the service is up and which configuration it runs
+func (app *application) healthHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := app.config()
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "ok",
+		Data: map[string]interface{}{
+			"config_hash":      cfg.hash,
+			"config_loaded_at": cfg.loadedAt,
+		},
+	})
+}
+
+// metricsHandler reports the counters of the service
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "metrics",
+		Data: map[string]interface{}{
+			"cors": corsMetrics.Snapshot(),
+		},
+	})
+}
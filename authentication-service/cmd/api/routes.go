@@ -1,25 +1,49 @@
 package main
 
 import (
-	"net/http"
-
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/cors"
+
+	"github.com/rabin-nyaundi/shared/openapi"
 )
 
-func (app *application) routes() http.Handler {
+func (app *application) routes() chi.Router {
 	mux := chi.NewRouter()
 
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"POST", "PUT", "OPTIONS", "GET", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	mux.Use(app.corsHandler)
+	mux.Use(app.spec.Validate(app.validationError))
+
+	mux.Get("/health", app.healthHandler)
+	mux.Get("/metrics", app.metricsHandler)
+	mux.Get("/openapi.json", app.spec.ServeHTTP)
+	mux.Get("/docs", openapi.DocsHandler("Authentication service API", "/openapi.json").ServeHTTP)
+
 	mux.Post("/v1/users", app.createUserHandeler)
-	mux.Get("/v1/users/{id}", app.fetchUserHandler)
+	mux.With(app.requireServiceOrAdmin).Get("/v1/users", app.listUsersHandler)
+	mux.With(app.requireServiceOrAdmin).Get("/v1/users/{id}", app.fetchUserHandler)
 	mux.Post("/v1/users/authenticate", app.authenticateHandler)
+	mux.Put("/v1/users/activated", app.activateUserHandler)
+	mux.Put("/v1/users/password", app.updateUserPasswordHandler)
+	mux.With(app.requireAdmin).Put("/v1/users/{id}/role", app.updateUserRoleHandler)
+	mux.With(app.requireAdmin).Put("/v1/users/{id}/lock", app.lockUserHandler)
+
+	mux.Get("/v1/roles", app.listRolesHandler)
+
+	mux.Post("/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	mux.Get("/v1/tokens/authentication", app.listSessionsHandler)
+	mux.Delete("/v1/tokens/authentication", app.deleteAuthenticationTokenHandler)
+	mux.With(app.requireServiceOrAdmin).Post("/v1/tokens/introspect", app.introspectTokenHandler)
+	mux.Post("/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+
+	mux.Route("/v1/webhooks", func(mux chi.Router) {
+		mux.Use(app.requireAdmin)
+
+		mux.Post("/", app.createWebhookHandler)
+		mux.Get("/", app.listWebhooksHandler)
+		mux.Get("/{id}", app.showWebhookHandler)
+		mux.Put("/{id}", app.updateWebhookHandler)
+		mux.Delete("/{id}", app.deleteWebhookHandler)
+		mux.Get("/{id}/deliveries", app.listDeliveriesHandler)
+		mux.Post("/{id}/deliveries/{deliveryID}/redeliver", app.redeliverHandler)
+	})
 	return mux
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rabin-nyaundi/shared/openapi"
+)
+
+func TestRoutesAreDocumented(t *testing.T) {
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{spec: spec}
+
+	err = app.spec.CheckRoutes(app.routes())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadIDParams(t *testing.T) {
+	app := &application{}
+
+	for _, test := range []struct {
+		param string
+		id    int64
+		ok    bool
+	}{
+		{"1", 1, true},
+		{"4096", 4096, true},
+		{"9007199254740993", 9007199254740993, true},
+		{"0", 0, false},
+		{"-3", 0, false},
+		{"abc", 0, false},
+	} {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", test.param)
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/"+test.param, nil)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+		id, err := app.readIDParams(r)
+		if (err == nil) != test.ok || id != test.id {
+			t.Errorf("id %q: %d, %v, want %d and ok %t", test.param, id, err, test.id, test.ok)
+		}
+	}
+}
+
+func TestFetchUserRejectsInvalidID(t *testing.T) {
+	app := &application{}
+
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", "abc")
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/abc", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+
+	w := httptest.NewRecorder()
+	app.fetchUserHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rabin-nyaundi/shared/certs"
+	"github.com/rabin-nyaundi/shared/config"
+)
+
+// serve runs the HTTP server until SIGINT or SIGTERM, then stops accepting
+// requests and waits for in-flight requests and background tasks to finish
+func (app *application) serve() error {
+	routes := app.routes()
+
+	err := app.spec.CheckRoutes(routes)
+	if err != nil {
+		log.Printf("openapi: %v", err)
+	}
+
+	svr := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config().port),
+		Handler:      routes,
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	if app.certs != nil {
+		svr.TLSConfig = app.certs.ServerConfig(app.authorizeClient)
+		app.watchCertificates()
+	}
+
+	shutdownError := make(chan error)
+
+	grpcSrv, healthServer := app.grpcServer(svr.TLSConfig)
+	if app.config().grpcPort > 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config().grpcPort))
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			log.Printf("Starting gRPC server at port:%d", app.config().grpcPort)
+			err := grpcSrv.Serve(lis)
+			if err != nil {
+				log.Printf("grpc server: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		log.Printf("shutting down server, signal: %s", s)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		// report NOT_SERVING so clients move away, then let in-flight
+		// calls finish, cutting off the ones still running at the deadline
+		healthServer.Shutdown()
+		stopped := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcSrv.Stop()
+		}
+
+		err := svr.Shutdown(ctx)
+
+		// queued emails and other background tasks are finished even when
+		// requests outlived the deadline
+		log.Printf("completing background tasks")
+		close(app.done)
+		app.wg.Wait()
+		shutdownError <- err
+	}()
+
+	if svr.TLSConfig != nil {
+		log.Printf("Starting TLS server at port:%d", app.config().port)
+		err = svr.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Starting server at port:%d", app.config().port)
+		err = svr.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	log.Printf("server stopped")
+	return nil
+}
+
+// openCertificates loads the TLS certificates of the settings, nil when the
+// service serves plain text
+func openCertificates(cfg Config) (*certs.Store, error) {
+	if cfg.tls.certFile == "" {
+		return nil, nil
+	}
+
+	store, err := certs.Load(certs.Files{
+		CertFile: cfg.tls.certFile,
+		KeyFile:  cfg.tls.keyFile,
+		CAFile:   cfg.tls.clientCAFile,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("tls: certificate loaded, expires %s", store.NotAfter().Format(time.RFC3339))
+	return store, nil
+}
+
+// watchCertificates reloads the TLS certificates on SIGHUP and when their
+// files change, so rotated certificates are served from the next handshake
+func (app *application) watchCertificates() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-app.done
+		cancel()
+	}()
+
+	go config.Watch(ctx, app.config().configWatchInterval, app.certs.Files(), func() {
+		err := app.certs.Reload()
+		if err != nil {
+			log.Printf("tls: keeping current certificate: %v", err)
+			return
+		}
+		log.Printf("tls: certificate reloaded, expires %s", app.certs.NotAfter().Format(time.RFC3339))
+	})
+}
+
+// authorizeClient accepts the client certificates with one of the SANs of
+// tls-client-sans in effect
+func (app *application) authorizeClient(cert *x509.Certificate) error {
+	return certs.AllowSANs(app.config().tls.clientSANs)(cert)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+	"github.com/rabin-nyaundi/authentication-service/internal/webhooks"
+)
+
+// webhookInput is the body of create and update requests. Omitted fields are
+// left unchanged on update.
+type webhookInput struct {
+	URL        *string  `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+	// RotateSecret replaces the signing secret on update
+	RotateSecret bool `json:"rotate_secret"`
+}
+
+// validateWebhook checks the url and event types of a webhook
+func validateWebhook(webhook *data.Webhook) error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	if len(webhook.EventTypes) == 0 {
+		return errors.New("event_types must contain at least one event type")
+	}
+
+	for _, t := range webhook.EventTypes {
+		known := false
+		for _, e := range data.WebhookEvents {
+			if t == e {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q, expected one of %v", t, data.WebhookEvents)
+		}
+	}
+	return nil
+}
+
+// readWebhookID returns the webhook id in the URL
+func (app *application) readWebhookID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, data.ErrorRecordNotFound
+	}
+	return id, nil
+}
+
+// createWebhookHandler adds a subscription. The signing secret is only
+// returned in this response.
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input webhookInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	webhook := &data.Webhook{EventTypes: input.EventTypes}
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+
+	err = validateWebhook(webhook)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	webhook.Secret, err = webhooks.NewSecret()
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v1/webhooks/%d", webhook.ID))
+	app.writeJSON(w, http.StatusCreated, JSONResponse{
+		Success: true,
+		Message: "webhook created",
+		Data:    webhook,
+	})
+}
+
+// listWebhooksHandler returns every subscription without their secrets
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	for _, webhook := range hooks {
+		webhook.Secret = ""
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "webhooks",
+		Data:    hooks,
+	})
+}
+
+// getWebhook loads the webhook in the URL, writing the error response on failure
+func (app *application) getWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readWebhookID(r)
+	if err == nil {
+		var webhook *data.Webhook
+		webhook, err = app.models.Webhooks.Get(id)
+		if err == nil {
+			return webhook, true
+		}
+	}
+
+	switch {
+	case errors.Is(err, data.ErrorRecordNotFound):
+		app.JSONEror(w, errors.New("webhook not found"), http.StatusNotFound)
+	default:
+		app.JSONEror(w, err, http.StatusInternalServerError)
+	}
+	return nil, false
+}
+
+// showWebhookHandler returns a subscription without its secret
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.getWebhook(w, r)
+	if !ok {
+		return
+	}
+	webhook.Secret = ""
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "webhook",
+		Data:    webhook,
+	})
+}
+
+// updateWebhookHandler changes a subscription. Setting active re-enables a
+// webhook disabled after repeated failures; rotate_secret returns a new secret.
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.getWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var input webhookInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.EventTypes != nil {
+		webhook.EventTypes = input.EventTypes
+	}
+	if input.Active != nil {
+		webhook.Active = *input.Active
+	}
+
+	err = validateWebhook(webhook)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if input.RotateSecret {
+		webhook.Secret, err = webhooks.NewSecret()
+		if err != nil {
+			app.JSONEror(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.JSONEror(w, errors.New("the webhook was changed by another request, please try again"), http.StatusConflict)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !input.RotateSecret {
+		webhook.Secret = ""
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "webhook updated",
+		Data:    webhook,
+	})
+}
+
+// deleteWebhookHandler removes a subscription and its delivery log
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readWebhookID(r)
+	if err == nil {
+		err = app.models.Webhooks.Delete(id)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, errors.New("webhook not found"), http.StatusNotFound)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "webhook deleted",
+	})
+}
+
+// listDeliveriesHandler returns the delivery log of a webhook, newest first
+func (app *application) listDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := app.getWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			app.JSONEror(w, errors.New("limit must be between 1 and 500"), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	deliveries, err := app.models.Webhooks.Deliveries(webhook.ID, limit)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "webhook deliveries",
+		Data:    deliveries,
+	})
+}
+
+// redeliverHandler queues a delivery to be sent again
+func (app *application) redeliverHandler(w http.ResponseWriter, r *http.Request) {
+	webhookID, err := app.readWebhookID(r)
+	if err == nil {
+		var deliveryID int64
+		deliveryID, err = strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+		if err != nil {
+			err = data.ErrorRecordNotFound
+		} else {
+			err = app.models.Webhooks.Redeliver(webhookID, deliveryID)
+		}
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrorRecordNotFound):
+			app.JSONEror(w, errors.New("delivery not found"), http.StatusNotFound)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusAccepted, JSONResponse{
+		Success: true,
+		Message: "delivery queued",
+	})
+}
+
+// startWebhookDispatcher sends due deliveries every interval until the server
+// shuts down
+func (app *application) startWebhookDispatcher() {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		sender := &webhooks.Sender{Client: &http.Client{Timeout: app.config().webhooks.timeout}}
+
+		ticker := time.NewTicker(app.config().outbox.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.done:
+				return
+			case <-ticker.C:
+			}
+
+			app.dispatchWebhooks(sender)
+		}
+	}()
+}
+
+// dispatchWebhooks claims a batch of due deliveries and sends them
+func (app *application) dispatchWebhooks(sender *webhooks.Sender) {
+	cfg := app.config().webhooks
+
+	// the lease outlives the sends so a slow batch is not picked up twice
+	lease := cfg.timeout*time.Duration(cfg.batchSize) + time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), lease)
+	defer cancel()
+
+	due, err := app.models.Webhooks.ClaimDue(ctx, cfg.batchSize, lease)
+	if err != nil {
+		log.Printf("webhooks: claiming deliveries: %v", err)
+		return
+	}
+
+	for _, d := range due {
+		body, err := json.Marshal(map[string]interface{}{
+			"id":         d.EventID,
+			"type":       d.EventType,
+			"created_at": d.CreatedAt,
+			"data":       d.Payload,
+		})
+		if err != nil {
+			log.Printf("webhooks: encoding delivery %d: %v", d.ID, err)
+			continue
+		}
+
+		status, err := sender.Send(ctx, d.URL, d.Secret, d.EventID, d.EventType, body)
+		if err == nil {
+			err = app.models.Webhooks.RecordSuccess(ctx, d, status)
+			if err != nil {
+				log.Printf("webhooks: recording delivery %d: %v", d.ID, err)
+			}
+			continue
+		}
+
+		var next *time.Time
+		if d.Attempts+1 < cfg.maxAttempts {
+			t := time.Now().Add(webhooks.Backoff(d.Attempts))
+			next = &t
+		}
+
+		disabled, rerr := app.models.Webhooks.RecordFailure(ctx, d, status, err.Error(), next, cfg.disableAfter)
+		if rerr != nil {
+			log.Printf("webhooks: recording delivery %d: %v", d.ID, rerr)
+			continue
+		}
+
+		if disabled {
+			log.Printf("webhooks: disabled webhook %d after %d consecutive failures", d.WebhookID, cfg.disableAfter)
+		}
+	}
+}
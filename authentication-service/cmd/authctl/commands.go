@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+)
+
+// exportPageSize is how many users export-users reads per query
+const exportPageSize = 500
+
+// parseFlags parses the flags of a command, checking the named flags were
+// given and printing its usage on errors, then connects to the database
+func (app *application) parseFlags(fs *flag.FlagSet, args []string, required ...string) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return errUsage
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected argument %q\n", fs.Arg(0))
+		fs.Usage()
+		return errUsage
+	}
+
+	for _, name := range required {
+		if fs.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(fs.Output(), "-%s must be provided\n", name)
+			fs.Usage()
+			return errUsage
+		}
+	}
+
+	return app.connect()
+}
+
+// findUser returns the user with the id or email
+func (app *application) findUser(ref string) (*data.User, error) {
+	var (
+		user *data.User
+		err  error
+	)
+
+	if id, convErr := strconv.ParseInt(ref, 10, 64); convErr == nil {
+		user, err = app.models.User.GetOneUser(int(id))
+		if user != nil {
+			user.ID = id
+		}
+	} else {
+		user, err = app.models.User.GetByEmail(ref)
+	}
+
+	if errors.Is(err, data.ErrorRecordNotFound) {
+		return nil, fmt.Errorf("user %s not found", ref)
+	}
+	return user, err
+}
+
+// printUser reads the user back, with every column, and prints it
+func (app *application) printUser(id int64) error {
+	users, err := app.models.User.GetMany([]int64{id})
+	if err != nil {
+		return err
+	}
+	return app.out.users(users)
+}
+
+// readPassword returns the password flag or, when it is empty, the first
+// line of stdin, so passwords need not appear in the process list
+func readPassword(flagValue string) (string, error) {
+	password := flagValue
+
+	if password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("reading password from stdin: no input")
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if len(password) < 8 {
+		return "", errors.New("password must be at least 8 characters long")
+	}
+	return password, nil
+}
+
+// parseRole accepts a role id or name
+func parseRole(ref string) (int, error) {
+	for _, role := range data.Roles {
+		if ref == role.Name || ref == strconv.Itoa(role.ID) {
+			return role.ID, nil
+		}
+	}
+
+	names := make([]string, len(data.Roles))
+	for i, role := range data.Roles {
+		names[i] = role.Name
+	}
+	return 0, fmt.Errorf("unknown role %q, must be one of %s", ref, strings.Join(names, ", "))
+}
+
+func createAdmin(app *application, fs *flag.FlagSet, args []string) error {
+	email := fs.String("email", "", "Email address")
+	firstName := fs.String("firstname", "", "First name")
+	lastName := fs.String("lastname", "", "Last name")
+	passwordFlag := fs.String("password", "", "Password (read from stdin when empty)")
+
+	err := app.parseFlags(fs, args, "email", "firstname", "lastname")
+	if err != nil {
+		return err
+	}
+
+	addr, err := mail.ParseAddress(*email)
+	if err != nil || addr.Address != *email {
+		return fmt.Errorf("%q is not a valid email address", *email)
+	}
+
+	password, err := readPassword(*passwordFlag)
+	if err != nil {
+		return err
+	}
+
+	user := &data.User{
+		FirstName: *firstName,
+		LastName:  *lastName,
+		Email:     *email,
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.User.Insert(user)
+	if err != nil {
+		if errors.Is(err, data.DuplicateEmail) {
+			return fmt.Errorf("a user with email %s already exists", *email)
+		}
+		return err
+	}
+
+	err = app.models.User.Activate(user)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.User.SetRole(user, data.RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	return app.printUser(user.ID)
+}
+
+func setRole(app *application, fs *flag.FlagSet, args []string) error {
+	ref := fs.String("user", "", "User id or email")
+	roleRef := fs.String("role", "", "Role id or name")
+
+	err := app.parseFlags(fs, args, "user", "role")
+	if err != nil {
+		return err
+	}
+
+	role, err := parseRole(*roleRef)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.findUser(*ref)
+	if err != nil {
+		return err
+	}
+
+	if user.Role != role {
+		err = app.models.User.SetRole(user, role)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.printUser(user.ID)
+}
+
+func activate(app *application, fs *flag.FlagSet, args []string) error {
+	return setActive(app, fs, args, true)
+}
+
+func deactivate(app *application, fs *flag.FlagSet, args []string) error {
+	return setActive(app, fs, args, false)
+}
+
+func setActive(app *application, fs *flag.FlagSet, args []string, active bool) error {
+	ref := fs.String("user", "", "User id or email")
+
+	err := app.parseFlags(fs, args, "user")
+	if err != nil {
+		return err
+	}
+
+	user, err := app.findUser(*ref)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case active && !user.Active:
+		err = app.models.User.Activate(user)
+	case !active && user.Active:
+		err = app.models.User.Deactivate(user)
+	}
+	if err != nil {
+		return err
+	}
+
+	return app.printUser(user.ID)
+}
+
+func revokeTokens(app *application, fs *flag.FlagSet, args []string) error {
+	ref := fs.String("user", "", "User id or email")
+
+	err := app.parseFlags(fs, args, "user")
+	if err != nil {
+		return err
+	}
+
+	user, err := app.findUser(*ref)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := app.models.Token.RevokeAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return app.out.result(fmt.Sprintf("revoked %d sessions of user %d", revoked, user.ID), map[string]interface{}{
+		"user_id": user.ID,
+		"revoked": revoked,
+	})
+}
+
+func resetPassword(app *application, fs *flag.FlagSet, args []string) error {
+	ref := fs.String("user", "", "User id or email")
+	passwordFlag := fs.String("password", "", "New password (read from stdin when empty)")
+
+	err := app.parseFlags(fs, args, "user")
+	if err != nil {
+		return err
+	}
+
+	user, err := app.findUser(*ref)
+	if err != nil {
+		return err
+	}
+
+	password, err := readPassword(*passwordFlag)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.User.ResetPassword(password, user)
+	if err != nil {
+		return err
+	}
+
+	// outstanding reset links must not undo the new password
+	err = app.models.Token.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return app.printUser(user.ID)
+}
+
+func purgeTokens(app *application, fs *flag.FlagSet, args []string) error {
+	err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := app.models.Token.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	return app.out.result(fmt.Sprintf("deleted %d expired tokens", deleted), map[string]interface{}{
+		"deleted": deleted,
+	})
+}
+
+func exportUsers(app *application, fs *flag.FlagSet, args []string) error {
+	err := app.parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var (
+		all   []*data.User
+		after int64
+	)
+
+	for {
+		users, err := app.models.User.List(after, exportPageSize)
+		if err != nil {
+			return err
+		}
+
+		all = append(all, users...)
+		if len(users) < exportPageSize {
+			break
+		}
+		after = users[len(users)-1].ID
+	}
+
+	return app.out.users(all)
+}
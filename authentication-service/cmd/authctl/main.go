@@ -0,0 +1,209 @@
+// Command authctl administers the authentication service's users and tokens
+// directly in its database. It reads -db-dsn and -bcrypt-cost like cmd/api,
+// from AUTH_DB_DSN, AUTH_DB_DSN_FILE or the service's config file.
+//
+// Usage:
+//
+//	authctl [-config file] [-db-dsn dsn] [-output table|json] <command> [flags]
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+	"github.com/rabin-nyaundi/shared/config"
+
+	_ "github.com/lib/pq"
+)
+
+// errUsage reports a command line error; the usage has already been printed
+var errUsage = errors.New("invalid usage")
+
+type application struct {
+	dsn    string
+	db     *sql.DB
+	models data.Models
+	out    *printer
+}
+
+// command is a subcommand. Commands define their flags on fs and connect to
+// the database when parsing them, so -h works without one.
+type command struct {
+	usage   string
+	summary string
+	run     func(app *application, fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"create-admin": {
+		usage:   "-email email -firstname name -lastname name [-password password]",
+		summary: "create an active admin user, reading the password from stdin when not given",
+		run:     createAdmin,
+	},
+	"set-role": {
+		usage:   "-user id|email -role id|name",
+		summary: "change the role of a user",
+		run:     setRole,
+	},
+	"activate": {
+		usage:   "-user id|email",
+		summary: "activate a user",
+		run:     activate,
+	},
+	"deactivate": {
+		usage:   "-user id|email",
+		summary: "deactivate a user",
+		run:     deactivate,
+	},
+	"revoke-tokens": {
+		usage:   "-user id|email",
+		summary: "end every session of a user",
+		run:     revokeTokens,
+	},
+	"reset-password": {
+		usage:   "-user id|email [-password password]",
+		summary: "set a user's password, reading it from stdin when not given",
+		run:     resetPassword,
+	},
+	"purge-tokens": {
+		summary: "delete expired tokens of every scope",
+		run:     purgeTokens,
+	},
+	"export-users": {
+		summary: "print every user",
+		run:     exportUsers,
+	},
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("authctl: ")
+
+	var (
+		dsn    string
+		output string
+	)
+
+	// the config file of cmd/api is shared, so its other settings are ignored
+	loader := config.New(flag.CommandLine, "AUTH")
+	loader.IgnoreUnknown = true
+	loader.Secret("db-dsn")
+
+	flag.StringVar(&dsn, "db-dsn", os.Getenv("DATABASE_DSN"), "Database connection string")
+	flag.IntVar(&data.PasswordCost, "bcrypt-cost", data.PasswordCost, "bcrypt cost of password hashes")
+	flag.StringVar(&output, "output", "table", "Output format (table|json)")
+	flag.Usage = usage
+
+	err := loader.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if loader.PrintRequested() {
+		err = loader.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if data.PasswordCost < bcrypt.MinCost || data.PasswordCost > bcrypt.MaxCost {
+		log.Fatalf("bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	out, err := newPrinter(os.Stdout, output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := &application{
+		dsn: dsn,
+		out: out,
+	}
+	defer app.close()
+
+	name := flag.Arg(0)
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: authctl %s %s\n\n%s\n", name, cmd.usage, cmd.summary)
+		fs.PrintDefaults()
+	}
+
+	err = cmd.run(app, fs, flag.Args()[1:])
+	if err != nil {
+		app.close()
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+
+	fmt.Fprintf(w, "Usage: authctl [flags] <command> [command flags]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-15s %s\n", name, commands[name].summary)
+	}
+
+	fmt.Fprintf(w, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// connect opens the database. authctl runs one command at a time, so it
+// needs no more than a couple of connections.
+func (app *application) connect() error {
+	if app.dsn == "" {
+		return errors.New("no database, set -db-dsn, AUTH_DB_DSN or AUTH_DB_DSN_FILE")
+	}
+
+	db, err := sql.Open("postgres", app.dsn)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	app.db = db
+	app.models = data.NewModel(db)
+	return nil
+}
+
+func (app *application) close() {
+	if app.db != nil {
+		app.db.Close()
+	}
+}
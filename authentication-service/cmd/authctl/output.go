@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+)
+
+// printer writes command results as an aligned table or as JSON
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case "table":
+		return &printer{w: w}, nil
+	case "json":
+		return &printer{w: w, json: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, must be table or json", format)
+	}
+}
+
+func (p *printer) writeJSON(v interface{}) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// users prints the users, one per row
+func (p *printer) users(users []*data.User) error {
+	if p.json {
+		if users == nil {
+			users = []*data.User{}
+		}
+		return p.writeJSON(users)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tNAME\tROLE\tACTIVE\tLOCKED\tCREATED")
+
+	for _, u := range users {
+		fmt.Fprintf(tw, "%d\t%s\t%s %s\t%s\t%t\t%t\t%s\n",
+			u.ID, u.Email, u.FirstName, u.LastName, roleName(u.Role), u.Active, u.Locked, u.CreatedAt.Format(time.RFC3339))
+	}
+
+	return tw.Flush()
+}
+
+// result prints the message, or the fields as a JSON object
+func (p *printer) result(message string, fields map[string]interface{}) error {
+	if p.json {
+		return p.writeJSON(fields)
+	}
+
+	_, err := fmt.Fprintln(p.w, message)
+	return err
+}
+
+func roleName(id int) string {
+	for _, role := range data.Roles {
+		if role.ID == id {
+			return role.Name
+		}
+	}
+	return strconv.Itoa(id)
+}
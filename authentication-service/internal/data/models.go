@@ -8,18 +8,23 @@ import (
 // ErrorRecordNotFound returns record not found error
 var (
 	ErrorRecordNotFound = errors.New("record not found")
+	ErrEditConflict     = errors.New("edit conflict")
 )
 
 // Models structs that wraps the models
 type Models struct {
-	User  UserModel
-	Token TokenModel
+	User     UserModel
+	Token    TokenModel
+	Outbox   OutboxModel
+	Webhooks WebhookModel
 }
 
 // NewModel returns models struct with initialized models
 func NewModel(db *sql.DB) Models {
 	return Models{
-		User:  UserModel{DB: db},
-		Token: TokenModel{DB: db},
+		User:     UserModel{DB: db},
+		Token:    TokenModel{DB: db},
+		Outbox:   OutboxModel{DB: db},
+		Webhooks: WebhookModel{DB: db},
 	}
 }
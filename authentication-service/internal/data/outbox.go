@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// Event types written to the outbox
+const (
+	EventUserCreated         = "user.created"
+	EventUserActivated       = "user.activated"
+	EventUserDeactivated     = "user.deactivated"
+	EventUserUpdated         = "user.updated"
+	EventUserDeleted         = "user.deleted"
+	EventUserPasswordChanged = "user.password_changed"
+	EventUserLoggedIn        = "user.logged_in"
+	EventUserLocked          = "user.locked"
+	EventUserUnlocked        = "user.unlocked"
+	EventUserRoleChanged     = "user.role_changed"
+	EventSessionRevoked      = "session.revoked"
+	EventTokenCreated        = "token.created"
+)
+
+// outboxLockID is the advisory lock held by the relay so that a single
+// replica publishes at a time and per-user ordering is preserved
+const outboxLockID = 7_301_001
+
+// OutboxEvent is a domain event waiting to be published
+type OutboxEvent struct {
+	ID             int64           `json:"-"`
+	AggregateID    int64           `json:"aggregate_id"`
+	Type           string          `json:"type"`
+	Payload        json.RawMessage `json:"data"`
+	IdempotencyKey string          `json:"id"`
+	CreatedAt      time.Time       `json:"occurred_at"`
+	Attempts       int             `json:"-"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// OutboxModel wraps the connection pool
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// addEvent writes an event in the caller's transaction, so it is only
+// recorded when the change it describes is committed
+func addEvent(ctx context.Context, tx execer, aggregateID int64, eventType string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 16)
+	_, err = rand.Read(key)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO outbox (aggregate_id, event_type, payload, idempotency_key)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err = tx.ExecContext(ctx, query, aggregateID, eventType, string(data), hex.EncodeToString(key))
+	return err
+}
+
+// Add writes an event outside of any other change
+func (m OutboxModel) Add(aggregateID int64, eventType string, payload interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addEvent(ctx, m.DB, aggregateID, eventType, payload)
+}
+
+// Relay hands pending events to publish in id order while holding the relay
+// lock. Once an event of a user fails, later events of that user are left for
+// the next round so consumers see each user's events in order. It returns the
+// number of events published.
+func (m OutboxModel) Relay(ctx context.Context, limit int, publish func(context.Context, *OutboxEvent) error) (int, error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, outboxLockID).Scan(&locked)
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	// skip users whose earliest pending event is still backing off
+	query := `
+		SELECT o.id, o.aggregate_id, o.event_type, o.payload, o.idempotency_key, o.created_at, o.attempts
+		FROM outbox o
+		WHERE o.published_at IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM outbox p
+			WHERE p.aggregate_id = o.aggregate_id
+			AND p.published_at IS NULL
+			AND p.id <= o.id
+			AND p.next_attempt_at > NOW()
+		)
+		ORDER BY o.id
+		LIMIT $1`
+
+	rows, err := tx.QueryContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []*OutboxEvent
+	for rows.Next() {
+		var e OutboxEvent
+		err = rows.Scan(&e.ID, &e.AggregateID, &e.Type, &e.Payload, &e.IdempotencyKey, &e.CreatedAt, &e.Attempts)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, &e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	blocked := map[int64]bool{}
+
+	for _, e := range events {
+		if blocked[e.AggregateID] {
+			continue
+		}
+
+		err := publish(ctx, e)
+		if err != nil {
+			blocked[e.AggregateID] = true
+
+			// the delay doubles with every attempt, up to about 17 minutes
+			shift := e.Attempts
+			if shift > 10 {
+				shift = 10
+			}
+			backoff := time.Duration(1<<uint(shift)) * time.Second
+			_, err = tx.ExecContext(ctx, `
+				UPDATE outbox
+				SET attempts = attempts + 1, last_error = $2, next_attempt_at = NOW() + $3::float8 * INTERVAL '1 millisecond'
+				WHERE id = $1`, e.ID, err.Error(), backoff.Milliseconds())
+			if err != nil {
+				return published, err
+			}
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE outbox SET published_at = NOW(), attempts = attempts + 1 WHERE id = $1`, e.ID)
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	return published, tx.Commit()
+}
+
+// DeletePublishedBefore removes published events older than the given time
+func (m OutboxModel) DeletePublishedBefore(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM outbox WHERE published_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// withTx runs fn in a transaction, committing when it returns nil
+func withTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
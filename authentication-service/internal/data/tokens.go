@@ -6,15 +6,19 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"log"
 	"time"
 )
 
 // ScopeActivation indcates an activation token
 // ScopeAuthentication indicates an authentication token
+// ScopePasswordReset indicates a password reset token
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
 )
 
 // Token structure to hold data for 1 token from the database
@@ -65,7 +69,24 @@ func (m TokenModel) Insert(token *Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&token.UserID)
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&token.UserID)
+		if err != nil {
+			return err
+		}
+
+		// the plaintext never leaves this service
+		err = addEvent(ctx, tx, token.UserID, EventTokenCreated, map[string]interface{}{
+			"user_id": token.UserID,
+			"scope":   token.Scope,
+			"expiry":  token.Expiry,
+		})
+		if err != nil || token.Scope != ScopeAuthentication {
+			return err
+		}
+
+		return addEvent(ctx, tx, token.UserID, EventUserLoggedIn, map[string]interface{}{"user_id": token.UserID})
+	})
 	if err != nil {
 		log.Panic(err)
 		return err
@@ -73,7 +94,204 @@ func (m TokenModel) Insert(token *Token) error {
 	return nil
 }
 
-// DeleteAllForUser deletes all activation tokens for the user
+// GetForToken returns the user and token matching an unexpired plaintext token of the given scope
+func (m TokenModel) GetForToken(scope, plaintext string) (*User, *Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT users.id, users.firstname, users.lastname, users.email, users.active, users.role, users.version, tokens.expiry
+		FROM users
+		INNER JOIN tokens ON users.id = tokens.user_id
+		WHERE tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND NOT users.locked`
+
+	args := []interface{}{hash[:], scope, time.Now()}
+
+	var user User
+	token := Token{
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		Scope:     scope,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.FirstName,
+		&user.LastName,
+		&user.Email,
+		&user.Active,
+		&user.Role,
+		&user.Version,
+		&token.Expiry,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrorRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+	return &user, &token, nil
+}
+
+// DeleteAllForUser deletes all tokens of the given scope for the user
+func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	return err
+}
+
+// RevokeAllForUser deletes the user's authentication tokens, recording a
+// session.revoked event for each, and returns how many there were
+func (m TokenModel) RevokeAllForUser(userID int64) (int, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2
+		RETURNING hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	revoked := 0
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, query, ScopeAuthentication, userID)
+		if err != nil {
+			return err
+		}
+
+		var hashes [][]byte
+		for rows.Next() {
+			var hash []byte
+			if err := rows.Scan(&hash); err != nil {
+				rows.Close()
+				return err
+			}
+			hashes = append(hashes, hash)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			err := addEvent(ctx, tx, userID, EventSessionRevoked, map[string]interface{}{
+				"user_id":    userID,
+				"session_id": SessionID(hash),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		revoked = len(hashes)
+		return nil
+	})
+
+	return revoked, err
+}
+
+// DeleteExpired removes the tokens of every scope that have expired and
+// returns how many there were
+func (m TokenModel) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM tokens WHERE expiry <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListForUser returns the unexpired tokens of the given scope for the user,
+// newest first. Only hashes are stored, so the tokens have no plaintext.
+func (m TokenModel) ListForUser(scope string, userID int64) ([]*Token, error) {
+	query := `
+		SELECT hash, expiry
+		FROM tokens
+		WHERE scope = $1 AND user_id = $2 AND expiry > $3
+		ORDER BY expiry DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		token := Token{UserID: userID, Scope: scope}
+		err = rows.Scan(&token.Hash, &token.Expiry)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// Delete removes a single token of the given scope. Deleting an
+// authentication token records a session.revoked event for its user.
+func (m TokenModel) Delete(scope, plaintext string) error {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2
+		RETURNING user_id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		var userID int64
+
+		err := tx.QueryRowContext(ctx, query, hash[:], scope).Scan(&userID)
+		if err != nil || scope != ScopeAuthentication {
+			return err
+		}
+
+		return addEvent(ctx, tx, userID, EventSessionRevoked, map[string]interface{}{
+			"user_id":    userID,
+			"session_id": SessionID(hash[:]),
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SessionID is the public identifier of an authentication token, derived
+// from its hash so that sessions can be told apart without the plaintext
+func SessionID(hash []byte) string {
+	return hex.EncodeToString(hash[:8])
+}
 
 // GenerateToken generates a new token
 func GenerateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
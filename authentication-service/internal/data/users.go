@@ -8,6 +8,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -15,6 +16,17 @@ var (
 	DuplicateEmail = errors.New("duplicate email found")
 )
 
+// PasswordCost is the bcrypt cost passwords are hashed with. Changing it
+// leaves existing hashes as they are.
+var PasswordCost = 12
+
+// RoleUser is the default role of a registered user
+// RoleAdmin is the role of a user allowed to manage other users
+const (
+	RoleUser  = 0
+	RoleAdmin = 1
+)
+
 // User is the structure that holds a user from the database
 type User struct {
 	ID        int64     `json:"id"`
@@ -23,12 +35,38 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Active    bool      `json:"active"`
+	Locked    bool      `json:"locked"`
 	Role      int       `json:"role"`
 	CreatedAt time.Time `json:"CreatedAt"`
 	UpdatedAt time.Time `json:"UpdatedAt"`
 	Version   int       `json:"-"`
 }
 
+// Role describes what the users holding it are allowed to do
+type Role struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// Roles are every role a user can hold, ordered by id
+var Roles = []Role{
+	{ID: RoleUser, Name: "user", Scopes: []string{"users:read"}},
+	{ID: RoleAdmin, Name: "admin", Scopes: []string{"users:read", "users:write", "logs:write", "mail:send"}},
+}
+
+// Scopes returns the scopes granted to the user's tokens based on their role
+func (u *User) Scopes() []string {
+	// roles above the highest known one get its scopes
+	scopes := Roles[0].Scopes
+	for _, role := range Roles {
+		if role.ID <= u.Role {
+			scopes = role.Scopes
+		}
+	}
+	return append([]string(nil), scopes...)
+}
+
 // password is the structure that hold a password
 type password struct {
 	plaintext *string
@@ -84,10 +122,94 @@ func (m UserModel) GetAllUsers() ([]*User, error) {
 	return users, nil
 }
 
+// List returns up to limit users with ids greater than afterID, ordered by id
+func (m UserModel) List(afterID int64, limit int) ([]*User, error) {
+	query := `
+		SELECT id, firstname, lastname, email, active, locked, role, version, created_at, updated_at
+		FROM users
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.FirstName,
+			&user.LastName,
+			&user.Email,
+			&user.Active,
+			&user.Locked,
+			&user.Role,
+			&user.Version,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetMany returns the users with the given ids, ordered by id. Unknown ids
+// are skipped.
+func (m UserModel) GetMany(ids []int64) ([]*User, error) {
+	query := `
+		SELECT id, firstname, lastname, email, active, locked, role, version, created_at, updated_at
+		FROM users
+		WHERE id = ANY($1)
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.FirstName,
+			&user.LastName,
+			&user.Email,
+			&user.Active,
+			&user.Locked,
+			&user.Role,
+			&user.Version,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
 // GetByEmail returns a single user from the database by email
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-		SELECT id, firstname, lastname, email, password_hash, active, role, version
+		SELECT id, firstname, lastname, email, password_hash, active, locked, role, version
 		FROM users
 		WHERE email = $1`
 
@@ -105,6 +227,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Active,
+		&user.Locked,
 		&user.Role,
 		&user.Version,
 	)
@@ -124,7 +247,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 // GetOneUser returns a single user from the database by id
 func (m UserModel) GetOneUser(id int) (*User, error) {
 	query := `
-		SELECT firstname, lastname, email, active, role, version
+		SELECT firstname, lastname, email, active, locked, role, version
 		FROM users
 		WHERE id = $1`
 
@@ -140,6 +263,7 @@ func (m UserModel) GetOneUser(id int) (*User, error) {
 		&user.LastName,
 		&user.Email,
 		&user.Active,
+		&user.Locked,
 		&user.Role,
 		&user.Version,
 	)
@@ -162,11 +286,12 @@ func (m UserModel) Update(user *User) error {
 	query := `
 		UPDATE users SET 
 		email = $1, 
-		fristname=$2, 
+		firstname=$2, 
 		lastname=$3, 
 		version=$4, 
 		updated_at=$5
-		WHERE id=$6`
+		WHERE id=$6
+		RETURNING version`
 
 	args := []interface{}{
 		user.Email,
@@ -180,18 +305,20 @@ func (m UserModel) Update(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
-	}
-	return nil
+		return addEvent(ctx, tx, user.ID, EventUserUpdated, userEvent(user))
+	})
 }
 
 // Delete returns a single user from the database
 func (m UserModel) Delete(user User) error {
 	query := `
-	DELETE * FROM users
+	DELETE FROM users
 	WHERE id = $1`
 
 	args := []interface{}{
@@ -201,13 +328,14 @@ func (m UserModel) Delete(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	if err != nil {
-		log.Panic(err)
-		return err
-	}
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return addEvent(ctx, tx, user.ID, EventUserDeleted, map[string]interface{}{"user_id": user.ID})
+	})
 }
 
 // Insert returns a single user inserted in to the database
@@ -229,7 +357,14 @@ func (m UserModel) Insert(user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+		if err != nil {
+			return err
+		}
+
+		return addEvent(ctx, tx, user.ID, EventUserCreated, userEvent(user))
+	})
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -243,9 +378,73 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+// Activate marks the user as active
+func (m UserModel) Activate(user *User) error {
+	query := `
+		UPDATE users
+		SET active = true, version = version + 1, updated_at = NOW()
+		WHERE id = $1
+		RETURNING version, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, user.ID).Scan(&user.Version, &user.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		return addEvent(ctx, tx, user.ID, EventUserActivated, map[string]interface{}{"user_id": user.ID})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	user.Active = true
+	return nil
+}
+
+// Deactivate marks the user as inactive
+func (m UserModel) Deactivate(user *User) error {
+	query := `
+		UPDATE users
+		SET active = false, version = version + 1, updated_at = NOW()
+		WHERE id = $1
+		RETURNING version, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, user.ID).Scan(&user.Version, &user.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		return addEvent(ctx, tx, user.ID, EventUserDeactivated, map[string]interface{}{"user_id": user.ID})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	user.Active = false
+	return nil
+}
+
 // ResetPassword is a method called to change the user's password
 func (m UserModel) ResetPassword(plaintext string, user *User) error {
-	newPasswordHash, err := bcrypt.GenerateFromPassword([]byte(plaintext), 12)
+	newPasswordHash, err := bcrypt.GenerateFromPassword([]byte(plaintext), PasswordCost)
 
 	if err != nil {
 		log.Panic(err)
@@ -254,8 +453,8 @@ func (m UserModel) ResetPassword(plaintext string, user *User) error {
 
 	query := `
 		UPDATE users 
-		SET password_hash = $1
-		WHER id = $2
+		SET password_hash = $1, version = version + 1, updated_at = NOW()
+		WHERE id = $2
 		RETURNING id`
 
 	args := []interface{}{
@@ -265,7 +464,14 @@ func (m UserModel) ResetPassword(plaintext string, user *User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+	err = withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, args...).Scan(&user.ID)
+		if err != nil {
+			return err
+		}
+
+		return addEvent(ctx, tx, user.ID, EventUserPasswordChanged, map[string]interface{}{"user_id": user.ID})
+	})
 
 	if err != nil {
 		log.Panic(err)
@@ -274,10 +480,106 @@ func (m UserModel) ResetPassword(plaintext string, user *User) error {
 	return nil
 }
 
+// SetRole changes the user's role. Tokens already issued get the scopes of
+// the new role the next time they are introspected.
+func (m UserModel) SetRole(user *User, role int) error {
+	query := `
+		UPDATE users
+		SET role = $1, version = version + 1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING version, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	previous := user.Role
+	user.Role = role
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, role, user.ID).Scan(&user.Version, &user.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		return addEvent(ctx, tx, user.ID, EventUserRoleChanged, map[string]interface{}{
+			"user_id":       user.ID,
+			"role":          role,
+			"previous_role": previous,
+			"scopes":        user.Scopes(),
+		})
+	})
+	if err != nil {
+		user.Role = previous
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetLocked locks or unlocks the user. Locking also deletes the user's
+// authentication tokens so every session ends at once.
+func (m UserModel) SetLocked(user *User, locked bool) error {
+	query := `
+		UPDATE users
+		SET locked = $1, version = version + 1, updated_at = NOW()
+		WHERE id = $2
+		RETURNING version, updated_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	event := EventUserUnlocked
+	if locked {
+		event = EventUserLocked
+	}
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, query, locked, user.ID).Scan(&user.Version, &user.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		if locked {
+			_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND scope = $2`, user.ID, ScopeAuthentication)
+			if err != nil {
+				return err
+			}
+		}
+
+		return addEvent(ctx, tx, user.ID, event, map[string]interface{}{"user_id": user.ID})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrorRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	user.Locked = locked
+	return nil
+}
+
+// userEvent is the payload of events describing a user's profile
+func userEvent(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id":   user.ID,
+		"email":     user.Email,
+		"firstname": user.FirstName,
+		"lastname":  user.LastName,
+	}
+}
+
 // Set method is called to encrypt user's passowrd
 func (p *password) Set(plaintextPassword string) error {
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), PasswordCost)
 
 	if err != nil {
 		log.Panic(err)
@@ -0,0 +1,379 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookEvents are the event types a webhook can subscribe to
+var WebhookEvents = []string{
+	EventUserCreated,
+	EventUserActivated,
+	EventUserDeactivated,
+	EventUserUpdated,
+	EventUserDeleted,
+	EventUserPasswordChanged,
+	EventUserLoggedIn,
+	EventUserLocked,
+	EventUserUnlocked,
+	EventUserRoleChanged,
+	EventSessionRevoked,
+}
+
+// Webhook is a partner endpoint subscribed to authentication events
+type Webhook struct {
+	ID           int64     `json:"id"`
+	URL          string    `json:"url"`
+	EventTypes   []string  `json:"event_types"`
+	Secret       string    `json:"secret,omitempty"`
+	Active       bool      `json:"active"`
+	FailureCount int       `json:"failure_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Version      int       `json:"version"`
+}
+
+// Delivery is one event sent, or to be sent, to a webhook
+type Delivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// DueDelivery is a claimed delivery along with where and how to sign it
+type DueDelivery struct {
+	Delivery
+	URL    string
+	Secret string
+}
+
+// WebhookModel wraps the connection pool
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a webhook
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, event_types, secret, active)
+		VALUES ($1, $2, $3, true)
+		RETURNING id, active, created_at, updated_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, webhook.URL, pq.Array(webhook.EventTypes), webhook.Secret).Scan(
+		&webhook.ID,
+		&webhook.Active,
+		&webhook.CreatedAt,
+		&webhook.UpdatedAt,
+		&webhook.Version,
+	)
+}
+
+const webhookColumns = `id, url, event_types, secret, active, failure_count, created_at, updated_at, version`
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	var webhook Webhook
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.URL,
+		pq.Array(&webhook.EventTypes),
+		&webhook.Secret,
+		&webhook.Active,
+		&webhook.FailureCount,
+		&webhook.CreatedAt,
+		&webhook.UpdatedAt,
+		&webhook.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// Get returns a webhook by id
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	webhook, err := scanWebhook(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrorRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return webhook, nil
+}
+
+// GetAll returns every webhook
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Update saves the webhook's url, event types, secret and active flag.
+// Re-enabling a webhook clears its failure count.
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, event_types = $2, secret = $3, active = $4,
+			failure_count = CASE WHEN $4 AND NOT active THEN 0 ELSE failure_count END,
+			updated_at = NOW(), version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING failure_count, updated_at, version`
+
+	args := []interface{}{
+		webhook.URL,
+		pq.Array(webhook.EventTypes),
+		webhook.Secret,
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.FailureCount, &webhook.UpdatedAt, &webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a webhook and its deliveries
+func (m WebhookModel) Delete(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
+
+// Enqueue creates a pending delivery of the event for every active webhook
+// subscribed to its type. Enqueuing the same event twice is a no-op.
+func (m WebhookModel) Enqueue(ctx context.Context, event *OutboxEvent) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT id, $1::text, $2::text, $3::jsonb FROM webhooks
+		WHERE active AND $2::text = ANY(event_types)
+		ON CONFLICT (webhook_id, event_id) DO NOTHING`
+
+	_, err := m.DB.ExecContext(ctx, query, event.IdempotencyKey, event.Type, string(event.Payload))
+	return err
+}
+
+// ClaimDue returns up to limit pending deliveries of active webhooks that are
+// due, pushing their next attempt lease into the future so other replicas
+// skip them while they are being sent
+func (m WebhookModel) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]*DueDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + $2::float8 * INTERVAL '1 millisecond'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id
+		AND d.id IN (
+			SELECT dd.id FROM webhook_deliveries dd
+			INNER JOIN webhooks ww ON ww.id = dd.webhook_id
+			WHERE dd.status = 'pending' AND dd.next_attempt_at <= NOW() AND ww.active
+			ORDER BY dd.id
+			LIMIT $1
+			FOR UPDATE OF dd SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.status, d.attempts, d.created_at, w.url, w.secret`
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var due []*DueDelivery
+	for rows.Next() {
+		var d DueDelivery
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, &d)
+	}
+
+	return due, rows.Err()
+}
+
+// RecordSuccess marks the delivery as delivered and resets the webhook's
+// consecutive failure count
+func (m WebhookModel) RecordSuccess(ctx context.Context, d *DueDelivery, responseStatus int) error {
+	return withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = 'succeeded', attempts = attempts + 1, response_status = $2, last_error = NULL, delivered_at = NOW()
+			WHERE id = $1`, d.ID, responseStatus)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE webhooks SET failure_count = 0 WHERE id = $1`, d.WebhookID)
+		return err
+	})
+}
+
+// RecordFailure records a failed attempt. The delivery is retried at next, or
+// marked failed when next is nil. The webhook is disabled once its consecutive
+// failures reach disableAfter; the returned flag reports whether that happened.
+func (m WebhookModel) RecordFailure(ctx context.Context, d *DueDelivery, responseStatus int, reason string, next *time.Time, disableAfter int) (bool, error) {
+	status := DeliveryPending
+	nextAttempt := time.Now()
+	if next == nil {
+		status = DeliveryFailed
+	} else {
+		nextAttempt = *next
+	}
+
+	var code *int
+	if responseStatus != 0 {
+		code = &responseStatus
+	}
+
+	disabled := false
+
+	err := withTx(ctx, m.DB, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE webhook_deliveries
+			SET status = $2, attempts = attempts + 1, response_status = $3, last_error = $4, next_attempt_at = $5
+			WHERE id = $1`, d.ID, status, code, reason, nextAttempt)
+		if err != nil {
+			return err
+		}
+
+		return tx.QueryRowContext(ctx, `
+			UPDATE webhooks
+			SET failure_count = failure_count + 1,
+				active = active AND failure_count + 1 < $2,
+				updated_at = CASE WHEN active AND failure_count + 1 >= $2 THEN NOW() ELSE updated_at END
+			WHERE id = $1
+			RETURNING NOT active AND failure_count = $2`, d.WebhookID, disableAfter).Scan(&disabled)
+	})
+
+	return disabled, err
+}
+
+// Deliveries returns the most recent deliveries of a webhook, newest first
+func (m WebhookModel) Deliveries(webhookID int64, limit int) ([]*Delivery, error) {
+	query := `
+		SELECT id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at, response_status, last_error, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		var d Delivery
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.ResponseStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Redeliver queues a delivery to be sent again right away with a fresh
+// attempt count. The event id is kept so receivers can still deduplicate.
+func (m WebhookModel) Redeliver(webhookID, deliveryID int64) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND webhook_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, deliveryID, webhookID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrorRecordNotFound
+	}
+	return nil
+}
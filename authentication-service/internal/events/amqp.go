@@ -0,0 +1,97 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+)
+
+// AMQPPublisher publishes events to a durable topic exchange with the event
+// type as routing key and waits for publisher confirms. The message layout
+// matches the broker's event bus, so broker consumers can bind to user.#.
+type AMQPPublisher struct {
+	exchange string
+
+	mu   sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+// DialAMQP connects and declares the exchange
+func DialAMQP(url, exchange string) (*AMQPPublisher, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err = ch.ExchangeDeclare(exchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("declaring exchange %s: %w", exchange, err)
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("enabling publisher confirms: %w", err)
+	}
+
+	return &AMQPPublisher{exchange: exchange, conn: conn, ch: ch}, nil
+}
+
+// Publish sends the event as a persistent message
+func (p *AMQPPublisher) Publish(ctx context.Context, event *data.OutboxEvent) error {
+	p.mu.Lock()
+	if p.ch == nil {
+		p.mu.Unlock()
+		return amqp.ErrClosed
+	}
+
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(ctx, p.exchange, event.Type, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    event.IdempotencyKey,
+		Type:         event.Type,
+		Timestamp:    event.CreatedAt,
+		Body:         event.Payload,
+	})
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !acked {
+		return fmt.Errorf("broker rejected event %s", event.IdempotencyKey)
+	}
+
+	return nil
+}
+
+// Close closes the connection
+func (p *AMQPPublisher) Close() error {
+	p.mu.Lock()
+	p.ch = nil
+	p.mu.Unlock()
+
+	err := p.conn.Close()
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
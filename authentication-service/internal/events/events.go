@@ -0,0 +1,30 @@
+// Package events publishes the domain events relayed from the outbox
+package events
+
+import (
+	"context"
+	"log"
+
+	"github.com/rabin-nyaundi/authentication-service/internal/data"
+)
+
+// Publisher delivers an outbox event. Delivery is at-least-once: the event's
+// idempotency key is sent along so consumers can drop duplicates.
+type Publisher interface {
+	Publish(ctx context.Context, event *data.OutboxEvent) error
+	Close() error
+}
+
+// LogPublisher writes events to the standard logger, for development
+type LogPublisher struct{}
+
+// Publish logs the event
+func (LogPublisher) Publish(ctx context.Context, event *data.OutboxEvent) error {
+	log.Printf("event %s %s user=%d %s", event.IdempotencyKey, event.Type, event.AggregateID, event.Payload)
+	return nil
+}
+
+// Close does nothing
+func (LogPublisher) Close() error {
+	return nil
+}
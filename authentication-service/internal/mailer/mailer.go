@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Mailer sends templated emails through the mail-service
+type Mailer struct {
+	URL    string
+	Client *http.Client
+
+	// Token is the service token sent in the X-Service-Token header
+	Token string
+}
+
+// New returns a Mailer calling the mail-service at baseURL with the token
+func New(baseURL, token string) *Mailer {
+	return &Mailer{
+		URL:    baseURL,
+		Client: &http.Client{Timeout: 30 * time.Second},
+		Token:  token,
+	}
+}
+
+// Send asks the mail-service to render the template with data and send it to recipient
+func (m *Mailer) Send(ctx context.Context, recipient, template string, data map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"to":       recipient,
+		"template": template,
+		"data":     data,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, m.URL+"/v1/mail", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if m.Token != "" {
+		request.Header.Set("X-Service-Token", m.Token)
+	}
+
+	response, err := m.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var payload struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(response.Body).Decode(&payload)
+		return fmt.Errorf("mail-service responded with status %d: %s", response.StatusCode, payload.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package pb holds the code generated from the protobuf definitions in proto/.
+// Regenerate it with buf, protoc-gen-go and protoc-gen-go-grpc on the PATH.
+package pb
+
+//go:generate sh -c "cd ../.. && buf generate"
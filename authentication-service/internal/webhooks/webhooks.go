@@ -0,0 +1,150 @@
+// Package webhooks signs and sends webhook deliveries.
+//
+// Each delivery is a POST of the event as JSON with these headers:
+//
+//	Webhook-Id:        the event id, the same across retries and redeliveries
+//	Webhook-Event:     the event type, e.g. user.created
+//	Webhook-Timestamp: unix seconds when this attempt was sent
+//	Webhook-Signature: t=<timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// Receivers should recompute the signature with the webhook's secret and
+// reject timestamps outside a few minutes of their clock to prevent replay.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrExpiredTimestamp = errors.New("webhook timestamp outside tolerance")
+)
+
+// NewSecret returns a random signing secret
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the Webhook-Signature header value for the body sent at t
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks a Webhook-Signature header against the body, rejecting
+// timestamps further than tolerance from now
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var sigs [][]byte
+
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sig, err := hex.DecodeString(value)
+			if err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return ErrInvalidSignature
+	}
+
+	if math.Abs(time.Since(time.Unix(unix, 0)).Seconds()) > tolerance.Seconds() {
+		return ErrExpiredTimestamp
+	}
+
+	expected := mac(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Backoff returns how long to wait before retrying after the given number of
+// failed attempts: 30s doubling up to 6h
+func Backoff(attempts int) time.Duration {
+	d := 30 * time.Second << uint(attempts)
+	if attempts > 10 || d > 6*time.Hour {
+		return 6 * time.Hour
+	}
+	return d
+}
+
+// Sender posts signed deliveries
+type Sender struct {
+	Client *http.Client
+}
+
+// Send posts the body to url. It returns the response status, and an error
+// for transport failures and non-2xx responses.
+func (s *Sender) Send(ctx context.Context, url, secret, eventID, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "authentication-service-webhooks")
+	req.Header.Set("Webhook-Id", eventID)
+	req.Header.Set("Webhook-Event", eventType)
+	req.Header.Set("Webhook-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set("Webhook-Signature", Sign(secret, now, body))
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS users;
+DROP EXTENSION IF EXISTS citext;
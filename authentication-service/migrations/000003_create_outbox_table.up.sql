@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    aggregate_id bigint NOT NULL,
+    event_type TEXT NOT NULL,
+    payload jsonb NOT NULL,
+    idempotency_key TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    published_at TIMESTAMP(6) WITH TIME ZONE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (aggregate_id, id) WHERE published_at IS NULL;
@@ -0,0 +1,10 @@
+// Package migrations holds the SQL migrations of the database schema,
+// embedded so the service binary can apply them itself
+package migrations
+
+import "embed"
+
+// FS holds the NNNNNN_name.up.sql and NNNNNN_name.down.sql files
+//
+//go:embed *.sql
+var FS embed.FS
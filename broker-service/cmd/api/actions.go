@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/ratelimit"
+	"github.com/rabin-nyaundi/broker/internal/upstream"
+)
+
+// action is a broker operation together with the scopes a caller needs to run
+// it and, optionally, a per-client rate limit stricter than the global one.
+// Actions taking credentials are sync only: a job record, kept on disk
+// until it is purged, must not hold a password or the token it bought.
+type action struct {
+	scopes   []string
+	limit    *ratelimit.Limit
+	syncOnly bool
+	handler  func(ctx context.Context, payload RequestPayload) (*JSONResponse, error)
+}
+
+// registerActions returns every action the broker can dispatch
+func (app *application) registerActions() map[string]action {
+	return map[string]action{
+		"auth": {
+			limit:    limitPtr(ratelimit.PerMinute(5)),
+			syncOnly: true,
+			handler:  app.authenticate,
+		},
+		"register": {
+			limit:    limitPtr(ratelimit.PerMinute(5)),
+			syncOnly: true,
+			handler:  app.register,
+		},
+		"login": {
+			limit:    limitPtr(ratelimit.PerMinute(5)),
+			syncOnly: true,
+			handler:  app.login,
+		},
+		"logout": {
+			handler: app.logout,
+		},
+		"sessions": {
+			handler: app.sessions,
+		},
+		"getuser": {
+			scopes:  []string{"users:read"},
+			handler: app.getUser,
+		},
+		"getusers": {
+			scopes:  []string{"users:read"},
+			handler: app.getUsers,
+		},
+		"roles": {
+			handler: app.roles,
+		},
+		"log": {
+			scopes:  []string{"logs:write"},
+			handler: app.publishLog,
+		},
+		"mail": {
+			scopes:  []string{"mail:send"},
+			limit:   limitPtr(ratelimit.PerMinute(30)),
+			handler: app.publishMail,
+		},
+	}
+}
+
+// dispatch runs the action named in the payload on behalf of the principal in ctx
+func (app *application) dispatch(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	a, err := app.authorize(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.handler(ctx, payload)
+}
+
+// authorize looks up the action and checks the caller's scopes and rate limit
+func (app *application) authorize(ctx context.Context, payload RequestPayload) (*action, error) {
+	a, ok := app.actions[payload.Action]
+	if !ok {
+		return nil, newActionError(http.StatusBadRequest, fmt.Errorf("unknown action %q", payload.Action))
+	}
+
+	if len(a.scopes) > 0 {
+		principal := auth.FromContext(ctx)
+		if principal == nil {
+			return nil, newActionError(http.StatusUnauthorized, errors.New("you must be authenticated to perform this action"))
+		}
+
+		for _, scope := range a.scopes {
+			if !principal.HasScope(scope) {
+				return nil, newActionError(http.StatusForbidden, fmt.Errorf("missing required scope %q", scope))
+			}
+		}
+	}
+
+	if a.limit != nil && app.config().limiter.enabled {
+		key := "action:" + payload.Action + ":" + app.contextGetClientKey(ctx)
+
+		res, err := app.limiter.Take(ctx, key, *a.limit)
+		if err != nil {
+			log.Printf("rate limiter: %v", err)
+		} else if !res.Allowed {
+			headers := http.Header{}
+			setRateLimitHeaders(headers, res)
+			return nil, &actionError{status: http.StatusTooManyRequests, err: errRateLimitExceeded, headers: headers}
+		}
+	}
+
+	return &a, nil
+}
+
+// callUpstream sends the request to the named service and decodes its JSON envelope
+func (app *application) callUpstream(ctx context.Context, service string, req *upstream.Request) (*JSONResponse, error) {
+	client, err := app.upstreams.Client(service)
+	if err != nil {
+		return nil, newActionError(http.StatusBadGateway, err)
+	}
+
+	response, err := client.Do(ctx, req)
+	if err != nil {
+		return nil, app.upstreamError(err)
+	}
+	defer response.Body.Close()
+
+	var jsonFromService JSONResponse
+
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if err != nil {
+		return nil, newActionError(http.StatusBadGateway, fmt.Errorf("error decoding response from %s", service))
+	}
+
+	if response.StatusCode >= http.StatusInternalServerError {
+		return nil, newActionError(http.StatusBadGateway, fmt.Errorf("error calling %s", service))
+	}
+
+	if response.StatusCode >= http.StatusBadRequest || jsonFromService.Error {
+		status := response.StatusCode
+		if status < http.StatusBadRequest {
+			status = http.StatusBadRequest
+		}
+		return nil, newActionError(status, errors.New(jsonFromService.Message))
+	}
+
+	return &jsonFromService, nil
+}
+
+func (app *application) authenticate(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	user, err := app.authClient.Authenticate(ctx, payload.Auth)
+	if err != nil {
+		var actionErr *actionError
+		if errors.As(err, &actionErr) && actionErr.status == http.StatusUnauthorized {
+			return nil, newActionError(http.StatusUnauthorized, errors.New("invalid credentials"))
+		}
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "login succsessful",
+		Data:    user,
+	}, nil
+}
+
+func (app *application) getUser(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	if payload.User.ID < 1 {
+		return nil, newActionError(http.StatusBadRequest, errors.New("invalid id"))
+	}
+
+	err := requireSelfOrAdmin(ctx, payload.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := app.authClient.GetUser(ctx, payload.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "user fetch succsessful",
+		Data:    user,
+	}, nil
+}
+
+// adminScope is only granted to the admin role, so the broker takes it as
+// the mark of an admin
+const adminScope = "users:write"
+
+// requireSelfOrAdmin lets the caller read their own user, and admins, who
+// hold adminScope, read any user. The broker fetches users with its service
+// credential, so this is the only check on whose users are read.
+func requireSelfOrAdmin(ctx context.Context, ids ...int64) error {
+	principal := auth.FromContext(ctx)
+	if principal == nil {
+		return newActionError(http.StatusUnauthorized, errors.New("you must be authenticated to perform this action"))
+	}
+
+	if principal.HasScope(adminScope) {
+		return nil
+	}
+
+	for _, id := range ids {
+		if id != principal.UserID && strconv.FormatInt(id, 10) != principal.Subject {
+			return newActionError(http.StatusForbidden, errors.New("only admins may read other users"))
+		}
+	}
+	return nil
+}
+
+// register creates an inactive user; the activation token is emailed
+func (app *application) register(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	body, err := json.Marshal(payload.Register)
+	if err != nil {
+		return nil, newActionError(http.StatusInternalServerError, err)
+	}
+
+	jsonFromService, err := app.callUpstream(ctx, "authentication-service", &upstream.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/users",
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "registration successful",
+		Data:    jsonFromService.Data,
+	}, nil
+}
+
+// login exchanges credentials for an authentication token
+func (app *application) login(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	body, err := json.Marshal(payload.Auth)
+	if err != nil {
+		return nil, newActionError(http.StatusInternalServerError, err)
+	}
+
+	jsonFromService, err := app.callUpstream(ctx, "authentication-service", &upstream.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/tokens/authentication",
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "login succsessful",
+		Data:    jsonFromService.Data,
+	}, nil
+}
+
+// callerRequest returns an upstream request carrying the caller's bearer token
+func (app *application) callerRequest(ctx context.Context, method, path string) (*upstream.Request, error) {
+	token := app.contextGetToken(ctx)
+	if token == "" {
+		return nil, newActionError(http.StatusUnauthorized, errors.New("you must be authenticated to perform this action"))
+	}
+
+	return &upstream.Request{
+		Method: method,
+		Path:   path,
+		Header: http.Header{"Authorization": {"Bearer " + token}},
+	}, nil
+}
+
+// logout revokes the caller's authentication token
+func (app *application) logout(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	req, err := app.callerRequest(ctx, http.MethodDelete, "/v1/tokens/authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = app.callUpstream(ctx, "authentication-service", req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "logged out",
+	}, nil
+}
+
+// sessions lists the caller's active authentication tokens
+func (app *application) sessions(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	req, err := app.callerRequest(ctx, http.MethodGet, "/v1/tokens/authentication")
+	if err != nil {
+		return nil, err
+	}
+
+	jsonFromService, err := app.callUpstream(ctx, "authentication-service", req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "sessions",
+		Data:    jsonFromService.Data,
+	}, nil
+}
+
+// getUsers fetches several users in one upstream call
+func (app *application) getUsers(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	if len(payload.User.IDs) == 0 {
+		return nil, newActionError(http.StatusBadRequest, errors.New("ids must be provided"))
+	}
+
+	err := requireSelfOrAdmin(ctx, payload.User.IDs...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(payload.User.IDs))
+	for i, id := range payload.User.IDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+
+	jsonFromService, err := app.callUpstream(ctx, "authentication-service", &upstream.Request{
+		Method: http.MethodGet,
+		Path:   "/v1/users?ids=" + strings.Join(ids, ","),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "user fetch succsessful",
+		Data:    jsonFromService.Data,
+	}, nil
+}
+
+// roles lists the roles users can hold and the scopes they grant
+func (app *application) roles(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	jsonFromService, err := app.callUpstream(ctx, "authentication-service", &upstream.Request{
+		Method: http.MethodGet,
+		Path:   "/v1/roles",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "roles",
+		Data:    jsonFromService.Data,
+	}, nil
+}
+
+// logLevels are the accepted log levels, also used as the last word of the routing key
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+// publishLog publishes the log entry as a log.<level> event
+func (app *application) publishLog(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	entry := payload.Log
+
+	if entry.Service == "" || entry.Message == "" {
+		return nil, newActionError(http.StatusBadRequest, errors.New("log service and message must be provided"))
+	}
+
+	if entry.Level == "" {
+		entry.Level = "info"
+	}
+
+	if !logLevels[entry.Level] {
+		return nil, newActionError(http.StatusBadRequest, fmt.Errorf("invalid log level %q", entry.Level))
+	}
+
+	err := app.bus.Publish(ctx, "log."+entry.Level, entry)
+	if err != nil {
+		return nil, newActionError(http.StatusServiceUnavailable, fmt.Errorf("publishing log event: %w", err))
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "log event published",
+	}, nil
+}
+
+// publishMail publishes the send request as a mail.send event
+func (app *application) publishMail(ctx context.Context, payload RequestPayload) (*JSONResponse, error) {
+	mail := payload.Mail
+
+	if mail.To == "" || mail.Template == "" {
+		return nil, newActionError(http.StatusBadRequest, errors.New("mail to and template must be provided"))
+	}
+
+	err := app.bus.Publish(ctx, "mail.send", mail)
+	if err != nil {
+		return nil, newActionError(http.StatusServiceUnavailable, fmt.Errorf("publishing mail event: %w", err))
+	}
+
+	return &JSONResponse{
+		Success: true,
+		Message: "mail event published",
+	}, nil
+}
+
+func limitPtr(l ratelimit.Limit) *ratelimit.Limit {
+	return &l
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	authv1 "github.com/rabin-nyaundi/broker/internal/pb/auth/v1"
+	"github.com/rabin-nyaundi/broker/internal/upstream"
+)
+
+// authClient is how the broker calls the authentication service. Both
+// transports return the same data so the transport is invisible to clients.
+type authClient interface {
+	Authenticate(ctx context.Context, input AuthPayload) (interface{}, error)
+	GetUser(ctx context.Context, id int64) (interface{}, error)
+}
+
+// openAuthClient returns the authentication service client for the configured
+// transport, and for gRPC the function used to introspect tokens
+func (app *application) openAuthClient() (authClient, func(ctx context.Context, token string) (*auth.Principal, error), error) {
+	switch app.config().auth.transport {
+	case "http":
+		return httpAuthClient{app: app}, nil, nil
+	case "grpc":
+		creds := insecure.NewCredentials()
+		if app.config().auth.grpcTLS {
+			// rotated files are picked up while the upstream stays in the
+			// registry; one replaced by a registry reload needs a restart
+			svc, err := app.registry.Service("authentication-service")
+			if err != nil {
+				return nil, nil, err
+			}
+			creds = credentials.NewTLS(svc.TLS)
+		}
+
+		// dns:/// resolves every replica and round_robin spreads calls over them
+		opts := []grpc.DialOption{
+			grpc.WithTransportCredentials(creds),
+			grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+		}
+		if token := app.config().auth.serviceToken; token != "" {
+			opts = append(opts, grpc.WithUnaryInterceptor(serviceTokenUnary(token)))
+		}
+
+		conn, err := grpc.Dial("dns:///"+app.config().auth.grpcAddr, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		client := grpcAuthClient{client: authv1.NewAuthServiceClient(conn), timeout: app.config().auth.grpcTimeout}
+		return client, client.introspect, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown auth transport %q", app.config().auth.transport)
+	}
+}
+
+// serviceTokenUnary sends the service credential in the x-service-token
+// metadata of every call
+func serviceTokenUnary(token string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-service-token", token)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// httpAuthClient calls the JSON API through the upstream pool
+type httpAuthClient struct {
+	app *application
+}
+
+func (c httpAuthClient) Authenticate(ctx context.Context, input AuthPayload) (interface{}, error) {
+	jsonData, err := json.MarshalIndent(input, "", "\t")
+	if err != nil {
+		return nil, newActionError(http.StatusInternalServerError, errors.New("error at mashal indent"))
+	}
+
+	jsonFromService, err := c.app.callUpstream(ctx, "authentication-service", &upstream.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/users/authenticate",
+		Body:   jsonData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonFromService.Data, nil
+}
+
+func (c httpAuthClient) GetUser(ctx context.Context, id int64) (interface{}, error) {
+	jsonFromService, err := c.app.callUpstream(ctx, "authentication-service", &upstream.Request{
+		Method: http.MethodGet,
+		Path:   fmt.Sprintf("/v1/users/%d", id),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonFromService.Data, nil
+}
+
+// grpcAuthClient calls the AuthService gRPC API
+type grpcAuthClient struct {
+	client  authv1.AuthServiceClient
+	timeout time.Duration
+}
+
+// grpcUser has the JSON layout of a user returned by the JSON API
+type grpcUser struct {
+	ID        int64      `json:"id"`
+	FirstName string     `json:"firstname"`
+	LastName  string     `json:"lastname"`
+	Email     string     `json:"email"`
+	Active    bool       `json:"active"`
+	Role      int32      `json:"role"`
+	CreatedAt *time.Time `json:"CreatedAt,omitempty"`
+	UpdatedAt *time.Time `json:"UpdatedAt,omitempty"`
+}
+
+func fromProtoUser(u *authv1.User) *grpcUser {
+	user := &grpcUser{
+		ID:        u.GetId(),
+		FirstName: u.GetFirstname(),
+		LastName:  u.GetLastname(),
+		Email:     u.GetEmail(),
+		Active:    u.GetActive(),
+		Role:      u.GetRole(),
+	}
+	if u.CreatedAt != nil {
+		t := u.CreatedAt.AsTime()
+		user.CreatedAt = &t
+	}
+	if u.UpdatedAt != nil {
+		t := u.UpdatedAt.AsTime()
+		user.UpdatedAt = &t
+	}
+	return user
+}
+
+func (c grpcAuthClient) Authenticate(ctx context.Context, input AuthPayload) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	resp, err := c.client.Authenticate(ctx, &authv1.AuthenticateRequest{Email: input.Email, Password: input.Password})
+	if err != nil {
+		return nil, grpcActionError(err)
+	}
+
+	return fromProtoUser(resp.GetUser()), nil
+}
+
+func (c grpcAuthClient) GetUser(ctx context.Context, id int64) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	resp, err := c.client.GetUser(ctx, &authv1.GetUserRequest{Id: id})
+	if err != nil {
+		return nil, grpcActionError(err)
+	}
+
+	return fromProtoUser(resp.GetUser()), nil
+}
+
+// introspect validates an opaque token with ValidateToken
+func (c grpcAuthClient) introspect(ctx context.Context, token string) (*auth.Principal, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	resp, err := c.client.ValidateToken(ctx, &authv1.ValidateTokenRequest{Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.GetActive() {
+		return nil, auth.ErrInvalidToken
+	}
+
+	return &auth.Principal{
+		Subject:   strconv.FormatInt(resp.GetUserId(), 10),
+		UserID:    resp.GetUserId(),
+		Email:     resp.GetEmail(),
+		Scopes:    resp.GetScopes(),
+		ExpiresAt: time.Unix(resp.GetExp(), 0),
+	}, nil
+}
+
+// grpcActionError maps a gRPC status to the action error the HTTP transport
+// would have returned for the same failure
+func grpcActionError(err error) error {
+	st := status.Convert(err)
+
+	switch st.Code() {
+	case codes.InvalidArgument:
+		return newActionError(http.StatusBadRequest, errors.New(st.Message()))
+	case codes.Unauthenticated:
+		return newActionError(http.StatusUnauthorized, errors.New(st.Message()))
+	case codes.PermissionDenied:
+		return newActionError(http.StatusForbidden, errors.New(st.Message()))
+	case codes.NotFound:
+		return newActionError(http.StatusNotFound, errors.New(st.Message()))
+	case codes.AlreadyExists:
+		return newActionError(http.StatusConflict, errors.New(st.Message()))
+	case codes.Unavailable:
+		return newActionError(http.StatusServiceUnavailable, errors.New("authentication-service is unavailable"))
+	case codes.DeadlineExceeded:
+		return newActionError(http.StatusGatewayTimeout, errors.New("authentication-service timed out"))
+	default:
+		return newActionError(http.StatusBadGateway, errors.New("error calling authentication-service"))
+	}
+}
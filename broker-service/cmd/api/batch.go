@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// BatchItem is one action of a batch request, identified by a client supplied id
+type BatchItem struct {
+	ID string `json:"id"`
+	RequestPayload
+}
+
+// BatchResult is the outcome of one item of a batch request
+type BatchResult struct {
+	ID      string      `json:"id"`
+	Status  int         `json:"status"`
+	Error   bool        `json:"error,omitempty"`
+	Success bool        `json:"success,omitempty"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// submitBatchHandler runs several actions concurrently and returns their
+// results in request order. Items still running when the batch deadline
+// passes are reported as timed out instead of holding up the response.
+func (app *application) submitBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var items []BatchItem
+
+	err := app.readJSON(w, r, &items)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(items) == 0 {
+		app.JSONEror(w, errors.New("batch must contain at least one item"), http.StatusBadRequest)
+		return
+	}
+
+	if len(items) > app.config().batch.maxItems {
+		app.JSONEror(w, fmt.Errorf("batch must not contain more than %d items", app.config().batch.maxItems), http.StatusBadRequest)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, item := range items {
+		if item.ID == "" {
+			app.JSONEror(w, errors.New("every batch item must have an id"), http.StatusBadRequest)
+			return
+		}
+		if seen[item.ID] {
+			app.JSONEror(w, fmt.Errorf("duplicate batch item id %q", item.ID), http.StatusBadRequest)
+			return
+		}
+		seen[item.ID] = true
+
+		// items are dispatched in place, so async would silently run sync
+		if item.Async {
+			app.JSONEror(w, fmt.Errorf("batch item %q cannot be async", item.ID), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), app.config().batch.timeout)
+	defer cancel()
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "batch processed",
+		Data:    app.runBatch(ctx, items),
+	})
+}
+
+// runBatch dispatches the items with at most batch.workers running at once
+func (app *application) runBatch(ctx context.Context, items []BatchItem) []BatchResult {
+	var (
+		mu      sync.Mutex
+		results = make([]BatchResult, len(items))
+		done    = make([]bool, len(items))
+		jobs    = make(chan int)
+		wg      sync.WaitGroup
+	)
+
+	workers := app.config().batch.workers
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				result := app.runLimitedItem(ctx, items[i])
+
+				mu.Lock()
+				if !done[i] {
+					results[i] = result
+					done[i] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+	feed:
+		for i := range items {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i, item := range items {
+		if !done[i] {
+			done[i] = true
+			results[i] = BatchResult{
+				ID:      item.ID,
+				Status:  http.StatusGatewayTimeout,
+				Error:   true,
+				Message: "batch deadline exceeded",
+			}
+		}
+	}
+
+	return results
+}
+
+// runLimitedItem runs an item that arrived within another request or on a
+// socket, charging it to the caller's default bucket like a request of its own
+func (app *application) runLimitedItem(ctx context.Context, item BatchItem) BatchResult {
+	err := app.takeGlobal(ctx, nil)
+	if err != nil {
+		return app.batchError(item.ID, err)
+	}
+
+	return app.runBatchItem(ctx, item)
+}
+
+func (app *application) runBatchItem(ctx context.Context, item BatchItem) BatchResult {
+	payload, err := app.dispatch(ctx, item.RequestPayload)
+	if err != nil {
+		return app.batchError(item.ID, err)
+	}
+
+	return BatchResult{
+		ID:      item.ID,
+		Status:  http.StatusOK,
+		Success: payload.Success,
+		Message: payload.Message,
+		Data:    payload.Data,
+	}
+}
+
+// batchError is the result of an item that failed with err
+func (app *application) batchError(id string, err error) BatchResult {
+	var actionErr *actionError
+	if !errors.As(err, &actionErr) {
+		actionErr = app.upstreamError(err).(*actionError)
+	}
+
+	return BatchResult{
+		ID:      id,
+		Status:  actionErr.status,
+		Error:   true,
+		Message: actionErr.err.Error(),
+	}
+}
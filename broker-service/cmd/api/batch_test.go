@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rabin-nyaundi/shared/openapi"
+)
+
+func TestBatchRejectsAsyncItems(t *testing.T) {
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{spec: spec}
+	current := &settings{}
+	current.batch.maxItems = 10
+	app.settings.Store(current)
+
+	body := `[{"id":"1","action":"roles"},{"id":"2","action":"roles","async":true}]`
+
+	for name, handler := range map[string]http.Handler{
+		// the schema and the handler each refuse the item
+		"schema": spec.Validate(app.validationError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})),
+		"handler": http.HandlerFunc(app.submitBatchHandler),
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/handle/batch", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status %d, want 422: %s", name, w.Code, w.Body)
+		}
+	}
+}
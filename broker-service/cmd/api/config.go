@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rabin-nyaundi/shared/config"
+	"github.com/rabin-nyaundi/shared/cors"
+)
+
+// envPrefix prefixes the environment variables of the settings,
+// BROKER_REGISTRY_FILE for -registry-file
+const envPrefix = "BROKER"
+
+// loadConfig reads the configuration from args, the environment, secret
+// files and the config file. The older unprefixed variables, JWKS_URL and
+// the like, are still read as defaults.
+func loadConfig(args []string) (Config, *config.Loader, error) {
+	var cfg Config
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	loader := config.New(fs, envPrefix)
+
+	fs.IntVar(&cfg.port, "port", 80, "API Server port")
+	fs.StringVar(&cfg.registryFile, "registry-file", "", "Upstream service registry JSON file")
+	fs.DurationVar(&cfg.configWatchInterval, "config-watch-interval", 5*time.Second, "How often the config and registry files are checked for changes to reload (0 reloads on SIGHUP only)")
+	fs.StringVar(&cfg.auth.jwksURL, "jwks-url", os.Getenv("JWKS_URL"), "JWKS URL used to verify JWT bearer tokens")
+	fs.StringVar(&cfg.auth.issuer, "jwt-issuer", "", "Required issuer of JWT bearer tokens")
+	fs.StringVar(&cfg.auth.audience, "jwt-audience", "", "Required audience of JWT bearer tokens")
+	fs.BoolVar(&cfg.auth.introspection, "token-introspection", true, "Validate opaque bearer tokens with the authentication service")
+	fs.DurationVar(&cfg.auth.cacheTTL, "introspection-cache-ttl", 30*time.Second, "How long introspection results are cached")
+	fs.StringVar(&cfg.auth.transport, "auth-transport", envOr("AUTH_TRANSPORT", "http"), "Transport used to call the authentication service (http|grpc)")
+	fs.StringVar(&cfg.auth.grpcAddr, "auth-grpc-addr", "authentication-service:50051", "Address of the authentication service gRPC API")
+	fs.DurationVar(&cfg.auth.grpcTimeout, "auth-grpc-timeout", 5*time.Second, "Timeout of authentication service gRPC calls")
+	fs.StringVar(&cfg.auth.serviceToken, "auth-service-token", "", "Service credential sent to the authentication service, one of its -service-tokens, to look up users and introspect tokens")
+	fs.StringVar(&cfg.mailServiceToken, "mail-service-token", "", "Service token sent to the mail service, one of its -service-tokens")
+	fs.StringVar(&cfg.loggerServiceToken, "logger-service-token", "", "Service token sent to the logger service, one of its -service-tokens")
+	fs.BoolVar(&cfg.auth.grpcTLS, "auth-grpc-tls", false, "Call the authentication service gRPC API over TLS, with the TLS settings of its upstream")
+	fs.StringVar(&cfg.tls.certFile, "tls-cert-file", "", "PEM certificate chain to serve HTTPS with, reloaded when it changes (empty serves plain HTTP)")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key-file", "", "PEM private key of -tls-cert-file")
+	fs.Var(&cfg.cors.allowedOrigins, "cors-allowed-origins", "Comma separated origins allowed to make cross-origin requests, exact or wildcard subdomains as https://*.example.com")
+	fs.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", true, "Allow cross-origin requests with credentials from allowed origins")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", 5*time.Minute, "How long browsers may cache preflight responses (0 leaves it to the browser, negative disables caching)")
+	cfg.cors.routes = config.List{"/openapi.json=*", "/docs=*", "/health=*", "/admin/*="}
+	fs.Var(&cfg.cors.routes, "cors-routes", "Comma separated PATH=ORIGIN ORIGIN... overrides of the allowed origins, PATH exact or a prefix ending in /*")
+	fs.IntVar(&cfg.batch.workers, "batch-workers", 8, "Maximum concurrent actions per batch request")
+	fs.IntVar(&cfg.batch.maxItems, "batch-max-items", 50, "Maximum number of actions in a batch request")
+	fs.DurationVar(&cfg.batch.timeout, "batch-timeout", 10*time.Second, "Overall deadline of a batch request")
+	fs.StringVar(&cfg.jobs.dir, "jobs-dir", "./data/jobs", "Directory where async job records are kept (empty keeps them in memory)")
+	fs.IntVar(&cfg.jobs.workers, "job-workers", 4, "Number of async job workers")
+	fs.IntVar(&cfg.jobs.queueSize, "job-queue-size", 100, "Maximum number of queued async jobs")
+	fs.DurationVar(&cfg.jobs.timeout, "job-timeout", 5*time.Minute, "Maximum run time of an async job")
+	fs.DurationVar(&cfg.jobs.retention, "job-retention", 24*time.Hour, "How long finished async jobs are kept")
+	fs.StringVar(&cfg.bus.kind, "event-bus", "inproc", "Event bus implementation (inproc|amqp)")
+	fs.StringVar(&cfg.bus.amqpURL, "amqp-url", os.Getenv("AMQP_URL"), "AMQP 0-9-1 broker URL used by the amqp event bus")
+	fs.StringVar(&cfg.bus.exchange, "amqp-exchange", "broker.events", "Topic exchange events are published to")
+	fs.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 8, "Maximum nesting depth of GraphQL queries")
+	fs.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 250, "Maximum complexity of GraphQL queries")
+	fs.IntVar(&cfg.ws.maxConnsPerUser, "ws-max-conns-per-user", 5, "Maximum open WebSocket connections per user (0 is unlimited)")
+	fs.IntVar(&cfg.ws.maxInFlight, "ws-max-in-flight", 8, "Maximum concurrent calls per WebSocket connection")
+	fs.IntVar(&cfg.ws.sendBuffer, "ws-send-buffer", 64, "Messages queued for a WebSocket client before it is disconnected as too slow")
+	fs.Int64Var(&cfg.ws.maxMessageSize, "ws-max-message-size", 64*1024, "Maximum size in bytes of a message received over a WebSocket")
+	fs.DurationVar(&cfg.ws.pingInterval, "ws-ping-interval", 30*time.Second, "How often WebSocket clients are pinged")
+	fs.DurationVar(&cfg.ws.callTimeout, "ws-call-timeout", 10*time.Second, "Deadline of an action called over a WebSocket")
+	fs.IntVar(&cfg.sse.replaySize, "sse-replay-size", 100, "Events kept per user to replay to reconnecting event streams")
+	fs.IntVar(&cfg.sse.bufferSize, "sse-buffer-size", 32, "Events queued for an event stream before it is ended as too slow")
+	fs.DurationVar(&cfg.sse.retention, "sse-retention", 15*time.Minute, "How long the replay buffer of a user without open streams is kept")
+	fs.DurationVar(&cfg.sse.heartbeat, "sse-heartbeat", 15*time.Second, "How often a heartbeat comment is sent on idle event streams")
+	fs.DurationVar(&cfg.sse.retry, "sse-retry", 3*time.Second, "Reconnection delay advertised to event stream clients")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable per-client rate limiting")
+	fs.Float64Var(&cfg.limiter.limit.Rate, "limiter-rps", 10, "Rate limiter maximum requests per second per client")
+	fs.IntVar(&cfg.limiter.limit.Burst, "limiter-burst", 20, "Rate limiter maximum burst per client")
+	fs.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Rate limiter store (memory|redis)")
+	fs.StringVar(&cfg.limiter.redisAddr, "redis-addr", os.Getenv("REDIS_ADDR"), "Redis address used by the redis rate limiter store")
+	fs.StringVar(&cfg.limiter.redisPassword, "redis-password", os.Getenv("REDIS_PASSWORD"), "Redis password")
+	fs.IntVar(&cfg.limiter.redisDB, "redis-db", 0, "Redis database number")
+	fs.Var(&cfg.limiter.trustedProxies, "trusted-proxies", "Comma separated CIDRs of proxies whose X-Forwarded-For is trusted")
+
+	loader.Secret("redis-password", "auth-service-token", "mail-service-token", "logger-service-token")
+
+	err := loader.Load(args)
+	return cfg, loader, err
+}
+
+// validate reports every invalid setting
+func (cfg Config) validate() error {
+	var p config.Problems
+
+	p.Check(cfg.port > 0 && cfg.port < 65536, "port must be between 1 and 65535")
+	p.Check(cfg.configWatchInterval >= 0, "config-watch-interval must not be negative")
+
+	if cfg.auth.jwksURL != "" {
+		u, err := url.Parse(cfg.auth.jwksURL)
+		p.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "jwks-url must be an http or https URL")
+	}
+	p.Check(cfg.auth.cacheTTL >= 0, "introspection-cache-ttl must not be negative")
+	switch cfg.auth.transport {
+	case "http":
+	case "grpc":
+		p.Check(cfg.auth.grpcAddr != "", "auth-grpc-addr must be provided for the grpc transport")
+		p.Check(cfg.auth.grpcTimeout > 0, "auth-grpc-timeout must be positive")
+	default:
+		p.Check(false, "auth-transport must be http or grpc, not %q", cfg.auth.transport)
+	}
+	_, err := cfg.corsHandler()
+	p.Check(err == nil, "cors: %v", err)
+
+	p.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-cert-file and tls-key-file must be provided together")
+
+	p.Check(cfg.batch.workers > 0, "batch-workers must be positive")
+	p.Check(cfg.batch.maxItems > 0, "batch-max-items must be positive")
+	p.Check(cfg.batch.timeout > 0, "batch-timeout must be positive")
+
+	p.Check(cfg.jobs.workers > 0, "job-workers must be positive")
+	p.Check(cfg.jobs.queueSize > 0, "job-queue-size must be positive")
+	p.Check(cfg.jobs.timeout > 0, "job-timeout must be positive")
+	p.Check(cfg.jobs.retention > 0, "job-retention must be positive")
+
+	switch cfg.bus.kind {
+	case "inproc":
+	case "amqp":
+		p.Check(cfg.bus.amqpURL != "", "amqp-url must be provided for the amqp event bus")
+	default:
+		p.Check(false, "event-bus must be inproc or amqp, not %q", cfg.bus.kind)
+	}
+
+	p.Check(cfg.graphql.maxDepth > 0, "graphql-max-depth must be positive")
+	p.Check(cfg.graphql.maxComplexity > 0, "graphql-max-complexity must be positive")
+
+	p.Check(cfg.ws.maxConnsPerUser >= 0, "ws-max-conns-per-user must not be negative")
+	p.Check(cfg.ws.maxInFlight > 0, "ws-max-in-flight must be positive")
+	p.Check(cfg.ws.sendBuffer > 0, "ws-send-buffer must be positive")
+	p.Check(cfg.ws.maxMessageSize > 0, "ws-max-message-size must be positive")
+	p.Check(cfg.ws.pingInterval > 0, "ws-ping-interval must be positive")
+	p.Check(cfg.ws.callTimeout > 0, "ws-call-timeout must be positive")
+
+	p.Check(cfg.sse.replaySize >= 0, "sse-replay-size must not be negative")
+	p.Check(cfg.sse.bufferSize > 0, "sse-buffer-size must be positive")
+	p.Check(cfg.sse.retention > 0, "sse-retention must be positive")
+	p.Check(cfg.sse.heartbeat > 0, "sse-heartbeat must be positive")
+	p.Check(cfg.sse.retry > 0, "sse-retry must be positive")
+
+	if cfg.limiter.enabled {
+		p.Check(cfg.limiter.limit.Rate > 0, "limiter-rps must be positive")
+		p.Check(cfg.limiter.limit.Burst > 0, "limiter-burst must be positive")
+	}
+	switch cfg.limiter.store {
+	case "memory":
+	case "redis":
+		p.Check(cfg.limiter.redisAddr != "", "redis-addr must be provided for the redis rate limiter store")
+	default:
+		p.Check(false, "limiter-store must be memory or redis, not %q", cfg.limiter.store)
+	}
+
+	return p.Err()
+}
+
+// corsHandler builds the CORS handler of the settings
+func (cfg Config) corsHandler() (*cors.Handler, error) {
+	policy := cors.Policy{
+		AllowedOrigins:   cfg.cors.allowedOrigins,
+		AllowedMethods:   []string{"POST", "PUT", "GET", "DELETE"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"Link"},
+		AllowCredentials: cfg.cors.allowCredentials,
+		MaxAge:           cfg.cors.maxAge,
+	}
+
+	routes, err := cors.ParseRoutes(cfg.cors.routes, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return cors.New(policy, routes, corsMetrics)
+}
+
+// cidrList is a flag of comma separated CIDRs. A bare address is a network
+// of that one address.
+type cidrList []*net.IPNet
+
+func (l *cidrList) String() string {
+	if l == nil {
+		return ""
+	}
+
+	cidrs := make([]string, len(*l))
+	for i, network := range *l {
+		cidrs[i] = network.String()
+	}
+	return strings.Join(cidrs, ",")
+}
+
+func (l *cidrList) Set(val string) error {
+	for _, cidr := range strings.Split(val, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, network)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/rabin-nyaundi/broker/internal/eventbus"
+	"github.com/rabin-nyaundi/broker/internal/upstream"
+)
+
+// startConsumers subscribes the broker to the events it forwards to upstream
+// services and to the account events it pushes to WebSocket and SSE clients
+func (app *application) startConsumers() error {
+	err := app.bus.Subscribe("broker.logger", []string{"log.#"}, app.forwardLog)
+	if err != nil {
+		return err
+	}
+
+	err = app.bus.Subscribe("broker.mailer", []string{"mail.send"}, app.forwardMail)
+	if err != nil {
+		return err
+	}
+
+	// every broker pushes to the clients connected to it, so each needs its own queues
+	err = app.bus.Subscribe("", wsPushEvents, app.pushEvent)
+	if err != nil {
+		return err
+	}
+
+	return app.bus.Subscribe("", sseNotifyEvents, app.notifyEvent)
+}
+
+// forwardLog stores a published log event in the logger service, keeping the
+// time it was published rather than the time it was delivered
+func (app *application) forwardLog(ctx context.Context, event eventbus.Event) error {
+	var entry map[string]interface{}
+
+	err := json.Unmarshal(event.Payload, &entry)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := entry["timestamp"]; !ok && !event.Timestamp.IsZero() {
+		entry["timestamp"] = event.Timestamp
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.callUpstream(ctx, "logger-service", &upstream.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/logs",
+		Body:   body,
+	})
+	return err
+}
+
+// forwardMail hands a published send request to the mail service
+func (app *application) forwardMail(ctx context.Context, event eventbus.Event) error {
+	_, err := app.callUpstream(ctx, "mail-service", &upstream.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/mail",
+		Body:   event.Payload,
+	})
+	return err
+}
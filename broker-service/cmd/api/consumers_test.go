@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/eventbus"
+)
+
+func TestSessionRevokedReachesSocketsAndStreams(t *testing.T) {
+	app := &application{
+		bus:     eventbus.NewInProcess(nil),
+		wsHub:   newWSHub(),
+		streams: newSSEStreams(16, 16),
+	}
+	defer app.bus.Close()
+
+	current := &settings{}
+	current.ws.maxConnsPerUser = 4
+	current.ws.maxInFlight = 4
+	current.ws.sendBuffer = 16
+	current.ws.maxMessageSize = 1 << 16
+	current.ws.pingInterval = time.Minute
+	current.sse.heartbeat = time.Hour
+	current.sse.retry = time.Second
+	app.settings.Store(current)
+
+	err := app.startConsumers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both connections authenticate as user 7 with the same session token
+	authenticated := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			r = app.contextSetToken(r, "jane-token")
+			next(w, r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{Subject: "7"})))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", authenticated(app.wsHandler))
+	mux.HandleFunc("/events", authenticated(app.eventsHandler))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	response, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	stream := bufio.NewReader(response.Body)
+	_, err = stream.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the payload the authentication service records when it revokes a
+	// session, published with the event type as routing key
+	payload := `{"session_id":"` + sessionID("jane-token") + `","user_id":7}`
+	err = app.bus.Publish(context.Background(), "session.revoked", json.RawMessage(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var pushed wsEvent
+	err = ws.ReadJSON(&pushed)
+	if err != nil {
+		t.Fatalf("reading the pushed event: %v", err)
+	}
+	if pushed.Event != "session.revoked" || string(pushed.Data) != payload {
+		t.Errorf("pushed %s %s, want session.revoked %s", pushed.Event, pushed.Data, payload)
+	}
+
+	_, _, err = ws.ReadMessage()
+	var closed *websocket.CloseError
+	if !errors.As(err, &closed) || closed.Code != websocket.ClosePolicyViolation {
+		t.Errorf("socket of the revoked session: %v, want closed with a policy violation", err)
+	}
+
+	streamed := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(stream)
+		streamed <- string(b)
+	}()
+
+	select {
+	case s := <-streamed:
+		if !strings.Contains(s, "event: session.revoked\ndata: "+payload+"\n") {
+			t.Errorf("stream %q, want the session.revoked event", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("stream of the revoked session stayed open")
+	}
+}
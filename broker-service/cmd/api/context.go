@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey string
+
+const (
+	clientKeyContextKey  = contextKey("client")
+	tokenContextKey      = contextKey("token")
+	queryTokenContextKey = contextKey("queryToken")
+)
+
+// contextSetClientKey stores the key identifying the caller for rate limiting
+func (app *application) contextSetClientKey(r *http.Request, key string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextSetToken stores the validated bearer token so actions can act on
+// behalf of the caller
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextSetQueryToken stores the unvalidated access_token query parameter
+// of a request opening a long lived connection
+func (app *application) contextSetQueryToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), queryTokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// contextGetQueryToken returns the access_token query parameter, if any
+func (app *application) contextGetQueryToken(ctx context.Context) string {
+	token, _ := ctx.Value(queryTokenContextKey).(string)
+	return token
+}
+
+// contextGetToken returns the caller's bearer token, if any
+func (app *application) contextGetToken(ctx context.Context) string {
+	token, _ := ctx.Value(tokenContextKey).(string)
+	return token
+}
+
+// contextGetClientKey returns the key identifying the caller for rate limiting
+func (app *application) contextGetClientKey(ctx context.Context) string {
+	key, _ := ctx.Value(clientKeyContextKey).(string)
+	return key
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/dataloader"
+)
+
+// gqlUser is a user as returned by the authentication service
+type gqlUser struct {
+	ID        int64      `json:"id"`
+	FirstName string     `json:"firstname"`
+	LastName  string     `json:"lastname"`
+	Email     string     `json:"email"`
+	Active    bool       `json:"active"`
+	Role      int        `json:"role"`
+	CreatedAt *time.Time `json:"CreatedAt"`
+}
+
+// gqlRole is a role and the scopes it grants
+type gqlRole struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// gqlSession is an active authentication token of the viewer
+type gqlSession struct {
+	ID      string    `json:"id"`
+	Expiry  time.Time `json:"expiry"`
+	Current bool      `json:"current"`
+}
+
+// gqlToken is the token issued by the login mutation
+type gqlToken struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// gqlLoaders batch the upstream calls of one GraphQL request
+type gqlLoaders struct {
+	users    *dataloader.Loader[int64, *gqlUser]
+	roles    *dataloader.Loader[int, *gqlRole]
+	sessions *dataloader.Loader[int64, []gqlSession]
+}
+
+type gqlContextKey struct{}
+
+// gqlError exposes the HTTP status of a failed action as an error extension.
+// graphql-go drops extensions of errors returned by thunks, so batched fields
+// only report the message.
+type gqlError struct {
+	*actionError
+}
+
+func (e gqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"status": e.status}
+}
+
+// newLoaders returns loaders backed by broker actions, so scopes and per-action
+// rate limits apply to GraphQL exactly as to /handle
+func (app *application) newLoaders() *gqlLoaders {
+	return &gqlLoaders{
+		users: dataloader.New(func(ctx context.Context, ids []int64) (map[int64]*gqlUser, error) {
+			var users []*gqlUser
+			err := app.dispatchInto(ctx, RequestPayload{Action: "getusers", User: UserPayload{IDs: ids}}, &users)
+			if err != nil {
+				return nil, err
+			}
+
+			byID := make(map[int64]*gqlUser, len(users))
+			for _, user := range users {
+				byID[user.ID] = user
+			}
+			return byID, nil
+		}, 100),
+
+		roles: dataloader.New(func(ctx context.Context, ids []int) (map[int]*gqlRole, error) {
+			var roles []*gqlRole
+			err := app.dispatchInto(ctx, RequestPayload{Action: "roles"}, &roles)
+			if err != nil {
+				return nil, err
+			}
+
+			byID := make(map[int]*gqlRole, len(roles))
+			for _, role := range roles {
+				byID[role.ID] = role
+			}
+
+			// roles above the highest known one get its scopes
+			for _, id := range ids {
+				if byID[id] == nil && len(roles) > 0 && id > roles[len(roles)-1].ID {
+					byID[id] = roles[len(roles)-1]
+				}
+			}
+			return byID, nil
+		}, 0),
+
+		sessions: dataloader.New(func(ctx context.Context, userIDs []int64) (map[int64][]gqlSession, error) {
+			var sessions []gqlSession
+			err := app.dispatchInto(ctx, RequestPayload{Action: "sessions"}, &sessions)
+			if err != nil {
+				return nil, err
+			}
+			// only the viewer's own sessions are ever requested
+			return map[int64][]gqlSession{userIDs[0]: sessions}, nil
+		}, 1),
+	}
+}
+
+// dispatchInto runs an action and decodes its data into v
+func (app *application) dispatchInto(ctx context.Context, payload RequestPayload, v interface{}) error {
+	response, err := app.dispatch(ctx, payload)
+	if err != nil {
+		return gqlActionError(app, err)
+	}
+
+	b, err := json.Marshal(response.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// gqlActionError converts an action failure into a GraphQL error
+func gqlActionError(app *application, err error) error {
+	var actionErr *actionError
+	if !errors.As(err, &actionErr) {
+		actionErr = app.upstreamError(err).(*actionError)
+	}
+	return gqlError{actionErr}
+}
+
+func loadersFrom(ctx context.Context) *gqlLoaders {
+	return ctx.Value(gqlContextKey{}).(*gqlLoaders)
+}
+
+// gqlID parses a GraphQL ID argument as a user id
+func gqlID(v interface{}) (int64, error) {
+	s, _ := v.(string)
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid id")
+	}
+	return id, nil
+}
+
+// graphqlSchema builds the schema of the GraphQL gateway
+func (app *application) graphqlSchema() (graphql.Schema, error) {
+	roleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Role",
+		Fields: graphql.Fields{
+			"id":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"name":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"scopes": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+		},
+	})
+
+	sessionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Session",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"expiresAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(gqlSession).Expiry, nil }},
+			"current":   &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.NewNonNull(graphql.ID), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return strconv.FormatInt(p.Source.(*gqlUser).ID, 10), nil
+			}},
+			"firstname": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*gqlUser).FirstName, nil }},
+			"lastname":  &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*gqlUser).LastName, nil }},
+			"email":     &graphql.Field{Type: graphql.String},
+			"active":    &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"createdAt": &graphql.Field{Type: graphql.DateTime, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if t := p.Source.(*gqlUser).CreatedAt; t != nil {
+					return *t, nil
+				}
+				return nil, nil
+			}},
+			"role": &graphql.Field{
+				Type: roleType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					thunk := loadersFrom(p.Context).roles.Load(p.Context, p.Source.(*gqlUser).Role)
+					return func() (interface{}, error) {
+						role, err := thunk()
+						if err != nil || role == nil {
+							return nil, err
+						}
+						return role, nil
+					}, nil
+				},
+			},
+			"sessions": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(sessionType))),
+				Description: "Active sessions, only visible on the viewer",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user := p.Source.(*gqlUser)
+					principal := auth.FromContext(p.Context)
+					if principal == nil || principal.UserID != user.ID {
+						return nil, gqlError{&actionError{status: http.StatusForbidden, err: errors.New("sessions are only visible to their owner")}}
+					}
+
+					thunk := loadersFrom(p.Context).sessions.Load(p.Context, user.ID)
+					return func() (interface{}, error) {
+						return thunk()
+					}, nil
+				},
+			},
+		},
+	})
+
+	tokenType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AuthToken",
+		Fields: graphql.Fields{
+			"token":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"expiresAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime), Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source.(*gqlToken).Expiry, nil }},
+		},
+	})
+
+	loadUser := func(ctx context.Context, id int64) interface{} {
+		thunk := loadersFrom(ctx).users.Load(ctx, id)
+		return func() (interface{}, error) {
+			user, err := thunk()
+			if err != nil || user == nil {
+				return nil, err
+			}
+			return user, nil
+		}
+	}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type:        userType,
+				Description: "The authenticated user, null for anonymous requests",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					principal := auth.FromContext(p.Context)
+					if principal == nil || principal.UserID == 0 {
+						return nil, nil
+					}
+					return loadUser(p.Context, principal.UserID), nil
+				},
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := gqlID(p.Args["id"])
+					if err != nil {
+						return nil, err
+					}
+					return loadUser(p.Context, id), nil
+				},
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(userType)),
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID)))},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					raw, _ := p.Args["ids"].([]interface{})
+
+					ids := make([]int64, len(raw))
+					for i, v := range raw {
+						id, err := gqlID(v)
+						if err != nil {
+							return nil, err
+						}
+						ids[i] = id
+					}
+
+					thunk := loadersFrom(p.Context).users.LoadMany(p.Context, ids)
+					return func() (interface{}, error) {
+						users, err := thunk()
+						if err != nil {
+							return nil, err
+						}
+
+						out := make([]interface{}, len(users))
+						for i, user := range users {
+							if user != nil {
+								out[i] = user
+							}
+						}
+						return out, nil
+					}, nil
+				},
+			},
+			"roles": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(roleType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var roles []*gqlRole
+					err := app.dispatchInto(p.Context, RequestPayload{Action: "roles"}, &roles)
+					return roles, err
+				},
+			},
+		},
+	})
+
+	registerInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "RegisterInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"firstname": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"lastname":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"email":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"password":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"register": &graphql.Field{
+				Type:        userType,
+				Description: "Registers an inactive user and emails their activation token",
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(registerInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					input, _ := p.Args["input"].(map[string]interface{})
+					str := func(key string) string { s, _ := input[key].(string); return s }
+
+					var created struct {
+						User *gqlUser `json:"user"`
+					}
+					err := app.dispatchInto(p.Context, RequestPayload{
+						Action: "register",
+						Register: RegisterPayload{
+							FirstName: str("firstname"),
+							LastName:  str("lastname"),
+							Email:     str("email"),
+							Password:  str("password"),
+						},
+					}, &created)
+					if err != nil {
+						return nil, err
+					}
+					return created.User, nil
+				},
+			},
+			"login": &graphql.Field{
+				Type: graphql.NewNonNull(tokenType),
+				Args: graphql.FieldConfigArgument{
+					"email":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"password": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					email, _ := p.Args["email"].(string)
+					password, _ := p.Args["password"].(string)
+
+					var token gqlToken
+					err := app.dispatchInto(p.Context, RequestPayload{Action: "login", Auth: AuthPayload{Email: email, Password: password}}, &token)
+					if err != nil {
+						return nil, err
+					}
+					return &token, nil
+				},
+			},
+			"logout": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Revokes the token the request was made with",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					_, err := app.dispatch(p.Context, RequestPayload{Action: "logout"})
+					if err != nil {
+						return nil, gqlActionError(app, err)
+					}
+					return true, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// graphqlRequest is the body of a GraphQL request
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphqlHandler executes GraphQL queries and mutations posted as JSON.
+// Documents that fail to parse, validate or exceed the depth and complexity
+// limits are rejected with 400 before anything is resolved.
+func (app *application) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var input graphqlRequest
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(input.Query), Name: "GraphQL request"})})
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, &graphql.Result{Errors: graphqlErrors(err)})
+		return
+	}
+
+	validation := graphql.ValidateDocument(&app.graphql, doc, nil)
+	if !validation.IsValid {
+		app.writeJSON(w, http.StatusBadRequest, &graphql.Result{Errors: validation.Errors})
+		return
+	}
+
+	err = checkQueryLimits(doc, input.OperationName, input.Variables, app.config().graphql.maxDepth, app.config().graphql.maxComplexity)
+	if err != nil {
+		app.writeJSON(w, http.StatusBadRequest, &graphql.Result{Errors: graphqlErrors(err)})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), gqlContextKey{}, app.newLoaders())
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        app.graphql,
+		AST:           doc,
+		OperationName: input.OperationName,
+		Args:          input.Variables,
+		Context:       ctx,
+	})
+
+	app.writeJSON(w, http.StatusOK, result)
+}
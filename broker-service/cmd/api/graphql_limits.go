@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// listCost is the assumed length of list fields whose size is not given by an
+// ids argument
+var listCost = map[string]int{
+	"sessions": 10,
+}
+
+// checkQueryLimits rejects operations nested deeper than maxDepth or whose
+// complexity exceeds maxComplexity. Every field costs one, and the cost of a
+// list field's selections is multiplied by the number of ids requested or its
+// listCost. Introspection fields are not counted.
+func checkQueryLimits(doc *ast.Document, operationName string, variables map[string]interface{}, maxDepth, maxComplexity int) error {
+	fragments := map[string]*ast.FragmentDefinition{}
+	var operations []*ast.OperationDefinition
+
+	for _, def := range doc.Definitions {
+		switch def := def.(type) {
+		case *ast.FragmentDefinition:
+			fragments[def.Name.Value] = def
+		case *ast.OperationDefinition:
+			operations = append(operations, def)
+		}
+	}
+
+	for _, op := range operations {
+		name := ""
+		if op.Name != nil {
+			name = op.Name.Value
+		}
+		if operationName != "" && name != operationName {
+			continue
+		}
+
+		w := limitWalker{fragments: fragments, variables: variables}
+		complexity := w.selectionSet(op.SelectionSet, 1)
+
+		if w.depth > maxDepth {
+			return fmt.Errorf("query depth %d exceeds the maximum of %d", w.depth, maxDepth)
+		}
+		if complexity > maxComplexity {
+			return fmt.Errorf("query complexity %d exceeds the maximum of %d", complexity, maxComplexity)
+		}
+	}
+
+	return nil
+}
+
+type limitWalker struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	depth     int
+}
+
+// selectionSet returns the complexity of the set at the given depth, recording
+// the deepest field seen
+func (w *limitWalker) selectionSet(set *ast.SelectionSet, depth int) int {
+	if set == nil {
+		return 0
+	}
+
+	complexity := 0
+	for _, selection := range set.Selections {
+		switch s := selection.(type) {
+		case *ast.Field:
+			if len(s.Name.Value) > 1 && s.Name.Value[:2] == "__" {
+				continue
+			}
+
+			if depth > w.depth {
+				w.depth = depth
+			}
+			complexity += 1 + w.multiplier(s)*w.selectionSet(s.SelectionSet, depth+1)
+		case *ast.InlineFragment:
+			complexity += w.selectionSet(s.SelectionSet, depth)
+		case *ast.FragmentSpread:
+			// validation has already rejected unknown and cyclic fragments
+			if fragment, ok := w.fragments[s.Name.Value]; ok {
+				complexity += w.selectionSet(fragment.SelectionSet, depth)
+			}
+		}
+	}
+	return complexity
+}
+
+// multiplier returns how many times a field's selections are resolved
+func (w *limitWalker) multiplier(field *ast.Field) int {
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "ids" {
+			continue
+		}
+
+		n := 0
+		switch v := arg.Value.(type) {
+		case *ast.ListValue:
+			n = len(v.Values)
+		case *ast.Variable:
+			list, _ := w.variables[v.Name.Value].([]interface{})
+			n = len(list)
+		}
+
+		if n < 1 {
+			n = 1
+		}
+		return n
+	}
+
+	if n, ok := listCost[field.Name.Value]; ok {
+		return n
+	}
+	return 1
+}
+
+// graphqlErrors formats an error for the errors member of a response
+func graphqlErrors(err error) []gqlerrors.FormattedError {
+	return gqlerrors.FormatErrors(err)
+}
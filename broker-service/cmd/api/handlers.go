@@ -1,10 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"errors"
-	"log"
 	"net/http"
 )
 
@@ -18,8 +15,13 @@ type JSONResponse struct {
 
 // RequestPayload holds request payload
 type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   AuthPayload `json:"auth,omitempty"`
+	Action   string          `json:"action"`
+	Async    bool            `json:"async,omitempty"`
+	Auth     AuthPayload     `json:"auth,omitempty"`
+	Register RegisterPayload `json:"register,omitempty"`
+	User     UserPayload     `json:"user,omitempty"`
+	Log      LogPayload      `json:"log,omitempty"`
+	Mail     MailPayload     `json:"mail,omitempty"`
 }
 
 // AuthPayload holds authentication request payload
@@ -28,6 +30,36 @@ type AuthPayload struct {
 	Password string `json:"password"`
 }
 
+// RegisterPayload holds the details of a new user
+type RegisterPayload struct {
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
+// LogPayload holds an application log entry
+type LogPayload struct {
+	Service string                 `json:"service"`
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// MailPayload holds a templated email send request
+type MailPayload struct {
+	To       string                 `json:"to"`
+	Template string                 `json:"template"`
+	Locale   string                 `json:"locale,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// UserPayload identifies the user a request is about
+type UserPayload struct {
+	ID  int64   `json:"id"`
+	IDs []int64 `json:"ids,omitempty"`
+}
+
 func (app *application) Broker(w http.ResponseWriter, r *http.Request) {
 	payload := JSONResponse{
 		Error:   false,
@@ -51,121 +83,25 @@ func (app *application) submitRequestHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// get user id from the request
-	// userId, err := app.readIDParams(w, r)
-	// if err != nil {
-	// 	app.JSONEror(w, errors.New("invalid id"))
-	// 	return
-	// }
-
-	switch requestPayload.Action {
-	case "auth":
-		app.authenticate(w, requestPayload.Auth)
-	// case "getuser":
-	// 	app.GetUser(w, userId)
-	default:
-		app.JSONEror(w, errors.New("Failed"))
-	}
-}
-
-func (app *application) authenticate(w http.ResponseWriter, a AuthPayload) {
-	jsonData, err := json.MarshalIndent(a, "", "\t")
-
-	if err != nil {
-		app.JSONEror(w, errors.New("error at mashal indent"))
-		return
-	}
-
-	// call auth service
-	request, err := http.NewRequest("POST", "http://authentication-service/v1/users/authenticate", bytes.NewBuffer(jsonData))
-	if err != nil {
-		app.JSONEror(w, err, http.StatusBadRequest)
+	if requestPayload.Async {
+		app.submitJob(w, r, requestPayload)
 		return
 	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	payload, err := app.dispatch(r.Context(), requestPayload)
 	if err != nil {
-		app.JSONEror(w, err)
+		app.actionErrorResponse(w, err)
 		return
 	}
 
-	defer response.Body.Close()
-
-	// make sure we get correct status code
-	if response.StatusCode == http.StatusUnauthorized {
-		app.JSONEror(w, errors.New("invalid credentials"))
-		return
-
-	} else if response.StatusCode != http.StatusOK {
-		app.JSONEror(w, errors.New("error calling auth service"))
-		return
-	}
-
-	var jsonFromService JSONResponse
-
-	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
-	if err != nil {
-		log.Println("error at decode here")
-		app.JSONEror(w, errors.New("error decoding request body"))
-		return
-	}
-
-	if jsonFromService.Error {
-		app.JSONEror(w, err, http.StatusForbidden)
-	}
-
-	var payload JSONResponse
-	payload.Success = true
-	payload.Message = "login succsessful"
-	payload.Data = jsonFromService.Data
-
 	app.writeJSON(w, http.StatusAccepted, payload)
 }
 
-// func (app *application) GetUser(w http.ResponseWriter, id int64) {
-
-// 	request, err := http.NewRequest("GET", fmt.Sprintf("http://authentication-service/v1/users/%d", id))
-// 	if err != nil {
-// 		app.JSONEror(w, errors.New("invalid id"))
-// 	}
-
-// 	client := &http.Client{}
-// 	response, err := client.Do(request)
-
-// 	if err != nil {
-// 		app.JSONEror(w, errors.New("invalid id"))
-// 	}
-
-// 	defer response.Body.Close()
-
-// 	if response.StatusCode == http.StatusUnauthorized {
-// 		app.JSONEror(w, errors.New("invalid credentials"))
-// 		return
-
-// 	} else if response.StatusCode != http.StatusOK {
-// 		app.JSONEror(w, errors.New("error calling auth service"))
-// 		return
-// 	}
-
-// 	var jsonFromService JSONResponse
-
-// 	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
-// 	if err != nil {
-// 		log.Println("error at decode here")
-// 		app.JSONEror(w, errors.New("error decoding request body"))
-// 		return
-// 	}
-
-// 	if jsonFromService.Error {
-// 		app.JSONEror(w, err, http.StatusForbidden)
-// 	}
-
-// 	var payload JSONResponse
-// 	payload.Success = true
-// 	payload.Message = "user fetch succsessful"
-// 	payload.Data = jsonFromService.Data
-
-// 	app.writeJSON(w, http.StatusAccepted, payload)
-
-// }
+// upstreamsHandler reports the circuit breaker state and replicas of every upstream
+func (app *application) upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "upstream status",
+		Data:    app.upstreams.Status(),
+	})
+}
@@ -1,35 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/go-chi/chi/v5"
+	"github.com/rabin-nyaundi/broker/internal/registry"
+	"github.com/rabin-nyaundi/broker/internal/upstream"
 )
 
 // JSONResponse structure holds response sent to a clint
 
-// readIDParams returns the id from the get request
-func (app *application) readIDParams(w http.ResponseWriter, r *http.Request) (int64, error) {
-	userID := chi.URLParam(r, "id")
-	id, err := strconv.ParseInt(userID, 10, 12)
-
-	if err != nil {
-		log.Panic(err)
-		return 0, err
-	}
-
-	fmt.Println(r.URL)
-	return id, nil
-
-}
-
 // writeJSON converts data provided to jon format
 func (app *application) writeJSON(w http.ResponseWriter, status int, data any) error {
 	jsonObject, err := json.MarshalIndent(data, "", "\t")
@@ -41,7 +30,7 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data any) e
 
 	jsonObject = append(jsonObject, '\n')
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(jsonObject)
 	return nil
 }
@@ -115,3 +104,59 @@ func (app *application) JSONEror(w http.ResponseWriter, err error, status ...int
 	return app.writeJSON(w, statusCode, payload)
 
 }
+
+// actionError carries the HTTP status an action failed with
+type actionError struct {
+	status     int
+	err        error
+	retryAfter time.Duration
+	headers    http.Header
+}
+
+func newActionError(status int, err error) error {
+	return &actionError{status: status, err: err}
+}
+
+func (e *actionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *actionError) Unwrap() error {
+	return e.err
+}
+
+// upstreamError converts a failure to reach an upstream into an actionError:
+// 503 with a retry delay when its circuit is open, 504 on timeouts and 502 otherwise
+func (app *application) upstreamError(err error) error {
+	var circuitErr *upstream.CircuitOpenError
+
+	switch {
+	case errors.As(err, &circuitErr):
+		return &actionError{status: http.StatusServiceUnavailable, err: err, retryAfter: circuitErr.RetryAfter}
+	case errors.Is(err, registry.ErrNoEndpoints):
+		return &actionError{status: http.StatusServiceUnavailable, err: err, retryAfter: time.Second}
+	case errors.Is(err, context.DeadlineExceeded):
+		return newActionError(http.StatusGatewayTimeout, err)
+	default:
+		return newActionError(http.StatusBadGateway, err)
+	}
+}
+
+// actionErrorResponse writes the error returned by an action
+func (app *application) actionErrorResponse(w http.ResponseWriter, err error) error {
+	var actionErr *actionError
+	if !errors.As(err, &actionErr) {
+		actionErr = app.upstreamError(err).(*actionError)
+	}
+
+	for key, values := range actionErr.headers {
+		w.Header()[key] = values
+	}
+
+	if actionErr.retryAfter > 0 {
+		seconds := int(math.Ceil(actionErr.retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	return app.JSONEror(w, actionErr.err, actionErr.status)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/jobs"
+)
+
+// submitJob authorizes the action now and runs it in the background, answering
+// 202 with the job record and its location
+func (app *application) submitJob(w http.ResponseWriter, r *http.Request, payload RequestPayload) {
+	job, err := app.enqueueJob(r.Context(), payload)
+	if err != nil {
+		app.actionErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	app.writeJSON(w, http.StatusAccepted, JSONResponse{
+		Success: true,
+		Message: "job accepted",
+		Data:    job,
+	})
+}
+
+// enqueueJob authorizes the action and queues it on the job runner
+func (app *application) enqueueJob(ctx context.Context, payload RequestPayload) (*jobs.Job, error) {
+	if app.actions[payload.Action].syncOnly {
+		return nil, newActionError(http.StatusUnprocessableEntity, fmt.Errorf("action %q cannot run async", payload.Action))
+	}
+
+	a, err := app.authorize(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := jobs.NewJob(payload.Action, jobOwner(ctx))
+	if err != nil {
+		return nil, newActionError(http.StatusInternalServerError, err)
+	}
+
+	err = app.jobs.Submit(ctx, job, func(ctx context.Context) (any, error) {
+		response, err := a.handler(ctx, payload)
+		if err != nil {
+			return nil, err
+		}
+		return response.Data, nil
+	})
+	if err != nil {
+		if errors.Is(err, jobs.ErrQueueFull) || errors.Is(err, jobs.ErrRunnerClosed) {
+			return nil, &actionError{status: http.StatusServiceUnavailable, err: err, retryAfter: 5 * time.Second}
+		}
+		return nil, newActionError(http.StatusInternalServerError, err)
+	}
+
+	return job, nil
+}
+
+// showJobHandler returns the status and, once finished, the result of a job
+func (app *application) showJobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := app.jobStore.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, jobs.ErrJobNotFound):
+			app.JSONEror(w, err, http.StatusNotFound)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// jobs of authenticated users are only visible to them
+	if job.Owner != "" && job.Owner != jobOwner(r.Context()) {
+		app.JSONEror(w, jobs.ErrJobNotFound, http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "job " + job.Status,
+		Data:    job,
+	})
+}
+
+// jobOwner returns the subject of the authenticated caller, if any
+func jobOwner(ctx context.Context) string {
+	if principal := auth.FromContext(ctx); principal != nil {
+		return principal.Subject
+	}
+	return ""
+}
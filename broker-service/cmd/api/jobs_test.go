@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/jobs"
+)
+
+func TestCredentialActionsAreNotQueued(t *testing.T) {
+	store := jobs.NewMemoryStore()
+	app := &application{jobStore: store, jobs: jobs.NewRunner(store, 1, 1, time.Second)}
+	app.actions = app.registerActions()
+	t.Cleanup(app.jobs.Shutdown)
+
+	for _, name := range []string{"auth", "register", "login"} {
+		_, err := app.enqueueJob(context.Background(), RequestPayload{Action: name, Async: true})
+
+		var actionErr *actionError
+		if !errors.As(err, &actionErr) || actionErr.status != http.StatusUnprocessableEntity {
+			t.Errorf("async %s: %v, want a 422 action error", name, err)
+		}
+	}
+
+	queued, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 0 {
+		t.Errorf("%d job records kept, want none", len(queued))
+	}
+}
@@ -1,40 +1,440 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/graphql-go/graphql"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/eventbus"
+	"github.com/rabin-nyaundi/broker/internal/jobs"
+	"github.com/rabin-nyaundi/broker/internal/ratelimit"
+	"github.com/rabin-nyaundi/broker/internal/registry"
+	"github.com/rabin-nyaundi/broker/internal/upstream"
+	"github.com/rabin-nyaundi/shared/certs"
+	"github.com/rabin-nyaundi/shared/config"
+	"github.com/rabin-nyaundi/shared/openapi"
 )
 
 type Config struct {
-	port int
+	port                int
+	registryFile        string
+	configWatchInterval time.Duration
+	auth                struct {
+		jwksURL       string
+		issuer        string
+		audience      string
+		introspection bool
+		cacheTTL      time.Duration
+		transport     string
+		grpcAddr      string
+		grpcTimeout   time.Duration
+		grpcTLS       bool
+		serviceToken  string
+	}
+	mailServiceToken   string
+	loggerServiceToken string
+	tls                struct {
+		certFile string
+		keyFile  string
+	}
+	batch struct {
+		workers  int
+		maxItems int
+		timeout  time.Duration
+	}
+	jobs struct {
+		dir       string
+		workers   int
+		queueSize int
+		timeout   time.Duration
+		retention time.Duration
+	}
+	bus struct {
+		kind     string
+		amqpURL  string
+		exchange string
+	}
+	graphql struct {
+		maxDepth      int
+		maxComplexity int
+	}
+	ws struct {
+		maxConnsPerUser int
+		maxInFlight     int
+		sendBuffer      int
+		maxMessageSize  int64
+		pingInterval    time.Duration
+		callTimeout     time.Duration
+	}
+	sse struct {
+		replaySize int
+		bufferSize int
+		retention  time.Duration
+		heartbeat  time.Duration
+		retry      time.Duration
+	}
+	limiter struct {
+		enabled        bool
+		limit          ratelimit.Limit
+		store          string
+		redisAddr      string
+		redisPassword  string
+		redisDB        int
+		trustedProxies cidrList
+	}
+	cors struct {
+		allowedOrigins   config.List
+		allowCredentials bool
+		maxAge           time.Duration
+		routes           config.List
+	}
 }
 
 type application struct {
-	config Config
+	settings   atomic.Pointer[settings]
+	registry   *registry.Registry
+	upstreams  *upstream.Pool
+	tokens     auth.Validator
+	authClient authClient
+	limiter    ratelimit.Store
+	jobStore   jobs.Store
+	jobs       *jobs.Runner
+	bus        eventbus.Bus
+	actions    map[string]action
+	graphql    graphql.Schema
+	wsHub      *wsHub
+	streams    *sseStreams
+	spec       *openapi.Document
+	// certs serves TLS, nil for plain text
+	certs *certs.Store
+}
+
+// defaultUpstreams are used when neither a registry file nor UPSTREAM_* variables
+// describe a service, matching the docker-compose service names
+var defaultUpstreams = registry.Config{
+	Services: []registry.ServiceConfig{
+		{Name: "authentication-service", URLs: []string{"http://authentication-service"}},
+		{Name: "logger-service", URLs: []string{"http://logger-service"}},
+		{Name: "mail-service", URLs: []string{"http://mail-service"}},
+	},
 }
 
 func main() {
-	var cfg Config
+	cfg, loader, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if loader.PrintRequested() {
+		err = loader.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if loader.PrintRequested() {
+		return
+	}
+
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	upstreams, err := upstreamConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reg, err := registry.New(upstreams)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	flag.IntVar(&cfg.port, "port", 80, "API Server port")
-	flag.Parse()
+	go reg.Run(context.Background())
+
+	tlsCerts, err := openCertificates(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pool := upstream.NewPool(reg)
+	if cfg.auth.serviceToken != "" {
+		pool.SetHeader("authentication-service", http.Header{"X-Service-Token": {cfg.auth.serviceToken}})
+	}
+	if cfg.mailServiceToken != "" {
+		pool.SetHeader("mail-service", http.Header{"X-Service-Token": {cfg.mailServiceToken}})
+	}
+	if cfg.loggerServiceToken != "" {
+		pool.SetHeader("logger-service", http.Header{"X-Service-Token": {cfg.loggerServiceToken}})
+	}
 
 	app := &application{
-		config: cfg,
+		registry:  reg,
+		upstreams: pool,
+		wsHub:     newWSHub(),
+		streams:   newSSEStreams(cfg.sse.replaySize, cfg.sse.bufferSize),
+		spec:      spec,
+		certs:     tlsCerts,
 	}
 
-	log.Printf("Stating broker server on port %d\n", app.config.port)
+	current, err := newSettings(cfg, loader, upstreams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.settings.Store(current)
 
-	svr := &http.Server{
-		Addr:    fmt.Sprintf(":%d", app.config.port),
-		Handler: app.routes(),
+	var introspect func(ctx context.Context, token string) (*auth.Principal, error)
+	app.authClient, introspect, err = app.openAuthClient()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	err := svr.ListenAndServe()
+	app.tokens, err = app.tokenValidator(introspect)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.limiter, err = app.rateLimitStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.jobStore, err = app.openJobStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.jobs = jobs.NewRunner(app.jobStore, cfg.jobs.workers, cfg.jobs.queueSize, cfg.jobs.timeout)
+	app.jobs.OnSave = app.notifyJob
+	go jobs.Purge(context.Background(), app.jobStore, cfg.jobs.retention, time.Hour)
+	go app.streams.prune(context.Background(), cfg.sse.retention, time.Minute)
+
+	app.bus, err = app.openEventBus()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer app.bus.Close()
+
+	err = app.startConsumers()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.actions = app.registerActions()
 
+	app.graphql, err = app.graphqlSchema()
 	if err != nil {
+		log.Fatal(err)
+	}
+
+	routes := app.routes()
+
+	err = app.spec.CheckRoutes(routes)
+	if err != nil {
+		log.Printf("openapi: %v", err)
+	}
+
+	app.watchConfig(os.Args[1:], loader)
+
+	svr := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.config().port),
+		Handler: routes,
+	}
+
+	svr.RegisterOnShutdown(app.streams.shutdown)
+
+	shutdownError := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		log.Printf("shutting down server, signal: %s", s)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		err := svr.Shutdown(ctx)
+
+		// queued jobs run to completion instead of failing as interrupted
+		// on the next start, even when requests outlived the deadline; the
+		// event bus they publish to closes after
+		log.Printf("completing async jobs")
+		app.jobs.Shutdown()
+		shutdownError <- err
+	}()
+
+	if app.certs != nil {
+		svr.TLSConfig = app.certs.ServerConfig(nil)
+		app.watchCertificates()
+
+		log.Printf("Stating broker TLS server on port %d\n", app.config().port)
+		err = svr.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Stating broker server on port %d\n", app.config().port)
+		err = svr.ListenAndServe()
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal("Server could not start")
 	}
+
+	err = <-shutdownError
+	if err != nil {
+		log.Printf("shutting down server: %v", err)
+		return
+	}
+
+	log.Printf("server stopped")
+}
+
+// upstreamConfig layers the registry file and UPSTREAM_* variables over the defaults
+func upstreamConfig(cfg Config) (registry.Config, error) {
+	regCfg := defaultUpstreams
+
+	if cfg.registryFile != "" {
+		fileCfg, err := registry.LoadFile(cfg.registryFile)
+		if err != nil {
+			return registry.Config{}, err
+		}
+		regCfg = regCfg.Merge(fileCfg)
+	}
+
+	envCfg, err := registry.FromEnv(os.Environ())
+	if err != nil {
+		return registry.Config{}, err
+	}
+
+	return regCfg.Merge(envCfg), nil
+}
+
+// openCertificates loads the TLS certificate of the settings, nil when the
+// broker serves plain text
+func openCertificates(cfg Config) (*certs.Store, error) {
+	if cfg.tls.certFile == "" {
+		return nil, nil
+	}
+
+	store, err := certs.Load(certs.Files{CertFile: cfg.tls.certFile, KeyFile: cfg.tls.keyFile})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("tls: certificate loaded, expires %s", store.NotAfter().Format(time.RFC3339))
+	return store, nil
+}
+
+// watchCertificates reloads the TLS certificate on SIGHUP and when its files
+// change, so a rotated certificate is served from the next handshake
+func (app *application) watchCertificates() {
+	go config.Watch(context.Background(), app.config().configWatchInterval, app.certs.Files(), func() {
+		err := app.certs.Reload()
+		if err != nil {
+			log.Printf("tls: keeping current certificate: %v", err)
+			return
+		}
+		log.Printf("tls: certificate reloaded, expires %s", app.certs.NotAfter().Format(time.RFC3339))
+	})
+}
+
+// tokenValidator builds the bearer token validator from the auth settings
+func (app *application) tokenValidator(introspect func(ctx context.Context, token string) (*auth.Principal, error)) (auth.Validator, error) {
+	var chain auth.Chain
+
+	if app.config().auth.jwksURL != "" {
+		chain.JWT = &auth.JWTValidator{
+			JWKSURL:  app.config().auth.jwksURL,
+			Issuer:   app.config().auth.issuer,
+			Audience: app.config().auth.audience,
+		}
+	}
+
+	if app.config().auth.introspection {
+		client, err := app.upstreams.Client("authentication-service")
+		if err != nil {
+			return nil, err
+		}
+		chain.Introspection = &auth.Introspector{
+			Client:     client,
+			Introspect: introspect,
+			CacheTTL:   app.config().auth.cacheTTL,
+		}
+	}
+
+	return chain, nil
+}
+
+// rateLimitStore returns the store holding the rate limiter buckets
+func (app *application) rateLimitStore() (ratelimit.Store, error) {
+	switch app.config().limiter.store {
+	case "memory":
+		return ratelimit.NewMemoryStore(10 * time.Minute), nil
+	case "redis":
+		if app.config().limiter.redisAddr == "" {
+			return nil, errors.New("redis-addr must be provided for the redis rate limiter store")
+		}
+		return ratelimit.NewRedisStore(app.config().limiter.redisAddr, app.config().limiter.redisPassword, app.config().limiter.redisDB, 16), nil
+	}
+
+	return nil, fmt.Errorf("unknown rate limiter store %q", app.config().limiter.store)
+}
+
+// openJobStore returns the store for async job records, failing jobs that a
+// previous process left unfinished
+func (app *application) openJobStore() (jobs.Store, error) {
+	if app.config().jobs.dir == "" {
+		return jobs.NewMemoryStore(), nil
+	}
+
+	store, err := jobs.NewFileStore(app.config().jobs.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = jobs.Recover(context.Background(), store)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// openEventBus connects the event bus actions publish to
+func (app *application) openEventBus() (eventbus.Bus, error) {
+	switch app.config().bus.kind {
+	case "inproc":
+		return eventbus.NewInProcess(nil), nil
+	case "amqp":
+		if app.config().bus.amqpURL == "" {
+			return nil, errors.New("amqp-url must be provided for the amqp event bus")
+		}
+		return eventbus.DialAMQP(eventbus.AMQPConfig{
+			URL:      app.config().bus.amqpURL,
+			Exchange: app.config().bus.exchange,
+		})
+	}
+
+	return nil, fmt.Errorf("unknown event bus %q", app.config().bus.kind)
+}
+
+// envOr returns the environment variable or the fallback when it is unset
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
 }
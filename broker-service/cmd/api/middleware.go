@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/ratelimit"
+)
+
+// authenticateToken validates the bearer token, if any, and attaches the
+// principal to the request context. Requests without a token continue
+// anonymously; actions decide whether they need a principal.
+func (app *application) authenticateToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		parts := strings.Split(header, " ")
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			app.invalidTokenResponse(w)
+			return
+		}
+
+		principal, err := app.tokens.Validate(r.Context(), parts[1])
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidToken) {
+				app.invalidTokenResponse(w)
+				return
+			}
+			app.actionErrorResponse(w, err)
+			return
+		}
+
+		// authenticated callers are limited per user from here on, so
+		// spreading requests over addresses does not raise their limit
+		r = app.contextSetToken(r, parts[1])
+		r = app.contextSetClientKey(r, "user:"+principal.Subject)
+
+		err = app.takeGlobal(r.Context(), w.Header())
+		if err != nil {
+			app.actionErrorResponse(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// queryTokenRoutes are opened by browsers with WebSocket and EventSource,
+// which cannot set the Authorization header
+var queryTokenRoutes = map[string]bool{
+	"/ws":     true,
+	"/events": true,
+}
+
+// takeQueryToken moves the access_token query parameter of queryTokenRoutes
+// into the request context and strips it from the URL, so that nothing
+// logging the request from here on records the token. Other routes refuse
+// it rather than let clients get used to putting tokens in URLs.
+func (app *application) takeQueryToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if _, ok := query["access_token"]; !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !queryTokenRoutes[r.URL.Path] {
+			app.JSONEror(w, errors.New("access_token is only accepted by /ws and /events, use the Authorization header"), http.StatusBadRequest)
+			return
+		}
+
+		token := query.Get("access_token")
+		query.Del("access_token")
+
+		r = app.contextSetQueryToken(r, token)
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		r.URL = &u
+		r.RequestURI = u.RequestURI()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connectionPrincipal returns the principal and token of a request opening a
+// long lived connection, writing the error response when there is none.
+// Browsers cannot set the Authorization header on WebSocket and EventSource
+// requests, so the token may also be given as the access_token query
+// parameter, which takeQueryToken has moved out of the URL.
+func (app *application) connectionPrincipal(w http.ResponseWriter, r *http.Request) (*auth.Principal, string, bool) {
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		return principal, app.contextGetToken(r.Context()), true
+	}
+
+	token := app.contextGetQueryToken(r.Context())
+	if token == "" {
+		app.invalidTokenResponse(w)
+		return nil, "", false
+	}
+
+	principal, err := app.tokens.Validate(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidToken) {
+			app.invalidTokenResponse(w)
+			return nil, "", false
+		}
+		app.actionErrorResponse(w, err)
+		return nil, "", false
+	}
+
+	return principal, token, true
+}
+
+// sessionID identifies the session of a token the way the authentication
+// service does in its session events
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requireScope only lets through authenticated callers holding scope
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := auth.FromContext(r.Context())
+			if principal == nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				app.JSONEror(w, errors.New("you must be authenticated to access this resource"), http.StatusUnauthorized)
+				return
+			}
+
+			if !principal.HasScope(scope) {
+				app.JSONEror(w, fmt.Errorf("missing required scope %q", scope), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (app *application) invalidTokenResponse(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	app.JSONEror(w, auth.ErrInvalidToken, http.StatusUnauthorized)
+}
+
+// rateLimit limits every client address to the default token bucket and
+// records it as the client key so actions can apply their own stricter
+// limits. It runs before authentication, so neither unchecked credentials
+// nor invalid tokens, each costing an introspection call, escape the limit;
+// authenticateToken then charges the user's own bucket.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientKey(r, "ip:"+app.clientIP(r))
+
+		err := app.takeGlobal(r.Context(), w.Header())
+		if err != nil {
+			app.actionErrorResponse(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeGlobal takes a token from the default bucket of the client key in ctx,
+// writing the RateLimit-* headers to h when it is not nil. Requests take one
+// as they arrive, batch items and socket calls one each.
+func (app *application) takeGlobal(ctx context.Context, h http.Header) error {
+	cfg := app.config()
+	if !cfg.limiter.enabled {
+		return nil
+	}
+
+	res, err := app.limiter.Take(ctx, "global:"+app.contextGetClientKey(ctx), cfg.limiter.limit)
+	if err != nil {
+		// fail open, an unavailable limiter store should not take the broker down
+		log.Printf("rate limiter: %v", err)
+		return nil
+	}
+
+	if h != nil {
+		setRateLimitHeaders(h, res)
+	}
+
+	if !res.Allowed {
+		headers := http.Header{}
+		setRateLimitHeaders(headers, res)
+		return &actionError{status: http.StatusTooManyRequests, err: errRateLimitExceeded, headers: headers}
+	}
+	return nil
+}
+
+var errRateLimitExceeded = errors.New("rate limit exceeded")
+
+// setRateLimitHeaders writes the RateLimit-* headers and Retry-After when the request was refused
+func setRateLimitHeaders(h http.Header, res ratelimit.Result) {
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	}
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For is only trusted
+// when the request came through a trusted proxy, and then the right-most
+// address not belonging to a trusted proxy is used.
+func (app *application) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !app.trustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+
+		if !app.trustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+
+	return host
+}
+
+func (app *application) trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range app.config().limiter.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
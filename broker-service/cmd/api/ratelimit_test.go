@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/ratelimit"
+)
+
+type tokenValidator map[string]*auth.Principal
+
+func (v tokenValidator) Validate(ctx context.Context, token string) (*auth.Principal, error) {
+	if p, ok := v[token]; ok {
+		return p, nil
+	}
+	return nil, auth.ErrInvalidToken
+}
+
+// newLimitedApp returns an app allowing burst requests per client, refilled
+// too slowly to matter during a test
+func newLimitedApp(burst int) *application {
+	app := &application{
+		limiter: ratelimit.NewMemoryStore(time.Hour),
+		tokens:  tokenValidator{"jane-token": {Subject: "7"}},
+	}
+	app.actions = app.registerActions()
+
+	current := &settings{}
+	current.limiter.enabled = true
+	current.limiter.limit = ratelimit.Limit{Rate: 0.001, Burst: burst}
+	current.batch.workers = 1
+	app.settings.Store(current)
+
+	return app
+}
+
+func TestAuthenticatedCallersAreLimitedPerUser(t *testing.T) {
+	app := newLimitedApp(2)
+	handler := app.rateLimit(app.authenticateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	serve := func(addr, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/handle", nil)
+		r.RemoteAddr = addr + ":40000"
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// every request comes from a fresh address, so only the user's bucket
+	// can run out
+	for i, addr := range []string{"10.0.0.1", "10.0.0.2"} {
+		if w := serve(addr, "jane-token"); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d, want 204", i+1, w.Code)
+		}
+	}
+
+	w := serve("10.0.0.3", "jane-token")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request of the user: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+
+	if w := serve("10.0.0.4", ""); w.Code != http.StatusNoContent {
+		t.Errorf("anonymous request from another address: status %d, want 204", w.Code)
+	}
+}
+
+func TestBatchItemsTakeATokenEach(t *testing.T) {
+	app := newLimitedApp(3)
+	ctx := context.WithValue(context.Background(), clientKeyContextKey, "user:7")
+
+	// unknown actions fail fast with 400, without calling an upstream
+	var items []BatchItem
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		items = append(items, BatchItem{ID: id, RequestPayload: RequestPayload{Action: "unknown"}})
+	}
+
+	want := []int{400, 400, 400, 429, 429}
+	for i, result := range app.runBatch(ctx, items) {
+		if result.Status != want[i] {
+			t.Errorf("item %s: status %d, want %d", result.ID, result.Status, want[i])
+		}
+	}
+
+	// socket calls share the user's bucket
+	result := app.runLimitedItem(ctx, BatchItem{ID: "ws", RequestPayload: RequestPayload{Action: "unknown"}})
+	if result.Status != http.StatusTooManyRequests {
+		t.Errorf("socket call over the limit: status %d, want 429", result.Status)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/registry"
+	"github.com/rabin-nyaundi/shared/config"
+	"github.com/rabin-nyaundi/shared/cors"
+)
+
+// reloadable names the settings a reload applies, along with the contents
+// of the registry file. The others are read once at startup, so a reload
+// changing them is rejected.
+var reloadable = map[string]bool{
+	"cors-allowed-origins":   true,
+	"cors-allow-credentials": true,
+	"cors-max-age":           true,
+	"cors-routes":            true,
+	"limiter-enabled":        true,
+	"limiter-rps":            true,
+	"limiter-burst":          true,
+	"trusted-proxies":        true,
+	"batch-workers":          true,
+	"batch-max-items":        true,
+	"batch-timeout":          true,
+	"graphql-max-depth":      true,
+	"graphql-max-complexity": true,
+}
+
+// settings is the configuration in effect. It is never modified once
+// published, so a request keeps the settings it started with when a reload
+// swaps them.
+type settings struct {
+	Config
+	upstreams registry.Config
+	hash      string
+	loadedAt  time.Time
+	cors      *cors.Handler
+}
+
+// corsMetrics counts cross-origin requests across reloads
+var corsMetrics = cors.NewMetrics("cors")
+
+func newSettings(cfg Config, loader *config.Loader, upstreams registry.Config) (*settings, error) {
+	b, err := json.Marshal(upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	corsHandler, err := cfg.corsHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	return &settings{
+		Config:    cfg,
+		upstreams: upstreams,
+		hash:      loader.Hash(b),
+		loadedAt:  time.Now(),
+		cors:      corsHandler,
+	}, nil
+}
+
+// config returns the settings in effect
+func (app *application) config() *settings {
+	return app.settings.Load()
+}
+
+// watchConfig reloads the configuration on SIGHUP and when the config or
+// registry file changes
+func (app *application) watchConfig(args []string, loader *config.Loader) {
+	var files []string
+	for _, file := range []string{loader.File(), app.config().registryFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	go config.Watch(context.Background(), app.config().configWatchInterval, files, func() {
+		next, err := app.reload(args, loader)
+		if err != nil {
+			log.Printf("config: keeping configuration %s: %v", app.config().hash, err)
+			return
+		}
+		loader = next
+	})
+}
+
+// reload loads the configuration again and publishes it, unless it is
+// invalid or changes settings that need a restart. Changed upstreams are
+// applied to the registry first.
+func (app *application) reload(args []string, current *config.Loader) (*config.Loader, error) {
+	cfg, loader, err := loadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var restart []string
+	for _, name := range loader.Changed(current) {
+		if !reloadable[name] {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("%s cannot change without a restart", strings.Join(restart, ", "))
+	}
+
+	upstreams, err := upstreamConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := newSettings(cfg, loader, upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	if next.hash == app.config().hash {
+		log.Printf("config: configuration %s is unchanged", next.hash)
+		return loader, nil
+	}
+
+	if !reflect.DeepEqual(upstreams, app.config().upstreams) {
+		err = app.registry.Update(upstreams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.settings.Store(next)
+	log.Printf("config: configuration %s loaded", next.hash)
+
+	return loader, nil
+}
+
+// corsHandler applies the CORS settings in effect
+func (app *application) corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.config().cors.Wrap(next).ServeHTTP(w, r)
+	})
+}
+
+// healthHandler reports the broker is up and which configuration it runs
+func (app *application) healthHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := app.config()
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "ok",
+		Data: map[string]interface{}{
+			"config_hash":      cfg.hash,
+			"config_loaded_at": cfg.loadedAt,
+		},
+	})
+}
+
+// metricsHandler reports the counters of the broker
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "metrics",
+		Data: map[string]interface{}{
+			"cors": corsMetrics.Snapshot(),
+		},
+	})
+}
@@ -1,29 +1,42 @@
 package main
 
 import (
-	"net/http"
-
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
+
+	"github.com/rabin-nyaundi/shared/openapi"
 )
 
-func (app *application) routes() http.Handler {
+func (app *application) routes() chi.Router {
 	mux := chi.NewRouter()
 
+	// before anything that may log the URL
+	mux.Use(app.takeQueryToken)
+
 	// specify who is allowed to connect
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"POST", "PUT", "OPTIONS", "GET", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	mux.Use(app.corsHandler)
 
 	mux.Use(middleware.Heartbeat("/ping"))
+	mux.Use(app.rateLimit)
+	mux.Use(app.authenticateToken)
+	mux.Use(app.spec.Validate(app.validationError))
+
+	mux.Get("/health", app.healthHandler)
+	mux.Get("/metrics", app.metricsHandler)
+	mux.Get("/openapi.json", app.spec.ServeHTTP)
+	mux.Get("/docs", openapi.DocsHandler("Broker API", "/openapi.json").ServeHTTP)
+
 	mux.Post("/", app.Broker)
 
 	mux.Post("/handle", app.submitRequestHandler)
+	mux.Post("/handle/batch", app.submitBatchHandler)
+	mux.Post("/rpc", app.rpcHandler)
+	mux.Post("/graphql", app.graphqlHandler)
+	mux.Get("/ws", app.wsHandler)
+	mux.Get("/events", app.eventsHandler)
+
+	mux.Get("/jobs/{id}", app.showJobHandler)
+
+	mux.With(app.requireScope(adminScope)).Get("/admin/upstreams", app.upstreamsHandler)
 	return mux
 }
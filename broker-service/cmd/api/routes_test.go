@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/shared/openapi"
+)
+
+func TestRoutesAreDocumented(t *testing.T) {
+	spec, err := openapi.Load(openapiDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{spec: spec}
+
+	err = app.spec.CheckRoutes(app.routes())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	app := &application{}
+	handler := app.requireScope(adminScope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, test := range []struct {
+		name      string
+		principal *auth.Principal
+		status    int
+	}{
+		{"anonymous", nil, http.StatusUnauthorized},
+		{"user", &auth.Principal{Subject: "1", Scopes: []string{"users:read"}}, http.StatusForbidden},
+		{"admin", &auth.Principal{Subject: "2", Scopes: []string{"users:read", adminScope}}, http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/upstreams", nil)
+		if test.principal != nil {
+			r = r.WithContext(auth.WithPrincipal(r.Context(), test.principal))
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestQueryTokenOnlyReachesStreams(t *testing.T) {
+	app := &application{}
+
+	var seen *http.Request
+	handler := app.takeQueryToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/handle?access_token=secret", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || seen != nil {
+		t.Errorf("access_token on /handle: status %d, want 400 without running the handler", w.Code)
+	}
+
+	for _, path := range []string{"/ws", "/events"} {
+		seen = nil
+		r := httptest.NewRequest(http.MethodGet, path+"?access_token=secret&last_event_id=7", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if seen == nil {
+			t.Fatalf("%s: handler not run", path)
+		}
+		if strings.Contains(seen.URL.String(), "secret") || strings.Contains(seen.RequestURI, "secret") {
+			t.Errorf("%s: token left in the URL %s, request URI %s", path, seen.URL, seen.RequestURI)
+		}
+		if got := seen.URL.Query().Get("last_event_id"); got != "7" {
+			t.Errorf("%s: last_event_id %q, want the other parameters kept", path, got)
+		}
+		if got := app.contextGetQueryToken(seen.Context()); got != "secret" {
+			t.Errorf("%s: token in context %q, want secret", path, got)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	// rpcActionError is returned when an action fails; the error data holds
+	// the HTTP status /handle would have answered with
+	rpcActionError = -32000
+)
+
+// rpcRequest is a JSON-RPC 2.0 request. A request without an id is a
+// notification and gets no response.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcError is the error member of a response
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response, holding either a result or an error
+type rpcResponse struct {
+	ID     json.RawMessage
+	Result interface{}
+	Error  *rpcError
+}
+
+// MarshalJSON writes result or error, never both, as the spec requires
+func (r rpcResponse) MarshalJSON() ([]byte, error) {
+	id := r.ID
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+
+	if r.Error != nil {
+		return json.Marshal(struct {
+			JSONRPC string          `json:"jsonrpc"`
+			Error   *rpcError       `json:"error"`
+			ID      json.RawMessage `json:"id"`
+		}{"2.0", r.Error, id})
+	}
+
+	return json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  interface{}     `json:"result"`
+		ID      json.RawMessage `json:"id"`
+	}{"2.0", r.Result, id})
+}
+
+// rpcHandler serves JSON-RPC 2.0 over POST /rpc. Methods are broker action
+// names and params are the rest of the /handle payload, so
+//
+//	{"jsonrpc": "2.0", "method": "getuser", "params": {"user": {"id": 1}}, "id": 1}
+//
+// runs the same action as {"action": "getuser", "user": {"id": 1}}. Batches run
+// concurrently under the /handle/batch limits.
+func (app *application) rpcHandler(w http.ResponseWriter, r *http.Request) {
+	maxBytes := int64(1_048_576)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		app.writeRPC(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: fmt.Sprintf("body must not be larger that %d bytes", maxBytes)}})
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		var raw json.RawMessage
+		err = json.Unmarshal(body, &raw)
+		if err != nil {
+			app.writeRPC(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: "parse error"}})
+			return
+		}
+
+		response, ok := app.rpcCall(r.Context(), raw)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		app.writeRPC(w, response)
+		return
+	}
+
+	var batch []json.RawMessage
+	err = json.Unmarshal(body, &batch)
+	if err != nil {
+		app.writeRPC(w, rpcResponse{Error: &rpcError{Code: rpcParseError, Message: "parse error"}})
+		return
+	}
+
+	if len(batch) == 0 {
+		app.writeRPC(w, rpcResponse{Error: &rpcError{Code: rpcInvalidRequest, Message: "batch must contain at least one request"}})
+		return
+	}
+
+	if len(batch) > app.config().batch.maxItems {
+		app.writeRPC(w, rpcResponse{Error: &rpcError{Code: rpcInvalidRequest, Message: fmt.Sprintf("batch must not contain more than %d requests", app.config().batch.maxItems)}})
+		return
+	}
+
+	responses := app.rpcBatch(r.Context(), batch)
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	app.writeRPC(w, responses)
+}
+
+// writeRPC writes a response or a batch of responses
+func (app *application) writeRPC(w http.ResponseWriter, data interface{}) {
+	app.writeJSON(w, http.StatusOK, data)
+}
+
+// parseRPC validates a request and turns it into the payload of the action it
+// calls. On failure it returns the error to answer with.
+func (app *application) parseRPC(raw json.RawMessage) (*rpcRequest, *RequestPayload, *rpcError) {
+	var req rpcRequest
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		return &req, nil, &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}
+	}
+
+	if !validRPCID(req.ID) {
+		req.ID = nil
+		return &req, nil, &rpcError{Code: rpcInvalidRequest, Message: "id must be a string, number or null"}
+	}
+
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return &req, nil, &rpcError{Code: rpcInvalidRequest, Message: `jsonrpc must be "2.0" and method must be provided`}
+	}
+
+	if _, ok := app.actions[req.Method]; !ok {
+		return &req, nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %q not found", req.Method)}
+	}
+
+	var payload RequestPayload
+
+	params := bytes.TrimSpace(req.Params)
+	if len(params) > 0 && !bytes.Equal(params, []byte("null")) {
+		if params[0] != '{' {
+			return &req, nil, &rpcError{Code: rpcInvalidParams, Message: "params must be an object"}
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(params))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&payload)
+		if err != nil {
+			return &req, nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+		}
+	}
+	payload.Action = req.Method
+
+	return &req, &payload, nil
+}
+
+// validRPCID reports whether an id is absent, a string, a number or null
+func validRPCID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+
+	var v interface{}
+	if json.Unmarshal(id, &v) != nil {
+		return false
+	}
+
+	switch v.(type) {
+	case nil, string, float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// rpcCall runs a single request. It returns false for notifications, whose
+// response is dropped.
+func (app *application) rpcCall(ctx context.Context, raw json.RawMessage) (rpcResponse, bool) {
+	req, payload, rpcErr := app.parseRPC(raw)
+	if rpcErr != nil {
+		// invalid requests are answered even without an id
+		return rpcResponse{ID: req.ID, Error: rpcErr}, true
+	}
+
+	var response rpcResponse
+	if payload.Async {
+		response = app.rpcEnqueue(ctx, req.ID, *payload)
+	} else {
+		response = rpcFromBatchResult(req.ID, app.runBatchItem(ctx, BatchItem{RequestPayload: *payload}))
+	}
+
+	return response, req.ID != nil
+}
+
+// rpcBatch runs the requests of a batch and returns the responses of the
+// calls that are not notifications
+func (app *application) rpcBatch(ctx context.Context, batch []json.RawMessage) []rpcResponse {
+	var (
+		responses = make([]*rpcResponse, len(batch))
+		items     []BatchItem
+		ids       = map[string]json.RawMessage{}
+	)
+
+	for i, raw := range batch {
+		req, payload, rpcErr := app.parseRPC(raw)
+		switch {
+		case rpcErr != nil:
+			responses[i] = &rpcResponse{ID: req.ID, Error: rpcErr}
+		case payload.Async:
+			response := app.rpcEnqueue(ctx, req.ID, *payload)
+			if req.ID != nil {
+				responses[i] = &response
+			}
+		default:
+			key := strconv.Itoa(i)
+			items = append(items, BatchItem{ID: key, RequestPayload: *payload})
+			ids[key] = req.ID
+		}
+	}
+
+	if len(items) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, app.config().batch.timeout)
+		defer cancel()
+
+		for _, result := range app.runBatch(ctx, items) {
+			id := ids[result.ID]
+			if id == nil {
+				continue
+			}
+
+			i, _ := strconv.Atoi(result.ID)
+			response := rpcFromBatchResult(id, result)
+			responses[i] = &response
+		}
+	}
+
+	out := []rpcResponse{}
+	for _, response := range responses {
+		if response != nil {
+			out = append(out, *response)
+		}
+	}
+	return out
+}
+
+// rpcEnqueue runs an async call as a job and returns the job as its result
+func (app *application) rpcEnqueue(ctx context.Context, id json.RawMessage, payload RequestPayload) rpcResponse {
+	job, err := app.enqueueJob(ctx, payload)
+	if err != nil {
+		var actionErr *actionError
+		if !errors.As(err, &actionErr) {
+			actionErr = app.upstreamError(err).(*actionError)
+		}
+		return rpcFromBatchResult(id, BatchResult{Status: actionErr.status, Error: true, Message: actionErr.err.Error()})
+	}
+
+	return rpcResponse{ID: id, Result: job}
+}
+
+// rpcFromBatchResult converts the outcome of an action into a response. Bad
+// input maps to invalid params; other failures carry their HTTP status.
+func rpcFromBatchResult(id json.RawMessage, result BatchResult) rpcResponse {
+	if !result.Error {
+		return rpcResponse{ID: id, Result: result.Data}
+	}
+
+	code := rpcActionError
+	switch {
+	case result.Status == http.StatusBadRequest:
+		code = rpcInvalidParams
+	case result.Status == http.StatusInternalServerError:
+		code = rpcInternalError
+	}
+
+	return rpcResponse{
+		ID: id,
+		Error: &rpcError{
+			Code:    code,
+			Message: result.Message,
+			Data:    map[string]int{"status": result.Status},
+		},
+	}
+}
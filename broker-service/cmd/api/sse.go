@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/eventbus"
+	"github.com/rabin-nyaundi/broker/internal/jobs"
+)
+
+// sseNotifyEvents are the account events streamed to the user they concern
+var sseNotifyEvents = []string{"session.revoked", "user.locked", "user.role_changed", "user.password_changed", "user.logged_in"}
+
+// sseEvent is an event queued for a user's streams. Ids are the process
+// epoch and a per-user sequence, so an id from before a restart is never
+// mistaken for one of the new sequence.
+type sseEvent struct {
+	id    uint64
+	event string
+	data  []byte
+}
+
+// sseSubscriber is an open stream. Its channel is closed when the stream
+// must end, either because the session ended or the client fell behind.
+type sseSubscriber struct {
+	events  chan sseEvent
+	session string
+}
+
+// sseUser holds the replay buffer and open streams of one user
+type sseUser struct {
+	seq     uint64
+	events  []sseEvent
+	subs    map[*sseSubscriber]struct{}
+	updated time.Time
+}
+
+// sseStreams fans events out to the open streams of each user and keeps
+// the last replaySize events of every user so reconnecting clients can
+// resume from their Last-Event-ID
+type sseStreams struct {
+	epoch      string
+	replaySize int
+	bufferSize int
+
+	mu    sync.Mutex
+	users map[string]*sseUser
+	// closed is set on shutdown, after which streams end as they open
+	closed bool
+}
+
+func newSSEStreams(replaySize, bufferSize int) *sseStreams {
+	return &sseStreams{
+		epoch:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		replaySize: replaySize,
+		bufferSize: bufferSize,
+		users:      map[string]*sseUser{},
+	}
+}
+
+func (s *sseStreams) user(subject string) *sseUser {
+	u, ok := s.users[subject]
+	if !ok {
+		u = &sseUser{subs: map[*sseSubscriber]struct{}{}}
+		s.users[subject] = u
+	}
+	return u
+}
+
+// publish buffers the event and sends it to the user's streams. A stream
+// whose buffer is full is ended; the client reconnects and catches up from
+// the replay buffer.
+func (s *sseStreams) publish(subject, event string, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("sse: encoding %s event: %v", event, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.user(subject)
+	u.seq++
+	u.updated = time.Now()
+
+	e := sseEvent{id: u.seq, event: event, data: b}
+
+	u.events = append(u.events, e)
+	if len(u.events) > s.replaySize {
+		u.events = append([]sseEvent(nil), u.events[len(u.events)-s.replaySize:]...)
+	}
+
+	for sub := range u.subs {
+		select {
+		case sub.events <- e:
+		default:
+			delete(u.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe opens a stream for the user and returns the buffered events
+// after lastEventID. An id from another epoch or older than the buffer
+// replays the whole buffer.
+func (s *sseStreams) subscribe(subject, session, lastEventID string) (*sseSubscriber, []sseEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.user(subject)
+
+	sub := &sseSubscriber{
+		events:  make(chan sseEvent, s.bufferSize),
+		session: session,
+	}
+	if s.closed {
+		close(sub.events)
+		return sub, nil
+	}
+	u.subs[sub] = struct{}{}
+
+	if lastEventID == "" {
+		return sub, nil
+	}
+
+	var after uint64
+	if epoch, seq, ok := strings.Cut(lastEventID, "-"); ok && epoch == s.epoch {
+		after, _ = strconv.ParseUint(seq, 10, 64)
+	}
+
+	var replay []sseEvent
+	for _, e := range u.events {
+		if e.id > after {
+			replay = append(replay, e)
+		}
+	}
+
+	return sub, replay
+}
+
+func (s *sseStreams) unsubscribe(subject string, sub *sseSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[subject]
+	if !ok {
+		return
+	}
+
+	if _, ok := u.subs[sub]; ok {
+		delete(u.subs, sub)
+		close(sub.events)
+	}
+}
+
+// disconnect ends the user's streams of the session, or all of them when
+// session is empty
+func (s *sseStreams) disconnect(subject, session string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[subject]
+	if !ok {
+		return
+	}
+
+	for sub := range u.subs {
+		if session == "" || sub.session == session {
+			delete(u.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// shutdown ends every stream, which http.Server.Shutdown would otherwise
+// wait for until its deadline
+func (s *sseStreams) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for _, u := range s.users {
+		for sub := range u.subs {
+			delete(u.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// prune drops the replay buffers of users without open streams that saw no
+// event for retention, every interval until ctx is cancelled
+func (s *sseStreams) prune(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for subject, u := range s.users {
+			if len(u.subs) == 0 && time.Since(u.updated) > retention {
+				delete(s.users, subject)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// eventsHandler streams the caller's job updates and account events as
+// Server-Sent Events. Clients resume with the Last-Event-ID header, which
+// EventSource sends on reconnect, and comments are sent as heartbeats so
+// proxies do not close an idle stream.
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, token, ok := app.connectionPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.JSONEror(w, errors.New("streaming is not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	sub, replay := app.streams.subscribe(principal.Subject, sessionID(token), lastEventID)
+	defer app.streams.unsubscribe(principal.Subject, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", app.config().sse.retry.Milliseconds())
+	for _, e := range replay {
+		app.writeSSE(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(app.config().sse.heartbeat)
+	defer heartbeat.Stop()
+
+	var expired <-chan time.Time
+	if !principal.ExpiresAt.IsZero() {
+		timer := time.NewTimer(time.Until(principal.ExpiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired:
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			app.writeSSE(w, e)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func (app *application) writeSSE(w http.ResponseWriter, e sseEvent) {
+	fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", app.streams.epoch, e.id, e.event, e.data)
+}
+
+// notifyJob streams every change of a job to its owner
+func (app *application) notifyJob(job jobs.Job) {
+	if job.Owner != "" {
+		app.streams.publish(job.Owner, "job", job)
+	}
+}
+
+// notifyEvent streams an account event to its user, ending the streams the
+// event invalidates
+func (app *application) notifyEvent(ctx context.Context, event eventbus.Event) error {
+	var payload struct {
+		UserID    int64  `json:"user_id"`
+		SessionID string `json:"session_id"`
+	}
+
+	err := json.Unmarshal(event.Payload, &payload)
+	if err != nil {
+		return fmt.Errorf("decoding %s event: %w", event.RoutingKey, err)
+	}
+
+	subject := strconv.FormatInt(payload.UserID, 10)
+	app.streams.publish(subject, event.RoutingKey, event.Payload)
+
+	switch event.RoutingKey {
+	case "session.revoked":
+		app.streams.disconnect(subject, payload.SessionID)
+	case "user.locked":
+		app.streams.disconnect(subject, "")
+	}
+
+	return nil
+}
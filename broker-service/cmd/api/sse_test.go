@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+)
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	app := &application{streams: newSSEStreams(16, 16)}
+	current := &settings{}
+	current.sse.heartbeat = time.Hour
+	current.sse.retry = time.Second
+	app.settings.Store(current)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := &auth.Principal{Subject: "42"}
+		app.eventsHandler(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}))
+	server.Config.RegisterOnShutdown(app.streams.shutdown)
+	server.Start()
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	// the retry field is flushed once the stream is open
+	_, err = bufio.NewReader(response.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err = server.Config.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown with an open stream: %v", err)
+	}
+
+	// a stream opened after shutdown ends at once
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		app.eventsHandler(w, r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{Subject: "42"})))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream opened after shutdown stayed open")
+	}
+}
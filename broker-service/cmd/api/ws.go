@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+	"github.com/rabin-nyaundi/broker/internal/eventbus"
+)
+
+// wsWriteWait is how long a single frame may take to write
+const wsWriteWait = 10 * time.Second
+
+// wsPushEvents are the events pushed to the sockets of the user they concern
+var wsPushEvents = []string{"session.revoked", "user.locked", "user.role_changed"}
+
+var errTooManyConnections = errors.New("too many open connections for this user")
+
+// wsResult answers a call made over the socket, carrying the call's id
+type wsResult struct {
+	Type string `json:"type"`
+	BatchResult
+}
+
+// wsEvent is a server side event pushed to the socket
+type wsEvent struct {
+	Type      string          `json:"type"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// wsHub tracks the open sockets of every user
+type wsHub struct {
+	mu    sync.Mutex
+	conns map[string]map[*wsConn]struct{}
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{conns: map[string]map[*wsConn]struct{}{}}
+}
+
+// add registers the socket unless its user already has max sockets open
+func (h *wsHub) add(c *wsConn, max int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns := h.conns[c.subject]
+	if max > 0 && len(conns) >= max {
+		return false
+	}
+
+	if conns == nil {
+		conns = map[*wsConn]struct{}{}
+		h.conns[c.subject] = conns
+	}
+	conns[c] = struct{}{}
+	return true
+}
+
+func (h *wsHub) remove(c *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.conns[c.subject], c)
+	if len(h.conns[c.subject]) == 0 {
+		delete(h.conns, c.subject)
+	}
+}
+
+// user returns the open sockets of the user
+func (h *wsHub) user(subject string) []*wsConn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	conns := make([]*wsConn, 0, len(h.conns[subject]))
+	for c := range h.conns[subject] {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// wsConn is an authenticated socket. Frames are written by a single writer
+// goroutine fed through send; a client that does not keep up with its
+// messages is disconnected rather than buffered without bound.
+type wsConn struct {
+	app     *application
+	ws      *websocket.Conn
+	subject string
+	token   string
+	session string
+
+	mu        sync.Mutex
+	principal *auth.Principal
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	send     chan []byte
+	inflight chan struct{}
+	close    chan wsClose
+	once     sync.Once
+}
+
+type wsClose struct {
+	code   int
+	reason string
+}
+
+// wsHandler upgrades an authenticated request to a socket on which the
+// client can call actions and receives events about its account
+func (app *application) wsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, token, ok := app.connectionPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	c := &wsConn{
+		app:       app,
+		subject:   principal.Subject,
+		token:     token,
+		session:   sessionID(token),
+		principal: principal,
+		send:      make(chan []byte, app.config().ws.sendBuffer),
+		inflight:  make(chan struct{}, app.config().ws.maxInFlight),
+		close:     make(chan wsClose, 1),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	if !app.wsHub.add(c, app.config().ws.maxConnsPerUser) {
+		c.cancel()
+		app.JSONEror(w, errTooManyConnections, http.StatusTooManyRequests)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// browsers do not apply CORS to sockets, so pages may only open
+		// them from the origins allowed to call the rest of the API
+		CheckOrigin: app.config().cors.AllowsOrigin,
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already written the error response
+		app.wsHub.remove(c)
+		c.cancel()
+		return
+	}
+
+	c.ws = ws
+
+	go c.writePump()
+	c.readPump()
+}
+
+// readPump reads calls until the socket fails or is closed. At most
+// ws.maxInFlight calls run at once; beyond that the pump stops reading, so a
+// client sending faster than its calls complete is slowed down by TCP.
+func (c *wsConn) readPump() {
+	defer func() {
+		c.app.wsHub.remove(c)
+		c.cancel()
+		c.shutdown(websocket.CloseNormalClosure, "")
+	}()
+
+	// a client that misses two pings in a row is considered gone
+	pongWait := 2 * c.app.config().ws.pingInterval
+
+	c.ws.SetReadLimit(c.app.config().ws.maxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				log.Printf("websocket %s: %v", c.subject, err)
+			}
+			return
+		}
+
+		var item BatchItem
+
+		err = json.Unmarshal(message, &item)
+		if err != nil || item.ID == "" {
+			c.reply(BatchResult{
+				ID:      item.ID,
+				Status:  http.StatusBadRequest,
+				Error:   true,
+				Message: "calls must be JSON objects with an id and an action",
+			})
+			continue
+		}
+
+		select {
+		case c.inflight <- struct{}{}:
+		case <-c.ctx.Done():
+			return
+		}
+
+		go func() {
+			defer func() { <-c.inflight }()
+			c.call(item)
+		}()
+	}
+}
+
+// call dispatches one action as the socket's user and replies with its result
+func (c *wsConn) call(item BatchItem) {
+	principal := c.currentPrincipal()
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.app.config().ws.callTimeout)
+	defer cancel()
+
+	ctx = auth.WithPrincipal(ctx, principal)
+	ctx = context.WithValue(ctx, tokenContextKey, c.token)
+	ctx = context.WithValue(ctx, clientKeyContextKey, "user:"+c.subject)
+
+	c.reply(c.app.runLimitedItem(ctx, item))
+}
+
+func (c *wsConn) currentPrincipal() *auth.Principal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.principal
+}
+
+// setScopes replaces the scopes the socket's calls are authorized with
+func (c *wsConn) setScopes(scopes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := *c.principal
+	p.Scopes = scopes
+	c.principal = &p
+}
+
+func (c *wsConn) reply(result BatchResult) {
+	c.write(wsResult{Type: "result", BatchResult: result})
+}
+
+// write queues a message for the writer, disconnecting the client when its
+// send buffer is full
+func (c *wsConn) write(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("websocket %s: %v", c.subject, err)
+		return
+	}
+
+	select {
+	case c.send <- b:
+	case <-c.ctx.Done():
+	default:
+		c.shutdown(websocket.CloseTryAgainLater, "client is not reading its messages")
+	}
+}
+
+// shutdown makes the writer send a close frame and close the socket
+func (c *wsConn) shutdown(code int, reason string) {
+	c.once.Do(func() {
+		c.close <- wsClose{code: code, reason: reason}
+	})
+}
+
+// writePump writes queued messages and pings, and closes the socket when
+// asked to, when a write fails or when the token expires. Messages queued
+// before a close are sent first, so the client learns why it was disconnected.
+func (c *wsConn) writePump() {
+	ticker := time.NewTicker(c.app.config().ws.pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.cancel()
+		c.ws.Close()
+	}()
+
+	var expired <-chan time.Time
+	if exp := c.currentPrincipal().ExpiresAt; !exp.IsZero() {
+		timer := time.NewTimer(time.Until(exp))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case <-expired:
+			c.shutdown(websocket.ClosePolicyViolation, auth.ErrInvalidToken.Error())
+
+		case message := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case cl := <-c.close:
+			for n := len(c.send); n > 0 && cl.code != websocket.CloseTryAgainLater; n-- {
+				c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := c.ws.WriteMessage(websocket.TextMessage, <-c.send); err != nil {
+					return
+				}
+			}
+
+			frame := websocket.FormatCloseMessage(cl.code, cl.reason)
+			c.ws.WriteControl(websocket.CloseMessage, frame, time.Now().Add(wsWriteWait))
+			return
+		}
+	}
+}
+
+// pushEvent forwards an account event to the user's open sockets. Revoked
+// sessions and locked accounts also close the sockets they invalidate, and
+// role changes take effect on the next call.
+func (app *application) pushEvent(ctx context.Context, event eventbus.Event) error {
+	var payload struct {
+		UserID    int64    `json:"user_id"`
+		SessionID string   `json:"session_id"`
+		Scopes    []string `json:"scopes"`
+	}
+
+	err := json.Unmarshal(event.Payload, &payload)
+	if err != nil {
+		return fmt.Errorf("decoding %s event: %w", event.RoutingKey, err)
+	}
+
+	for _, c := range app.wsHub.user(strconv.FormatInt(payload.UserID, 10)) {
+		if event.RoutingKey == "session.revoked" && payload.SessionID != c.session {
+			continue
+		}
+
+		c.write(wsEvent{
+			Type:      "event",
+			Event:     event.RoutingKey,
+			Data:      event.Payload,
+			Timestamp: event.Timestamp,
+		})
+
+		switch event.RoutingKey {
+		case "session.revoked":
+			c.shutdown(websocket.ClosePolicyViolation, "session revoked")
+		case "user.locked":
+			c.shutdown(websocket.ClosePolicyViolation, "account locked")
+		case "user.role_changed":
+			if payload.Scopes != nil {
+				c.setScopes(payload.Scopes)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/rabin-nyaundi/broker/internal/auth"
+)
+
+func TestSocketsOnlyOpenFromAllowedOrigins(t *testing.T) {
+	app := &application{wsHub: newWSHub()}
+
+	current := &settings{}
+	current.Config.cors.allowedOrigins = []string{"http://localhost:3000"}
+	current.ws.maxConnsPerUser = 4
+	current.ws.maxInFlight = 4
+	current.ws.sendBuffer = 16
+	current.ws.maxMessageSize = 1 << 16
+	current.ws.pingInterval = time.Minute
+
+	var err error
+	current.cors, err = current.Config.corsHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.settings.Store(current)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetToken(r, "jane-token")
+		app.wsHandler(w, r.WithContext(auth.WithPrincipal(r.Context(), &auth.Principal{Subject: "7"})))
+	}))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, test := range []struct {
+		origin string
+		status int
+	}{
+		{"http://localhost:3000", http.StatusSwitchingProtocols},
+		{"", http.StatusSwitchingProtocols},
+		{server.URL, http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"http://localhost:3001", http.StatusForbidden},
+	} {
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Origin", test.origin)
+		}
+
+		ws, response, err := websocket.DefaultDialer.Dial(url, header)
+		if ws != nil {
+			ws.Close()
+		}
+		if response == nil {
+			t.Errorf("origin %q: %v", test.origin, err)
+			continue
+		}
+		if response.StatusCode != test.status {
+			t.Errorf("origin %q: status %d, want %d", test.origin, response.StatusCode, test.status)
+		}
+	}
+}
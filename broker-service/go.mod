@@ -1,8 +1,25 @@
 module github.com/rabin-nyaundi/broker
 
-go 1.18
+go 1.19
 
 require (
-	github.com/go-chi/chi/v5 v5.0.7 // indirect
-	github.com/go-chi/cors v1.2.1 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/go-chi/chi/v5 v5.0.7
+	github.com/gorilla/websocket v1.5.0
+	github.com/graphql-go/graphql v0.8.1
+	github.com/rabbitmq/amqp091-go v1.9.0
+	github.com/rabin-nyaundi/shared v0.0.0
+	google.golang.org/grpc v1.56.0
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.9.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+)
+
+replace github.com/rabin-nyaundi/shared => ../shared
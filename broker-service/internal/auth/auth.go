@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for malformed, unknown, expired or revoked tokens
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Subject   string    `json:"sub"`
+	UserID    int64     `json:"user_id,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// HasScope reports whether the principal was granted the scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Validator checks a bearer token and returns the principal it belongs to
+type Validator interface {
+	Validate(ctx context.Context, token string) (*Principal, error)
+}
+
+// Chain validates JWTs locally and every other token by introspection.
+// Either validator may be nil when that kind of token is not accepted.
+type Chain struct {
+	JWT           Validator
+	Introspection Validator
+}
+
+// Validate dispatches the token to the matching validator
+func (c Chain) Validate(ctx context.Context, token string) (*Principal, error) {
+	if strings.Count(token, ".") == 2 {
+		if c.JWT == nil {
+			return nil, ErrInvalidToken
+		}
+		return c.JWT.Validate(ctx, token)
+	}
+
+	if c.Introspection == nil {
+		return nil, ErrInvalidToken
+	}
+	return c.Introspection.Validate(ctx, token)
+}
+
+type contextKey string
+
+const principalContextKey = contextKey("principal")
+
+// WithPrincipal returns a copy of ctx carrying the principal
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, p)
+}
+
+// FromContext returns the principal of the request, or nil for anonymous callers
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalContextKey).(*Principal)
+	return p
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/upstream"
+)
+
+// Introspector validates opaque tokens by asking the authentication service,
+// caching answers for a short time so each request doesn't cost a round trip.
+// Tokens are posted to /v1/tokens/introspect through Client unless Introspect
+// is set, e.g. to call the service over another transport.
+type Introspector struct {
+	Client     *upstream.Client
+	Introspect func(ctx context.Context, token string) (*Principal, error)
+	CacheTTL   time.Duration
+
+	mu    sync.Mutex
+	cache map[[32]byte]cacheEntry
+}
+
+type cacheEntry struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// introspectionResponse is the data returned by /v1/tokens/introspect
+type introspectionResponse struct {
+	Active    bool     `json:"active"`
+	UserID    int64    `json:"user_id"`
+	Email     string   `json:"email"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// Validate returns the principal of an active token
+func (v *Introspector) Validate(ctx context.Context, token string) (*Principal, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	v.mu.Lock()
+	entry, ok := v.cache[key]
+	v.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		if entry.principal == nil {
+			return nil, ErrInvalidToken
+		}
+		return entry.principal, nil
+	}
+
+	principal, err := v.introspect(ctx, token)
+	if err != nil && err != ErrInvalidToken {
+		return nil, err
+	}
+
+	expires := now.Add(v.CacheTTL)
+	if principal != nil && principal.ExpiresAt.Before(expires) {
+		expires = principal.ExpiresAt
+	}
+
+	v.mu.Lock()
+	if v.cache == nil {
+		v.cache = map[[32]byte]cacheEntry{}
+	}
+	v.evict(now)
+	v.cache[key] = cacheEntry{principal: principal, expires: expires}
+	v.mu.Unlock()
+
+	return principal, err
+}
+
+func (v *Introspector) introspect(ctx context.Context, token string) (*Principal, error) {
+	if v.Introspect != nil {
+		return v.Introspect(ctx, token)
+	}
+
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := v.Client.Do(ctx, &upstream.Request{
+		Method:     http.MethodPost,
+		Path:       "/v1/tokens/introspect",
+		Body:       body,
+		Idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection failed with status %d", response.StatusCode)
+	}
+
+	var envelope struct {
+		Data introspectionResponse `json:"data"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if !envelope.Data.Active {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{
+		Subject:   strconv.FormatInt(envelope.Data.UserID, 10),
+		UserID:    envelope.Data.UserID,
+		Email:     envelope.Data.Email,
+		Scopes:    envelope.Data.Scopes,
+		ExpiresAt: time.Unix(envelope.Data.ExpiresAt, 0),
+	}, nil
+}
+
+// evict drops expired entries; callers must hold v.mu
+func (v *Introspector) evict(now time.Time) {
+	if len(v.cache) < 1024 {
+		return
+	}
+
+	for key, entry := range v.cache {
+		if now.After(entry.expires) {
+			delete(v.cache, key)
+		}
+	}
+}
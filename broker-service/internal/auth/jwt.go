@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval limits how often unknown key ids trigger a JWKS fetch
+const jwksRefreshInterval = time.Minute
+
+// JWTValidator verifies JWTs signed with keys published as a JWKS document
+type JWTValidator struct {
+	JWKSURL  string
+	Issuer   string
+	Audience string
+	Client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// fetching is closed when the JWKS fetch in progress completes, nil
+	// when there is none
+	fetching chan struct{}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Email     string          `json:"email"`
+	Scope     string          `json:"scope"`
+	Scopes    []string        `json:"scp"`
+}
+
+// Validate checks the signature and the registered claims of the token
+func (v *JWTValidator) Validate(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrInvalidToken
+	}
+
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return nil, ErrInvalidToken
+	}
+
+	if v.Audience != "" && !hasAudience(claims.Audience, v.Audience) {
+		return nil, ErrInvalidToken
+	}
+
+	p := &Principal{
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Scopes:    claims.Scopes,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+
+	if claims.Scope != "" {
+		p.Scopes = append(p.Scopes, strings.Fields(claims.Scope)...)
+	}
+
+	if id, err := strconv.ParseInt(claims.Subject, 10, 64); err == nil {
+		p.UserID = id
+	}
+
+	return p, nil
+}
+
+// key returns the public key with the given id, fetching the JWKS when the
+// id is unknown and the last fetch is old enough. The fetch runs without the
+// lock so that a slow JWKS endpoint only holds up the tokens of unknown keys,
+// which wait for it instead of fetching again.
+func (v *JWTValidator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	for {
+		v.mu.Lock()
+
+		if key, ok := v.keys[kid]; ok {
+			v.mu.Unlock()
+			return key, nil
+		}
+
+		if fetching := v.fetching; fetching != nil {
+			v.mu.Unlock()
+
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		if time.Since(v.fetchedAt) < jwksRefreshInterval {
+			v.mu.Unlock()
+			return nil, ErrInvalidToken
+		}
+
+		done := make(chan struct{})
+		v.fetching = done
+		v.fetchedAt = time.Now()
+		v.mu.Unlock()
+
+		keys, err := v.fetch(ctx)
+
+		v.mu.Lock()
+		if err == nil {
+			v.keys = keys
+		}
+		key, ok := v.keys[kid]
+		v.fetching = nil
+		close(done)
+		v.mu.Unlock()
+
+		if err != nil {
+			return nil, fmt.Errorf("fetching jwks: %w", err)
+		}
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+		return key, nil
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (v *JWTValidator) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, v.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("algorithm does not match key")
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+
+	case *ecdsa.PublicKey:
+		// ES256 signs with P-256 and ES384 with P-384, r and s padded to the
+		// size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg != "ES"+strconv.Itoa(k.Curve.Params().BitSize) || len(signature) != 2*size {
+			return errors.New("algorithm does not match key")
+		}
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return errors.New("unsupported key")
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+
+	var many []string
+	if json.Unmarshal(raw, &many) == nil {
+		for _, a := range many {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer signs tokens and serves its public keys as a JWKS document
+type testIssuer struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu      sync.Mutex
+	keys    []jwk
+	fetches int32
+	// block, when set, holds JWKS requests until it is closed
+	block chan struct{}
+}
+
+func newTestIssuer(t *testing.T) (*testIssuer, *JWTValidator) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	iss.publish("rsa-1", "ec-1")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&iss.fetches, 1)
+
+		iss.mu.Lock()
+		keys, block := iss.keys, iss.block
+		iss.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(server.Close)
+
+	v := &JWTValidator{
+		JWKSURL:  server.URL,
+		Issuer:   "https://auth.example.com",
+		Audience: "broker",
+		Client:   server.Client(),
+	}
+	return iss, v
+}
+
+// publish replaces the JWKS with the RSA key as rsaKid and the EC key as ecKid
+func (iss *testIssuer) publish(rsaKid, ecKid string) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.keys = []jwk{
+		{
+			Kty: "RSA", Kid: rsaKid, Use: "sig",
+			N: b64(iss.rsaKey.N.Bytes()),
+			E: b64(big.NewInt(int64(iss.rsaKey.E)).Bytes()),
+		},
+		{
+			Kty: "EC", Kid: ecKid, Use: "sig", Crv: "P-256",
+			X: b64(iss.ecKey.X.FillBytes(make([]byte, 32))),
+			Y: b64(iss.ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}
+}
+
+func (iss *testIssuer) setBlock(block chan struct{}) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.block = block
+}
+
+// sign returns a token with the header and claims, signed with the RSA key
+// for RS256 and the EC key for ES256, and left unsigned otherwise
+func (iss *testIssuer) sign(t *testing.T, header map[string]any, claims map[string]any) string {
+	t.Helper()
+
+	segment := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := segment(header) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch header["alg"] {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, iss.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, iss.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub":   "42",
+		"iss":   "https://auth.example.com",
+		"aud":   "broker",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": "jane@example.com",
+		"scope": "users:read logs:write",
+	}
+}
+
+func TestJWTValidatorAcceptsSignedTokens(t *testing.T) {
+	iss, v := newTestIssuer(t)
+
+	for _, header := range []map[string]any{
+		{"alg": "RS256", "kid": "rsa-1"},
+		{"alg": "ES256", "kid": "ec-1"},
+	} {
+		p, err := v.Validate(context.Background(), iss.sign(t, header, validClaims()))
+		if err != nil {
+			t.Errorf("%s: %v", header["alg"], err)
+			continue
+		}
+
+		if p.Subject != "42" || p.UserID != 42 || p.Email != "jane@example.com" {
+			t.Errorf("%s: principal %+v, want user 42", header["alg"], p)
+		}
+		if !p.HasScope("users:read") || !p.HasScope("logs:write") {
+			t.Errorf("%s: scopes %v, want users:read and logs:write", header["alg"], p.Scopes)
+		}
+	}
+}
+
+func TestJWTValidatorRejectsBadSignatures(t *testing.T) {
+	iss, v := newTestIssuer(t)
+
+	tampered := iss.sign(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, validClaims())
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+
+	for name, token := range map[string]string{
+		"tampered signature":      tampered,
+		"ES256 on the RSA key":    iss.sign(t, map[string]any{"alg": "ES256", "kid": "rsa-1"}, validClaims()),
+		"RS256 on the EC key":     iss.sign(t, map[string]any{"alg": "RS256", "kid": "ec-1"}, validClaims()),
+		"ES384 on a P-256 key":    iss.sign(t, map[string]any{"alg": "ES384", "kid": "ec-1"}, validClaims()),
+		"HS256":                   iss.sign(t, map[string]any{"alg": "HS256", "kid": "rsa-1"}, validClaims()),
+		"alg none":                iss.sign(t, map[string]any{"alg": "none", "kid": "rsa-1"}, validClaims()),
+		"alg none without a kid":  iss.sign(t, map[string]any{"alg": "none"}, validClaims()),
+		"not a JWT":               "not.a-jwt",
+		"two segments":            "e30.e30",
+		"header not base64url":    "!!!.e30.e30",
+		"signature not base64url": "e30.e30.!!!",
+	} {
+		_, err := v.Validate(context.Background(), token)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestJWTValidatorChecksClaims(t *testing.T) {
+	iss, v := newTestIssuer(t)
+	now := time.Now()
+
+	for _, test := range []struct {
+		name  string
+		claim string
+		value any
+	}{
+		{"expired", "exp", now.Add(-time.Minute).Unix()},
+		{"without exp", "exp", nil},
+		{"not yet valid", "nbf", now.Add(time.Minute).Unix()},
+		{"other issuer", "iss", "https://evil.example.net"},
+		{"without issuer", "iss", nil},
+		{"other audience", "aud", "mail-service"},
+		{"audience list without the broker", "aud", []string{"mail-service", "logger-service"}},
+		{"without audience", "aud", nil},
+	} {
+		claims := validClaims()
+		if test.value == nil {
+			delete(claims, test.claim)
+		} else {
+			claims[test.claim] = test.value
+		}
+
+		_, err := v.Validate(context.Background(), iss.sign(t, map[string]any{"alg": "ES256", "kid": "ec-1"}, claims))
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: %v, want ErrInvalidToken", test.name, err)
+		}
+	}
+
+	claims := validClaims()
+	claims["nbf"] = now.Add(-time.Minute).Unix()
+	claims["aud"] = []string{"mail-service", "broker"}
+	_, err := v.Validate(context.Background(), iss.sign(t, map[string]any{"alg": "ES256", "kid": "ec-1"}, claims))
+	if err != nil {
+		t.Errorf("past nbf and the broker among audiences: %v", err)
+	}
+}
+
+func TestJWTValidatorRefetchesForUnknownKeys(t *testing.T) {
+	iss, v := newTestIssuer(t)
+	header := map[string]any{"alg": "RS256", "kid": "rsa-1"}
+
+	for i := 0; i < 3; i++ {
+		_, err := v.Validate(context.Background(), iss.sign(t, header, validClaims()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&iss.fetches); n != 1 {
+		t.Fatalf("fetched the JWKS %d times for a known key, want once", n)
+	}
+
+	// the issuer rotates its keys; a kid seen within the refresh interval of
+	// the last fetch is rejected without fetching again
+	iss.publish("rsa-2", "ec-2")
+	rotated := map[string]any{"alg": "RS256", "kid": "rsa-2"}
+
+	_, err := v.Validate(context.Background(), iss.sign(t, rotated, validClaims()))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("unknown kid right after a fetch: %v, want ErrInvalidToken", err)
+	}
+	if n := atomic.LoadInt32(&iss.fetches); n != 1 {
+		t.Fatalf("fetched the JWKS %d times, want the refresh interval to hold it at once", n)
+	}
+
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+	v.mu.Unlock()
+
+	_, err = v.Validate(context.Background(), iss.sign(t, rotated, validClaims()))
+	if err != nil {
+		t.Fatalf("rotated kid after the refresh interval: %v", err)
+	}
+	if n := atomic.LoadInt32(&iss.fetches); n != 2 {
+		t.Errorf("fetched the JWKS %d times, want a refetch for the rotated kid", n)
+	}
+
+	_, err = v.Validate(context.Background(), iss.sign(t, header, validClaims()))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("retired kid: %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestJWTValidatorFetchesWithoutBlockingKnownKeys(t *testing.T) {
+	iss, v := newTestIssuer(t)
+
+	known := iss.sign(t, map[string]any{"alg": "RS256", "kid": "rsa-1"}, validClaims())
+	_, err := v.Validate(context.Background(), known)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.mu.Lock()
+	v.fetchedAt = time.Now().Add(-jwksRefreshInterval)
+	v.mu.Unlock()
+
+	block := make(chan struct{})
+	iss.setBlock(block)
+	iss.publish("rsa-1", "ec-2")
+
+	// two tokens of a new key wait on a single slow fetch
+	rotated := iss.sign(t, map[string]any{"alg": "ES256", "kid": "ec-2"}, validClaims())
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := v.Validate(context.Background(), rotated)
+			results <- err
+		}()
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); atomic.LoadInt32(&iss.fetches) < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the JWKS was not fetched again")
+		}
+	}
+
+	validated := make(chan error, 1)
+	go func() {
+		_, err := v.Validate(context.Background(), known)
+		validated <- err
+	}()
+
+	select {
+	case err := <-validated:
+		if err != nil {
+			t.Errorf("known key during a fetch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("a token of a known key waited for the JWKS fetch")
+	}
+
+	close(block)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("token of the rotated key: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&iss.fetches); n != 2 {
+		t.Errorf("fetched the JWKS %d times, want concurrent unknown kids to share one fetch", n)
+	}
+}
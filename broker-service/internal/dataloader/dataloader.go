@@ -0,0 +1,108 @@
+// Package dataloader batches and caches lookups by key for the lifetime of a
+// request, so resolving N objects costs one upstream call instead of N.
+//
+// Load queues a key and returns a thunk. Keys queued before any of their
+// thunks is called are fetched together in a single call of the batch
+// function, which suits executors that resolve a whole level of a query
+// before calling its thunks.
+package dataloader
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchFunc fetches the values of keys. Keys missing from the returned map
+// resolve to the zero value.
+type BatchFunc[K comparable, V any] func(ctx context.Context, keys []K) (map[K]V, error)
+
+// Thunk returns the value of a queued key, fetching its batch if needed
+type Thunk[V any] func() (V, error)
+
+type result[V any] struct {
+	value V
+	err   error
+	done  bool
+}
+
+// Loader batches and caches lookups. It is meant to be created per request.
+type Loader[K comparable, V any] struct {
+	fetch    BatchFunc[K, V]
+	maxBatch int
+
+	mu      sync.Mutex
+	cache   map[K]*result[V]
+	pending []K
+}
+
+// New returns a loader calling fetch with at most maxBatch keys at a time.
+// maxBatch <= 0 means no limit.
+func New[K comparable, V any](fetch BatchFunc[K, V], maxBatch int) *Loader[K, V] {
+	return &Loader[K, V]{
+		fetch:    fetch,
+		maxBatch: maxBatch,
+		cache:    map[K]*result[V]{},
+	}
+}
+
+// Load queues key and returns a thunk resolving to its value
+func (l *Loader[K, V]) Load(ctx context.Context, key K) Thunk[V] {
+	l.mu.Lock()
+	if _, ok := l.cache[key]; !ok {
+		l.cache[key] = &result[V]{}
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		r := l.cache[key]
+		if !r.done {
+			l.dispatch(ctx)
+		}
+		return r.value, r.err
+	}
+}
+
+// LoadMany queues every key and returns a thunk resolving to their values in
+// the same order
+func (l *Loader[K, V]) LoadMany(ctx context.Context, keys []K) Thunk[[]V] {
+	thunks := make([]Thunk[V], len(keys))
+	for i, key := range keys {
+		thunks[i] = l.Load(ctx, key)
+	}
+
+	return func() ([]V, error) {
+		values := make([]V, len(keys))
+		for i, thunk := range thunks {
+			v, err := thunk()
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+}
+
+// dispatch fetches every pending key; callers must hold l.mu
+func (l *Loader[K, V]) dispatch(ctx context.Context) {
+	pending := l.pending
+	l.pending = nil
+
+	for len(pending) > 0 {
+		batch := pending
+		if l.maxBatch > 0 && len(batch) > l.maxBatch {
+			batch = batch[:l.maxBatch]
+		}
+		pending = pending[len(batch):]
+
+		values, err := l.fetch(ctx, batch)
+		for _, key := range batch {
+			r := l.cache[key]
+			r.value, r.err, r.done = values[key], err, true
+		}
+	}
+}
@@ -0,0 +1,596 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrUnroutable is returned when no queue is bound for the routing key of
+// a published event
+var ErrUnroutable = errors.New("event was not routed to any queue")
+
+var (
+	errNotConnected = errors.New("event bus is reconnecting")
+	errNotConfirmed = errors.New("channel closed before the broker confirmed the event")
+)
+
+// Headers the bus keeps on messages it republishes for another attempt
+const (
+	retriesHeader    = "x-retries"
+	routingKeyHeader = "x-routing-key"
+)
+
+// retryPublishTimeout bounds republishing a failed message for another attempt
+const retryPublishTimeout = 10 * time.Second
+
+// AMQP publishes events to a durable topic exchange on an AMQP 0-9-1 broker
+// such as RabbitMQ. Publishes are mandatory and wait for publisher confirms,
+// so events no queue is bound for fail instead of being dropped. A message
+// is handled Attempts times before it is routed to the dead-letter exchange.
+// When the connection drops the bus reconnects and subscribes again.
+type AMQP struct {
+	cfg        AMQPConfig
+	deadLetter string
+	dial       func(url string) (amqpConnection, error)
+
+	mu      sync.Mutex
+	conn    amqpConnection
+	publish *publisher
+	closed  bool
+	done    chan struct{}
+
+	// subMu is held while consuming subscriptions, so one subscribing
+	// during a reconnect is consumed exactly once
+	subMu         sync.Mutex
+	subscriptions []*subscription
+
+	wg sync.WaitGroup
+}
+
+// AMQPConfig holds the connection settings of the AMQP bus
+type AMQPConfig struct {
+	URL      string
+	Exchange string
+	Prefetch int
+
+	// Attempts is how many times a failing message is handled before it is
+	// dead-lettered, 2 by default
+	Attempts int
+
+	// ReconnectDelay is the delay before the first reconnection attempt,
+	// doubled up to a minute while the broker stays unreachable
+	ReconnectDelay time.Duration
+}
+
+type subscription struct {
+	queue    string
+	bindings []string
+	handler  Handler
+}
+
+// amqpConnection and amqpChannel are the parts of the client the bus uses,
+// so tests can stand in for the broker
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type amqpChannel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	GetNextPublishSeqNo() uint64
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Close() error
+}
+
+// clientConnection adapts *amqp.Connection to amqpConnection
+type clientConnection struct {
+	*amqp.Connection
+}
+
+func (c clientConnection) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func dialClient(url string) (amqpConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return clientConnection{conn}, nil
+}
+
+// DialAMQP connects and declares the exchange, the dead-letter exchange and
+// the dead-letter queue where poison messages can be inspected
+func DialAMQP(cfg AMQPConfig) (*AMQP, error) {
+	return dialAMQP(cfg, dialClient)
+}
+
+func dialAMQP(cfg AMQPConfig, dial func(url string) (amqpConnection, error)) (*AMQP, error) {
+	if cfg.Prefetch == 0 {
+		cfg.Prefetch = 16
+	}
+	if cfg.Attempts == 0 {
+		cfg.Attempts = 2
+	}
+	if cfg.ReconnectDelay == 0 {
+		cfg.ReconnectDelay = time.Second
+	}
+
+	b := &AMQP{
+		cfg:        cfg,
+		deadLetter: cfg.Exchange + ".dlx",
+		dial:       dial,
+		done:       make(chan struct{}),
+	}
+
+	err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// connect dials the broker, declares the exchanges, consumes every
+// subscription and watches the connection to reconnect when it drops
+func (b *AMQP) connect() error {
+	conn, err := b.dial(b.cfg.URL)
+	if err != nil {
+		return err
+	}
+	closes := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := b.setup(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	b.conn = conn
+	b.publish = newPublisher(ch)
+	b.mu.Unlock()
+
+	for _, sub := range b.subscriptions {
+		err = b.consume(conn, sub)
+		if err != nil {
+			// the watcher reconnects and tries again
+			log.Printf("eventbus: subscribing queue %s: %v", sub.queue, err)
+			conn.Close()
+			break
+		}
+	}
+
+	b.wg.Add(1)
+	go b.watch(closes)
+	return nil
+}
+
+// watch waits for the connection to close and, unless the bus was closed,
+// reconnects with exponential backoff
+func (b *AMQP) watch(closes chan *amqp.Error) {
+	defer b.wg.Done()
+
+	reason := <-closes
+
+	b.mu.Lock()
+	closed := b.closed
+	b.publish = nil
+	b.mu.Unlock()
+	if closed {
+		return
+	}
+
+	log.Printf("eventbus: amqp connection lost: %v", reason)
+
+	delay := b.cfg.ReconnectDelay
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-time.After(delay):
+		}
+
+		err := b.connect()
+		if err == nil {
+			log.Printf("eventbus: amqp connection restored")
+			return
+		}
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+
+		log.Printf("eventbus: reconnecting to amqp: %v", err)
+		delay *= 2
+		if delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+}
+
+// setup declares the exchanges and the dead-letter queue and returns the
+// confirm mode channel to publish on
+func (b *AMQP) setup(conn amqpConnection) (amqpChannel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.ExchangeDeclare(b.cfg.Exchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("declaring exchange %s: %w", b.cfg.Exchange, err)
+	}
+
+	err = ch.ExchangeDeclare(b.deadLetter, amqp.ExchangeTopic, true, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("declaring exchange %s: %w", b.deadLetter, err)
+	}
+
+	_, err = ch.QueueDeclare(b.deadLetter, true, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("declaring queue %s: %w", b.deadLetter, err)
+	}
+
+	err = ch.QueueBind(b.deadLetter, "#", b.deadLetter, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("binding queue %s: %w", b.deadLetter, err)
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		return nil, fmt.Errorf("enabling publisher confirms: %w", err)
+	}
+
+	return ch, nil
+}
+
+// Publish sends a persistent message and waits until the broker confirms
+// it. Events no queue is bound for fail with ErrUnroutable.
+func (b *AMQP) Publish(ctx context.Context, routingKey string, payload any) error {
+	event, err := NewEvent(routingKey, payload)
+	if err != nil {
+		return err
+	}
+
+	return b.send(ctx, b.cfg.Exchange, routingKey, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    event.ID,
+		Timestamp:    event.Timestamp,
+		Body:         event.Payload,
+	})
+}
+
+func (b *AMQP) send(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	b.mu.Lock()
+	p, closed := b.publish, b.closed
+	b.mu.Unlock()
+
+	switch {
+	case closed:
+		return ErrClosed
+	case p == nil:
+		return errNotConnected
+	}
+
+	return p.publish(ctx, exchange, key, msg)
+}
+
+// Subscribe declares a durable queue dead-lettering to the bus's dead-letter
+// exchange, binds it and consumes it with manual acknowledgements. An empty
+// queue name declares an exclusive server-named queue instead, which the
+// broker deletes when the connection closes. Queues are declared again
+// after a reconnect.
+func (b *AMQP) Subscribe(queue string, bindings []string, handler Handler) error {
+	sub := &subscription{queue: queue, bindings: bindings, handler: handler}
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+
+	b.mu.Lock()
+	conn, closed := b.conn, b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	err := b.consume(conn, sub)
+	if err != nil {
+		return err
+	}
+
+	b.subscriptions = append(b.subscriptions, sub)
+	return nil
+}
+
+// consume declares and binds the subscription's queue on conn and handles
+// its deliveries until the connection closes
+func (b *AMQP) consume(conn amqpConnection, sub *subscription) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	durable, exclusive := true, false
+	if sub.queue == "" {
+		durable, exclusive = false, true
+	}
+
+	q, err := ch.QueueDeclare(sub.queue, durable, exclusive, exclusive, false, amqp.Table{
+		"x-dead-letter-exchange": b.deadLetter,
+	})
+	if err != nil {
+		return fmt.Errorf("declaring queue %s: %w", sub.queue, err)
+	}
+
+	for _, key := range sub.bindings {
+		err = ch.QueueBind(q.Name, key, b.cfg.Exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("binding queue %s to %s: %w", q.Name, key, err)
+		}
+	}
+
+	err = ch.Qos(b.cfg.Prefetch, 0, false)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+
+		for d := range deliveries {
+			b.handle(q.Name, d, sub.handler)
+		}
+	}()
+
+	return nil
+}
+
+// handle runs the handler on a delivery. A failed message is republished to
+// its queue with its attempts counted in a header, and dead-lettered once it
+// has failed Attempts times. The redelivered flag cannot count attempts:
+// the broker also sets it on messages a lost connection left unacknowledged.
+func (b *AMQP) handle(queue string, d amqp.Delivery, handler Handler) {
+	routingKey := d.RoutingKey
+	if key, ok := d.Headers[routingKeyHeader].(string); ok {
+		routingKey = key
+	}
+
+	event := Event{
+		ID:         d.MessageId,
+		RoutingKey: routingKey,
+		Payload:    d.Body,
+		Timestamp:  d.Timestamp,
+	}
+
+	err := handler(context.Background(), event)
+	if err == nil {
+		d.Ack(false)
+		return
+	}
+
+	retries := retryCount(d.Headers)
+	if retries+1 >= b.cfg.Attempts {
+		log.Printf("eventbus: dead-lettering %s (%s) from queue %s after %d attempts: %v", event.ID, event.RoutingKey, queue, retries+1, err)
+		d.Nack(false, false)
+		return
+	}
+
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retriesHeader] = int32(retries + 1)
+	headers[routingKeyHeader] = routingKey
+
+	ctx, cancel := context.WithTimeout(context.Background(), retryPublishTimeout)
+	defer cancel()
+
+	// through the default exchange, so only this queue sees the message again
+	err = b.send(ctx, "", queue, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: d.DeliveryMode,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+	})
+	if err != nil {
+		// keep the message even though its attempt is not counted
+		log.Printf("eventbus: republishing %s to queue %s: %v", event.ID, queue, err)
+		d.Nack(false, true)
+		return
+	}
+
+	d.Ack(false)
+}
+
+// retryCount returns the attempts recorded on a message that failed before
+func retryCount(headers amqp.Table) int {
+	switch n := headers[retriesHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// Close closes the connection, stopping every consumer and the reconnection
+func (b *AMQP) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.publish = nil
+	conn := b.conn
+	close(b.done)
+	b.mu.Unlock()
+
+	err := conn.Close()
+	b.wg.Wait()
+
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// publisher publishes on one confirm mode channel and hands the returns and
+// confirms the broker sends back to the publishes waiting for them
+type publisher struct {
+	ch amqpChannel
+
+	// mu serializes publishes so each learns its delivery tag
+	mu sync.Mutex
+
+	pendingMu sync.Mutex
+	pending   map[uint64]*pendingPublish
+	byID      map[string]uint64
+}
+
+type pendingPublish struct {
+	id       string
+	returned *amqp.Return
+	done     chan error
+}
+
+func newPublisher(ch amqpChannel) *publisher {
+	p := &publisher{
+		ch:      ch,
+		pending: map[uint64]*pendingPublish{},
+		byID:    map[string]uint64{},
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation))
+	go p.dispatch(returns, confirms)
+
+	return p
+}
+
+func (p *publisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	pp := &pendingPublish{id: msg.MessageId, done: make(chan error, 1)}
+
+	p.mu.Lock()
+	tag := p.ch.GetNextPublishSeqNo()
+	p.track(tag, pp)
+	err := p.ch.PublishWithContext(ctx, exchange, key, true, false, msg)
+	p.mu.Unlock()
+	if err != nil {
+		p.untrack(tag)
+		return err
+	}
+
+	select {
+	case err := <-pp.done:
+		return err
+	case <-ctx.Done():
+		p.untrack(tag)
+		return ctx.Err()
+	}
+}
+
+func (p *publisher) track(tag uint64, pp *pendingPublish) {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	p.pending[tag] = pp
+	p.byID[pp.id] = tag
+}
+
+func (p *publisher) untrack(tag uint64) *pendingPublish {
+	p.pendingMu.Lock()
+	defer p.pendingMu.Unlock()
+
+	pp, ok := p.pending[tag]
+	if !ok {
+		return nil
+	}
+
+	delete(p.pending, tag)
+	if p.byID[pp.id] == tag {
+		delete(p.byID, pp.id)
+	}
+	return pp
+}
+
+// dispatch resolves pending publishes. The client hands over the return of
+// a message before its confirm and waits for each to be received, so
+// reading both here sees the return first.
+func (p *publisher) dispatch(returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+
+			p.pendingMu.Lock()
+			if tag, ok := p.byID[r.MessageId]; ok {
+				p.pending[tag].returned = &r
+			}
+			p.pendingMu.Unlock()
+
+		case c, ok := <-confirms:
+			if !ok {
+				p.pendingMu.Lock()
+				for tag, pp := range p.pending {
+					pp.done <- errNotConfirmed
+					delete(p.pending, tag)
+				}
+				p.byID = map[string]uint64{}
+				p.pendingMu.Unlock()
+				return
+			}
+
+			pp := p.untrack(c.DeliveryTag)
+			switch {
+			case pp == nil:
+			case !c.Ack:
+				pp.done <- fmt.Errorf("broker rejected event %s", pp.id)
+			case pp.returned != nil:
+				pp.done <- fmt.Errorf("%w: %s (%s)", ErrUnroutable, pp.returned.RoutingKey, pp.returned.ReplyText)
+			default:
+				pp.done <- nil
+			}
+		}
+	}
+}
@@ -0,0 +1,732 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeBroker is a stand-in AMQP broker keeping queues and bindings across
+// connections like RabbitMQ: it routes through topic exchanges and the
+// default exchange, returns unroutable mandatory messages before confirming
+// them, dead-letters rejected messages and deletes exclusive queues with
+// the connection that declared them
+type fakeBroker struct {
+	mu       sync.Mutex
+	queues   map[string]*fakeQueue
+	bindings []fakeBinding
+	conns    []*fakeConn
+	dials    int
+	down     bool
+	named    int
+}
+
+type fakeBinding struct {
+	exchange, pattern, queue string
+}
+
+type fakeQueue struct {
+	name       string
+	deadLetter string
+	owner      *fakeConn
+	messages   chan amqp.Delivery
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{queues: map[string]*fakeQueue{}}
+}
+
+func (f *fakeBroker) dial(url string) (amqpConnection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dials++
+	if f.down {
+		return nil, errors.New("connection refused")
+	}
+
+	c := &fakeConn{broker: f}
+	f.conns = append(f.conns, c)
+	return c, nil
+}
+
+// drop closes every connection as a broker restart would
+func (f *fakeBroker) drop() {
+	f.mu.Lock()
+	conns := f.conns
+	f.conns = nil
+	f.mu.Unlock()
+
+	for _, c := range conns {
+		c.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker restart"})
+	}
+}
+
+func (f *fakeBroker) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeBroker) dialCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials
+}
+
+func (f *fakeBroker) queue(name string) *fakeQueue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queues[name]
+}
+
+// route delivers the message to the queues bound for the key and returns
+// how many there were
+func (f *fakeBroker) route(exchange, key string, msg amqp.Publishing) int {
+	f.mu.Lock()
+	var targets []*fakeQueue
+	if exchange == "" {
+		if q, ok := f.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, b := range f.bindings {
+			if b.exchange == exchange && !seen[b.queue] && Match(b.pattern, key) {
+				seen[b.queue] = true
+				targets = append(targets, f.queues[b.queue])
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	for _, q := range targets {
+		q.messages <- amqp.Delivery{
+			Headers:      msg.Headers,
+			ContentType:  msg.ContentType,
+			DeliveryMode: msg.DeliveryMode,
+			MessageId:    msg.MessageId,
+			Timestamp:    msg.Timestamp,
+			Body:         msg.Body,
+			Exchange:     exchange,
+			RoutingKey:   key,
+		}
+	}
+	return len(targets)
+}
+
+type fakeConn struct {
+	broker *fakeBroker
+
+	mu       sync.Mutex
+	closed   bool
+	closes   []chan *amqp.Error
+	channels []*fakeChannel
+}
+
+func (c *fakeConn) Channel() (amqpChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	ch := &fakeChannel{conn: c, events: make(chan func(), 256), stop: make(chan struct{})}
+	go ch.run()
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *fakeConn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		close(receiver)
+	} else {
+		c.closes = append(c.closes, receiver)
+	}
+	return receiver
+}
+
+func (c *fakeConn) Close() error {
+	if !c.shutdown(nil) {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+func (c *fakeConn) shutdown(reason *amqp.Error) bool {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	c.closed = true
+	closes, channels := c.closes, c.channels
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.shutdown()
+	}
+
+	f := c.broker
+	f.mu.Lock()
+	for name, q := range f.queues {
+		if q.owner == c {
+			delete(f.queues, name)
+		}
+	}
+	bindings := f.bindings[:0]
+	for _, b := range f.bindings {
+		if _, ok := f.queues[b.queue]; ok {
+			bindings = append(bindings, b)
+		}
+	}
+	f.bindings = bindings
+	f.mu.Unlock()
+
+	for _, receiver := range closes {
+		if reason != nil {
+			receiver <- reason
+		}
+		close(receiver)
+	}
+	return true
+}
+
+type fakeChannel struct {
+	conn *fakeConn
+
+	mu         sync.Mutex
+	closed     bool
+	confirming bool
+	published  uint64
+	returns    []chan amqp.Return
+	confirms   []chan amqp.Confirmation
+
+	// events hands returns and confirms to the listeners in order, as the
+	// client's reader does
+	events chan func()
+	stop   chan struct{}
+}
+
+func (ch *fakeChannel) run() {
+	for event := range ch.events {
+		event()
+	}
+}
+
+func (ch *fakeChannel) shutdown() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	close(ch.stop)
+
+	returns, confirms := ch.returns, ch.confirms
+	ch.events <- func() {
+		for _, c := range returns {
+			close(c)
+		}
+		for _, c := range confirms {
+			close(c)
+		}
+	}
+	close(ch.events)
+}
+
+func (ch *fakeChannel) err() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return ch.err()
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if err := ch.err(); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	f := ch.conn.broker
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if name == "" {
+		f.named++
+		name = fmt.Sprintf("amq.gen-%d", f.named)
+	}
+
+	if _, ok := f.queues[name]; !ok {
+		q := &fakeQueue{name: name, messages: make(chan amqp.Delivery, 64)}
+		q.deadLetter, _ = args["x-dead-letter-exchange"].(string)
+		if exclusive {
+			q.owner = ch.conn
+		}
+		f.queues[name] = q
+	}
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	if err := ch.err(); err != nil {
+		return err
+	}
+
+	f := ch.conn.broker
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b := fakeBinding{exchange: exchange, pattern: key, queue: name}
+	for _, existing := range f.bindings {
+		if existing == b {
+			return nil
+		}
+	}
+	f.bindings = append(f.bindings, b)
+	return nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return ch.err()
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if err := ch.err(); err != nil {
+		return nil, err
+	}
+
+	q := ch.conn.broker.queue(queue)
+	if q == nil {
+		return nil, fmt.Errorf("no queue %s", queue)
+	}
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+
+		for tag := uint64(1); ; tag++ {
+			select {
+			case <-ch.stop:
+				return
+			case d := <-q.messages:
+				d.DeliveryTag = tag
+				d.Acknowledger = &fakeAck{broker: ch.conn.broker, queue: q, delivery: d}
+
+				select {
+				case out <- d:
+				case <-ch.stop:
+					// unacknowledged messages go back to the queue
+					d.Redelivered = true
+					q.messages <- d
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.confirming = true
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *fakeChannel) GetNextPublishSeqNo() uint64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.published + 1
+}
+
+func (ch *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	ch.published++
+	tag := ch.published
+
+	routed := ch.conn.broker.route(exchange, key, msg)
+
+	returns, confirms := ch.returns, ch.confirms
+	if mandatory && routed == 0 {
+		ret := amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key, MessageId: msg.MessageId}
+		ch.events <- func() {
+			for _, c := range returns {
+				c <- ret
+			}
+		}
+	}
+	if ch.confirming {
+		ch.events <- func() {
+			for _, c := range confirms {
+				c <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.shutdown()
+	return nil
+}
+
+// fakeAck settles a delivery: rejected messages are requeued or routed to
+// the queue's dead-letter exchange with their routing key
+type fakeAck struct {
+	broker   *fakeBroker
+	queue    *fakeQueue
+	delivery amqp.Delivery
+}
+
+func (a *fakeAck) Ack(tag uint64, multiple bool) error {
+	return nil
+}
+
+func (a *fakeAck) Nack(tag uint64, multiple, requeue bool) error {
+	return a.Reject(tag, requeue)
+}
+
+func (a *fakeAck) Reject(tag uint64, requeue bool) error {
+	d := a.delivery
+
+	if requeue {
+		d.Redelivered = true
+		a.queue.messages <- d
+		return nil
+	}
+
+	if a.queue.deadLetter != "" {
+		a.broker.route(a.queue.deadLetter, d.RoutingKey, amqp.Publishing{
+			Headers:      d.Headers,
+			ContentType:  d.ContentType,
+			DeliveryMode: d.DeliveryMode,
+			MessageId:    d.MessageId,
+			Timestamp:    d.Timestamp,
+			Body:         d.Body,
+		})
+	}
+	return nil
+}
+
+func newTestAMQP(t *testing.T, f *fakeBroker, cfg AMQPConfig) *AMQP {
+	cfg.Exchange = "test.events"
+	if cfg.ReconnectDelay == 0 {
+		cfg.ReconnectDelay = 5 * time.Millisecond
+	}
+
+	b, err := dialAMQP(cfg, f.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func receive(t *testing.T, events chan Event) Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event delivered")
+		return Event{}
+	}
+}
+
+// eventually polls cond until it holds or a couple of seconds pass
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestAMQPPublishesToBoundQueues(t *testing.T) {
+	f := newFakeBroker()
+	b := newTestAMQP(t, f, AMQPConfig{})
+
+	events := make(chan Event, 1)
+	err := b.Subscribe("test.logger", []string{"log.#"}, func(ctx context.Context, event Event) error {
+		events <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Publish(context.Background(), "log.info", map[string]string{"message": "started"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := receive(t, events)
+	if event.RoutingKey != "log.info" {
+		t.Errorf("routing key %q, want log.info", event.RoutingKey)
+	}
+
+	var payload map[string]string
+	json.Unmarshal(event.Payload, &payload)
+	if payload["message"] != "started" {
+		t.Errorf("payload %s, want the published one", event.Payload)
+	}
+}
+
+func TestAMQPDeliversEventsOfTheAuthenticationService(t *testing.T) {
+	f := newFakeBroker()
+	b := newTestAMQP(t, f, AMQPConfig{})
+
+	events := make(chan Event, 1)
+	err := b.Subscribe("", []string{"session.revoked"}, func(ctx context.Context, event Event) error {
+		events <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the authentication service's outbox relay publishes the event type as
+	// routing key, the idempotency key as message id and the bare payload
+	occurred := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	payload := `{"session_id":"0123456789abcdef","user_id":7}`
+	n := f.route("test.events", "session.revoked", amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    "9f86d081884c7d65",
+		Type:         "session.revoked",
+		Timestamp:    occurred,
+		Body:         []byte(payload),
+	})
+	if n != 1 {
+		t.Fatalf("routed to %d queues, want the subscription's", n)
+	}
+
+	event := receive(t, events)
+	if event.ID != "9f86d081884c7d65" || event.RoutingKey != "session.revoked" || !event.Timestamp.Equal(occurred) {
+		t.Errorf("event %s %s at %s, want the message's id, routing key and timestamp", event.ID, event.RoutingKey, event.Timestamp)
+	}
+	if string(event.Payload) != payload {
+		t.Errorf("payload %s, want %s", event.Payload, payload)
+	}
+}
+
+func TestAMQPPublishFailsWhenUnroutable(t *testing.T) {
+	f := newFakeBroker()
+	b := newTestAMQP(t, f, AMQPConfig{})
+
+	err := b.Subscribe("test.logger", []string{"log.#"}, func(ctx context.Context, event Event) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Publish(context.Background(), "mail.send", map[string]string{"to": "jane@example.com"})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("publishing without a bound queue: %v, want ErrUnroutable", err)
+	}
+
+	// the publish after an unroutable one is matched to its own confirm
+	err = b.Publish(context.Background(), "log.info", nil)
+	if err != nil {
+		t.Fatalf("publishing to a bound queue: %v", err)
+	}
+}
+
+func TestAMQPCountsAttemptsBeforeDeadLettering(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		attempts   int
+		failures   int
+		handled    int
+		deadLetter bool
+	}{
+		{"succeeds on retry", 0, 1, 2, false},
+		{"fails every attempt", 0, 10, 2, true},
+		{"fails every one of more attempts", 4, 10, 4, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeBroker()
+			b := newTestAMQP(t, f, AMQPConfig{Attempts: test.attempts})
+
+			var mu sync.Mutex
+			var keys []string
+			err := b.Subscribe("test.logger", []string{"log.#"}, func(ctx context.Context, event Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				keys = append(keys, event.RoutingKey)
+				if len(keys) <= test.failures {
+					return errors.New("logger unavailable")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = b.Publish(context.Background(), "log.error", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handled := func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(keys)
+			}
+			eventually(t, fmt.Sprintf("%d attempts", test.handled), func() bool { return handled() >= test.handled })
+
+			dlq := f.queue("test.events.dlx")
+			if test.deadLetter {
+				select {
+				case d := <-dlq.messages:
+					if n := retryCount(d.Headers); n != test.handled-1 {
+						t.Errorf("dead-lettered with %d retries recorded, want %d", n, test.handled-1)
+					}
+					if key := d.Headers[routingKeyHeader]; key != "log.error" {
+						t.Errorf("dead-lettered with routing key header %v, want log.error", key)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("message was not dead-lettered")
+				}
+			}
+
+			// give a wrong extra attempt or dead-lettering time to show
+			time.Sleep(20 * time.Millisecond)
+
+			if n := handled(); n != test.handled {
+				t.Errorf("handled %d times, want %d", n, test.handled)
+			}
+			if n := len(dlq.messages); n != 0 {
+				t.Errorf("%d messages left in the dead-letter queue, want none", n)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for i, key := range keys {
+				if key != "log.error" {
+					t.Errorf("attempt %d saw routing key %q, want log.error", i+1, key)
+				}
+			}
+		})
+	}
+}
+
+func TestAMQPReconnectsAndSubscribesAgain(t *testing.T) {
+	f := newFakeBroker()
+	b := newTestAMQP(t, f, AMQPConfig{})
+
+	durable := make(chan Event, 1)
+	err := b.Subscribe("test.logger", []string{"log.#"}, func(ctx context.Context, event Event) error {
+		durable <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exclusive := make(chan Event, 1)
+	err = b.Subscribe("", []string{"log.#"}, func(ctx context.Context, event Event) error {
+		exclusive <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the broker restarts and refuses connections for a while
+	f.setDown(true)
+	f.drop()
+
+	eventually(t, "reconnection attempts", func() bool { return f.dialCount() >= 3 })
+
+	err = b.Publish(context.Background(), "log.info", nil)
+	if err == nil {
+		t.Error("publishing while disconnected succeeded")
+	}
+
+	f.setDown(false)
+
+	// publishes fail until the bus has reconnected and bound its queues
+	eventually(t, "publishing after the reconnection", func() bool {
+		return b.Publish(context.Background(), "log.info", nil) == nil
+	})
+
+	receive(t, durable)
+	receive(t, exclusive)
+}
+
+func TestAMQPCloseStopsReconnecting(t *testing.T) {
+	f := newFakeBroker()
+	b := newTestAMQP(t, f, AMQPConfig{})
+
+	f.setDown(true)
+	f.drop()
+	eventually(t, "a reconnection attempt", func() bool { return f.dialCount() >= 2 })
+
+	err := b.Close()
+	if err != nil {
+		t.Fatalf("close while reconnecting: %v", err)
+	}
+
+	dials := f.dialCount()
+	time.Sleep(30 * time.Millisecond)
+	if n := f.dialCount(); n != dials {
+		t.Errorf("dialed %d more times after close", n-dials)
+	}
+
+	err = b.Publish(context.Background(), "log.info", nil)
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("publishing after close: %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,87 @@
+package eventbus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrClosed is returned when publishing to or subscribing on a closed bus
+var ErrClosed = errors.New("event bus is closed")
+
+// Event is a message published on the bus
+type Event struct {
+	ID         string          `json:"id"`
+	RoutingKey string          `json:"routing_key"`
+	Payload    json.RawMessage `json:"payload"`
+	Timestamp  time.Time       `json:"timestamp"`
+}
+
+// Handler processes an event delivered to a subscription. Returning an error
+// makes the bus retry the event once before dead-lettering it.
+type Handler func(ctx context.Context, event Event) error
+
+// Bus publishes events with routing keys and delivers them to subscribers
+// whose binding patterns match. Patterns follow AMQP topic rules: words are
+// separated by dots, * matches one word and # matches zero or more.
+//
+// Subscribers sharing a queue name compete for its events. An empty queue
+// name subscribes with a queue of its own that only lives as long as the
+// bus, for events every process must see.
+type Bus interface {
+	Publish(ctx context.Context, routingKey string, payload any) error
+	Subscribe(queue string, bindings []string, handler Handler) error
+	Close() error
+}
+
+// NewEvent wraps the payload in an event with a random id
+func NewEvent(routingKey string, payload any) (Event, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		ID:         hex.EncodeToString(id),
+		RoutingKey: routingKey,
+		Payload:    b,
+		Timestamp:  time.Now().UTC(),
+	}, nil
+}
+
+// Match reports whether the routing key matches the topic binding pattern
+func Match(pattern, routingKey string) bool {
+	return match(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func match(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if match(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+
+	case "*":
+		return len(words) > 0 && match(pattern[1:], words[1:])
+
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && match(pattern[1:], words[1:])
+	}
+}
@@ -0,0 +1,143 @@
+package eventbus
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// InProcess delivers events to subscribers in the same process through
+// buffered queues. Events are lost on restart; use AMQP when they must survive.
+type InProcess struct {
+	mu         sync.RWMutex
+	closed     bool
+	queues     map[string]*inprocQueue
+	transient  int
+	deadLetter func(queue string, event Event, err error)
+	wg         sync.WaitGroup
+}
+
+type inprocQueue struct {
+	bindings []string
+	events   chan Event
+}
+
+// NewInProcess returns an empty bus. Events failing twice are passed to
+// deadLetter, which may be nil to only log them.
+func NewInProcess(deadLetter func(queue string, event Event, err error)) *InProcess {
+	return &InProcess{
+		queues:     map[string]*inprocQueue{},
+		deadLetter: deadLetter,
+	}
+}
+
+// inprocBufferSize is the number of events a queue holds before Publish blocks
+const inprocBufferSize = 256
+
+// Publish delivers the event to every queue with a matching binding. It
+// blocks while a matching queue is full, until ctx is done.
+func (b *InProcess) Publish(ctx context.Context, routingKey string, payload any) error {
+	event, err := NewEvent(routingKey, payload)
+	if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	for name, q := range b.queues {
+		if !q.matches(routingKey) {
+			continue
+		}
+
+		select {
+		case q.events <- event:
+		case <-ctx.Done():
+			log.Printf("eventbus: dropping %s for queue %s: %v", event.ID, name, ctx.Err())
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Subscribe creates the queue if needed, binds it and starts a consumer. An
+// empty queue name always creates a new queue.
+func (b *InProcess) Subscribe(queue string, bindings []string, handler Handler) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	if queue == "" {
+		b.transient++
+		queue = fmt.Sprintf("transient.%d", b.transient)
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		q = &inprocQueue{events: make(chan Event, inprocBufferSize)}
+		b.queues[queue] = q
+	}
+	q.bindings = append(q.bindings, bindings...)
+
+	b.wg.Add(1)
+	go b.consume(queue, q, handler)
+
+	return nil
+}
+
+func (b *InProcess) consume(name string, q *inprocQueue, handler Handler) {
+	defer b.wg.Done()
+
+	for event := range q.events {
+		err := handler(context.Background(), event)
+		if err == nil {
+			continue
+		}
+
+		// one redelivery, then the event is treated as poison
+		err = handler(context.Background(), event)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("eventbus: dead-lettering %s (%s) from queue %s: %v", event.ID, event.RoutingKey, name, err)
+		if b.deadLetter != nil {
+			b.deadLetter(name, event, err)
+		}
+	}
+}
+
+// Close stops accepting events and waits for queued ones to be handled
+func (b *InProcess) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	for _, q := range b.queues {
+		close(q.events)
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+func (q *inprocQueue) matches(routingKey string) bool {
+	for _, pattern := range q.bindings {
+		if Match(pattern, routingKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Job statuses
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// ErrJobNotFound is returned when no job has the requested id
+// ErrQueueFull is returned when the runner cannot accept more jobs
+// ErrRunnerClosed is returned for jobs submitted after the runner shut down
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrQueueFull    = errors.New("job queue is full")
+	ErrRunnerClosed = errors.New("job runner is shutting down")
+)
+
+// Job is the persisted record of an asynchronous broker action
+type Job struct {
+	ID         string          `json:"id"`
+	Action     string          `json:"action"`
+	Owner      string          `json:"-"`
+	Status     string          `json:"status"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the job reached a final status
+func (j *Job) Done() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+// Store persists job records
+type Store interface {
+	Save(ctx context.Context, job *Job) error
+	Get(ctx context.Context, id string) (*Job, error)
+	List(ctx context.Context) ([]*Job, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// NewJob returns a pending job for the action with a random id
+func NewJob(action, owner string) (*Job, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Job{
+		ID:        hex.EncodeToString(b),
+		Action:    action,
+		Owner:     owner,
+		Status:    StatusPending,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
@@ -0,0 +1,223 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Func performs the work of a job and returns its result
+type Func func(ctx context.Context) (any, error)
+
+type task struct {
+	job *Job
+	ctx context.Context
+	fn  Func
+}
+
+// Runner executes submitted jobs on a fixed pool of workers
+type Runner struct {
+	// OnSave, when set, is called with a copy of the job every time its
+	// record is saved. It must be set before the first job is submitted.
+	OnSave func(job Job)
+
+	store   Store
+	timeout time.Duration
+	queue   chan task
+	wg      sync.WaitGroup
+
+	// mu guards closed against jobs submitted while the runner shuts down
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewRunner starts workers goroutines taking jobs from a queue of queueSize
+func NewRunner(store Store, workers, queueSize int, timeout time.Duration) *Runner {
+	r := &Runner{
+		store:   store,
+		timeout: timeout,
+		queue:   make(chan task, queueSize),
+	}
+
+	for i := 0; i < workers; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+
+	return r
+}
+
+// Submit persists the pending job and queues fn to run it. ctx carries the
+// values the job needs, such as the principal; its cancellation is ignored
+// since the job outlives the request that submitted it.
+func (r *Runner) Submit(ctx context.Context, job *Job, fn Func) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return ErrRunnerClosed
+	}
+
+	err := r.store.Save(ctx, job)
+	if err != nil {
+		return err
+	}
+	r.saved(job)
+
+	// the worker owns its own copy so callers can keep reading theirs
+	queued := *job
+
+	select {
+	case r.queue <- task{job: &queued, ctx: detach{ctx}, fn: fn}:
+		return nil
+	default:
+		job.Status = StatusFailed
+		job.Error = ErrQueueFull.Error()
+		r.finish(job)
+		return ErrQueueFull
+	}
+}
+
+// Shutdown stops accepting jobs and waits for queued ones to finish
+func (r *Runner) Shutdown() {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+}
+
+func (r *Runner) work() {
+	defer r.wg.Done()
+
+	for t := range r.queue {
+		r.run(t)
+	}
+}
+
+func (r *Runner) run(t task) {
+	job := t.job
+
+	now := time.Now().UTC()
+	job.Status = StatusRunning
+	job.StartedAt = &now
+	r.save(job)
+
+	ctx, cancel := context.WithTimeout(t.ctx, r.timeout)
+	defer cancel()
+
+	result, err := safeCall(ctx, t.fn)
+	if err != nil {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = StatusSucceeded
+		job.Result, err = json.Marshal(result)
+		if err != nil {
+			job.Status = StatusFailed
+			job.Error = err.Error()
+		}
+	}
+
+	r.finish(job)
+}
+
+func (r *Runner) finish(job *Job) {
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	r.save(job)
+}
+
+func (r *Runner) save(job *Job) {
+	err := r.store.Save(context.Background(), job)
+	if err != nil {
+		log.Printf("jobs: saving %s: %v", job.ID, err)
+		return
+	}
+	r.saved(job)
+}
+
+func (r *Runner) saved(job *Job) {
+	if r.OnSave != nil {
+		r.OnSave(*job)
+	}
+}
+
+// safeCall turns a panicking job into a failed one instead of crashing the broker
+func safeCall(ctx context.Context, fn Func) (result any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+
+	return fn(ctx)
+}
+
+// Recover marks jobs left pending or running by a previous process as failed
+func Recover(ctx context.Context, store Store) error {
+	jobs, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.Done() {
+			continue
+		}
+
+		now := time.Now().UTC()
+		job.Status = StatusFailed
+		job.Error = "interrupted by broker restart"
+		job.FinishedAt = &now
+
+		err = store.Save(ctx, job)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Purge deletes finished jobs older than retention every interval until ctx is cancelled
+func Purge(ctx context.Context, store Store, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		jobs, err := store.List(ctx)
+		if err != nil {
+			log.Printf("jobs: listing for purge: %v", err)
+			continue
+		}
+
+		for _, job := range jobs {
+			if job.Done() && job.FinishedAt != nil && time.Since(*job.FinishedAt) > retention {
+				store.Delete(ctx, job.ID)
+			}
+		}
+	}
+}
+
+// detach keeps the values of a context but not its deadline or cancellation
+type detach struct {
+	parent context.Context
+}
+
+func (d detach) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (d detach) Done() <-chan struct{}             { return nil }
+func (d detach) Err() error                        { return nil }
+func (d detach) Value(key interface{}) interface{} { return d.parent.Value(key) }
@@ -0,0 +1,54 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownFinishesQueuedJobs(t *testing.T) {
+	store := NewMemoryStore()
+	r := NewRunner(store, 1, 4, time.Second)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, err := NewJob("roles", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = r.Submit(context.Background(), job, func(ctx context.Context) (any, error) {
+			time.Sleep(10 * time.Millisecond)
+			return "done", nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	r.Shutdown()
+
+	for _, id := range ids {
+		job, err := store.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != StatusSucceeded {
+			t.Errorf("job %s %s after shutdown, want succeeded", id, job.Status)
+		}
+	}
+
+	job, err := NewJob("roles", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Submit(context.Background(), job, func(ctx context.Context) (any, error) { return nil, nil })
+	if !errors.Is(err, ErrRunnerClosed) {
+		t.Errorf("submit after shutdown: %v, want ErrRunnerClosed", err)
+	}
+
+	// a second shutdown, as from a deferred call, returns at once
+	r.Shutdown()
+}
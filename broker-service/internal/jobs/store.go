@@ -0,0 +1,189 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var validID = regexp.MustCompile(`^[a-f0-9]{32}$`)
+
+// record is the on-disk form of a job; Owner is not exposed over the API
+// but must survive a restart
+type record struct {
+	*Job
+	Owner string `json:"owner,omitempty"`
+}
+
+// FileStore keeps one JSON file per job in a directory
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a store writing to dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+// Save writes the job atomically by renaming a temporary file over the old record
+func (s *FileStore) Save(ctx context.Context, job *Job) error {
+	b, err := json.Marshal(record{Job: job, Owner: job.Owner})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, job.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(job.ID))
+}
+
+// Get reads the job with the given id
+func (s *FileStore) Get(ctx context.Context, id string) (*Job, error) {
+	if !validID.MatchString(id) {
+		return nil, ErrJobNotFound
+	}
+
+	b, err := os.ReadFile(s.path(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrJobNotFound
+		}
+		return nil, err
+	}
+
+	rec := record{Job: &Job{}}
+	err = json.Unmarshal(b, &rec)
+	if err != nil {
+		return nil, err
+	}
+	rec.Job.Owner = rec.Owner
+
+	return rec.Job, nil
+}
+
+// List reads every job in the store
+func (s *FileStore) List(ctx context.Context) ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if !validID.MatchString(id) || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		job, err := s.Get(ctx, id)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// Delete removes the job record
+func (s *FileStore) Delete(ctx context.Context, id string) error {
+	if !validID.MatchString(id) {
+		return ErrJobNotFound
+	}
+
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrJobNotFound
+	}
+	return err
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// MemoryStore keeps jobs in process memory; records are lost on restart
+type MemoryStore struct {
+	mu   sync.RWMutex
+	jobs map[string]Job
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jobs: map[string]Job{}}
+}
+
+// Save stores a copy of the job
+func (s *MemoryStore) Save(ctx context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+// Get returns a copy of the job with the given id
+func (s *MemoryStore) Get(ctx context.Context, id string) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+// List returns copies of every job
+func (s *MemoryStore) List(ctx context.Context) ([]*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		job := job
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// Delete removes the job
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	delete(s.jobs, id)
+	return nil
+}
@@ -0,0 +1,6 @@
+// Package pb holds the client code generated from the authentication service's
+// protobuf definitions. Regenerate it with buf, protoc-gen-go and
+// protoc-gen-go-grpc on the PATH.
+package pb
+
+//go:generate sh -c "cd ../.. && buf generate"
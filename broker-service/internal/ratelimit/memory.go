@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps buckets in process memory. It is only suitable when the
+// broker runs as a single replica.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// NewMemoryStore returns a MemoryStore that forgets idle clients every cleanupInterval
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+
+	go s.cleanup(cleanupInterval)
+
+	return s
+}
+
+// Take removes a token from the client's bucket
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+
+	return b.take(now, limit), nil
+}
+
+// cleanup removes buckets that have not been used for a whole interval; by
+// then they would have refilled for all but the slowest limits anyway
+func (s *MemoryStore) cleanup(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		s.mu.Lock()
+		for key, b := range s.buckets {
+			if s.now().Sub(b.last) > interval {
+				delete(s.buckets, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
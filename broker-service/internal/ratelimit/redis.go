@@ -0,0 +1,245 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenBucketScript atomically refills and takes from a bucket stored as a hash.
+// ARGV: rate in tokens per millisecond, burst, current time in milliseconds.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate))
+return {allowed, math.floor(tokens), math.ceil((burst - tokens) / rate), retry}
+`
+
+// RedisStore keeps buckets in Redis, or any server speaking the Redis
+// protocol with Lua scripting, so all broker replicas share the same limits
+type RedisStore struct {
+	Addr     string
+	Password string
+	DB       int
+	Prefix   string
+	Timeout  time.Duration
+
+	sha   string
+	conns chan *redisConn
+}
+
+// NewRedisStore returns a store keeping at most poolSize idle connections
+func NewRedisStore(addr, password string, db, poolSize int) *RedisStore {
+	sum := sha1.Sum([]byte(tokenBucketScript))
+
+	return &RedisStore{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+		Prefix:   "ratelimit:",
+		Timeout:  time.Second,
+		sha:      hex.EncodeToString(sum[:]),
+		conns:    make(chan *redisConn, poolSize),
+	}
+}
+
+// Take removes a token from the client's bucket
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	conn, err := s.get(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	args := []string{
+		"1", s.Prefix + key,
+		strconv.FormatFloat(limit.Rate/1000, 'f', -1, 64),
+		strconv.Itoa(limit.Burst),
+		strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}
+
+	reply, err := conn.do(append([]string{"EVALSHA", s.sha}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = conn.do(append([]string{"EVAL", tokenBucketScript}, args...)...)
+	}
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			conn.Close()
+			return Result{}, err
+		}
+		s.put(conn)
+		return Result{}, err
+	}
+	s.put(conn)
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 4 {
+		return Result{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+
+	n := make([]int64, 4)
+	for i, v := range values {
+		n[i], ok = v.(int64)
+		if !ok {
+			return Result{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+		}
+	}
+
+	return Result{
+		Allowed:    n[0] == 1,
+		Limit:      limit.Burst,
+		Remaining:  int(n[1]),
+		Reset:      time.Duration(n[2]) * time.Millisecond,
+		RetryAfter: time.Duration(n[3]) * time.Millisecond,
+	}, nil
+}
+
+func (s *RedisStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.conns:
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.Timeout}
+	c, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &redisConn{Conn: c, r: bufio.NewReader(c)}
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	if s.Password != "" {
+		if _, err := conn.do("AUTH", s.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if s.DB != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(s.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (s *RedisStore) put(conn *redisConn) {
+	select {
+	case s.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// redisConn speaks RESP over a single connection
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) do(args ...string) (any, error) {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := io.WriteString(c.Conn, b.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return c.read()
+}
+
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		values := make([]any, n)
+		for i := range values {
+			values[i], err = c.read()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unexpected reply from redis: %q", line)
+}
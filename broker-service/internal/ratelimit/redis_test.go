@@ -0,0 +1,298 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in Redis server speaking enough RESP for the store:
+// AUTH, SELECT, EVAL and EVALSHA of the token bucket script, which it runs
+// in Go
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	scripts  map[string]bool
+	buckets  map[string][2]float64
+	commands []string
+	conns    int
+	fail     string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		scripts:  map[string]bool{},
+		buckets:  map[string][2]float64{},
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.ToUpper(args[0]))
+		fail := f.fail
+		f.mu.Unlock()
+
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[1] != f.password {
+				io.WriteString(c, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			io.WriteString(c, "+OK\r\n")
+
+		case "SELECT":
+			io.WriteString(c, "+OK\r\n")
+
+		case "EVAL", "EVALSHA":
+			if !authed {
+				io.WriteString(c, "-NOAUTH Authentication required.\r\n")
+				continue
+			}
+			if fail != "" {
+				io.WriteString(c, "-"+fail+"\r\n")
+				continue
+			}
+
+			sha := args[1]
+			if strings.ToUpper(args[0]) == "EVAL" {
+				sum := sha1.Sum([]byte(args[1]))
+				sha = hex.EncodeToString(sum[:])
+			}
+
+			f.mu.Lock()
+			known := f.scripts[sha]
+			if strings.ToUpper(args[0]) == "EVAL" {
+				f.scripts[sha] = true
+			}
+			f.mu.Unlock()
+
+			if strings.ToUpper(args[0]) == "EVALSHA" && !known {
+				io.WriteString(c, "-NOSCRIPT No matching script. Please use EVAL.\r\n")
+				continue
+			}
+
+			// args: script, numkeys, key, rate, burst, now
+			io.WriteString(c, f.takeToken(args[3], args[4], args[5], args[6]))
+
+		default:
+			fmt.Fprintf(c, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// takeToken runs tokenBucketScript
+func (f *fakeRedis) takeToken(key, rateArg, burstArg, nowArg string) string {
+	rate, _ := strconv.ParseFloat(rateArg, 64)
+	burst, _ := strconv.ParseFloat(burstArg, 64)
+	now, _ := strconv.ParseFloat(nowArg, 64)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state, ok := f.buckets[key]
+	tokens, ts := state[0], state[1]
+	if !ok {
+		tokens, ts = burst, now
+	}
+
+	tokens = math.Min(burst, tokens+math.Max(0, now-ts)*rate)
+	allowed, retry := 0, 0.0
+	if tokens >= 1 {
+		tokens--
+		allowed = 1
+	} else {
+		retry = math.Ceil((1 - tokens) / rate)
+	}
+	f.buckets[key] = [2]float64{tokens, now}
+
+	return fmt.Sprintf("*4\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n",
+		allowed, int64(math.Floor(tokens)), int64(math.Ceil((burst-tokens)/rate)), int64(retry))
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func (f *fakeRedis) count(command string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, c := range f.commands {
+		if c == command {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRedisStoreTakesUntilBurst(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	store := NewRedisStore(f.ln.Addr().String(), "secret", 2, 4)
+	limit := Limit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		res, err := store.Take(context.Background(), "ip:1", limit)
+		if err != nil {
+			t.Fatalf("take %d: %v", i, err)
+		}
+		if !res.Allowed {
+			t.Fatalf("take %d refused, want allowed", i)
+		}
+		if res.Remaining != 2-i {
+			t.Errorf("take %d: remaining %d, want %d", i, res.Remaining, 2-i)
+		}
+		if res.Limit != 3 {
+			t.Errorf("take %d: limit %d, want 3", i, res.Limit)
+		}
+	}
+
+	res, err := store.Take(context.Background(), "ip:1", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed {
+		t.Fatal("take past the burst allowed, want refused")
+	}
+	if res.RetryAfter <= 0 || res.RetryAfter > time.Second {
+		t.Errorf("retry after %s, want within a second at 1 token/s", res.RetryAfter)
+	}
+
+	// buckets are per key
+	res, err = store.Take(context.Background(), "ip:2", limit)
+	if err != nil || !res.Allowed {
+		t.Fatalf("take on another key: allowed %v, err %v", res.Allowed, err)
+	}
+}
+
+func TestRedisStoreLoadsScriptOnceAndReusesConnections(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := NewRedisStore(f.ln.Addr().String(), "", 0, 4)
+
+	for i := 0; i < 5; i++ {
+		_, err := store.Take(context.Background(), "user:1", Limit{Rate: 10, Burst: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := f.count("EVAL"); n != 1 {
+		t.Errorf("EVAL sent %d times, want once after NOSCRIPT", n)
+	}
+	if n := f.count("EVALSHA"); n != 5 {
+		t.Errorf("EVALSHA sent %d times, want 5", n)
+	}
+	if n := f.count("AUTH") + f.count("SELECT"); n != 0 {
+		t.Errorf("AUTH or SELECT sent %d times without password or database", n)
+	}
+
+	f.mu.Lock()
+	conns := f.conns
+	f.mu.Unlock()
+	if conns != 1 {
+		t.Errorf("opened %d connections, want the pooled one reused", conns)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+
+	_, err := NewRedisStore(f.ln.Addr().String(), "wrong", 0, 4).Take(context.Background(), "k", Limit{Rate: 1, Burst: 1})
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("wrong password: err %v, want WRONGPASS", err)
+	}
+
+	store := NewRedisStore(f.ln.Addr().String(), "secret", 0, 4)
+	f.mu.Lock()
+	f.fail = "BUSY Redis is busy running a script"
+	f.mu.Unlock()
+
+	_, err = store.Take(context.Background(), "k", Limit{Rate: 1, Burst: 1})
+	if err == nil || !strings.Contains(err.Error(), "BUSY") {
+		t.Errorf("error reply: err %v, want BUSY", err)
+	}
+
+	f.ln.Close()
+	store = NewRedisStore(f.ln.Addr().String(), "", 0, 4)
+	store.Timeout = 100 * time.Millisecond
+	_, err = store.Take(context.Background(), "k", Limit{Rate: 1, Burst: 1})
+	if err == nil {
+		t.Error("take without a server succeeded, want a dial error")
+	}
+}
@@ -0,0 +1,58 @@
+package registry
+
+import (
+	"sync/atomic"
+)
+
+// Balancer chooses one endpoint out of the available replicas
+type Balancer interface {
+	Next(endpoints []*Endpoint) *Endpoint
+}
+
+// NewBalancer returns the balancer for the given strategy name
+func NewBalancer(strategy string) Balancer {
+	switch strategy {
+	case LeastConnections:
+		return &leastConnections{}
+	default:
+		return &roundRobin{}
+	}
+}
+
+// roundRobin hands out endpoints in turn
+type roundRobin struct {
+	next uint64
+}
+
+func (b *roundRobin) Next(endpoints []*Endpoint) *Endpoint {
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return endpoints[n%uint64(len(endpoints))]
+}
+
+// leastConnections picks the endpoint with the fewest in-flight requests,
+// rotating the starting point so ties are spread across replicas
+type leastConnections struct {
+	next uint64
+}
+
+func (b *leastConnections) Next(endpoints []*Endpoint) *Endpoint {
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	start := int(atomic.AddUint64(&b.next, 1) % uint64(len(endpoints)))
+
+	var best *Endpoint
+	for i := range endpoints {
+		e := endpoints[(start+i)%len(endpoints)]
+		if best == nil || e.Active() < best.Active() {
+			best = e
+		}
+	}
+
+	return best
+}
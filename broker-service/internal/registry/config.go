@@ -0,0 +1,351 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Balancing strategies supported by a service
+const (
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// envPrefix is the prefix of environment variables describing upstream services
+const envPrefix = "UPSTREAM_"
+
+// Duration wraps time.Duration so it can be read from strings such as "5s"
+type Duration time.Duration
+
+// UnmarshalJSON reads a duration from a JSON string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", string(b))
+		}
+		*d = Duration(n)
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// TLSConfig holds the TLS settings used when calling a service over https
+type TLSConfig struct {
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// RetryConfig controls how idempotent calls to a service are retried
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts,omitempty"`
+	BaseDelay   Duration `json:"base_delay,omitempty"`
+	MaxDelay    Duration `json:"max_delay,omitempty"`
+}
+
+// BreakerConfig controls when the circuit breaker of a service trips
+type BreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+	OpenTimeout      Duration `json:"open_timeout,omitempty"`
+	HalfOpenRequests int      `json:"half_open_requests,omitempty"`
+}
+
+// ServiceConfig describes one upstream service and how to reach its replicas
+type ServiceConfig struct {
+	Name         string        `json:"name"`
+	URLs         []string      `json:"urls,omitempty"`
+	SRV          string        `json:"srv,omitempty"`
+	Scheme       string        `json:"scheme,omitempty"`
+	Timeout      Duration      `json:"timeout,omitempty"`
+	MaxIdleConns int           `json:"max_idle_conns,omitempty"`
+	Balancer     string        `json:"balancer,omitempty"`
+	TLS          TLSConfig     `json:"tls,omitempty"`
+	Retry        RetryConfig   `json:"retry,omitempty"`
+	Breaker      BreakerConfig `json:"breaker,omitempty"`
+}
+
+// Config holds all the upstream services known to the broker
+type Config struct {
+	RefreshInterval Duration        `json:"refresh_interval,omitempty"`
+	Services        []ServiceConfig `json:"services"`
+}
+
+// LoadFile reads the registry configuration from a JSON file
+func LoadFile(path string) (Config, error) {
+	var cfg Config
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("registry file %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// envSettings are the <SETTING> suffixes of UPSTREAM_* variables
+var envSettings = []string{
+	"URLS", "SRV", "SCHEME", "TIMEOUT", "MAX_IDLE_CONNS", "BALANCER",
+	"RETRY_MAX_ATTEMPTS", "BREAKER_FAILURE_THRESHOLD", "BREAKER_OPEN_TIMEOUT",
+	"TLS_CA_FILE", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_SERVER_NAME", "TLS_INSECURE_SKIP_VERIFY",
+}
+
+// FromEnv builds services from UPSTREAM_<NAME>_<SETTING> variables, for example
+// UPSTREAM_AUTHENTICATION_SERVICE_URLS=http://auth-1,http://auth-2
+func FromEnv(environ []string) (Config, error) {
+	services := map[string]*ServiceConfig{}
+
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(key, envPrefix) || value == "" {
+			continue
+		}
+
+		// the longest suffix wins, so _BREAKER_OPEN_TIMEOUT is not read as
+		// the _TIMEOUT of a service named ..._BREAKER_OPEN
+		setting := ""
+		for _, s := range envSettings {
+			if strings.HasSuffix(key, "_"+s) && len(s) > len(setting) {
+				setting = s
+			}
+		}
+		if setting == "" {
+			continue
+		}
+
+		name := strings.ToLower(strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(key, envPrefix), "_"+setting), "_", "-"))
+		svc, ok := services[name]
+		if !ok {
+			svc = &ServiceConfig{Name: name}
+			services[name] = svc
+		}
+
+		var err error
+		switch setting {
+		case "URLS":
+			svc.URLs = strings.Split(value, ",")
+		case "SRV":
+			svc.SRV = value
+		case "SCHEME":
+			svc.Scheme = value
+		case "TIMEOUT":
+			err = parseDuration(value, &svc.Timeout)
+		case "MAX_IDLE_CONNS":
+			svc.MaxIdleConns, err = strconv.Atoi(value)
+		case "BALANCER":
+			svc.Balancer = value
+		case "RETRY_MAX_ATTEMPTS":
+			svc.Retry.MaxAttempts, err = strconv.Atoi(value)
+		case "BREAKER_FAILURE_THRESHOLD":
+			svc.Breaker.FailureThreshold, err = strconv.Atoi(value)
+		case "BREAKER_OPEN_TIMEOUT":
+			err = parseDuration(value, &svc.Breaker.OpenTimeout)
+		case "TLS_CA_FILE":
+			svc.TLS.CAFile = value
+		case "TLS_CERT_FILE":
+			svc.TLS.CertFile = value
+		case "TLS_KEY_FILE":
+			svc.TLS.KeyFile = value
+		case "TLS_SERVER_NAME":
+			svc.TLS.ServerName = value
+		case "TLS_INSECURE_SKIP_VERIFY":
+			svc.TLS.InsecureSkipVerify, err = strconv.ParseBool(value)
+		}
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: invalid value %q", key, value)
+		}
+	}
+
+	var cfg Config
+	for _, svc := range services {
+		cfg.Services = append(cfg.Services, *svc)
+	}
+	sort.Slice(cfg.Services, func(i, j int) bool {
+		return cfg.Services[i].Name < cfg.Services[j].Name
+	})
+
+	return cfg, nil
+}
+
+func parseDuration(value string, d *Duration) error {
+	v, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Merge returns c with services from other added, or merged field by field
+// into those with the same name so that only the settings other sets change
+func (c Config) Merge(other Config) Config {
+	out := Config{RefreshInterval: c.RefreshInterval}
+	if other.RefreshInterval != 0 {
+		out.RefreshInterval = other.RefreshInterval
+	}
+
+	index := map[string]int{}
+	for _, svc := range c.Services {
+		index[svc.Name] = len(out.Services)
+		out.Services = append(out.Services, svc)
+	}
+
+	for _, svc := range other.Services {
+		if i, ok := index[svc.Name]; ok {
+			out.Services[i] = out.Services[i].merge(svc)
+			continue
+		}
+		index[svc.Name] = len(out.Services)
+		out.Services = append(out.Services, svc)
+	}
+
+	return out
+}
+
+// merge returns s with the non-zero settings of other applied on top
+func (s ServiceConfig) merge(other ServiceConfig) ServiceConfig {
+	// urls and srv are mutually exclusive, setting one replaces the other
+	if len(other.URLs) > 0 {
+		s.URLs, s.SRV = other.URLs, ""
+	}
+	if other.SRV != "" {
+		s.URLs, s.SRV = nil, other.SRV
+	}
+
+	if other.Scheme != "" {
+		s.Scheme = other.Scheme
+	}
+	if other.Timeout != 0 {
+		s.Timeout = other.Timeout
+	}
+	if other.MaxIdleConns != 0 {
+		s.MaxIdleConns = other.MaxIdleConns
+	}
+	if other.Balancer != "" {
+		s.Balancer = other.Balancer
+	}
+
+	if other.TLS.CAFile != "" {
+		s.TLS.CAFile = other.TLS.CAFile
+	}
+	if other.TLS.CertFile != "" {
+		s.TLS.CertFile = other.TLS.CertFile
+	}
+	if other.TLS.KeyFile != "" {
+		s.TLS.KeyFile = other.TLS.KeyFile
+	}
+	if other.TLS.ServerName != "" {
+		s.TLS.ServerName = other.TLS.ServerName
+	}
+	if other.TLS.InsecureSkipVerify {
+		s.TLS.InsecureSkipVerify = true
+	}
+
+	if other.Retry.MaxAttempts != 0 {
+		s.Retry.MaxAttempts = other.Retry.MaxAttempts
+	}
+	if other.Retry.BaseDelay != 0 {
+		s.Retry.BaseDelay = other.Retry.BaseDelay
+	}
+	if other.Retry.MaxDelay != 0 {
+		s.Retry.MaxDelay = other.Retry.MaxDelay
+	}
+
+	if other.Breaker.FailureThreshold != 0 {
+		s.Breaker.FailureThreshold = other.Breaker.FailureThreshold
+	}
+	if other.Breaker.OpenTimeout != 0 {
+		s.Breaker.OpenTimeout = other.Breaker.OpenTimeout
+	}
+	if other.Breaker.HalfOpenRequests != 0 {
+		s.Breaker.HalfOpenRequests = other.Breaker.HalfOpenRequests
+	}
+
+	return s
+}
+
+// validate checks the service configuration and fills in defaults
+func (s *ServiceConfig) validate() error {
+	if s.Name == "" {
+		return errors.New("service name must be provided")
+	}
+
+	if len(s.URLs) == 0 && s.SRV == "" {
+		return fmt.Errorf("service %s: either urls or srv must be provided", s.Name)
+	}
+
+	if len(s.URLs) > 0 && s.SRV != "" {
+		return fmt.Errorf("service %s: urls and srv are mutually exclusive", s.Name)
+	}
+
+	if s.Scheme == "" {
+		s.Scheme = "http"
+	}
+
+	if s.Timeout == 0 {
+		s.Timeout = Duration(10 * time.Second)
+	}
+
+	if s.MaxIdleConns == 0 {
+		s.MaxIdleConns = 16
+	}
+
+	if s.Retry.MaxAttempts == 0 {
+		s.Retry.MaxAttempts = 3
+	}
+
+	if s.Retry.BaseDelay == 0 {
+		s.Retry.BaseDelay = Duration(50 * time.Millisecond)
+	}
+
+	if s.Retry.MaxDelay == 0 {
+		s.Retry.MaxDelay = Duration(time.Second)
+	}
+
+	if s.Breaker.FailureThreshold == 0 {
+		s.Breaker.FailureThreshold = 5
+	}
+
+	if s.Breaker.OpenTimeout == 0 {
+		s.Breaker.OpenTimeout = Duration(30 * time.Second)
+	}
+
+	if s.Breaker.HalfOpenRequests == 0 {
+		s.Breaker.HalfOpenRequests = 1
+	}
+
+	switch s.Balancer {
+	case "":
+		s.Balancer = RoundRobin
+	case RoundRobin, LeastConnections:
+	default:
+		return fmt.Errorf("service %s: unknown balancer %q", s.Name, s.Balancer)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFromEnvReadsEverySetting(t *testing.T) {
+	for _, test := range []struct {
+		env  string
+		want ServiceConfig
+	}{
+		{"URLS=http://auth-1,http://auth-2", ServiceConfig{URLs: []string{"http://auth-1", "http://auth-2"}}},
+		{"SRV=_http._tcp.auth", ServiceConfig{SRV: "_http._tcp.auth"}},
+		{"SCHEME=https", ServiceConfig{Scheme: "https"}},
+		{"TIMEOUT=3s", ServiceConfig{Timeout: Duration(3 * time.Second)}},
+		{"MAX_IDLE_CONNS=32", ServiceConfig{MaxIdleConns: 32}},
+		{"BALANCER=least-connections", ServiceConfig{Balancer: LeastConnections}},
+		{"RETRY_MAX_ATTEMPTS=5", ServiceConfig{Retry: RetryConfig{MaxAttempts: 5}}},
+		{"BREAKER_FAILURE_THRESHOLD=7", ServiceConfig{Breaker: BreakerConfig{FailureThreshold: 7}}},
+		{"BREAKER_OPEN_TIMEOUT=10s", ServiceConfig{Breaker: BreakerConfig{OpenTimeout: Duration(10 * time.Second)}}},
+		{"TLS_CA_FILE=/certs/ca.pem", ServiceConfig{TLS: TLSConfig{CAFile: "/certs/ca.pem"}}},
+		{"TLS_CERT_FILE=/certs/broker.pem", ServiceConfig{TLS: TLSConfig{CertFile: "/certs/broker.pem"}}},
+		{"TLS_KEY_FILE=/certs/broker-key.pem", ServiceConfig{TLS: TLSConfig{KeyFile: "/certs/broker-key.pem"}}},
+		{"TLS_SERVER_NAME=auth.internal", ServiceConfig{TLS: TLSConfig{ServerName: "auth.internal"}}},
+		{"TLS_INSECURE_SKIP_VERIFY=true", ServiceConfig{TLS: TLSConfig{InsecureSkipVerify: true}}},
+	} {
+		cfg, err := FromEnv([]string{"UPSTREAM_AUTHENTICATION_SERVICE_" + test.env})
+		if err != nil {
+			t.Errorf("%s: %v", test.env, err)
+			continue
+		}
+
+		test.want.Name = "authentication-service"
+		if len(cfg.Services) != 1 || !reflect.DeepEqual(cfg.Services[0], test.want) {
+			t.Errorf("%s: services %+v, want only %+v", test.env, cfg.Services, test.want)
+		}
+	}
+}
+
+func TestFromEnvRejectsInvalidValues(t *testing.T) {
+	for _, env := range []string{
+		"TIMEOUT=3",
+		"MAX_IDLE_CONNS=many",
+		"RETRY_MAX_ATTEMPTS=three",
+		"BREAKER_FAILURE_THRESHOLD=5.5",
+		"BREAKER_OPEN_TIMEOUT=soon",
+		"TLS_INSECURE_SKIP_VERIFY=yes",
+	} {
+		_, err := FromEnv([]string{"UPSTREAM_AUTHENTICATION_SERVICE_" + env})
+		if err == nil {
+			t.Errorf("%s: accepted, want an error", env)
+		}
+	}
+}
+
+func TestMergeOverridesOnlySetFields(t *testing.T) {
+	defaults := Config{Services: []ServiceConfig{
+		{Name: "authentication-service", URLs: []string{"http://authentication-service"}},
+		{Name: "logger-service", URLs: []string{"http://logger-service"}},
+	}}
+
+	env, err := FromEnv([]string{
+		"UPSTREAM_AUTHENTICATION_SERVICE_TIMEOUT=3s",
+		"UPSTREAM_AUTHENTICATION_SERVICE_TLS_CA_FILE=/certs/ca.pem",
+		"UPSTREAM_LOGGER_SERVICE_SRV=_http._tcp.logger",
+		"UPSTREAM_MAIL_SERVICE_URLS=http://mail-1,http://mail-2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := defaults.Merge(env).Services
+	want := []ServiceConfig{
+		{
+			Name:    "authentication-service",
+			URLs:    []string{"http://authentication-service"},
+			Timeout: Duration(3 * time.Second),
+			TLS:     TLSConfig{CAFile: "/certs/ca.pem"},
+		},
+		{Name: "logger-service", SRV: "_http._tcp.logger"},
+		{Name: "mail-service", URLs: []string{"http://mail-1", "http://mail-2"}},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged services\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestMergeKeepsEarlierSettings(t *testing.T) {
+	file := Config{RefreshInterval: Duration(time.Minute), Services: []ServiceConfig{{
+		Name:     "authentication-service",
+		URLs:     []string{"https://auth-1", "https://auth-2"},
+		Balancer: LeastConnections,
+		Retry:    RetryConfig{MaxAttempts: 5},
+		Breaker:  BreakerConfig{FailureThreshold: 10, OpenTimeout: Duration(time.Minute)},
+	}}}
+
+	got := file.Merge(Config{Services: []ServiceConfig{{
+		Name:    "authentication-service",
+		Breaker: BreakerConfig{FailureThreshold: 3},
+	}}})
+
+	if got.RefreshInterval != file.RefreshInterval {
+		t.Errorf("refresh interval %s, want the earlier %s", time.Duration(got.RefreshInterval), time.Duration(file.RefreshInterval))
+	}
+
+	svc := got.Services[0]
+	if len(svc.URLs) != 2 || svc.Balancer != LeastConnections || svc.Retry.MaxAttempts != 5 {
+		t.Errorf("earlier settings lost: %+v", svc)
+	}
+	if svc.Breaker.FailureThreshold != 3 || svc.Breaker.OpenTimeout != Duration(time.Minute) {
+		t.Errorf("breaker %+v, want the threshold overridden and the open timeout kept", svc.Breaker)
+	}
+}
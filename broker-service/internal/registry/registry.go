@@ -0,0 +1,289 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rabin-nyaundi/shared/certs"
+)
+
+// ErrUnknownService is returned when a service is not in the registry
+// ErrNoEndpoints is returned when a service currently has no replicas
+var (
+	ErrUnknownService = errors.New("unknown upstream service")
+	ErrNoEndpoints    = errors.New("no endpoints available for upstream service")
+)
+
+// Endpoint is one replica of a service
+type Endpoint struct {
+	BaseURL *url.URL
+	active  int64
+}
+
+// URL joins the endpoint base URL with the given path
+func (e *Endpoint) URL(path string) string {
+	return e.BaseURL.String() + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Active returns the number of in-flight requests to the endpoint
+func (e *Endpoint) Active() int64 {
+	return atomic.LoadInt64(&e.active)
+}
+
+// Release marks a request picked from the endpoint as finished
+func (e *Endpoint) Release() {
+	atomic.AddInt64(&e.active, -1)
+}
+
+// Service holds the resolved replicas of one upstream service
+type Service struct {
+	Config   ServiceConfig
+	Client   *http.Client
+	TLS      *tls.Config
+	certs    *certs.Store
+	resolver Resolver
+	balancer Balancer
+
+	mu        sync.RWMutex
+	endpoints []*Endpoint
+}
+
+// Pick chooses a replica for the next request. Callers must call Release on
+// the returned endpoint once the request is complete.
+func (s *Service) Pick() (*Endpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e := s.balancer.Next(s.endpoints)
+	if e == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoEndpoints, s.Config.Name)
+	}
+
+	atomic.AddInt64(&e.active, 1)
+	return e, nil
+}
+
+// Endpoints returns a snapshot of the currently known replicas
+func (s *Service) Endpoints() []*Endpoint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]*Endpoint(nil), s.endpoints...)
+}
+
+// refresh resolves the service again, keeping the in-flight counters of
+// replicas that are still present
+func (s *Service) refresh(ctx context.Context) error {
+	urls, err := s.resolver.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing := map[string]*Endpoint{}
+	for _, e := range s.endpoints {
+		existing[e.BaseURL.String()] = e
+	}
+
+	endpoints := make([]*Endpoint, 0, len(urls))
+	for _, u := range urls {
+		if e, ok := existing[u.String()]; ok {
+			endpoints = append(endpoints, e)
+			continue
+		}
+		endpoints = append(endpoints, &Endpoint{BaseURL: u})
+	}
+
+	s.endpoints = endpoints
+	return nil
+}
+
+// Registry maps service names to their replicas
+type Registry struct {
+	refreshInterval time.Duration
+
+	mu       sync.RWMutex
+	services map[string]*Service
+}
+
+// New builds a registry from the config and resolves every service once
+func New(cfg Config) (*Registry, error) {
+	services, err := buildServices(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Registry{
+		refreshInterval: time.Duration(cfg.RefreshInterval),
+		services:        services,
+	}
+
+	if r.refreshInterval == 0 {
+		r.refreshInterval = 30 * time.Second
+	}
+
+	return r, nil
+}
+
+// Update replaces the services with those of the config, resolving them
+// first. On error the registry is left as it was. Requests already sent
+// finish on the replicas they picked; the refresh interval is kept.
+func (r *Registry) Update(cfg Config) error {
+	services, err := buildServices(cfg)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.services
+	r.services = services
+	r.mu.Unlock()
+
+	for _, svc := range old {
+		svc.Client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// buildServices validates and resolves the services of the config
+func buildServices(cfg Config) (map[string]*Service, error) {
+	services := map[string]*Service{}
+
+	for _, sc := range cfg.Services {
+		err := sc.validate()
+		if err != nil {
+			return nil, err
+		}
+
+		svc, err := newService(sc)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = svc.refresh(ctx)
+		cancel()
+		if err != nil {
+			// DNS may not be ready yet, the refresh loop will retry
+			log.Printf("registry: resolving %s: %v", sc.Name, err)
+		}
+
+		services[sc.Name] = svc
+	}
+
+	return services, nil
+}
+
+func newService(cfg ServiceConfig) (*Service, error) {
+	svc := &Service{
+		Config:   cfg,
+		balancer: NewBalancer(cfg.Balancer),
+	}
+
+	if cfg.SRV != "" {
+		svc.resolver = &SRVResolver{Name: cfg.SRV, Scheme: cfg.Scheme}
+	} else {
+		resolver, err := NewStaticResolver(cfg.URLs)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", cfg.Name, err)
+		}
+		svc.resolver = resolver
+	}
+
+	store, err := certs.Load(certs.Files{
+		CertFile: cfg.TLS.CertFile,
+		KeyFile:  cfg.TLS.KeyFile,
+		CAFile:   cfg.TLS.CAFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", cfg.Name, err)
+	}
+	svc.certs = store
+	svc.TLS = store.ClientConfig(cfg.TLS.ServerName, cfg.TLS.InsecureSkipVerify)
+
+	svc.Client = &http.Client{
+		Timeout: time.Duration(cfg.Timeout),
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     svc.TLS,
+			MaxIdleConnsPerHost: cfg.MaxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	return svc, nil
+}
+
+// Service returns the named service
+func (r *Registry) Service(name string) (*Service, error) {
+	r.mu.RLock()
+	svc, ok := r.services[name]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownService, name)
+	}
+
+	return svc, nil
+}
+
+// Services returns all registered services
+func (r *Registry) Services() []*Service {
+	r.mu.RLock()
+	services := make([]*Service, 0, len(r.services))
+	for _, svc := range r.services {
+		services = append(services, svc)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Config.Name < services[j].Config.Name
+	})
+
+	return services
+}
+
+// Run re-resolves DNS based services and reloads the TLS files of services,
+// so rotated client certificates and CAs are used from the next
+// connection, until the context is cancelled
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, svc := range r.Services() {
+				if len(svc.certs.Files()) > 0 {
+					err := svc.certs.Reload()
+					if err != nil {
+						log.Printf("registry: reloading TLS files of %s: %v", svc.Config.Name, err)
+					}
+				}
+
+				if svc.Config.SRV == "" {
+					continue
+				}
+
+				err := svc.refresh(ctx)
+				if err != nil {
+					log.Printf("registry: resolving %s: %v", svc.Config.Name, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Resolver returns the base URLs of the replicas of a service
+type Resolver interface {
+	Resolve(ctx context.Context) ([]*url.URL, error)
+}
+
+// StaticResolver always returns the same list of URLs
+type StaticResolver struct {
+	URLs []*url.URL
+}
+
+// NewStaticResolver parses raw base URLs into a StaticResolver
+func NewStaticResolver(rawURLs []string) (*StaticResolver, error) {
+	r := &StaticResolver{}
+
+	for _, raw := range rawURLs {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid url %q: %w", raw, err)
+		}
+
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid url %q: scheme and host are required", raw)
+		}
+
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		r.URLs = append(r.URLs, u)
+	}
+
+	return r, nil
+}
+
+// Resolve returns the configured URLs
+func (r *StaticResolver) Resolve(ctx context.Context) ([]*url.URL, error) {
+	return r.URLs, nil
+}
+
+// SRVResolver looks up replicas using DNS SRV records such as
+// _http._tcp.authentication-service.service.consul
+type SRVResolver struct {
+	Name     string
+	Scheme   string
+	Resolver *net.Resolver
+}
+
+// Resolve looks up the SRV record and returns one URL per target, ordered by
+// priority and weight as returned by the resolver
+func (r *SRVResolver) Resolve(ctx context.Context) ([]*url.URL, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", r.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []*url.URL
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		urls = append(urls, &url.URL{
+			Scheme: r.Scheme,
+			Host:   net.JoinHostPort(host, fmt.Sprint(record.Port)),
+		})
+	}
+
+	return urls, nil
+}
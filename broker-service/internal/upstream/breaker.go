@@ -0,0 +1,187 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned without calling the upstream while its circuit is open
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// CircuitOpenError reports which upstream rejected the call and when to retry
+type CircuitOpenError struct {
+	Service    string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return ErrCircuitOpen.Error() + ": " + e.Service
+}
+
+// Is makes errors.Is(err, ErrCircuitOpen) match
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// Breaker is a closed/open/half-open circuit breaker for one upstream
+type Breaker struct {
+	failureThreshold int
+	openTimeout      time.Duration
+	halfOpenRequests int
+
+	mu    sync.Mutex
+	state string
+	// generation changes with the state, so results of requests allowed in
+	// an earlier state do not count against the current one
+	generation uint64
+	failures   int
+	inFlight   int
+	openedAt   time.Time
+	now        func() time.Time
+}
+
+// BreakerSnapshot is the state of a breaker at a point in time
+type BreakerSnapshot struct {
+	State    string    `json:"state"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+	RetryAt  time.Time `json:"retry_at,omitempty"`
+}
+
+// NewBreaker returns a closed breaker that opens after failureThreshold
+// consecutive failures and lets halfOpenRequests probes through after openTimeout
+func NewBreaker(failureThreshold int, openTimeout time.Duration, halfOpenRequests int) *Breaker {
+	return &Breaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		halfOpenRequests: halfOpenRequests,
+		state:            StateClosed,
+		now:              time.Now,
+	}
+}
+
+// Allow reports whether a request may be sent to the upstream and returns
+// the generation it was allowed in. Every allowed request must be followed by
+// a call to Success, Failure or Cancel with that generation.
+func (b *Breaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return 0, ErrCircuitOpen
+		}
+		b.setState(StateHalfOpen)
+		fallthrough
+
+	case StateHalfOpen:
+		if b.inFlight >= b.halfOpenRequests {
+			return 0, ErrCircuitOpen
+		}
+	}
+
+	b.inFlight++
+	return b.generation, nil
+}
+
+// Success records a successful call and closes the circuit
+func (b *Breaker) Success(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.inFlight--
+	b.failures = 0
+	if b.state != StateClosed {
+		b.setState(StateClosed)
+	}
+}
+
+// Cancel releases an allowed request that was never sent or whose caller
+// gave up on it
+func (b *Breaker) Cancel(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.inFlight--
+}
+
+// Failure records a failed call, opening the circuit once the threshold is
+// reached or immediately when a half-open probe fails
+func (b *Breaker) Failure(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	b.inFlight--
+	b.failures++
+
+	if b.state == StateHalfOpen || b.failures >= b.failureThreshold {
+		b.setState(StateOpen)
+	}
+}
+
+// setState moves the breaker to state in a new generation. It must be
+// called with the mutex held.
+func (b *Breaker) setState(state string) {
+	b.state = state
+	b.generation++
+	b.inFlight = 0
+
+	if state == StateOpen {
+		b.openedAt = b.now()
+	}
+}
+
+// RetryAfter returns how long until an open circuit lets a probe through
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != StateOpen {
+		return 0
+	}
+
+	d := b.openTimeout - b.now().Sub(b.openedAt)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Snapshot returns the current state of the breaker
+func (b *Breaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerSnapshot{
+		State:    b.state,
+		Failures: b.failures,
+	}
+
+	if b.state != StateClosed {
+		s.OpenedAt = b.openedAt
+		s.RetryAt = b.openedAt.Add(b.openTimeout)
+	}
+
+	return s
+}
@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestBreaker returns a breaker with a clock the test moves
+func newTestBreaker(failureThreshold, halfOpenRequests int) (*Breaker, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBreaker(failureThreshold, time.Minute, halfOpenRequests)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func allow(t *testing.T, b *Breaker) uint64 {
+	t.Helper()
+
+	generation, err := b.Allow()
+	if err != nil {
+		t.Fatalf("allow in state %s: %v", b.Snapshot().State, err)
+	}
+	return generation
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, now := newTestBreaker(2, 1)
+
+	b.Failure(allow(t, b))
+	if s := b.Snapshot().State; s != StateClosed {
+		t.Fatalf("state %s after one failure, want closed", s)
+	}
+
+	b.Failure(allow(t, b))
+	if s := b.Snapshot().State; s != StateOpen {
+		t.Fatalf("state %s after two failures, want open", s)
+	}
+
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow while open: %v, want ErrCircuitOpen", err)
+	}
+	if d := b.RetryAfter(); d != time.Minute {
+		t.Errorf("retry after %s, want 1m", d)
+	}
+
+	*now = now.Add(time.Minute)
+	probe := allow(t, b)
+	if s := b.Snapshot().State; s != StateHalfOpen {
+		t.Fatalf("state %s after the open timeout, want half-open", s)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second probe: %v, want ErrCircuitOpen past half-open-requests", err)
+	}
+
+	b.Success(probe)
+	if s := b.Snapshot(); s.State != StateClosed || s.Failures != 0 {
+		t.Fatalf("after a successful probe: %+v, want closed without failures", s)
+	}
+}
+
+func TestBreakerReopensWhenProbeFails(t *testing.T) {
+	b, now := newTestBreaker(1, 1)
+
+	b.Failure(allow(t, b))
+	*now = now.Add(time.Minute)
+
+	b.Failure(allow(t, b))
+	if s := b.Snapshot(); s.State != StateOpen || !s.OpenedAt.Equal(*now) {
+		t.Fatalf("after a failed probe: %+v, want open since now", s)
+	}
+}
+
+func TestBreakerIgnoresResultsOfEarlierState(t *testing.T) {
+	b, now := newTestBreaker(1, 1)
+
+	// a slow request allowed while closed is still running when another
+	// failure opens the circuit and the open timeout passes
+	slow := allow(t, b)
+	b.Failure(allow(t, b))
+	*now = now.Add(time.Minute)
+
+	probe := allow(t, b)
+
+	// the slow request finishing must neither free the probe's slot nor
+	// close or reopen the circuit
+	b.Success(slow)
+	if s := b.Snapshot().State; s != StateHalfOpen {
+		t.Fatalf("state %s after a closed-state success, want half-open", s)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow with the probe in flight: %v, want ErrCircuitOpen", err)
+	}
+
+	b.Failure(slow)
+	b.Cancel(slow)
+	if s := b.Snapshot().State; s != StateHalfOpen {
+		t.Fatalf("state %s after a closed-state failure, want half-open", s)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow with the probe in flight: %v, want ErrCircuitOpen", err)
+	}
+
+	b.Success(probe)
+	if s := b.Snapshot().State; s != StateClosed {
+		t.Fatalf("state %s after the probe succeeded, want closed", s)
+	}
+}
+
+func TestBreakerCancelFreesProbe(t *testing.T) {
+	b, now := newTestBreaker(1, 1)
+
+	b.Failure(allow(t, b))
+	*now = now.Add(time.Minute)
+
+	b.Cancel(allow(t, b))
+	b.Success(allow(t, b))
+	if s := b.Snapshot().State; s != StateClosed {
+		t.Fatalf("state %s, want closed after the second probe succeeded", s)
+	}
+}
@@ -0,0 +1,275 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/registry"
+)
+
+// Request describes a call to an upstream service
+type Request struct {
+	Method string
+	Path   string
+	Body   []byte
+	Header http.Header
+
+	// Idempotent marks a request that is safe to retry even though its
+	// method is not idempotent, such as a token introspection sent as POST.
+	// Credential checks are not: each attempt is another password guess,
+	// beyond the rate limit of the action that sent it.
+	Idempotent bool
+}
+
+// idempotent reports whether the request may be retried
+func (r *Request) idempotent() bool {
+	if r.Idempotent {
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Client sends requests to the replicas of one upstream service. The
+// service is looked up for every request, so registry updates apply to the
+// next one while the breaker keeps its state.
+type Client struct {
+	name     string
+	registry *registry.Registry
+	breaker  *Breaker
+	header   http.Header
+}
+
+// Do sends the request, retrying idempotent requests on transport errors and
+// 502/503/504 responses with jittered exponential backoff. The caller must
+// close the response body.
+func (c *Client) Do(ctx context.Context, req *Request) (*http.Response, error) {
+	svc, err := c.registry.Service(c.name)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := svc.Config.Retry
+
+	attempts := 1
+	if req.idempotent() {
+		attempts = retry.MaxAttempts
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			err := sleep(ctx, backoff(attempt, time.Duration(retry.BaseDelay), time.Duration(retry.MaxDelay)))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := c.attempt(ctx, svc, req)
+		if err == nil && !retryableStatus(response.StatusCode) {
+			return response, nil
+		}
+
+		if errors.Is(err, ErrCircuitOpen) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		if err == nil {
+			// hand the last 5xx back to the caller instead of an error
+			if attempt == attempts-1 {
+				return response, nil
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			lastErr = fmt.Errorf("%s responded with status %d", c.name, response.StatusCode)
+			continue
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// attempt sends the request once to a single replica
+func (c *Client) attempt(ctx context.Context, svc *registry.Service, req *Request) (*http.Response, error) {
+	generation, err := c.breaker.Allow()
+	if err != nil {
+		return nil, &CircuitOpenError{Service: c.name, RetryAfter: c.breaker.RetryAfter()}
+	}
+
+	endpoint, err := svc.Pick()
+	if err != nil {
+		c.breaker.Failure(generation)
+		return nil, err
+	}
+	defer endpoint.Release()
+
+	request, err := http.NewRequestWithContext(ctx, req.Method, endpoint.URL(req.Path), bytes.NewReader(req.Body))
+	if err != nil {
+		c.breaker.Cancel(generation)
+		return nil, err
+	}
+
+	for key, values := range c.header {
+		request.Header[key] = values
+	}
+	for key, values := range req.Header {
+		request.Header[key] = values
+	}
+
+	if len(req.Body) > 0 && request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := svc.Client.Do(request)
+	if err != nil {
+		// a caller giving up says nothing about the upstream's health
+		if ctx.Err() != nil {
+			c.breaker.Cancel(generation)
+		} else {
+			c.breaker.Failure(generation)
+		}
+		return nil, err
+	}
+
+	if response.StatusCode >= http.StatusInternalServerError {
+		c.breaker.Failure(generation)
+	} else {
+		c.breaker.Success(generation)
+	}
+
+	return response, nil
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// backoff returns the full-jitter exponential delay before the given attempt
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << uint(attempt-1)
+	if d <= 0 || d > max {
+		d = max
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Pool holds one client per registered upstream
+type Pool struct {
+	registry *registry.Registry
+
+	mu      sync.Mutex
+	clients map[string]*Client
+	headers map[string]http.Header
+}
+
+// NewPool returns a pool creating clients for services in the registry
+func NewPool(reg *registry.Registry) *Pool {
+	return &Pool{
+		registry: reg,
+		clients:  map[string]*Client{},
+		headers:  map[string]http.Header{},
+	}
+}
+
+// SetHeader sets the headers sent with every request to the named upstream,
+// such as a service credential, under the headers of the request itself. It
+// must be called before the upstream's client is used.
+func (p *Pool) SetHeader(name string, header http.Header) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.headers[name] = header
+	if c, ok := p.clients[name]; ok {
+		c.header = header
+	}
+}
+
+// Client returns the shared client of the named upstream
+func (p *Pool) Client(name string) (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if c, ok := p.clients[name]; ok {
+		return c, nil
+	}
+
+	svc, err := p.registry.Service(name)
+	if err != nil {
+		return nil, err
+	}
+
+	breaker := svc.Config.Breaker
+	c := &Client{
+		name:     name,
+		registry: p.registry,
+		breaker:  NewBreaker(breaker.FailureThreshold, time.Duration(breaker.OpenTimeout), breaker.HalfOpenRequests),
+		header:   p.headers[name],
+	}
+	p.clients[name] = c
+
+	return c, nil
+}
+
+// EndpointStatus describes one replica of an upstream
+type EndpointStatus struct {
+	URL    string `json:"url"`
+	Active int64  `json:"active"`
+}
+
+// Status describes an upstream and the state of its circuit breaker
+type Status struct {
+	Name      string           `json:"name"`
+	Breaker   BreakerSnapshot  `json:"breaker"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+// Status returns the state of every upstream in the registry
+func (p *Pool) Status() []Status {
+	var statuses []Status
+
+	for _, svc := range p.registry.Services() {
+		c, err := p.Client(svc.Config.Name)
+		if err != nil {
+			continue
+		}
+
+		status := Status{
+			Name:    svc.Config.Name,
+			Breaker: c.breaker.Snapshot(),
+		}
+
+		for _, e := range svc.Endpoints() {
+			status.Endpoints = append(status.Endpoints, EndpointStatus{URL: e.BaseURL.String(), Active: e.Active()})
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/broker/internal/registry"
+)
+
+// newTestClient returns the client of an upstream served by handler
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	reg, err := registry.New(registry.Config{Services: []registry.ServiceConfig{{
+		Name:    "test-service",
+		URLs:    []string{server.URL},
+		Retry:   registry.RetryConfig{MaxAttempts: 3, BaseDelay: registry.Duration(time.Millisecond), MaxDelay: registry.Duration(time.Millisecond)},
+		Breaker: registry.BreakerConfig{FailureThreshold: 1},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewPool(reg).Client("test-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientRetriesOnlyIdempotentRequests(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		req      *Request
+		attempts int32
+	}{
+		{"GET", &Request{Method: http.MethodGet, Path: "/"}, 3},
+		{"POST marked idempotent", &Request{Method: http.MethodPost, Path: "/", Idempotent: true}, 3},
+		{"POST", &Request{Method: http.MethodPost, Path: "/"}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})
+			// a single failure would open the circuit and stop the retries
+			c.breaker.failureThreshold = 10
+
+			response, err := c.Do(context.Background(), test.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if n := atomic.LoadInt32(&calls); n != test.attempts {
+				t.Errorf("sent %d times, want %d", n, test.attempts)
+			}
+		})
+	}
+}
+
+func TestClientCancelledCallDoesNotOpenCircuit(t *testing.T) {
+	release := make(chan struct{})
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Do(ctx, &Request{Method: http.MethodGet, Path: "/"})
+	if err == nil {
+		t.Fatal("call outliving its context succeeded")
+	}
+
+	if s := c.breaker.Snapshot(); s.State != StateClosed || s.Failures != 0 {
+		t.Errorf("breaker %+v after the caller gave up, want closed without failures", s)
+	}
+}
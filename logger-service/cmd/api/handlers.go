@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rabin-nyaundi/logger-service/internal/data"
+)
+
+// createLogHandler stores one application event log
+func (app *application) createLogHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Service   string                 `json:"service"`
+		Level     string                 `json:"level"`
+		Message   string                 `json:"message"`
+		Data      map[string]interface{} `json:"data"`
+		Timestamp *time.Time             `json:"timestamp"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if input.Level == "" {
+		input.Level = "info"
+	}
+
+	switch {
+	case input.Service == "":
+		app.JSONEror(w, errors.New("service must be provided"), http.StatusUnprocessableEntity)
+		return
+	case input.Message == "":
+		app.JSONEror(w, errors.New("message must be provided"), http.StatusUnprocessableEntity)
+		return
+	case !data.ValidLevel(input.Level):
+		app.JSONEror(w, fmt.Errorf("level must be one of %v", data.Levels), http.StatusUnprocessableEntity)
+		return
+	}
+
+	entry := &data.LogEntry{
+		Service: input.Service,
+		Level:   input.Level,
+		Message: input.Message,
+		Data:    input.Data,
+	}
+
+	if input.Timestamp != nil {
+		entry.CreatedAt = input.Timestamp.UTC()
+	}
+
+	err = app.logs.Insert(r.Context(), entry)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, JSONResponse{
+		Success: true,
+		Message: "log entry created",
+		Data:    entry,
+	})
+}
+
+// listLogsHandler returns log entries newest first, filtered by the from, to,
+// service and level query parameters and paginated with cursor and limit
+func (app *application) listLogsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	filter := data.Filter{
+		Service: qs.Get("service"),
+		Level:   qs.Get("level"),
+		Cursor:  qs.Get("cursor"),
+		Limit:   50,
+	}
+
+	var err error
+
+	if v := qs.Get("from"); v != "" {
+		filter.From, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			app.JSONEror(w, errors.New("from must be an RFC 3339 timestamp"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := qs.Get("to"); v != "" {
+		filter.To, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			app.JSONEror(w, errors.New("to must be an RFC 3339 timestamp"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if filter.Level != "" && !data.ValidLevel(filter.Level) {
+		app.JSONEror(w, fmt.Errorf("level must be one of %v", data.Levels), http.StatusBadRequest)
+		return
+	}
+
+	if v := qs.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 1 || filter.Limit > 500 {
+			app.JSONEror(w, errors.New("limit must be between 1 and 500"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, next, err := app.logs.List(r.Context(), filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			app.JSONEror(w, err, http.StatusBadRequest)
+		default:
+			app.JSONEror(w, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if entries == nil {
+		entries = []*data.LogEntry{}
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "success",
+		Data: map[string]interface{}{
+			"logs":        entries,
+			"next_cursor": next,
+		},
+	})
+}
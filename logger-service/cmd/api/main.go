@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rabin-nyaundi/logger-service/internal/data"
+	"github.com/rabin-nyaundi/shared/cors"
+
+	_ "github.com/lib/pq"
+)
+
+type JSONResponse struct {
+	Error   bool        `json:"error,omitempty"`
+	Success bool        `json:"success,omitempty"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type Config struct {
+	port  int
+	store string
+	file  string
+	// serviceTokens are the credentials callers send in the X-Service-Token
+	// header
+	serviceTokens      []string
+	corsAllowedOrigins []string
+	migrateOnStart     bool
+	db                 struct {
+		dsn          string
+		maxOpenConns int
+		maxIdleConns int
+		maxIdleTime  string
+	}
+	retention data.RetentionPolicy
+}
+
+type application struct {
+	config Config
+	logs   data.Store
+	cors   *cors.Handler
+}
+
+func main() {
+	var cfg Config
+
+	cfg.retention.PerLevel = map[string]time.Duration{}
+
+	var serviceTokens, corsAllowedOrigins string
+
+	flag.IntVar(&cfg.port, "port", 80, "Logger server port")
+	flag.StringVar(&serviceTokens, "service-tokens", envOrFile("SERVICE_TOKENS"), "Comma separated tokens callers must send in the X-Service-Token header")
+	flag.StringVar(&corsAllowedOrigins, "cors-allowed-origins", os.Getenv("CORS_ALLOWED_ORIGINS"), "Comma separated origins allowed to make cross-origin requests (empty allows none)")
+	flag.StringVar(&cfg.store, "store", "file", "Storage backend (postgres|file)")
+	flag.StringVar(&cfg.file, "file", "./data/logs.jsonl", "Log file used by the file storage backend")
+	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DATABASE_DSN"), "Database connection string")
+	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL maximum open connections")
+	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL maximum idle connections")
+	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "10m", "PostgreSQL maximum idle time")
+	flag.BoolVar(&cfg.migrateOnStart, "migrate-on-start", os.Getenv("MIGRATE_ON_START") != "false", "Apply pending database migrations before serving with the postgres store")
+	flag.DurationVar(&cfg.retention.Default, "retention", 30*24*time.Hour, "How long log entries are kept (0 keeps them forever)")
+	flag.Func("retention-level", "Per level retention as level=duration, for example debug=24h (repeatable)", func(val string) error {
+		level, duration, ok := strings.Cut(val, "=")
+		if !ok || !data.ValidLevel(level) {
+			return fmt.Errorf("invalid level retention %q", val)
+		}
+
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+
+		cfg.retention.PerLevel[level] = d
+		return nil
+	})
+	flag.Parse()
+
+	cfg.serviceTokens = splitList(serviceTokens)
+	cfg.corsAllowedOrigins = splitList(corsAllowedOrigins)
+
+	if len(cfg.serviceTokens) == 0 {
+		log.Fatal("service-tokens must be provided, with -service-tokens, SERVICE_TOKENS or SERVICE_TOKENS_FILE")
+	}
+
+	corsHandler, err := cors.New(cors.Policy{
+		AllowedOrigins: cfg.corsAllowedOrigins,
+		AllowedMethods: []string{"POST", "GET"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Service-Token"},
+		MaxAge:         5 * time.Minute,
+	}, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	app := &application{
+		config: cfg,
+		logs:   store,
+		cors:   corsHandler,
+	}
+
+	go app.enforceRetention(time.Hour)
+
+	log.Printf("Starting logger server at port:%d", cfg.port)
+	svr := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.config.port),
+		Handler: app.routes(),
+	}
+
+	err = svr.ListenAndServe()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openStore opens the configured storage backend
+func openStore(cfg Config) (data.Store, error) {
+	switch cfg.store {
+	case "file":
+		return data.OpenFileStore(cfg.file)
+	case "postgres":
+		db, err := OpenDB(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.migrateOnStart {
+			err = migrateOnStart(db)
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		return data.PostgresStore{DB: db}, nil
+	}
+
+	return nil, fmt.Errorf("unknown store %q", cfg.store)
+}
+
+// enforceRetention applies the retention policy at startup and then every interval
+func (app *application) enforceRetention(interval time.Duration) {
+	for {
+		deleted, err := app.config.retention.Apply(context.Background(), app.logs, time.Now())
+		if err != nil {
+			log.Printf("applying retention policy: %v", err)
+		} else if deleted > 0 {
+			log.Printf("retention policy deleted %d log entries", deleted)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func OpenDB(cfg Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", cfg.db.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxIdleConns(cfg.db.maxIdleConns)
+	db.SetMaxOpenConns(cfg.db.maxOpenConns)
+
+	duration, err := time.ParseDuration(cfg.db.maxIdleTime)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetConnMaxIdleTime(duration)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// envOrFile returns the environment variable, or the contents of the file
+// named by the variable suffixed _FILE, as Docker secrets are mounted
+func envOrFile(key string) string {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return os.Getenv(key)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("%s_FILE: %v", key, err)
+	}
+	return strings.TrimRight(string(b), "\r\n")
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+var errServiceTokenRequired = errors.New("this resource requires a service token")
+
+// requireService only lets through requests bearing one of the
+// service-tokens in the X-Service-Token header
+func (app *application) requireService(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Service-Token")
+
+		found := 0
+		for _, t := range app.config.serviceTokens {
+			found |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+		}
+
+		if token == "" || found != 1 {
+			app.JSONEror(w, errServiceTokenRequired, http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
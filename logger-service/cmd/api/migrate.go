@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/rabin-nyaundi/logger-service/migrations"
+	"github.com/rabin-nyaundi/shared/migrate"
+)
+
+// migrateOnStart applies pending migrations of the logs table before the
+// server starts. Replicas starting together wait for the one holding the
+// migration lock and then find nothing left to apply.
+func migrateOnStart(db *sql.DB) error {
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	migrator.Logf = log.Printf
+
+	applied, err := migrator.Up(context.Background())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("database is at version %d, %d migrations applied", migrator.Latest(), applied)
+	return nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (app *application) routes() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.Use(app.cors.Wrap)
+	mux.Use(app.requireService)
+
+	mux.Post("/v1/logs", app.createLogHandler)
+	mux.Get("/v1/logs", app.listLogsHandler)
+	return mux
+}
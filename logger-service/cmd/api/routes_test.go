@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/logger-service/internal/data"
+	"github.com/rabin-nyaundi/logger-service/migrations"
+	"github.com/rabin-nyaundi/shared/cors"
+	"github.com/rabin-nyaundi/shared/migrate"
+)
+
+func newTestApp(t *testing.T) *application {
+	store, err := data.OpenFileStore(filepath.Join(t.TempDir(), "logs.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	corsHandler, err := cors.New(cors.Policy{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"POST", "GET"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Service-Token"},
+		MaxAge:         5 * time.Minute,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{
+		config: Config{serviceTokens: []string{"service-token"}},
+		logs:   store,
+		cors:   corsHandler,
+	}
+}
+
+func serve(handler http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("X-Service-Token", token)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestLogsRequireServiceToken(t *testing.T) {
+	handler := newTestApp(t).routes()
+	entry := `{"service":"broker","level":"info","message":"started"}`
+
+	for _, token := range []string{"", "guess", "service"} {
+		if w := serve(handler, http.MethodPost, "/v1/logs", token, entry); w.Code != http.StatusUnauthorized {
+			t.Errorf("POST with token %q: status %d, want 401", token, w.Code)
+		}
+		if w := serve(handler, http.MethodGet, "/v1/logs", token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("GET with token %q: status %d, want 401", token, w.Code)
+		}
+	}
+
+	if w := serve(handler, http.MethodPost, "/v1/logs", "service-token", entry); w.Code != http.StatusCreated {
+		t.Fatalf("POST with the service token: status %d, want 201: %s", w.Code, w.Body)
+	}
+
+	w := serve(handler, http.MethodGet, "/v1/logs", "service-token", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET with the service token: status %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var response struct {
+		Data struct {
+			Logs []*data.LogEntry `json:"logs"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logs := response.Data.Logs; len(logs) != 1 || logs[0].Message != "started" {
+		t.Errorf("listed %+v, want only the entry created with the service token", logs)
+	}
+}
+
+func TestCORSOnlyAllowsListedOrigins(t *testing.T) {
+	handler := newTestApp(t).routes()
+
+	for _, test := range []struct {
+		origin string
+		allow  string
+	}{
+		{"https://app.example.com", "https://app.example.com"},
+		{"https://evil.example.net", ""},
+	} {
+		r := httptest.NewRequest(http.MethodOptions, "/v1/logs", nil)
+		r.Header.Set("Origin", test.origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		r.Header.Set("Access-Control-Request-Headers", "x-service-token")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("origin %s: Access-Control-Allow-Origin %q, want %q", test.origin, got, test.allow)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("origin %s: Access-Control-Allow-Credentials %q, want none", test.origin, got)
+		}
+	}
+}
+
+func TestMigrationsAreEmbedded(t *testing.T) {
+	migrator, err := migrate.New(nil, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := migrator.Latest(); v != 1 {
+		t.Errorf("latest migration %d, want 1, the logs table", v)
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/rabin-nyaundi/logger-service
+
+go 1.19
+
+require (
+	github.com/go-chi/chi/v5 v5.0.7
+	github.com/lib/pq v1.10.7
+	github.com/rabin-nyaundi/shared v0.0.0
+)
+
+replace github.com/rabin-nyaundi/shared => ../shared
@@ -0,0 +1,232 @@
+package data
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileStore keeps log entries in a JSON lines file with an in-memory index.
+// It needs no database and suits single-replica deployments and development.
+type FileStore struct {
+	path string
+
+	mu      sync.RWMutex
+	file    *os.File
+	entries []*LogEntry
+	nextID  int64
+}
+
+// OpenFileStore loads the entries of the file at path, creating it if needed
+func OpenFileStore(path string) (*FileStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{path: path, nextID: 1}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	s.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var entry LogEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", s.path, line, err)
+		}
+
+		s.entries = append(s.entries, &entry)
+		if entry.ID >= s.nextID {
+			s.nextID = entry.ID + 1
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// entries are appended in insertion order; keep them sorted by time for listing
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return s.entries[i].CreatedAt.Before(s.entries[j].CreatedAt)
+	})
+
+	return nil
+}
+
+// Insert appends the entry to the file
+func (s *FileStore) Insert(ctx context.Context, entry *LogEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = s.nextID
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	s.nextID++
+
+	// keep the index sorted even when a client supplies an older timestamp
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].CreatedAt.After(entry.CreatedAt)
+	})
+	s.entries = append(s.entries, nil)
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = entry
+
+	return nil
+}
+
+// List returns a page of entries matching the filter, newest first
+func (s *FileStore) List(ctx context.Context, filter Filter) ([]*LogEntry, string, error) {
+	after, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var page []*LogEntry
+
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+
+		switch {
+		case after != nil && !after.before(e):
+			continue
+		case !filter.From.IsZero() && e.CreatedAt.Before(filter.From):
+			continue
+		case !filter.To.IsZero() && !e.CreatedAt.Before(filter.To):
+			continue
+		case filter.Service != "" && e.Service != filter.Service:
+			continue
+		case filter.Level != "" && e.Level != filter.Level:
+			continue
+		}
+
+		if len(page) == filter.Limit {
+			return page, encodeCursor(page[len(page)-1]), nil
+		}
+
+		page = append(page, e)
+	}
+
+	return page, "", nil
+}
+
+// DeleteBefore drops entries of the level created before the given time and
+// rewrites the file without them
+func (s *FileStore) DeleteBefore(ctx context.Context, level string, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.entries[:0:0]
+	for _, e := range s.entries {
+		if e.Level != level || !e.CreatedAt.Before(before) {
+			kept = append(kept, e)
+		}
+	}
+
+	deleted := int64(len(s.entries) - len(kept))
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	err := s.rewrite(kept)
+	if err != nil {
+		return 0, err
+	}
+
+	s.entries = kept
+	return deleted, nil
+}
+
+// rewrite replaces the file with the given entries; callers must hold s.mu
+func (s *FileStore) rewrite(entries []*LogEntry) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	return err
+}
+
+// Close closes the file
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
@@ -0,0 +1,136 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Levels are the accepted log levels
+var Levels = []string{"debug", "info", "warn", "error"}
+
+// ValidLevel reports whether level is one of Levels
+func ValidLevel(level string) bool {
+	for _, l := range Levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// LogEntry is one application event log
+type LogEntry struct {
+	ID        int64                  `json:"id"`
+	Service   string                 `json:"service"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// Filter selects log entries; zero values match everything
+type Filter struct {
+	From    time.Time
+	To      time.Time
+	Service string
+	Level   string
+	Cursor  string
+	Limit   int
+}
+
+// Store is implemented by every log storage backend. List returns entries
+// newest first together with the cursor of the next page, empty on the last page.
+type Store interface {
+	Insert(ctx context.Context, entry *LogEntry) error
+	List(ctx context.Context, filter Filter) ([]*LogEntry, string, error)
+	DeleteBefore(ctx context.Context, level string, before time.Time) (int64, error)
+	Close() error
+}
+
+// cursor is the position after the last entry of a page
+type cursor struct {
+	createdAt time.Time
+	id        int64
+}
+
+func encodeCursor(e *LogEntry) string {
+	raw := fmt.Sprintf("%d:%d", e.CreatedAt.UnixNano(), e.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	c := &cursor{createdAt: time.Unix(0, n).UTC()}
+	c.id, err = strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// before reports whether the entry sorts after the cursor in newest first order
+func (c *cursor) before(e *LogEntry) bool {
+	if e.CreatedAt.Equal(c.createdAt) {
+		return e.ID < c.id
+	}
+	return e.CreatedAt.Before(c.createdAt)
+}
+
+// RetentionPolicy says how long entries are kept, optionally per level
+type RetentionPolicy struct {
+	Default  time.Duration
+	PerLevel map[string]time.Duration
+}
+
+// Apply deletes every entry older than its level's retention period
+func (p RetentionPolicy) Apply(ctx context.Context, store Store, now time.Time) (int64, error) {
+	var total int64
+
+	for _, level := range Levels {
+		retention, ok := p.PerLevel[level]
+		if !ok {
+			retention = p.Default
+		}
+
+		if retention <= 0 {
+			continue
+		}
+
+		n, err := store.DeleteBefore(ctx, level, now.Add(-retention))
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	return total, nil
+}
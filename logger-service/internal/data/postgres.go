@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PostgresStore keeps log entries in the logs table
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+// Insert adds the entry and sets its id and creation time
+func (s PostgresStore) Insert(ctx context.Context, entry *LogEntry) error {
+	query := `
+		INSERT INTO logs (service, level, message, data, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+
+	data, err := json.Marshal(entry.Data)
+	if err != nil {
+		return err
+	}
+
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+
+	args := []interface{}{
+		entry.Service,
+		entry.Level,
+		entry.Message,
+		data,
+		entry.CreatedAt,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return s.DB.QueryRowContext(ctx, query, args...).Scan(&entry.ID)
+}
+
+// List returns a page of entries matching the filter, newest first
+func (s PostgresStore) List(ctx context.Context, filter Filter) ([]*LogEntry, string, error) {
+	after, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		where []string
+		args  []interface{}
+	)
+
+	add := func(clause string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	if !filter.From.IsZero() {
+		add("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		add("created_at < $%d", filter.To)
+	}
+	if filter.Service != "" {
+		add("service = $%d", filter.Service)
+	}
+	if filter.Level != "" {
+		add("level = $%d", filter.Level)
+	}
+	if after != nil {
+		args = append(args, after.createdAt, after.id)
+		where = append(where, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	query := `
+		SELECT id, service, level, message, data, created_at
+		FROM logs`
+
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+
+	// fetch one extra row to know whether there is a next page
+	args = append(args, filter.Limit+1)
+	query += fmt.Sprintf("\n\t\tORDER BY created_at DESC, id DESC\n\t\tLIMIT $%d", len(args))
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var entries []*LogEntry
+
+	for rows.Next() {
+		var (
+			entry LogEntry
+			data  []byte
+		)
+
+		err := rows.Scan(&entry.ID, &entry.Service, &entry.Level, &entry.Message, &data, &entry.CreatedAt)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(data) > 0 {
+			err = json.Unmarshal(data, &entry.Data)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+		next = encodeCursor(entries[len(entries)-1])
+	}
+
+	return entries, next, nil
+}
+
+// DeleteBefore removes entries of the level created before the given time
+func (s PostgresStore) DeleteBefore(ctx context.Context, level string, before time.Time) (int64, error) {
+	query := `
+		DELETE FROM logs
+		WHERE level = $1 AND created_at < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, level, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Close closes the connection pool
+func (s PostgresStore) Close() error {
+	return s.DB.Close()
+}
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS logs (
+    id BIGSERIAL PRIMARY KEY,
+    service TEXT NOT NULL,
+    level TEXT NOT NULL,
+    message TEXT NOT NULL,
+    data JSONB,
+    created_at TIMESTAMP(6) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS logs_created_at_id_idx ON logs (created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS logs_service_created_at_idx ON logs (service, created_at DESC);
+CREATE INDEX IF NOT EXISTS logs_level_created_at_idx ON logs (level, created_at);
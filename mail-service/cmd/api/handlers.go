@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+
+	"github.com/rabin-nyaundi/mail-service/internal/mailer"
+)
+
+// sendMailHandler renders the requested template and sends it
+func (app *application) sendMailHandler(w http.ResponseWriter, r *http.Request) {
+	var input mailer.Request
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.JSONEror(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := mail.ParseAddress(input.To); err != nil {
+		app.JSONEror(w, errors.New("to must be a valid email address"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if input.Template == "" {
+		app.JSONEror(w, errors.New("template must be provided"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = app.mailer.Send(r.Context(), input)
+	if err != nil {
+		switch {
+		case errors.Is(err, mailer.ErrTemplateNotFound):
+			app.JSONEror(w, err, http.StatusUnprocessableEntity)
+		default:
+			app.JSONEror(w, err, http.StatusBadGateway)
+		}
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "mail sent",
+	})
+}
+
+// listTemplatesHandler returns the available templates and their locales
+func (app *application) listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, JSONResponse{
+		Success: true,
+		Message: "success",
+		Data:    app.mailer.Templates.Names(),
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rabin-nyaundi/mail-service/internal/mailer"
+	"github.com/rabin-nyaundi/shared/cors"
+)
+
+type JSONResponse struct {
+	Error   bool        `json:"error,omitempty"`
+	Success bool        `json:"success,omitempty"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type Config struct {
+	port int
+	// serviceTokens are the credentials callers send in the X-Service-Token
+	// header
+	serviceTokens      []string
+	corsAllowedOrigins []string
+	smtp               struct {
+		host               string
+		port               int
+		username           string
+		password           string
+		from               string
+		tlsMode            string
+		insecureSkipVerify bool
+		timeout            time.Duration
+		attempts           int
+		retryDelay         time.Duration
+	}
+}
+
+type application struct {
+	config Config
+	mailer *mailer.Mailer
+	cors   *cors.Handler
+}
+
+func main() {
+	var cfg Config
+
+	smtpPort, _ := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if smtpPort == 0 {
+		smtpPort = 1025
+	}
+
+	var serviceTokens, corsAllowedOrigins string
+
+	flag.IntVar(&cfg.port, "port", 80, "Mail server port")
+	flag.StringVar(&serviceTokens, "service-tokens", envOrFile("SERVICE_TOKENS"), "Comma separated tokens callers must send in the X-Service-Token header")
+	flag.StringVar(&corsAllowedOrigins, "cors-allowed-origins", os.Getenv("CORS_ALLOWED_ORIGINS"), "Comma separated origins allowed to make cross-origin requests (empty allows none)")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", envOr("SMTP_HOST", "mailhog"), "SMTP host")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", smtpPort, "SMTP port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("SMTP_USERNAME"), "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
+	flag.StringVar(&cfg.smtp.from, "smtp-from", envOr("SMTP_FROM", "Microservice <no-reply@microservice.local>"), "SMTP sender")
+	flag.StringVar(&cfg.smtp.tlsMode, "smtp-tls", envOr("SMTP_TLS", mailer.TLSNone), "SMTP TLS mode (none|starttls|tls)")
+	flag.BoolVar(&cfg.smtp.insecureSkipVerify, "smtp-insecure-skip-verify", false, "Skip SMTP certificate verification")
+	flag.DurationVar(&cfg.smtp.timeout, "smtp-timeout", 10*time.Second, "SMTP connection timeout")
+	flag.IntVar(&cfg.smtp.attempts, "smtp-attempts", 4, "Attempts to send a message before giving up")
+	flag.DurationVar(&cfg.smtp.retryDelay, "smtp-retry-delay", 500*time.Millisecond, "Delay before the first retry, doubled on each attempt")
+	flag.Parse()
+
+	cfg.serviceTokens = splitList(serviceTokens)
+	cfg.corsAllowedOrigins = splitList(corsAllowedOrigins)
+
+	if len(cfg.serviceTokens) == 0 {
+		log.Fatal("service-tokens must be provided, with -service-tokens, SERVICE_TOKENS or SERVICE_TOKENS_FILE")
+	}
+
+	switch cfg.smtp.tlsMode {
+	case mailer.TLSNone, mailer.TLSStartTLS, mailer.TLSImplicit:
+	default:
+		log.Fatalf("invalid smtp-tls mode %q", cfg.smtp.tlsMode)
+	}
+
+	templates, err := mailer.LoadTemplates()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	corsHandler, err := cors.New(cors.Policy{
+		AllowedOrigins: cfg.corsAllowedOrigins,
+		AllowedMethods: []string{"POST", "GET"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Service-Token"},
+		MaxAge:         5 * time.Minute,
+	}, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app := &application{
+		config: cfg,
+		mailer: &mailer.Mailer{
+			Templates: templates,
+			Sender: &mailer.SMTPSender{
+				Host:               cfg.smtp.host,
+				Port:               cfg.smtp.port,
+				Username:           cfg.smtp.username,
+				Password:           cfg.smtp.password,
+				TLSMode:            cfg.smtp.tlsMode,
+				Timeout:            cfg.smtp.timeout,
+				InsecureSkipVerify: cfg.smtp.insecureSkipVerify,
+			},
+			From:       cfg.smtp.from,
+			Attempts:   cfg.smtp.attempts,
+			RetryDelay: cfg.smtp.retryDelay,
+		},
+		cors: corsHandler,
+	}
+
+	log.Printf("Starting mail server at port:%d", cfg.port)
+	svr := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.config.port),
+		Handler: app.routes(),
+	}
+
+	err = svr.ListenAndServe()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envOrFile returns the environment variable, or the contents of the file
+// named by the variable suffixed _FILE, as Docker secrets are mounted
+func envOrFile(key string) string {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return os.Getenv(key)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("%s_FILE: %v", key, err)
+	}
+	return strings.TrimRight(string(b), "\r\n")
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
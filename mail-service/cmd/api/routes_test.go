@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/mail-service/internal/mailer"
+	"github.com/rabin-nyaundi/shared/cors"
+)
+
+// recordingSender keeps the messages it is asked to send
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []*mailer.Message
+}
+
+func (s *recordingSender) Send(ctx context.Context, from string, msg *mailer.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func newTestApp(t *testing.T, sender mailer.Sender) *application {
+	templates, err := mailer.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corsHandler, err := cors.New(cors.Policy{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"POST", "GET"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Service-Token"},
+		MaxAge:         5 * time.Minute,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &application{
+		config: Config{serviceTokens: []string{"old-token", "service-token"}},
+		mailer: &mailer.Mailer{
+			Templates: templates,
+			Sender:    sender,
+			From:      "Microservice <no-reply@microservice.local>",
+			Attempts:  1,
+		},
+		cors: corsHandler,
+	}
+}
+
+const welcomeBody = `{"to":"jane@example.com","template":"welcome","data":{"firstname":"Jane","activationToken":"TOKEN"}}`
+
+func TestSendMailRequiresServiceToken(t *testing.T) {
+	sender := &recordingSender{}
+	handler := newTestApp(t, sender).routes()
+
+	for _, test := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "guess", http.StatusUnauthorized},
+		{"prefix of a token", "service", http.StatusUnauthorized},
+		{"service token", "service-token", http.StatusOK},
+		{"second service token", "old-token", http.StatusOK},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/mail", strings.NewReader(welcomeBody))
+			r.Header.Set("Content-Type", "application/json")
+			if test.token != "" {
+				r.Header.Set("X-Service-Token", test.token)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if len(sender.sent) != 2 {
+		t.Errorf("sent %d messages, want only the 2 with a service token", len(sender.sent))
+	}
+}
+
+func TestListTemplatesRequiresServiceToken(t *testing.T) {
+	handler := newTestApp(t, &recordingSender{}).routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/templates", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d without a token, want 401", w.Code)
+	}
+}
+
+func TestCORSOnlyAllowsListedOrigins(t *testing.T) {
+	handler := newTestApp(t, &recordingSender{}).routes()
+
+	for _, test := range []struct {
+		origin string
+		allow  string
+	}{
+		{"https://app.example.com", "https://app.example.com"},
+		{"https://evil.example.net", ""},
+	} {
+		r := httptest.NewRequest(http.MethodOptions, "/v1/mail", nil)
+		r.Header.Set("Origin", test.origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		r.Header.Set("Access-Control-Request-Headers", "content-type, x-service-token")
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("origin %s: Access-Control-Allow-Origin %q, want %q", test.origin, got, test.allow)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+			t.Errorf("origin %s: Access-Control-Allow-Credentials %q, want none", test.origin, got)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/rabin-nyaundi/mail-service
+
+go 1.19
+
+require (
+	github.com/go-chi/chi/v5 v5.0.7
+	github.com/rabin-nyaundi/shared v0.0.0
+)
+
+replace github.com/rabin-nyaundi/shared => ../shared
@@ -0,0 +1,71 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// Request asks for a templated email to be sent
+type Request struct {
+	To       string                 `json:"to"`
+	Template string                 `json:"template"`
+	Locale   string                 `json:"locale"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+// Mailer renders templates and sends them, retrying transient failures
+type Mailer struct {
+	Templates  *Templates
+	Sender     Sender
+	From       string
+	Attempts   int
+	RetryDelay time.Duration
+}
+
+// Send renders and delivers the request. Network errors and 4xx SMTP replies
+// are retried with jittered exponential backoff; 5xx replies are permanent.
+func (m *Mailer) Send(ctx context.Context, req Request) error {
+	msg, err := m.Templates.Render(req.Template, req.Locale, req.Data)
+	if err != nil {
+		return err
+	}
+	msg.To = req.To
+
+	for attempt := 1; ; attempt++ {
+		err = m.Sender.Send(ctx, m.From, msg)
+		if err == nil || !transient(err) || attempt >= m.Attempts {
+			return err
+		}
+
+		delay := m.RetryDelay << uint(attempt-1)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("mailer: sending %s to %s failed (attempt %d): %v, retrying in %s", req.Template, req.To, attempt, err, delay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// transient reports whether sending may succeed if tried again
+func transient(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
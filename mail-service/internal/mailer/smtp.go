@@ -0,0 +1,194 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// TLS modes of the SMTP sender
+const (
+	TLSNone     = "none"
+	TLSStartTLS = "starttls"
+	TLSImplicit = "tls"
+)
+
+// Sender delivers a rendered message
+type Sender interface {
+	Send(ctx context.Context, from string, msg *Message) error
+}
+
+// SMTPSender sends mail through an SMTP server
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	TLSMode  string
+	Timeout  time.Duration
+
+	// InsecureSkipVerify disables certificate checks, for local sinks only
+	InsecureSkipVerify bool
+}
+
+// Send connects to the server and delivers the message as multipart/alternative
+func (s *SMTPSender) Send(ctx context.Context, from string, msg *Message) error {
+	body, err := buildMessage(from, msg)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	tlsConfig := &tls.Config{ServerName: s.Host, InsecureSkipVerify: s.InsecureSkipVerify, MinVersion: tls.VersionTLS12}
+
+	dialer := &net.Dialer{Deadline: deadline}
+
+	var conn net.Conn
+	if s.TLSMode == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.TLSMode == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Username != "" {
+		// PlainAuth refuses to send credentials over plaintext connections
+		// except to localhost, which protects against misconfigured TLSMode
+		err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+
+	toAddr, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+
+	err = c.Mail(fromAddr.Address)
+	if err != nil {
+		return err
+	}
+
+	err = c.Rcpt(toAddr.Address)
+	if err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// buildMessage encodes headers and the plain and HTML parts
+func buildMessage(from string, msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	id := make([]byte, 12)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	mw := multipart.NewWriter(&buf)
+
+	headers := []struct{ key, value string }{
+		{"From", from},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@mail-service>", hex.EncodeToString(id))},
+		{"Content-Language", msg.Locale},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	}
+
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h.key, h.value)
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Plain},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qw := quotedprintable.NewWriter(pw)
+		_, err = qw.Write([]byte(part.body))
+		if err != nil {
+			return nil, err
+		}
+		qw.Close()
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
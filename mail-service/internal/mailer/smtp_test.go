@@ -0,0 +1,290 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sinkMessage is a message accepted by the SMTP sink
+type sinkMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpSink is a stand-in SMTP server, like MailHog, keeping the messages it
+// accepts. rcptReplies are answered to RCPT TO in turn before accepting.
+type smtpSink struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	rcptReplies []string
+	messages    []sinkMessage
+	conns       int
+}
+
+func newSMTPSink(t *testing.T, rcptReplies ...string) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &smtpSink{ln: ln, rcptReplies: rcptReplies}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+func (s *smtpSink) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	io.WriteString(c, "220 sink ESMTP\r\n")
+
+	var msg sinkMessage
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			io.WriteString(c, "250-sink\r\n250 8BITMIME\r\n")
+
+		case "MAIL":
+			msg = sinkMessage{from: address(line)}
+			io.WriteString(c, "250 OK\r\n")
+
+		case "RCPT":
+			s.mu.Lock()
+			reply := "250 OK"
+			if len(s.rcptReplies) > 0 {
+				reply, s.rcptReplies = s.rcptReplies[0], s.rcptReplies[1:]
+			}
+			s.mu.Unlock()
+
+			if strings.HasPrefix(reply, "250") {
+				msg.to = append(msg.to, address(line))
+			}
+			io.WriteString(c, reply+"\r\n")
+
+		case "DATA":
+			io.WriteString(c, "354 End data with <CR><LF>.<CR><LF>\r\n")
+
+			data, err := textproto.NewReader(r).ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			io.WriteString(c, "250 OK queued\r\n")
+
+		case "RSET", "NOOP":
+			io.WriteString(c, "250 OK\r\n")
+
+		case "QUIT":
+			io.WriteString(c, "221 Bye\r\n")
+			return
+
+		default:
+			fmt.Fprintf(c, "502 %s not implemented\r\n", verb)
+		}
+	}
+}
+
+// address returns the address in MAIL FROM:<a> and RCPT TO:<a>
+func address(line string) string {
+	start, end := strings.Index(line, "<"), strings.LastIndex(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func (s *smtpSink) state() ([]sinkMessage, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]sinkMessage(nil), s.messages...), s.conns
+}
+
+func newTestMailer(t *testing.T, sink *smtpSink) *Mailer {
+	templates, err := LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(sink.ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	return &Mailer{
+		Templates: templates,
+		Sender: &SMTPSender{
+			Host:    host,
+			Port:    p,
+			TLSMode: TLSNone,
+			Timeout: 5 * time.Second,
+		},
+		From:       "Microservice <no-reply@microservice.local>",
+		Attempts:   3,
+		RetryDelay: time.Millisecond,
+	}
+}
+
+func welcomeRequest() Request {
+	return Request{
+		To:       "jane@example.com",
+		Template: "welcome",
+		Locale:   "en",
+		Data: map[string]interface{}{
+			"firstname":       "Jane",
+			"activationToken": "ACTIVATIONTOKEN123",
+		},
+	}
+}
+
+func TestMailerDeliversRenderedTemplate(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := newTestMailer(t, sink)
+
+	err := m.Send(context.Background(), welcomeRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, _ := sink.state()
+	if len(messages) != 1 {
+		t.Fatalf("sink accepted %d messages, want 1", len(messages))
+	}
+
+	msg := messages[0]
+	if msg.from != "no-reply@microservice.local" {
+		t.Errorf("MAIL FROM %q, want no-reply@microservice.local", msg.from)
+	}
+	if len(msg.to) != 1 || msg.to[0] != "jane@example.com" {
+		t.Errorf("RCPT TO %q, want jane@example.com", msg.to)
+	}
+
+	for _, want := range []string{
+		"From: Microservice <no-reply@microservice.local>\n",
+		"To: jane@example.com\n",
+		"Subject: Welcome, activate your account\n",
+		"Content-Type: multipart/alternative; boundary=",
+		"Content-Type: text/plain; charset=utf-8\n",
+		"Content-Type: text/html; charset=utf-8\n",
+	} {
+		if !strings.Contains(msg.data, want) {
+			t.Errorf("message is missing header %q:\n%s", want, msg.data)
+		}
+	}
+
+	// the parts are quoted-printable encoded
+	body, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(msg.data[strings.Index(msg.data, "\n\n"):])))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"Hi Jane,", "<p>Hi Jane,</p>", "ACTIVATIONTOKEN123"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("message is missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMailerRetriesTransientReplies(t *testing.T) {
+	sink := newSMTPSink(t, "451 4.3.0 try again later", "451 4.3.0 try again later")
+	m := newTestMailer(t, sink)
+
+	err := m.Send(context.Background(), welcomeRequest())
+	if err != nil {
+		t.Fatalf("send after two 4xx replies: %v", err)
+	}
+
+	messages, conns := sink.state()
+	if len(messages) != 1 {
+		t.Errorf("sink accepted %d messages, want 1", len(messages))
+	}
+	if conns != 3 {
+		t.Errorf("connected %d times, want 3", conns)
+	}
+}
+
+func TestMailerGivesUpAfterAttempts(t *testing.T) {
+	sink := newSMTPSink(t, "451 4.3.0 try again later", "451 4.3.0 try again later", "451 4.3.0 try again later")
+	m := newTestMailer(t, sink)
+
+	err := m.Send(context.Background(), welcomeRequest())
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 451 {
+		t.Fatalf("err %v, want the last 451 reply", err)
+	}
+	if _, conns := sink.state(); conns != 3 {
+		t.Errorf("connected %d times, want the 3 attempts", conns)
+	}
+}
+
+func TestMailerDoesNotRetryPermanentReplies(t *testing.T) {
+	sink := newSMTPSink(t, "550 5.1.1 no such user")
+	m := newTestMailer(t, sink)
+
+	err := m.Send(context.Background(), welcomeRequest())
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Fatalf("err %v, want the 550 reply", err)
+	}
+
+	messages, conns := sink.state()
+	if len(messages) != 0 {
+		t.Errorf("sink accepted %d messages, want none", len(messages))
+	}
+	if conns != 1 {
+		t.Errorf("connected %d times, want 1", conns)
+	}
+}
+
+func TestMailerRejectsUnknownTemplate(t *testing.T) {
+	sink := newSMTPSink(t)
+	m := newTestMailer(t, sink)
+
+	req := welcomeRequest()
+	req.Template = "missing"
+
+	err := m.Send(context.Background(), req)
+	if !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("err %v, want ErrTemplateNotFound", err)
+	}
+	if _, conns := sink.state(); conns != 0 {
+		t.Errorf("connected %d times for an unknown template, want none", conns)
+	}
+}
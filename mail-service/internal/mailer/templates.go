@@ -0,0 +1,195 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates locales
+var content embed.FS
+
+// ErrTemplateNotFound is returned for an unknown template name
+var ErrTemplateNotFound = errors.New("template not found")
+
+// DefaultLocale is used when no template exists for the requested locale
+const DefaultLocale = "en"
+
+// Message is a rendered email ready to be sent
+type Message struct {
+	To      string
+	Subject string
+	Plain   string
+	HTML    string
+	Locale  string
+}
+
+// templateSet holds the parsed variants of one template in one locale
+type templateSet struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// Templates renders the embedded email templates. Each template lives in
+// templates/<name>.<locale>.tmpl and defines the subject, plainBody and
+// htmlBody blocks, which are wrapped in the layouts from templates/layouts.
+// Layout strings are translated with the t function from locales/<locale>.json.
+type Templates struct {
+	sets map[string]map[string]*templateSet
+}
+
+// LoadTemplates parses every embedded template
+func LoadTemplates() (*Templates, error) {
+	catalogs, err := loadCatalogs()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := fs.Glob(content, "templates/*.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{sets: map[string]map[string]*templateSet{}}
+
+	for _, file := range files {
+		parts := strings.Split(strings.TrimSuffix(path.Base(file), ".tmpl"), ".")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("template %s must be named <name>.<locale>.tmpl", file)
+		}
+		name, locale := parts[0], parts[1]
+
+		translate := translator(catalogs, locale)
+
+		text, err := texttemplate.New("").Funcs(texttemplate.FuncMap{"t": translate}).
+			ParseFS(content, "templates/layouts/text.tmpl", file)
+		if err != nil {
+			return nil, err
+		}
+
+		html, err := htmltemplate.New("").Funcs(htmltemplate.FuncMap{"t": translate}).
+			ParseFS(content, "templates/layouts/html.tmpl", file)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.sets[name] == nil {
+			t.sets[name] = map[string]*templateSet{}
+		}
+		t.sets[name][locale] = &templateSet{text: text, html: html}
+	}
+
+	return t, nil
+}
+
+// Render renders the named template in the closest available locale: the
+// exact locale, then its base language, then DefaultLocale
+func (t *Templates) Render(name, locale string, data map[string]interface{}) (*Message, error) {
+	locales, ok := t.sets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	base, _, _ := strings.Cut(locale, "-")
+
+	var set *templateSet
+	for _, candidate := range []string{locale, base, DefaultLocale} {
+		if set, ok = locales[candidate]; ok {
+			locale = candidate
+			break
+		}
+	}
+
+	if set == nil {
+		return nil, fmt.Errorf("%w: %s has no %s variant", ErrTemplateNotFound, name, DefaultLocale)
+	}
+
+	view := struct {
+		Locale string
+		Data   map[string]interface{}
+	}{locale, data}
+
+	msg := &Message{Locale: locale}
+
+	var buf bytes.Buffer
+
+	err := set.text.ExecuteTemplate(&buf, "subject", view)
+	if err != nil {
+		return nil, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	err = set.text.ExecuteTemplate(&buf, "plainLayout", view)
+	if err != nil {
+		return nil, err
+	}
+	msg.Plain = strings.TrimSpace(buf.String()) + "\n"
+
+	buf.Reset()
+	err = set.html.ExecuteTemplate(&buf, "htmlLayout", view)
+	if err != nil {
+		return nil, err
+	}
+	msg.HTML = strings.TrimSpace(buf.String()) + "\n"
+
+	return msg, nil
+}
+
+// Names returns the available templates and their locales
+func (t *Templates) Names() map[string][]string {
+	names := map[string][]string{}
+	for name, locales := range t.sets {
+		for locale := range locales {
+			names[name] = append(names[name], locale)
+		}
+	}
+	return names
+}
+
+func loadCatalogs() (map[string]map[string]string, error) {
+	files, err := fs.Glob(content, "locales/*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	catalogs := map[string]map[string]string{}
+	for _, file := range files {
+		b, err := content.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var catalog map[string]string
+		err = json.Unmarshal(b, &catalog)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		catalogs[strings.TrimSuffix(path.Base(file), ".json")] = catalog
+	}
+
+	return catalogs, nil
+}
+
+// translator returns the t template function of a locale, falling back to
+// DefaultLocale and finally to the key itself
+func translator(catalogs map[string]map[string]string, locale string) func(string) string {
+	return func(key string) string {
+		if s, ok := catalogs[locale][key]; ok {
+			return s
+		}
+		if s, ok := catalogs[DefaultLocale][key]; ok {
+			return s
+		}
+		return key
+	}
+}
@@ -0,0 +1,34 @@
+#!/bin/sh
+# Generates a development CA and the certificates docker-compose.tls.yml
+# mounts: each service gets one certificate, valid for serving and as a
+# client, named after its compose service. Run again with -keep-ca to rotate
+# them; the services pick the new files up without a restart.
+set -e
+umask 077
+
+cd "$(dirname "$0")"
+
+days=30
+
+if [ "$1" != "-keep-ca" ] || [ ! -f ca.key ]; then
+	openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+		-subj "/CN=Microservice development CA" \
+		-keyout ca.key -out ca.pem 2>/dev/null
+fi
+
+for service in broker-service authentication-service; do
+	openssl req -newkey rsa:2048 -nodes -subj "/CN=$service" \
+		-keyout "$service.key.new" -out "$service.csr" 2>/dev/null
+
+	printf 'subjectAltName=DNS:%s,DNS:localhost\nextendedKeyUsage=serverAuth,clientAuth\n' "$service" > "$service.ext"
+	openssl x509 -req -days "$days" -in "$service.csr" -extfile "$service.ext" \
+		-CA ca.pem -CAkey ca.key -CAcreateserial -out "$service.pem.new" 2>/dev/null
+
+	# replace the key and certificate last and close together, a reload
+	# in between keeps the previous pair
+	mv "$service.key.new" "$service.key"
+	mv "$service.pem.new" "$service.pem"
+	rm "$service.csr" "$service.ext"
+done
+
+echo "certificates written to $(pwd), valid for $days days"
@@ -0,0 +1,261 @@
+// Package auth is a client of the authentication service's HTTP API
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rabin-nyaundi/sdk"
+	"github.com/rabin-nyaundi/sdk/internal/rest"
+)
+
+// Client calls the authentication service. Methods acting as a user, such
+// as Logout, need a token source.
+type Client struct {
+	rest *rest.Client
+}
+
+// New returns a client of the authentication service at baseURL
+func New(baseURL string, opts ...sdk.Option) (*Client, error) {
+	c, err := rest.New(baseURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rest: c}, nil
+}
+
+// TokenSource returns a token source logging in with the credentials
+// whenever it needs a new token
+func (c *Client) TokenSource(email, password string) sdk.TokenSource {
+	return sdk.RefreshingTokenSource(func(ctx context.Context) (*sdk.Token, error) {
+		return c.Login(ctx, email, password)
+	})
+}
+
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// CreateUser creates an inactive user and emails them an activation token
+func (c *Client) CreateUser(ctx context.Context, user sdk.NewUser) (*sdk.CreatedUser, error) {
+	var created sdk.CreatedUser
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/users",
+		Body:   user,
+	}, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// ActivateUser activates the user owning the activation token
+func (c *Client) ActivateUser(ctx context.Context, token string) (*sdk.User, error) {
+	var user sdk.User
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPut,
+		Path:   "/v1/users/activated",
+		Body:   map[string]string{"token": token},
+	}, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Authenticate checks the credentials and returns their user
+func (c *Client) Authenticate(ctx context.Context, email, password string) (*sdk.User, error) {
+	var user sdk.User
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/users/authenticate",
+		Body:   credentials{Email: email, Password: password},
+	}, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// GetUser returns the user with the id. It needs a service token or the
+// token source of an admin.
+func (c *Client) GetUser(ctx context.Context, id int64) (*sdk.User, error) {
+	var user sdk.User
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodGet,
+		Path:   "/v1/users/" + strconv.FormatInt(id, 10),
+		Auth:   true,
+	}, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ListUsers returns the users with the ids, at most 100 of them. Ids without
+// a user are left out. It needs a service token or the token source of an
+// admin.
+func (c *Client) ListUsers(ctx context.Context, ids []int64) ([]sdk.User, error) {
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.FormatInt(id, 10)
+	}
+
+	var users []sdk.User
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodGet,
+		Path:   "/v1/users",
+		Query:  url.Values{"ids": {strings.Join(values, ",")}},
+		Auth:   true,
+	}, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// ListRoles returns the roles users can hold and the scopes they grant
+func (c *Client) ListRoles(ctx context.Context) ([]sdk.Role, error) {
+	var roles []sdk.Role
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodGet,
+		Path:   "/v1/roles",
+	}, &roles)
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// SetRole changes the role of a user. It needs an admin token.
+func (c *Client) SetRole(ctx context.Context, id int64, role int) (*sdk.User, error) {
+	var user sdk.User
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPut,
+		Path:   "/v1/users/" + strconv.FormatInt(id, 10) + "/role",
+		Body:   map[string]int{"role": role},
+		Auth:   true,
+	}, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// SetLocked locks or unlocks a user. It needs an admin token.
+func (c *Client) SetLocked(ctx context.Context, id int64, locked bool) (*sdk.User, error) {
+	var user sdk.User
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPut,
+		Path:   "/v1/users/" + strconv.FormatInt(id, 10) + "/lock",
+		Body:   map[string]bool{"locked": locked},
+		Auth:   true,
+	}, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Login exchanges the credentials for an authentication token
+func (c *Client) Login(ctx context.Context, email, password string) (*sdk.Token, error) {
+	var token sdk.Token
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/tokens/authentication",
+		Body:   credentials{Email: email, Password: password},
+	}, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Logout revokes the token of the token source
+func (c *Client) Logout(ctx context.Context) error {
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodDelete,
+		Path:   "/v1/tokens/authentication",
+		Auth:   true,
+	}, nil)
+	return err
+}
+
+// ListSessions returns the sessions of the token source's user
+func (c *Client) ListSessions(ctx context.Context) ([]sdk.Session, error) {
+	var sessions []sdk.Session
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodGet,
+		Path:   "/v1/tokens/authentication",
+		Auth:   true,
+	}, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Introspect reports whether the authentication token is active and who it
+// belongs to. An unknown token is not an error but an inactive token. It
+// needs a service token or the token source of an admin.
+func (c *Client) Introspect(ctx context.Context, token string) (*sdk.Introspection, error) {
+	var introspection sdk.Introspection
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/tokens/introspect",
+		Body:   map[string]string{"token": token},
+		Auth:   true,
+	}, &introspection)
+	if err != nil {
+		return nil, err
+	}
+
+	return &introspection, nil
+}
+
+// RequestPasswordReset emails a password reset token to the user with the
+// email. It succeeds whether or not there is such a user.
+func (c *Client) RequestPasswordReset(ctx context.Context, email string) error {
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/v1/tokens/password-reset",
+		Body:   map[string]string{"email": email},
+	}, nil)
+	return err
+}
+
+// ResetPassword sets a new password using a password reset token
+func (c *Client) ResetPassword(ctx context.Context, token, password string) error {
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPut,
+		Path:   "/v1/users/password",
+		Body:   map[string]string{"token": token, "password": password},
+	}, nil)
+	return err
+}
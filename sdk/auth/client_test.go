@@ -0,0 +1,549 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/sdk"
+)
+
+// received is what the test server saw of a request
+type received struct {
+	method        string
+	path          string
+	query         string
+	authorization string
+	serviceToken  string
+	body          string
+}
+
+// replyWith returns a server answering every request with the data in the
+// response envelope, and the requests it received
+func replyWith(t *testing.T, data interface{}) (*httptest.Server, *[]received) {
+	var (
+		mu       sync.Mutex
+		requests []received
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests = append(requests, received{
+			method:        r.Method,
+			path:          r.URL.Path,
+			query:         r.URL.RawQuery,
+			authorization: r.Header.Get("Authorization"),
+			serviceToken:  r.Header.Get("X-Service-Token"),
+			body:          string(body),
+		})
+		mu.Unlock()
+
+		writeEnvelope(w, http.StatusOK, map[string]interface{}{"success": true, "message": "ok", "data": data})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, envelope map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope)
+}
+
+// sameJSON reports whether a and b encode the same JSON value
+func sameJSON(t *testing.T, a, b string) bool {
+	if a == "" || b == "" {
+		return a == b
+	}
+
+	var x, y interface{}
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatalf("decoding %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestClientMethods(t *testing.T) {
+	user := sdk.User{ID: 7, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", Active: true}
+	token := sdk.Token{Token: "ABCDEF", Expiry: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	tests := []struct {
+		name   string
+		call   func(ctx context.Context, c *Client) (interface{}, error)
+		data   interface{}
+		method string
+		path   string
+		query  string
+		body   string
+		auth   bool
+		want   interface{}
+	}{
+		{
+			name: "CreateUser",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.CreateUser(ctx, sdk.NewUser{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", Password: "pa55word"})
+			},
+			data:   sdk.CreatedUser{User: &user},
+			method: http.MethodPost,
+			path:   "/v1/users",
+			body:   `{"firstname":"Ada","lastname":"Lovelace","email":"ada@example.com","password":"pa55word"}`,
+			want:   &sdk.CreatedUser{User: &user},
+		},
+		{
+			name: "ActivateUser",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ActivateUser(ctx, "ACTIVATE")
+			},
+			data:   user,
+			method: http.MethodPut,
+			path:   "/v1/users/activated",
+			body:   `{"token":"ACTIVATE"}`,
+			want:   &user,
+		},
+		{
+			name: "Authenticate",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Authenticate(ctx, "ada@example.com", "pa55word")
+			},
+			data:   user,
+			method: http.MethodPost,
+			path:   "/v1/users/authenticate",
+			body:   `{"email":"ada@example.com","password":"pa55word"}`,
+			want:   &user,
+		},
+		{
+			name: "GetUser",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.GetUser(ctx, 7)
+			},
+			data:   user,
+			method: http.MethodGet,
+			path:   "/v1/users/7",
+			auth:   true,
+			want:   &user,
+		},
+		{
+			name: "ListUsers",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ListUsers(ctx, []int64{7, 8})
+			},
+			data:   []sdk.User{user},
+			method: http.MethodGet,
+			path:   "/v1/users",
+			query:  "ids=7%2C8",
+			auth:   true,
+			want:   []sdk.User{user},
+		},
+		{
+			name: "ListRoles",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ListRoles(ctx)
+			},
+			data:   []sdk.Role{{ID: sdk.RoleUser, Name: "user", Scopes: []string{"users:read"}}},
+			method: http.MethodGet,
+			path:   "/v1/roles",
+			want:   []sdk.Role{{ID: sdk.RoleUser, Name: "user", Scopes: []string{"users:read"}}},
+		},
+		{
+			name: "SetRole",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.SetRole(ctx, 7, sdk.RoleAdmin)
+			},
+			data:   user,
+			method: http.MethodPut,
+			path:   "/v1/users/7/role",
+			body:   `{"role":1}`,
+			auth:   true,
+			want:   &user,
+		},
+		{
+			name: "SetLocked",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.SetLocked(ctx, 7, true)
+			},
+			data:   user,
+			method: http.MethodPut,
+			path:   "/v1/users/7/lock",
+			body:   `{"locked":true}`,
+			auth:   true,
+			want:   &user,
+		},
+		{
+			name: "Login",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Login(ctx, "ada@example.com", "pa55word")
+			},
+			data:   token,
+			method: http.MethodPost,
+			path:   "/v1/tokens/authentication",
+			body:   `{"email":"ada@example.com","password":"pa55word"}`,
+			want:   &token,
+		},
+		{
+			name: "Logout",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return nil, c.Logout(ctx)
+			},
+			method: http.MethodDelete,
+			path:   "/v1/tokens/authentication",
+			auth:   true,
+		},
+		{
+			name: "ListSessions",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ListSessions(ctx)
+			},
+			data:   []sdk.Session{{ID: "1", Expiry: token.Expiry, Current: true}},
+			method: http.MethodGet,
+			path:   "/v1/tokens/authentication",
+			auth:   true,
+			want:   []sdk.Session{{ID: "1", Expiry: token.Expiry, Current: true}},
+		},
+		{
+			name: "Introspect",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Introspect(ctx, "ABCDEF")
+			},
+			data:   sdk.Introspection{Active: true, UserID: 7, Email: "ada@example.com", UserActive: true, Scopes: []string{"users:read"}},
+			method: http.MethodPost,
+			path:   "/v1/tokens/introspect",
+			body:   `{"token":"ABCDEF"}`,
+			auth:   true,
+			want:   &sdk.Introspection{Active: true, UserID: 7, Email: "ada@example.com", UserActive: true, Scopes: []string{"users:read"}},
+		},
+		{
+			name: "RequestPasswordReset",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return nil, c.RequestPasswordReset(ctx, "ada@example.com")
+			},
+			method: http.MethodPost,
+			path:   "/v1/tokens/password-reset",
+			body:   `{"email":"ada@example.com"}`,
+		},
+		{
+			name: "ResetPassword",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return nil, c.ResetPassword(ctx, "RESET", "n3wpa55word")
+			},
+			method: http.MethodPut,
+			path:   "/v1/users/password",
+			body:   `{"token":"RESET","password":"n3wpa55word"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := replyWith(t, tt.data)
+
+			c, err := New(srv.URL, sdk.WithToken("TOKEN"), sdk.WithServiceToken("SERVICE"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tt.call(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			if len(*requests) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(*requests))
+			}
+			r := (*requests)[0]
+
+			if r.method != tt.method || r.path != tt.path || r.query != tt.query {
+				t.Errorf("sent %s %s?%s, want %s %s?%s", r.method, r.path, r.query, tt.method, tt.path, tt.query)
+			}
+			if !sameJSON(t, r.body, tt.body) {
+				t.Errorf("sent body %s, want %s", r.body, tt.body)
+			}
+
+			wantAuthorization, wantServiceToken := "", ""
+			if tt.auth {
+				wantAuthorization, wantServiceToken = "Bearer TOKEN", "SERVICE"
+			}
+			if r.authorization != wantAuthorization {
+				t.Errorf("sent Authorization %q, want %q", r.authorization, wantAuthorization)
+			}
+			if r.serviceToken != wantServiceToken {
+				t.Errorf("sent X-Service-Token %q, want %q", r.serviceToken, wantServiceToken)
+			}
+		})
+	}
+}
+
+// tokenServer issues the tokens in order on login and accepts only the
+// last one for logout
+type tokenServer struct {
+	tokens []string
+
+	mu      sync.Mutex
+	logins  int
+	logouts []string
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		token := s.tokens[s.logins%len(s.tokens)]
+		s.logins++
+		writeEnvelope(w, http.StatusCreated, map[string]interface{}{"success": true, "message": "ok", "data": sdk.Token{Token: token}})
+
+	case http.MethodDelete:
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		s.logouts = append(s.logouts, bearer)
+
+		if bearer != s.tokens[len(s.tokens)-1] {
+			writeEnvelope(w, http.StatusUnauthorized, map[string]interface{}{"error": true, "message": "invalid or expired token"})
+			return
+		}
+		writeEnvelope(w, http.StatusOK, map[string]interface{}{"success": true, "message": "logged out"})
+	}
+}
+
+func TestRefreshesRejectedToken(t *testing.T) {
+	ts := &tokenServer{tokens: []string{"REVOKED", "FRESH"}}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	login, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(srv.URL, sdk.WithTokenSource(login.TokenSource("ada@example.com", "pa55word")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Logout(context.Background())
+	if err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+
+	if ts.logins != 2 {
+		t.Errorf("logged in %d times, want 2", ts.logins)
+	}
+	if want := []string{"REVOKED", "FRESH"}; !reflect.DeepEqual(ts.logouts, want) {
+		t.Errorf("sent tokens %v, want %v", ts.logouts, want)
+	}
+
+	// the fresh token is kept for the next request
+	err = c.Logout(context.Background())
+	if err != nil {
+		t.Fatalf("second logout: %v", err)
+	}
+	if ts.logins != 2 {
+		t.Errorf("logged in %d times after the second logout, want 2", ts.logins)
+	}
+}
+
+func TestRetriesRejectedTokenOnce(t *testing.T) {
+	ts := &tokenServer{tokens: []string{"REVOKED", "REVOKED", "NEVER_ISSUED"}}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	login, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(srv.URL, sdk.WithTokenSource(login.TokenSource("ada@example.com", "pa55word")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Logout(context.Background())
+	if !errors.Is(err, sdk.ErrInvalidToken) {
+		t.Fatalf("logout: err %v, want ErrInvalidToken", err)
+	}
+	if len(ts.logouts) != 2 {
+		t.Errorf("sent %d requests, want the first and one retry", len(ts.logouts))
+	}
+}
+
+func TestStaticTokenIsNotRetried(t *testing.T) {
+	ts := &tokenServer{tokens: []string{"FRESH"}}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	c, err := New(srv.URL, sdk.WithToken("REVOKED"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Logout(context.Background())
+	if !errors.Is(err, sdk.ErrUnauthorized) {
+		t.Fatalf("logout: err %v, want ErrUnauthorized", err)
+	}
+	if len(ts.logouts) != 1 || ts.logins != 0 {
+		t.Errorf("sent %d requests and logged in %d times, want 1 and 0", len(ts.logouts), ts.logins)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		header     http.Header
+		is         []error
+		isNot      []error
+		message    string
+		statusCode int
+		retryAfter time.Duration
+	}{
+		{
+			name:       "invalid credentials",
+			status:     http.StatusUnauthorized,
+			body:       `{"error":true,"message":"invalid credentials"}`,
+			is:         []error{sdk.ErrUnauthorized, sdk.ErrInvalidCredentials},
+			isNot:      []error{sdk.ErrInvalidToken, sdk.ErrServer},
+			message:    "invalid credentials",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "locked account",
+			status:     http.StatusForbidden,
+			body:       `{"error":true,"message":"this account is locked"}`,
+			is:         []error{sdk.ErrForbidden, sdk.ErrAccountLocked},
+			isNot:      []error{sdk.ErrAdminRequired},
+			message:    "this account is locked",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "admin required",
+			status:     http.StatusForbidden,
+			body:       `{"error":true,"message":"this resource requires an admin authentication token"}`,
+			is:         []error{sdk.ErrForbidden, sdk.ErrAdminRequired},
+			message:    "this resource requires an admin authentication token",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "duplicate email",
+			status:     http.StatusBadRequest,
+			body:       `{"error":true,"message":"user wit email already exist"}`,
+			is:         []error{sdk.ErrBadRequest, sdk.ErrDuplicateEmail},
+			message:    "user wit email already exist",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "validation",
+			status:     http.StatusUnprocessableEntity,
+			body:       `{"error":true,"message":"email is required"}`,
+			is:         []error{sdk.ErrValidation},
+			isNot:      []error{sdk.ErrBadRequest},
+			message:    "email is required",
+			statusCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "rate limited",
+			status:     http.StatusTooManyRequests,
+			body:       `{"error":true,"message":"rate limit exceeded"}`,
+			header:     http.Header{"Retry-After": {"3"}},
+			is:         []error{sdk.ErrRateLimited},
+			message:    "rate limit exceeded",
+			statusCode: http.StatusTooManyRequests,
+			retryAfter: 3 * time.Second,
+		},
+		{
+			name:       "bad gateway",
+			status:     http.StatusBadGateway,
+			body:       `{"error":true,"message":"error calling authentication-service"}`,
+			is:         []error{sdk.ErrUnavailable, sdk.ErrServer},
+			message:    "error calling authentication-service",
+			statusCode: http.StatusBadGateway,
+		},
+		{
+			name:       "unknown server error",
+			status:     http.StatusNotImplemented,
+			body:       `{"error":true,"message":"not implemented"}`,
+			is:         []error{sdk.ErrServer},
+			isNot:      []error{sdk.ErrUnavailable},
+			message:    "not implemented",
+			statusCode: http.StatusNotImplemented,
+		},
+		{
+			name:       "body that is not an envelope",
+			status:     http.StatusServiceUnavailable,
+			body:       "upstream connect error\n",
+			is:         []error{sdk.ErrUnavailable},
+			message:    "upstream connect error",
+			statusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "error envelope with a success status",
+			status:     http.StatusOK,
+			body:       `{"error":true,"message":"user wit email already exist"}`,
+			is:         []error{sdk.ErrBadRequest, sdk.ErrDuplicateEmail},
+			message:    "user wit email already exist",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for key, values := range tt.header {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			c, err := New(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.Authenticate(context.Background(), "ada@example.com", "pa55word")
+
+			var apiErr *sdk.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err %v is not an *sdk.APIError", err)
+			}
+			if apiErr.StatusCode != tt.statusCode || apiErr.Message != tt.message || apiErr.RetryAfter != tt.retryAfter {
+				t.Errorf("got %d %q retry after %s, want %d %q retry after %s",
+					apiErr.StatusCode, apiErr.Message, apiErr.RetryAfter, tt.statusCode, tt.message, tt.retryAfter)
+			}
+
+			for _, target := range tt.is {
+				if !errors.Is(err, target) {
+					t.Errorf("err %v does not match %q", err, target)
+				}
+			}
+			for _, target := range tt.isNot {
+				if errors.Is(err, target) {
+					t.Errorf("err %v matches %q", err, target)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsBadBaseURL(t *testing.T) {
+	for _, u := range []string{"", "authentication-service", "ftp://authentication-service", "http://[::1"} {
+		_, err := New(u)
+		if err == nil {
+			t.Errorf("New(%q) succeeded, want an error", u)
+		}
+	}
+}
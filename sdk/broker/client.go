@@ -0,0 +1,228 @@
+// Package broker is a client of the broker's HTTP API
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rabin-nyaundi/sdk"
+	"github.com/rabin-nyaundi/sdk/internal/rest"
+)
+
+// Client calls the broker. Actions needing a scope or acting as a user, such
+// as GetUser or Logout, need a token source.
+type Client struct {
+	rest *rest.Client
+}
+
+// New returns a client of the broker at baseURL
+func New(baseURL string, opts ...sdk.Option) (*Client, error) {
+	c, err := rest.New(baseURL, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rest: c}, nil
+}
+
+// TokenSource returns a token source logging in through the broker with the
+// credentials whenever it needs a new token
+func (c *Client) TokenSource(email, password string) sdk.TokenSource {
+	return sdk.RefreshingTokenSource(func(ctx context.Context) (*sdk.Token, error) {
+		return c.Login(ctx, email, password)
+	})
+}
+
+// Call runs the action of the request and decodes its data into out, which
+// may be nil
+func (c *Client) Call(ctx context.Context, req Request, out interface{}) error {
+	return c.call(ctx, req, true, out)
+}
+
+// call runs the action, with a bearer token when auth is set. The actions
+// taking credentials are called without one, so a token source logging in
+// through the broker does not wait on itself.
+func (c *Client) call(ctx context.Context, req Request, auth bool, out interface{}) error {
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/handle",
+		Body:   req,
+		Auth:   auth,
+	}, out)
+	return err
+}
+
+// Submit queues the action of the request and returns its pending job
+func (c *Client) Submit(ctx context.Context, req Request) (*Job, error) {
+	req.Async = true
+
+	var job Job
+
+	err := c.Call(ctx, req, &job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// GetJob returns the job with the id
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	var job Job
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodGet,
+		Path:   "/jobs/" + id,
+		Auth:   true,
+	}, &job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// WaitJob polls the job every interval until it is done or ctx is cancelled
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if job.Done() {
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Batch runs the items concurrently and returns their results in order. A
+// failed item does not fail the batch; check each result's Err.
+func (c *Client) Batch(ctx context.Context, items []BatchItem) ([]BatchResult, error) {
+	if len(items) == 0 {
+		return nil, errors.New("batch must contain at least one item")
+	}
+
+	var results []BatchResult
+
+	_, err := c.rest.Do(ctx, &rest.Request{
+		Method: http.MethodPost,
+		Path:   "/handle/batch",
+		Body:   items,
+		Auth:   true,
+	}, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Authenticate checks the credentials and returns their user
+func (c *Client) Authenticate(ctx context.Context, email, password string) (*sdk.User, error) {
+	var user sdk.User
+
+	err := c.call(ctx, Request{Action: ActionAuth, Auth: &Credentials{Email: email, Password: password}}, false, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Register creates an inactive user and emails them an activation token
+func (c *Client) Register(ctx context.Context, user sdk.NewUser) (*sdk.CreatedUser, error) {
+	var created sdk.CreatedUser
+
+	err := c.call(ctx, Request{Action: ActionRegister, Register: &user}, false, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// Login exchanges the credentials for an authentication token
+func (c *Client) Login(ctx context.Context, email, password string) (*sdk.Token, error) {
+	var token sdk.Token
+
+	err := c.call(ctx, Request{Action: ActionLogin, Auth: &Credentials{Email: email, Password: password}}, false, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Logout revokes the token of the token source
+func (c *Client) Logout(ctx context.Context) error {
+	return c.Call(ctx, Request{Action: ActionLogout}, nil)
+}
+
+// ListSessions returns the sessions of the token source's user
+func (c *Client) ListSessions(ctx context.Context) ([]sdk.Session, error) {
+	var sessions []sdk.Session
+
+	err := c.Call(ctx, Request{Action: ActionSessions}, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// GetUser returns the user with the id. It needs the users:read scope.
+func (c *Client) GetUser(ctx context.Context, id int64) (*sdk.User, error) {
+	var user sdk.User
+
+	err := c.Call(ctx, Request{Action: ActionGetUser, User: &UserRef{ID: id}}, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ListUsers returns the users with the ids. It needs the users:read scope.
+func (c *Client) ListUsers(ctx context.Context, ids []int64) ([]sdk.User, error) {
+	var users []sdk.User
+
+	err := c.Call(ctx, Request{Action: ActionGetUsers, User: &UserRef{IDs: ids}}, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// ListRoles returns the roles users can hold and the scopes they grant
+func (c *Client) ListRoles(ctx context.Context) ([]sdk.Role, error) {
+	var roles []sdk.Role
+
+	err := c.Call(ctx, Request{Action: ActionRoles}, &roles)
+	if err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Log publishes the log entry. It needs the logs:write scope.
+func (c *Client) Log(ctx context.Context, entry LogEntry) error {
+	return c.Call(ctx, Request{Action: ActionLog, Log: &entry}, nil)
+}
+
+// SendMail publishes the email to send. It needs the mail:send scope.
+func (c *Client) SendMail(ctx context.Context, mail Mail) error {
+	return c.Call(ctx, Request{Action: ActionMail, Mail: &mail}, nil)
+}
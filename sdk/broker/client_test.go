@@ -0,0 +1,398 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rabin-nyaundi/sdk"
+)
+
+// received is what the test server saw of a request
+type received struct {
+	method        string
+	path          string
+	authorization string
+	body          string
+}
+
+// replyWith returns a server answering every request with the data in the
+// response envelope, and the requests it received
+func replyWith(t *testing.T, data interface{}) (*httptest.Server, *[]received) {
+	var (
+		mu       sync.Mutex
+		requests []received
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests = append(requests, received{
+			method:        r.Method,
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		})
+		mu.Unlock()
+
+		writeEnvelope(w, http.StatusOK, map[string]interface{}{"success": true, "message": "ok", "data": data})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &requests
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, envelope map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope)
+}
+
+// sameJSON reports whether a and b encode the same JSON value
+func sameJSON(t *testing.T, a, b string) bool {
+	var x, y interface{}
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatalf("decoding %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestClientActions(t *testing.T) {
+	user := sdk.User{ID: 7, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", Active: true}
+	token := sdk.Token{Token: "ABCDEF", Expiry: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}
+	created := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context, c *Client) (interface{}, error)
+		data interface{}
+		body string
+		auth bool
+		want interface{}
+	}{
+		{
+			name: "Authenticate",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Authenticate(ctx, "ada@example.com", "pa55word")
+			},
+			data: user,
+			body: `{"action":"auth","auth":{"email":"ada@example.com","password":"pa55word"}}`,
+			want: &user,
+		},
+		{
+			name: "Register",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Register(ctx, sdk.NewUser{FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", Password: "pa55word"})
+			},
+			data: sdk.CreatedUser{User: &user},
+			body: `{"action":"register","register":{"firstname":"Ada","lastname":"Lovelace","email":"ada@example.com","password":"pa55word"}}`,
+			want: &sdk.CreatedUser{User: &user},
+		},
+		{
+			name: "Login",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Login(ctx, "ada@example.com", "pa55word")
+			},
+			data: token,
+			body: `{"action":"login","auth":{"email":"ada@example.com","password":"pa55word"}}`,
+			want: &token,
+		},
+		{
+			name: "Logout",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return nil, c.Logout(ctx)
+			},
+			body: `{"action":"logout"}`,
+			auth: true,
+		},
+		{
+			name: "ListSessions",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ListSessions(ctx)
+			},
+			data: []sdk.Session{{ID: "1", Expiry: token.Expiry, Current: true}},
+			body: `{"action":"sessions"}`,
+			auth: true,
+			want: []sdk.Session{{ID: "1", Expiry: token.Expiry, Current: true}},
+		},
+		{
+			name: "GetUser",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.GetUser(ctx, 7)
+			},
+			data: user,
+			body: `{"action":"getuser","user":{"id":7}}`,
+			auth: true,
+			want: &user,
+		},
+		{
+			name: "ListUsers",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ListUsers(ctx, []int64{7, 8})
+			},
+			data: []sdk.User{user},
+			body: `{"action":"getusers","user":{"ids":[7,8]}}`,
+			auth: true,
+			want: []sdk.User{user},
+		},
+		{
+			name: "ListRoles",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.ListRoles(ctx)
+			},
+			data: []sdk.Role{{ID: sdk.RoleAdmin, Name: "admin", Scopes: []string{"users:write"}}},
+			body: `{"action":"roles"}`,
+			auth: true,
+			want: []sdk.Role{{ID: sdk.RoleAdmin, Name: "admin", Scopes: []string{"users:write"}}},
+		},
+		{
+			name: "Log",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return nil, c.Log(ctx, LogEntry{Service: "billing", Level: "warn", Message: "card declined", Data: map[string]interface{}{"user_id": 7}})
+			},
+			body: `{"action":"log","log":{"service":"billing","level":"warn","message":"card declined","data":{"user_id":7}}}`,
+			auth: true,
+		},
+		{
+			name: "SendMail",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return nil, c.SendMail(ctx, Mail{To: "ada@example.com", Template: "welcome", Locale: "en"})
+			},
+			body: `{"action":"mail","mail":{"to":"ada@example.com","template":"welcome","locale":"en"}}`,
+			auth: true,
+		},
+		{
+			name: "Submit",
+			call: func(ctx context.Context, c *Client) (interface{}, error) {
+				return c.Submit(ctx, Request{Action: ActionGetUser, User: &UserRef{ID: 7}})
+			},
+			data: Job{ID: "job-1", Action: ActionGetUser, Status: JobPending, CreatedAt: created},
+			body: `{"action":"getuser","async":true,"user":{"id":7}}`,
+			auth: true,
+			want: &Job{ID: "job-1", Action: ActionGetUser, Status: JobPending, CreatedAt: created},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := replyWith(t, tt.data)
+
+			c, err := New(srv.URL, sdk.WithToken("TOKEN"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tt.call(context.Background(), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			if len(*requests) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(*requests))
+			}
+			r := (*requests)[0]
+
+			if r.method != http.MethodPost || r.path != "/handle" {
+				t.Errorf("sent %s %s, want POST /handle", r.method, r.path)
+			}
+			if !sameJSON(t, r.body, tt.body) {
+				t.Errorf("sent body %s, want %s", r.body, tt.body)
+			}
+
+			wantAuthorization := ""
+			if tt.auth {
+				wantAuthorization = "Bearer TOKEN"
+			}
+			if r.authorization != wantAuthorization {
+				t.Errorf("sent Authorization %q, want %q", r.authorization, wantAuthorization)
+			}
+		})
+	}
+}
+
+func TestGetJob(t *testing.T) {
+	result := json.RawMessage(`{"id":7}`)
+	srv, requests := replyWith(t, Job{ID: "job-1", Action: ActionGetUser, Status: JobSucceeded, Result: result})
+
+	c, err := New(srv.URL, sdk.WithToken("TOKEN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := c.GetJob(context.Background(), "job-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !job.Done() || string(job.Result) != `{"id":7}` {
+		t.Errorf("got job %+v, want a succeeded job with its result", job)
+	}
+
+	r := (*requests)[0]
+	if r.method != http.MethodGet || r.path != "/jobs/job-1" || r.authorization != "Bearer TOKEN" {
+		t.Errorf("sent %s %s with Authorization %q, want GET /jobs/job-1 with the token", r.method, r.path, r.authorization)
+	}
+}
+
+func TestWaitJobPollsUntilDone(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		polls    int
+		finishAt = 3
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls++
+		status := JobRunning
+		if polls == finishAt {
+			status = JobFailed
+		}
+		mu.Unlock()
+
+		writeEnvelope(w, http.StatusOK, map[string]interface{}{"success": true, "message": "ok", "data": Job{ID: "job-1", Status: status, Error: "boom"}})
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := c.WaitJob(context.Background(), "job-1", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if job.Status != JobFailed || polls != 3 {
+		t.Errorf("got status %q after %d polls, want failed after 3", job.Status, polls)
+	}
+	mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// a job that never finishes
+	mu.Lock()
+	finishAt = 0
+	mu.Unlock()
+
+	_, err = c.WaitJob(ctx, "job-1", time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waiting past the deadline: err %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	srv, requests := replyWith(t, []BatchResult{
+		{ID: "a", Status: http.StatusOK, Success: true, Message: "ok", Data: json.RawMessage(`{"id":7,"email":"ada@example.com"}`)},
+		{ID: "b", Status: http.StatusForbidden, Error: true, Message: "missing required scope \"logs:write\""},
+	})
+
+	c, err := New(srv.URL, sdk.WithToken("TOKEN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := c.Batch(context.Background(), []BatchItem{
+		{ID: "a", Request: Request{Action: ActionGetUser, User: &UserRef{ID: 7}}},
+		{ID: "b", Request: Request{Action: ActionLog, Log: &LogEntry{Service: "billing", Message: "hi"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := (*requests)[0]
+	if r.method != http.MethodPost || r.path != "/handle/batch" || r.authorization != "Bearer TOKEN" {
+		t.Errorf("sent %s %s with Authorization %q, want POST /handle/batch with the token", r.method, r.path, r.authorization)
+	}
+	want := `[{"id":"a","action":"getuser","user":{"id":7}},{"id":"b","action":"log","log":{"service":"billing","message":"hi"}}]`
+	if !sameJSON(t, r.body, want) {
+		t.Errorf("sent body %s, want %s", r.body, want)
+	}
+
+	var user sdk.User
+	err = results[0].Decode(&user)
+	if err != nil || user.ID != 7 || user.Email != "ada@example.com" {
+		t.Errorf("first result: user %+v, err %v", user, err)
+	}
+
+	err = results[1].Decode(&user)
+	if !errors.Is(err, sdk.ErrForbidden) {
+		t.Errorf("second result: err %v, want ErrForbidden", err)
+	}
+
+	_, err = c.Batch(context.Background(), nil)
+	if err == nil || len(*requests) != 1 {
+		t.Errorf("empty batch: err %v after %d requests, want an error without a request", err, len(*requests))
+	}
+}
+
+func TestRefreshesRejectedTokenThroughBroker(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		logins  int
+		actions []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if req.Action == ActionLogin {
+			logins++
+			token := "REVOKED"
+			if logins > 1 {
+				token = "FRESH"
+			}
+			writeEnvelope(w, http.StatusOK, map[string]interface{}{"success": true, "message": "ok", "data": sdk.Token{Token: token}})
+			return
+		}
+
+		actions = append(actions, req.Action+" "+r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer FRESH" {
+			writeEnvelope(w, http.StatusUnauthorized, map[string]interface{}{"error": true, "message": "invalid or expired token"})
+			return
+		}
+		writeEnvelope(w, http.StatusOK, map[string]interface{}{"success": true, "message": "ok", "data": sdk.User{ID: 7}})
+	}))
+	defer srv.Close()
+
+	var c *Client
+	c, err := New(srv.URL, sdk.WithTokenSource(sdk.RefreshingTokenSource(func(ctx context.Context) (*sdk.Token, error) {
+		return c.Login(ctx, "ada@example.com", "pa55word")
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := c.GetUser(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 7 {
+		t.Errorf("got user %d, want 7", user.ID)
+	}
+
+	want := []string{"getuser Bearer REVOKED", "getuser Bearer FRESH"}
+	if logins != 2 || !reflect.DeepEqual(actions, want) {
+		t.Errorf("logged in %d times and sent %v, want 2 logins and %v", logins, actions, want)
+	}
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rabin-nyaundi/sdk"
+)
+
+// Actions the broker dispatches
+const (
+	ActionAuth     = "auth"
+	ActionRegister = "register"
+	ActionLogin    = "login"
+	ActionLogout   = "logout"
+	ActionSessions = "sessions"
+	ActionGetUser  = "getuser"
+	ActionGetUsers = "getusers"
+	ActionRoles    = "roles"
+	ActionLog      = "log"
+	ActionMail     = "mail"
+)
+
+// Request names an action and, in the member named after its kind, its input
+type Request struct {
+	Action   string       `json:"action"`
+	Async    bool         `json:"async,omitempty"`
+	Auth     *Credentials `json:"auth,omitempty"`
+	Register *sdk.NewUser `json:"register,omitempty"`
+	User     *UserRef     `json:"user,omitempty"`
+	Log      *LogEntry    `json:"log,omitempty"`
+	Mail     *Mail        `json:"mail,omitempty"`
+}
+
+// Credentials are the email and password of a user
+type Credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// UserRef identifies the users a request is about
+type UserRef struct {
+	ID  int64   `json:"id,omitempty"`
+	IDs []int64 `json:"ids,omitempty"`
+}
+
+// LogEntry is an application log entry. The level defaults to info.
+type LogEntry struct {
+	Service string                 `json:"service"`
+	Level   string                 `json:"level,omitempty"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Mail is a templated email to send
+type Mail struct {
+	To       string                 `json:"to"`
+	Template string                 `json:"template"`
+	Locale   string                 `json:"locale,omitempty"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// BatchItem is one request of a batch, identified by an id unique within it
+type BatchItem struct {
+	ID string `json:"id"`
+	Request
+}
+
+// BatchResult is the outcome of one item of a batch
+type BatchResult struct {
+	ID      string          `json:"id"`
+	Status  int             `json:"status"`
+	Error   bool            `json:"error,omitempty"`
+	Success bool            `json:"success,omitempty"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Err returns the failure of the item as an *sdk.APIError, or nil when it
+// succeeded
+func (r *BatchResult) Err() error {
+	if !r.Error && r.Status < http.StatusBadRequest {
+		return nil
+	}
+	return &sdk.APIError{StatusCode: r.Status, Message: r.Message}
+}
+
+// Decode decodes the data of a successful item into v
+func (r *BatchResult) Decode(v interface{}) error {
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if len(r.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+// Job statuses
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is an action run in the background
+type Job struct {
+	ID         string          `json:"id"`
+	Action     string          `json:"action"`
+	Status     string          `json:"status"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// Done reports whether the job reached a final status
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
@@ -0,0 +1,80 @@
+package sdk
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Errors matched by the *APIError a client returns, using errors.Is. The
+// status errors match every response with that status, the others match the
+// specific message the services answer with.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrTooLarge     = errors.New("request too large")
+	ErrValidation   = errors.New("validation failed")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServer       = errors.New("server error")
+	ErrUnavailable  = errors.New("service unavailable")
+
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidToken       = errors.New("invalid or expired token")
+	ErrAccountLocked      = errors.New("this account is locked")
+	ErrAdminRequired      = errors.New("this resource requires an admin authentication token")
+	ErrDuplicateEmail     = errors.New("user with email already exists")
+)
+
+// statusErrors maps response statuses to the error they match
+var statusErrors = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusUnprocessableEntity:   ErrValidation,
+	http.StatusTooManyRequests:       ErrRateLimited,
+	http.StatusInternalServerError:   ErrServer,
+	http.StatusBadGateway:            ErrUnavailable,
+	http.StatusServiceUnavailable:    ErrUnavailable,
+	http.StatusGatewayTimeout:        ErrUnavailable,
+}
+
+// messageErrors maps the messages of the services' error responses to the
+// error they match. The services do not send error codes, so the message is
+// the only way to tell these apart.
+var messageErrors = map[string]error{
+	"invalid credentials":                                  ErrInvalidCredentials,
+	"invalid or expired token":                             ErrInvalidToken,
+	"this account is locked":                               ErrAccountLocked,
+	"user wit email already exist":                         ErrDuplicateEmail,
+	"this resource requires an admin authentication token": ErrAdminRequired,
+}
+
+// APIError is an error response of a service
+type APIError struct {
+	StatusCode int
+	Message    string
+
+	// RetryAfter is how long the service asked the caller to wait before
+	// retrying, when it did
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is reports whether target is the status error or message error of e
+func (e *APIError) Is(target error) bool {
+	if err, ok := statusErrors[e.StatusCode]; ok && err == target {
+		return true
+	}
+	if err, ok := messageErrors[e.Message]; ok && err == target {
+		return true
+	}
+	return e.StatusCode >= http.StatusInternalServerError && target == ErrServer
+}
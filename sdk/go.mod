@@ -0,0 +1,3 @@
+module github.com/rabin-nyaundi/sdk
+
+go 1.18
@@ -0,0 +1,197 @@
+// Package rest sends requests to the services and decodes the JSON envelope
+// every response is wrapped in
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rabin-nyaundi/sdk"
+)
+
+// maxResponseBytes is the largest response body read
+const maxResponseBytes = 10 << 20
+
+// envelope is the body of every response
+type envelope struct {
+	Error   bool            `json:"error"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Client sends requests to one service
+type Client struct {
+	baseURL *url.URL
+	opts    sdk.Options
+}
+
+// New returns a client of the service at baseURL
+func New(baseURL string, opts ...sdk.Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing base url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("base url %q must be an http or https url", baseURL)
+	}
+
+	return &Client{baseURL: u, opts: sdk.NewOptions(opts...)}, nil
+}
+
+// Request is a request to the service
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   interface{}
+
+	// Auth makes the request carry a bearer token from the token source
+	Auth bool
+}
+
+// Response is the decoded envelope of a successful response
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Message    string
+}
+
+// Do sends the request and decodes the data of the response into out, which
+// may be nil. Error responses are returned as *sdk.APIError. A request
+// answered with 401 is retried once with a new token when the token source
+// can replace the rejected one.
+func (c *Client) Do(ctx context.Context, req *Request, out interface{}) (*Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := json.Marshal(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("encoding request body: %w", err)
+		}
+		body = b
+	}
+
+	res, token, err := c.send(ctx, req, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized && token != "" {
+		if inv, ok := c.opts.TokenSource.(sdk.Invalidator); ok {
+			res.Body.Close()
+			inv.Invalidate(token)
+
+			res, _, err = c.send(ctx, req, body)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	defer res.Body.Close()
+
+	return decode(res, out)
+}
+
+// send sends one attempt of the request, returning the bearer token it
+// carried when it came from the token source
+func (c *Client) send(ctx context.Context, req *Request, body []byte) (*http.Response, string, error) {
+	u := *c.baseURL
+	u.Path += req.Path
+	if len(req.Query) > 0 {
+		u.RawQuery = req.Query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, u.String(), r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.Header.Set("User-Agent", c.opts.UserAgent)
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+
+	if req.Auth && c.opts.ServiceToken != "" {
+		httpReq.Header.Set("X-Service-Token", c.opts.ServiceToken)
+	}
+
+	var fromSource string
+
+	if req.Auth && c.opts.TokenSource != nil {
+		token, err := c.opts.TokenSource.Token(ctx)
+		if err != nil {
+			return nil, "", fmt.Errorf("getting token: %w", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token.Token)
+		fromSource = token.Token
+	}
+
+	res, err := c.opts.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return res, fromSource, nil
+}
+
+func decode(res *http.Response, out interface{}) (*Response, error) {
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	var env envelope
+
+	err = json.Unmarshal(data, &env)
+	if err != nil && res.StatusCode < http.StatusBadRequest {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	if res.StatusCode >= http.StatusBadRequest || env.Error {
+		apiErr := &sdk.APIError{
+			StatusCode: res.StatusCode,
+			Message:    env.Message,
+			RetryAfter: retryAfter(res.Header.Get("Retry-After")),
+		}
+		if apiErr.StatusCode < http.StatusBadRequest {
+			apiErr.StatusCode = http.StatusBadRequest
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return nil, apiErr
+	}
+
+	if out != nil && len(env.Data) > 0 {
+		err = json.Unmarshal(env.Data, out)
+		if err != nil {
+			return nil, fmt.Errorf("decoding response data: %w", err)
+		}
+	}
+
+	return &Response{StatusCode: res.StatusCode, Header: res.Header, Message: env.Message}, nil
+}
+
+// retryAfter parses a Retry-After header given in seconds
+func retryAfter(v string) time.Duration {
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
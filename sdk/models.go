@@ -0,0 +1,62 @@
+package sdk
+
+import "time"
+
+// Role ids
+const (
+	RoleUser  = 0
+	RoleAdmin = 1
+)
+
+// User is a user of the authentication service
+type User struct {
+	ID        int64     `json:"id"`
+	FirstName string    `json:"firstname"`
+	LastName  string    `json:"lastname"`
+	Email     string    `json:"email"`
+	Active    bool      `json:"active"`
+	Locked    bool      `json:"locked"`
+	Role      int       `json:"role"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	UpdatedAt time.Time `json:"UpdatedAt"`
+}
+
+// Role describes what the users holding it are allowed to do
+type Role struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// NewUser holds the details of a user to create
+type NewUser struct {
+	FirstName string `json:"firstname"`
+	LastName  string `json:"lastname"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
+// CreatedUser is a newly created, inactive user. The activation token is
+// only returned by services configured to echo tokens, in development.
+type CreatedUser struct {
+	User            *User  `json:"user"`
+	ActivationToken *Token `json:"activation_token,omitempty"`
+}
+
+// Session is an unexpired authentication token of a user
+type Session struct {
+	ID      string    `json:"id"`
+	Expiry  time.Time `json:"expiry"`
+	Current bool      `json:"current"`
+}
+
+// Introspection reports whether an authentication token is active and who
+// it belongs to
+type Introspection struct {
+	Active     bool     `json:"active"`
+	UserID     int64    `json:"user_id,omitempty"`
+	Email      string   `json:"email,omitempty"`
+	UserActive bool     `json:"user_active,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	Expiry     int64    `json:"exp,omitempty"`
+}
@@ -0,0 +1,86 @@
+// Package sdk holds what the clients of the broker and the authentication
+// service share: the options they are created with, the resources they
+// return, bearer token sources and the errors the services answer with.
+//
+// The clients are in the auth and broker packages:
+//
+//	users, err := auth.New("http://authentication-service")
+//	...
+//	b, err := broker.New("http://broker-service",
+//		sdk.WithTokenSource(users.TokenSource("admin@example.com", password)))
+//	...
+//	user, err := b.GetUser(ctx, 7)
+//	if errors.Is(err, sdk.ErrForbidden) {
+//		...
+//	}
+package sdk
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout bounds requests made with the default HTTP client
+const DefaultTimeout = 30 * time.Second
+
+// Options configure a client
+type Options struct {
+	HTTPClient   *http.Client
+	TokenSource  TokenSource
+	ServiceToken string
+	UserAgent    string
+}
+
+// Option sets one of the Options of a client
+type Option func(*Options)
+
+// WithHTTPClient makes the client send its requests with c, for example to
+// add tracing or change timeouts and TLS settings
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *Options) {
+		o.HTTPClient = c
+	}
+}
+
+// WithTokenSource makes the client send a bearer token from ts with every
+// request that needs one
+func WithTokenSource(ts TokenSource) Option {
+	return func(o *Options) {
+		o.TokenSource = ts
+	}
+}
+
+// WithToken makes the client send token with every request that needs one
+func WithToken(token string) Option {
+	return WithTokenSource(StaticTokenSource(token))
+}
+
+// WithServiceToken makes the client send a service token of the
+// authentication service with every request that needs a credential, for
+// services looking up users and introspecting tokens
+func WithServiceToken(token string) Option {
+	return func(o *Options) {
+		o.ServiceToken = token
+	}
+}
+
+// WithUserAgent sets the User-Agent header of the client's requests
+func WithUserAgent(ua string) Option {
+	return func(o *Options) {
+		o.UserAgent = ua
+	}
+}
+
+// NewOptions applies opts over the defaults
+func NewOptions(opts ...Option) Options {
+	o := Options{
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		UserAgent:  "rabin-nyaundi-sdk",
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
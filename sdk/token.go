@@ -0,0 +1,90 @@
+package sdk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// expiryDelta is how long before its expiry a token is replaced, so a token
+// does not expire between being read and reaching the service
+const expiryDelta = time.Minute
+
+// Token is an authentication token
+type Token struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// Valid reports whether the token is set and not about to expire
+func (t *Token) Valid() bool {
+	return t != nil && t.Token != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > expiryDelta)
+}
+
+// TokenSource returns the bearer token to send with a request
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// Invalidator is implemented by token sources that can replace a token the
+// service rejected. Clients invalidate the token and retry once when a
+// request is answered with 401.
+type Invalidator interface {
+	Invalidate(token string)
+}
+
+// StaticTokenSource returns a token source that always returns token
+func StaticTokenSource(token string) TokenSource {
+	return staticTokenSource(token)
+}
+
+type staticTokenSource string
+
+func (s staticTokenSource) Token(ctx context.Context) (*Token, error) {
+	return &Token{Token: string(s)}, nil
+}
+
+// RefreshFunc returns a new token, typically by logging in again
+type RefreshFunc func(ctx context.Context) (*Token, error)
+
+// RefreshingTokenSource returns a token source that calls refresh for a new
+// token when it has none, its token is about to expire or its token was
+// invalidated. Concurrent callers share one refresh.
+func RefreshingTokenSource(refresh RefreshFunc) TokenSource {
+	return &refreshingTokenSource{refresh: refresh}
+}
+
+type refreshingTokenSource struct {
+	refresh RefreshFunc
+
+	mu    sync.Mutex
+	token *Token
+}
+
+func (s *refreshingTokenSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token.Valid() {
+		return s.token, nil
+	}
+
+	token, err := s.refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.token = token
+	return token, nil
+}
+
+// Invalidate drops the token if it is still the current one, so a token
+// refreshed by another request meanwhile is kept
+func (s *refreshingTokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != nil && s.token.Token == token {
+		s.token = nil
+	}
+}
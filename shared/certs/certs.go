@@ -0,0 +1,252 @@
+// Package certs builds TLS configurations from certificate files and keeps
+// them current when the files are rotated, without restarting listeners or
+// clients.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Files names the PEM files of a TLS configuration
+type Files struct {
+	// CertFile and KeyFile hold the certificate chain presented to peers
+	// and its private key
+	CertFile string
+	KeyFile  string
+
+	// CAFile holds the authorities peer certificates must be signed by.
+	// Empty trusts the system roots for servers and asks clients for no
+	// certificate.
+	CAFile string
+}
+
+// Store holds the certificate and authorities last loaded from the files.
+// Configurations built from it see reloads at the next handshake.
+type Store struct {
+	files   Files
+	current atomic.Pointer[loaded]
+}
+
+type loaded struct {
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+// Load reads the files into a store
+func Load(files Files) (*Store, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("a certificate and its key must be provided together")
+	}
+
+	s := &Store{files: files}
+
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload reads the files again. On error the store keeps what it held, so a
+// rotation caught halfway, a new certificate with the old key, is retried
+// at the next reload.
+func (s *Store) Reload() error {
+	var next loaded
+
+	if s.files.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.files.CertFile, s.files.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		next.cert = &cert
+	}
+
+	if s.files.CAFile != "" {
+		pem, err := os.ReadFile(s.files.CAFile)
+		if err != nil {
+			return err
+		}
+
+		next.pool = x509.NewCertPool()
+		if !next.pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.files.CAFile)
+		}
+	}
+
+	s.current.Store(&next)
+	return nil
+}
+
+// Files returns the paths of the files of the store, to watch for rotation
+func (s *Store) Files() []string {
+	var files []string
+	for _, file := range []string{s.files.CertFile, s.files.KeyFile, s.files.CAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// NotAfter returns when the certificate expires, zero without one
+func (s *Store) NotAfter() time.Time {
+	cert := s.current.Load().cert
+	if cert == nil {
+		return time.Time{}
+	}
+	return cert.Leaf.NotAfter
+}
+
+// ServerConfig returns the configuration of a server presenting the
+// certificate. With a CA file clients must present a certificate signed by
+// one of its authorities, which authorize, when not nil, may still refuse
+// by returning an error; the handshake then fails.
+func (s *Store) ServerConfig(authorize func(cert *x509.Certificate) error) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := s.current.Load().cert
+			if cert == nil {
+				return nil, errors.New("no server certificate")
+			}
+			return cert, nil
+		},
+	}
+
+	if s.files.CAFile == "" {
+		return cfg
+	}
+
+	// ClientCAs cannot change once the config is in use, so the chain is
+	// verified here against the authorities last loaded
+	cfg.ClientAuth = tls.RequireAnyClientCert
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		leaf, err := s.verify(cs.PeerCertificates, "", x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			return err
+		}
+
+		if authorize != nil {
+			return authorize(leaf)
+		}
+		return nil
+	}
+
+	return cfg
+}
+
+// ClientConfig returns the configuration of a client presenting the
+// certificate, when there is one, and verifying servers against the
+// authorities of the CA file, or the system roots without one
+func (s *Store) ClientConfig(serverName string, insecureSkipVerify bool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if s.files.CertFile != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return s.current.Load().cert, nil
+		}
+	}
+
+	if s.files.CAFile == "" || insecureSkipVerify {
+		return cfg
+	}
+
+	// as for servers RootCAs is fixed, so the standard verification is
+	// replaced by the same one against the authorities last loaded. The
+	// connection only knows the name sent in SNI, never an IP address, so
+	// servers reached by address need serverName.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		name := serverName
+		if name == "" {
+			name = cs.ServerName
+		}
+		if name == "" {
+			return errors.New("tls: a server name is needed to verify a server reached by IP address")
+		}
+
+		_, err := s.verify(cs.PeerCertificates, name, x509.ExtKeyUsageServerAuth)
+		return err
+	}
+
+	return cfg
+}
+
+// verify checks the peer chain against the authorities of the store and
+// returns its leaf
+func (s *Store) verify(chain []*x509.Certificate, name string, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("tls: peer presented no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         s.current.Load().pool,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain[0], nil
+}
+
+// SANs returns the subject alternative names of the certificate: DNS names,
+// URIs such as spiffe://example.org/broker, email and IP addresses
+func SANs(cert *x509.Certificate) []string {
+	var names []string
+
+	names = append(names, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return names
+}
+
+// AllowSANs returns an authorize function for ServerConfig accepting the
+// certificates with one of the names among their SANs. No names accepts
+// every certificate.
+func AllowSANs(names []string) func(cert *x509.Certificate) error {
+	return func(cert *x509.Certificate) error {
+		if len(names) == 0 {
+			return nil
+		}
+
+		for _, san := range SANs(cert) {
+			for _, name := range names {
+				if san == name {
+					return nil
+				}
+			}
+		}
+
+		return fmt.Errorf("tls: client certificate %q is not authorized", cert.Subject.CommonName)
+	}
+}
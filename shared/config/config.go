@@ -0,0 +1,411 @@
+// Package config layers the settings of a service over its flags. Every
+// setting is a flag, and its value is taken from the first of:
+//
+//  1. the command line, -db-dsn
+//  2. the environment variable named after the flag, PREFIX_DB_DSN
+//  3. the file named by PREFIX_DB_DSN_FILE, as Docker secrets are mounted
+//  4. the YAML or TOML file given with -config or PREFIX_CONFIG
+//  5. the flag's default
+//
+// In the config file a setting is named after its flag, either flat or
+// nested on the dashes of the flag name, so db-dsn is also db: {dsn: ...}.
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sourceDefault = "default"
+	sourceFlag    = "command line"
+)
+
+// Loader loads the flags of a flag set from the layered sources
+type Loader struct {
+	fs      *flag.FlagSet
+	prefix  string
+	secrets map[string]bool
+	sources map[string]string
+
+	file  string
+	print bool
+
+	// IgnoreUnknown accepts config file settings that are not flags of the
+	// flag set, for tools reading the config file of a service
+	IgnoreUnknown bool
+}
+
+// New returns a loader of the flags of fs, reading environment variables
+// named PREFIX_NAME. It defines the -config and -print-config flags on fs.
+func New(fs *flag.FlagSet, prefix string) *Loader {
+	l := &Loader{
+		fs:      fs,
+		prefix:  prefix,
+		secrets: map[string]bool{},
+		sources: map[string]string{},
+	}
+
+	fs.StringVar(&l.file, "config", "", "YAML or TOML config file")
+	fs.BoolVar(&l.print, "print-config", false, "Print the configuration, secrets redacted, and exit")
+
+	return l
+}
+
+// Secret marks flags whose values are redacted when printed
+func (l *Loader) Secret(names ...string) {
+	for _, name := range names {
+		l.secrets[name] = true
+	}
+}
+
+// EnvName returns the environment variable of a flag
+func (l *Loader) EnvName(name string) string {
+	return l.prefix + "_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// File returns the path of the config file, empty when there is none
+func (l *Loader) File() string {
+	return l.file
+}
+
+// Args returns the arguments left after the flags
+func (l *Loader) Args() []string {
+	return l.fs.Args()
+}
+
+// PrintRequested reports whether -print-config was given
+func (l *Loader) PrintRequested() bool {
+	return l.print
+}
+
+// Load parses the command line args and fills every flag it did not set
+// from the environment, secret files and config file, in that order
+func (l *Loader) Load(args []string) error {
+	err := l.fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	l.fs.Visit(func(f *flag.Flag) {
+		l.sources[f.Name] = sourceFlag
+	})
+
+	var errs []string
+
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if l.sources[f.Name] != "" {
+			return
+		}
+
+		err := l.loadEnv(f)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+
+	if l.file == "" {
+		return nil
+	}
+
+	return l.loadFile(l.file)
+}
+
+// loadEnv sets the flag from its environment variable or secret file
+func (l *Loader) loadEnv(f *flag.Flag) error {
+	name := l.EnvName(f.Name)
+
+	value, inEnv := os.LookupEnv(name)
+	path, inFile := os.LookupEnv(name + "_FILE")
+
+	switch {
+	case inEnv && inFile:
+		return fmt.Errorf("both %s and %s_FILE are set", name, name)
+
+	case inEnv:
+		return l.set(f.Name, value, "env "+name)
+
+	case inFile:
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		return l.set(f.Name, strings.TrimRight(string(b), "\r\n"), "file "+path)
+	}
+
+	return nil
+}
+
+// loadFile sets the flags no other source set from the config file
+func (l *Loader) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	doc := map[string]interface{}{}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		return fmt.Errorf("config file %s: unknown format %q, use .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	settings := map[string]string{}
+
+	err = flatten("", doc, settings)
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+
+	for _, name := range names {
+		switch {
+		case l.fs.Lookup(name) == nil:
+			if !l.IgnoreUnknown {
+				errs = append(errs, fmt.Sprintf("config file %s: unknown setting %q", path, name))
+			}
+
+		case name == "config":
+			errs = append(errs, fmt.Sprintf("config file %s: config cannot be set in a config file", path))
+
+		case l.sources[name] == "":
+			err := l.set(name, settings[name], "config file "+path)
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// flatten names the scalars of a config file document after flags, joining
+// nested keys with dashes. Lists become comma separated values.
+func flatten(prefix string, doc map[string]interface{}, settings map[string]string) error {
+	for key, v := range doc {
+		name := strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		if nested, ok := v.(map[string]interface{}); ok {
+			err := flatten(name, nested, settings)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := scalar(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if _, ok := settings[name]; ok {
+			return fmt.Errorf("%s is set twice", name)
+		}
+		settings[name] = value
+	}
+	return nil
+}
+
+func scalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			values[i] = s
+		}
+		return strings.Join(values, ","), nil
+	}
+
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// set sets a flag, naming the source in the error of an invalid value
+func (l *Loader) set(name, value, source string) error {
+	err := l.fs.Set(name, value)
+	if err != nil {
+		if l.secrets[name] {
+			return fmt.Errorf("%s: invalid value for -%s: %v", source, name, err)
+		}
+		return fmt.Errorf("%s: invalid value %q for -%s: %v", source, value, name, err)
+	}
+
+	l.sources[name] = source
+	return nil
+}
+
+// Print writes the configuration as a YAML config file, each setting
+// commented with where its value came from. Secrets and the passwords of
+// URLs and connection strings are redacted.
+func (l *Loader) Print(w io.Writer) error {
+	var err error
+
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+
+		source := l.sources[f.Name]
+		if source == "" {
+			source = sourceDefault
+		}
+
+		_, err = fmt.Fprintf(w, "%s: %s # %s\n", f.Name, strconv.Quote(l.redact(f.Name, f.Value.String())), source)
+	})
+
+	return err
+}
+
+// Changed returns the settings whose values differ between l and other,
+// loaders of the same flags
+func (l *Loader) Changed(other *Loader) []string {
+	var changed []string
+
+	l.fs.VisitAll(func(f *flag.Flag) {
+		o := other.fs.Lookup(f.Name)
+		if o == nil || o.Value.String() != f.Value.String() {
+			changed = append(changed, f.Name)
+		}
+	})
+
+	return changed
+}
+
+// Hash returns a short digest of the settings and of extra, such as the
+// contents of other files the service reads, to tell configurations apart.
+// Secrets are hashed redacted, so the digest tells nothing about them.
+func (l *Loader) Hash(extra ...[]byte) string {
+	h := sha256.New()
+
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "print-config" {
+			fmt.Fprintf(h, "%s=%s\n", f.Name, l.redact(f.Name, f.Value.String()))
+		}
+	})
+
+	for _, b := range extra {
+		h.Write(b)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+const redacted = "REDACTED"
+
+var passwordParam = regexp.MustCompile(`(?i)\b(password=)(\S+)`)
+
+func (l *Loader) redact(name, value string) string {
+	if value == "" {
+		return value
+	}
+
+	if l.secrets[name] {
+		return redacted
+	}
+
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+
+	return passwordParam.ReplaceAllString(value, "${1}"+redacted)
+}
+
+// List is a flag of comma separated values. Setting it replaces the values.
+type List []string
+
+func (l *List) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(s string) error {
+	*l = nil
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// Problems collects what is wrong with a configuration, so a service
+// reports every problem at once instead of the first
+type Problems []string
+
+// Check records the problem when ok is false
+func (p *Problems) Check(ok bool, format string, v ...interface{}) {
+	if !ok {
+		*p = append(*p, fmt.Sprintf(format, v...))
+	}
+}
+
+// Err returns the problems as an error, nil when there are none
+func (p Problems) Err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+func (p Problems) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(p, "\n\t")
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Watch calls reload when the process receives SIGHUP and when one of the
+// files changes, checking them every interval, until ctx is done. With an
+// interval of 0 only SIGHUP triggers a reload.
+func Watch(ctx context.Context, interval time.Duration, files []string, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 && len(files) > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	stamps := stat(files)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			stamps = stat(files)
+
+		case <-tick:
+			next := stat(files)
+			if equal(next, stamps) {
+				continue
+			}
+			stamps = next
+		}
+
+		reload()
+	}
+}
+
+// stat returns the modification time and size of each file, empty for
+// files that cannot be read
+func stat(files []string) []string {
+	stamps := make([]string, len(files))
+
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err == nil {
+			stamps[i] = fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+
+	return stamps
+}
+
+func equal(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
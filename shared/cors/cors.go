@@ -0,0 +1,373 @@
+// Package cors answers cross-origin requests from allowlists of origins,
+// with a default policy and per route overrides.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Any is the origin pattern allowing every origin. Credentials are never
+// allowed to it.
+const Any = "*"
+
+// Policy is how cross-origin requests to a group of routes are answered
+type Policy struct {
+	// AllowedOrigins holds exact origins, https://app.example.com, and
+	// wildcard patterns, https://*.example.com, matching every subdomain
+	// of example.com but not example.com itself. Empty allows none.
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight response. Zero
+	// leaves it to the browser; a negative duration asks it not to cache.
+	MaxAge time.Duration
+}
+
+// Route overrides the policy of the paths it matches
+type Route struct {
+	// Path is an exact path, /health, or a prefix ending in /*, /admin/*
+	Path   string
+	Policy Policy
+}
+
+// ParseRoutes parses PATH=ORIGIN ORIGIN... entries into routes with the
+// base policy and the origins of the entry. PATH= allows no origin.
+func ParseRoutes(entries []string, base Policy) ([]Route, error) {
+	routes := make([]Route, 0, len(entries))
+
+	for _, entry := range entries {
+		path, origins, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("route %q must be PATH=ORIGIN ORIGIN..., PATH starting with /", entry)
+		}
+
+		policy := base
+		policy.AllowedOrigins = strings.Fields(origins)
+		routes = append(routes, Route{Path: path, Policy: policy})
+	}
+
+	return routes, nil
+}
+
+// policy is a Policy ready to match requests
+type policy struct {
+	Policy
+	name      string
+	any       bool
+	exact     map[string]bool
+	wildcards []wildcard
+	methods   map[string]bool
+	headers   map[string]bool
+}
+
+// wildcard matches the subdomains of a domain
+type wildcard struct {
+	scheme string
+	suffix string
+	port   string
+}
+
+func compile(name string, p Policy) (*policy, error) {
+	c := &policy{
+		Policy:  p,
+		name:    name,
+		exact:   map[string]bool{},
+		methods: map[string]bool{},
+		headers: map[string]bool{},
+	}
+
+	for _, pattern := range p.AllowedOrigins {
+		if pattern == Any {
+			c.any = true
+			c.AllowCredentials = false
+			continue
+		}
+
+		scheme, host, port, err := parseOrigin(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(host, "*.") {
+			c.exact[scheme+"://"+joinPort(host, port)] = true
+			continue
+		}
+
+		domain := strings.TrimPrefix(host, "*.")
+		if !strings.Contains(domain, ".") || strings.Contains(domain, "*") {
+			return nil, fmt.Errorf("origin %q: a wildcard must be followed by a domain such as example.com", pattern)
+		}
+		c.wildcards = append(c.wildcards, wildcard{scheme: scheme, suffix: "." + domain, port: port})
+	}
+
+	for _, method := range p.AllowedMethods {
+		c.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range p.AllowedHeaders {
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	return c, nil
+}
+
+// parseOrigin splits an origin into its lowercase scheme, host and port,
+// leaving out the default port of the scheme as browsers do
+func parseOrigin(origin string) (scheme, host, port string, err error) {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", "", fmt.Errorf("origin %q must be scheme://host[:port], http or https", origin)
+	}
+
+	host, port = u.Hostname(), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+
+	return u.Scheme, host, port, nil
+}
+
+func joinPort(host, port string) string {
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+// allows reports whether the origin may make cross-origin requests
+func (p *policy) allows(origin string) bool {
+	if p.any {
+		return true
+	}
+
+	scheme, host, port, err := parseOrigin(origin)
+	if err != nil || strings.Contains(host, "*") {
+		return false
+	}
+
+	if p.exact[scheme+"://"+joinPort(host, port)] {
+		return true
+	}
+
+	for _, w := range p.wildcards {
+		if scheme == w.scheme && port == w.port && len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler answers cross-origin requests with the policy of their path
+type Handler struct {
+	def     *policy
+	routes  []route
+	metrics *Metrics
+}
+
+type route struct {
+	path   string
+	prefix bool
+	policy *policy
+}
+
+// New returns a handler applying the default policy to every path no route
+// matches. The first matching route applies. metrics may be nil.
+func New(def Policy, routes []Route, metrics *Metrics) (*Handler, error) {
+	h := &Handler{metrics: metrics}
+
+	var err error
+	h.def, err = compile("default", def)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range routes {
+		c, err := compile(r.Path, r.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", r.Path, err)
+		}
+
+		rt := route{path: r.Path, policy: c}
+		if strings.HasSuffix(r.Path, "/*") {
+			rt.path, rt.prefix = strings.TrimSuffix(r.Path, "*"), true
+		}
+		h.routes = append(h.routes, rt)
+	}
+
+	return h, nil
+}
+
+// policyFor returns the policy of the path
+func (h *Handler) policyFor(path string) *policy {
+	for _, r := range h.routes {
+		if path == r.path || (r.prefix && strings.HasPrefix(path, r.path)) {
+			return r.policy
+		}
+	}
+	return h.def
+}
+
+// AllowsOrigin reports whether the request comes from its own origin or from
+// one the policy of its path allows. Requests without an Origin header, sent
+// by clients other than browsers, are allowed. Handlers that bypass the
+// browser's CORS checks, such as WebSocket upgrades, use it to enforce the
+// policy themselves.
+func (h *Handler) AllowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(r, origin) {
+		return true
+	}
+
+	p := h.policyFor(r.URL.Path)
+	if !p.allows(origin) {
+		h.metrics.count(p.name, "rejected_origin")
+		return false
+	}
+	return true
+}
+
+// Wrap returns next behind the handler. Preflight requests are answered
+// here; other requests are always passed on, with the CORS headers when
+// their origin is allowed, so the browser decides what the page may read.
+func (h *Handler) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, next)
+	})
+}
+
+// serve answers the request, passing it on to next unless it is a preflight
+// request
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	p := h.policyFor(r.URL.Path)
+	origin := r.Header.Get("Origin")
+
+	if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.preflight(w, r, p, origin)
+		return
+	}
+
+	w.Header().Add("Vary", "Origin")
+
+	if origin == "" || sameOrigin(r, origin) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if !p.allows(origin) {
+		h.metrics.count(p.name, "rejected_origin")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	h.metrics.count(p.name, "allowed")
+	h.allowOrigin(w, p, origin)
+	if len(p.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+func (h *Handler) preflight(w http.ResponseWriter, r *http.Request, p *policy, origin string) {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	if !p.allows(origin) {
+		h.reject(w, p, "rejected_origin")
+		return
+	}
+
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	if !p.methods[method] {
+		h.reject(w, p, "rejected_method")
+		return
+	}
+
+	requested, err := requestedHeaders(r)
+	if err != nil {
+		h.reject(w, p, "rejected_headers")
+		return
+	}
+	for _, name := range requested {
+		if !p.headers[name] {
+			h.reject(w, p, "rejected_headers")
+			return
+		}
+	}
+
+	h.metrics.count(p.name, "preflight")
+	h.allowOrigin(w, p, origin)
+	header.Set("Access-Control-Allow-Methods", method)
+	if len(requested) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+
+	switch {
+	case p.MaxAge > 0:
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	case p.MaxAge < 0:
+		header.Set("Access-Control-Max-Age", "0")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reject answers a preflight request without CORS headers, so the browser
+// does not send the request it describes
+func (h *Handler) reject(w http.ResponseWriter, p *policy, outcome string) {
+	h.metrics.count(p.name, outcome)
+	w.WriteHeader(http.StatusForbidden)
+}
+
+func (h *Handler) allowOrigin(w http.ResponseWriter, p *policy, origin string) {
+	if p.any && !p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+var errHeaderName = errors.New("invalid header name")
+
+// requestedHeaders returns the canonical names of the headers a preflight
+// request asks for
+func requestedHeaders(r *http.Request) ([]string, error) {
+	var names []string
+
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if strings.ContainsAny(name, " \t\"(),/:;<=>?@[\\]{}") {
+				return nil, errHeaderName
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	return names, nil
+}
+
+// sameOrigin reports whether the origin is the host the request was sent
+// to; browsers send Origin on some same-origin requests too
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,41 @@
+package cors
+
+import (
+	"expvar"
+	"strings"
+)
+
+// Metrics counts the cross-origin requests handled, by the route whose
+// policy applied and by outcome: allowed, preflight, rejected_origin,
+// rejected_method and rejected_headers. It outlives the handlers built
+// when policies are reloaded.
+type Metrics struct {
+	counts *expvar.Map
+}
+
+// NewMetrics returns metrics published as the expvar variable of the name.
+// Names must be unique in the process.
+func NewMetrics(name string) *Metrics {
+	return &Metrics{counts: expvar.NewMap(name)}
+}
+
+func (m *Metrics) count(route, outcome string) {
+	if m != nil {
+		m.counts.Add(route+" "+outcome, 1)
+	}
+}
+
+// Snapshot returns the counts by route and outcome
+func (m *Metrics) Snapshot() map[string]map[string]int64 {
+	snapshot := map[string]map[string]int64{}
+
+	m.counts.Do(func(kv expvar.KeyValue) {
+		route, outcome, _ := strings.Cut(kv.Key, " ")
+		if snapshot[route] == nil {
+			snapshot[route] = map[string]int64{}
+		}
+		snapshot[route][outcome] = kv.Value.(*expvar.Int).Value()
+	})
+
+	return snapshot
+}
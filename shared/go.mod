@@ -0,0 +1,9 @@
+module github.com/rabin-nyaundi/shared
+
+go 1.19
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/go-chi/chi/v5 v5.0.7
+	gopkg.in/yaml.v3 v3.0.1
+)
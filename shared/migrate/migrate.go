@@ -0,0 +1,353 @@
+// Package migrate applies SQL migrations to a PostgreSQL database. The
+// version is kept in a schema_migrations table of the same layout as the
+// one golang-migrate uses, so databases migrated with its CLI carry on
+// where it stopped.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// NoVersion is the version of a database no migration was applied to
+const NoVersion = -1
+
+// lockID is the advisory lock held while migrating, so replicas starting
+// together apply each migration once
+const lockID = 7_301_002
+
+var (
+	ErrDirty          = errors.New("database is dirty")
+	ErrUnknownVersion = errors.New("no migration with this version")
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration is a pair of up and down SQL scripts
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies the migrations of a directory to a database
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+
+	// Logf, when set, is called after each migration is applied
+	Logf func(format string, v ...interface{})
+}
+
+// New loads the NNNNNN_name.up.sql and NNNNNN_name.down.sql files at the
+// root of fsys
+func New(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil || entry.IsDir() {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrator := &Migrator{db: db}
+	for _, m := range byVersion {
+		migrator.migrations = append(migrator.migrations, m)
+	}
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].Version < migrator.migrations[j].Version
+	})
+
+	return migrator, nil
+}
+
+// Latest returns the version of the last migration, or NoVersion when there
+// are none
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return NoVersion
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the version of the database and whether a migration to it
+// failed part way
+func (m *Migrator) Version(ctx context.Context) (int64, bool, error) {
+	var exists bool
+
+	err := m.db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return NoVersion, false, err
+	}
+
+	return version(ctx, m.db)
+}
+
+// Up applies every pending migration and returns how many there were
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	return m.Goto(ctx, m.Latest())
+}
+
+// Down reverts the last n applied migrations and returns how many it
+// reverted, fewer when there were not as many
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	reverted := 0
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		current, err := m.current(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for ; reverted < n && current != NoVersion; reverted++ {
+			current, err = m.down(ctx, conn, current)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Goto applies or reverts migrations until the database is at the version,
+// which is NoVersion or a migration's version, and returns how many it ran
+func (m *Migrator) Goto(ctx context.Context, target int64) (int, error) {
+	if target != NoVersion && m.index(target) < 0 {
+		return 0, fmt.Errorf("%w %d", ErrUnknownVersion, target)
+	}
+
+	steps := 0
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		current, err := m.current(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for current < target {
+			current, err = m.up(ctx, conn, current)
+			if err != nil {
+				return err
+			}
+			steps++
+		}
+
+		for current > target {
+			current, err = m.down(ctx, conn, current)
+			if err != nil {
+				return err
+			}
+			steps++
+		}
+		return nil
+	})
+
+	return steps, err
+}
+
+// Force sets the version, clearing the dirty flag, without running any
+// migration. It is used after repairing a failed migration by hand.
+func (m *Migrator) Force(ctx context.Context, target int64) error {
+	if target != NoVersion && m.index(target) < 0 {
+		return fmt.Errorf("%w %d", ErrUnknownVersion, target)
+	}
+
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		return setVersion(ctx, conn, target, false)
+	})
+}
+
+// current returns the clean version of the database
+func (m *Migrator) current(ctx context.Context, conn *sql.Conn) (int64, error) {
+	current, dirty, err := version(ctx, conn)
+	if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return 0, fmt.Errorf("%w at version %d, repair it and force a version", ErrDirty, current)
+	}
+
+	if current != NoVersion && m.index(current) < 0 {
+		return 0, fmt.Errorf("database is at version %d: %w", current, ErrUnknownVersion)
+	}
+
+	return current, nil
+}
+
+// up applies the migration after current and returns its version
+func (m *Migrator) up(ctx context.Context, conn *sql.Conn, current int64) (int64, error) {
+	next := m.migrations[m.index(current)+1]
+
+	err := m.run(ctx, conn, next.Version, next.Up)
+	if err != nil {
+		return 0, fmt.Errorf("migration %d %s up: %w", next.Version, next.Name, err)
+	}
+
+	m.logf("applied %d %s", next.Version, next.Name)
+	return next.Version, nil
+}
+
+// down reverts the current migration and returns the version before it
+func (m *Migrator) down(ctx context.Context, conn *sql.Conn, current int64) (int64, error) {
+	i := m.index(current)
+	migration := m.migrations[i]
+
+	previous := int64(NoVersion)
+	if i > 0 {
+		previous = m.migrations[i-1].Version
+	}
+
+	err := m.run(ctx, conn, previous, migration.Down)
+	if err != nil {
+		return 0, fmt.Errorf("migration %d %s down: %w", migration.Version, migration.Name, err)
+	}
+
+	m.logf("reverted %d %s", migration.Version, migration.Name)
+	return previous, nil
+}
+
+// run marks the database dirty at the version it moves to, runs the script
+// and marks it clean. A failed script leaves it dirty, as golang-migrate
+// does, because the statements run before the failing one are not undone.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, to int64, script string) error {
+	err := setVersion(ctx, conn, to, true)
+	if err != nil {
+		return err
+	}
+
+	if script != "" {
+		_, err = conn.ExecContext(ctx, script)
+		if err != nil {
+			return err
+		}
+	}
+
+	return setVersion(ctx, conn, to, false)
+}
+
+// index returns the position of the migration with the version, -1 for
+// NoVersion and for unknown versions
+func (m *Migrator) index(version int64) int {
+	for i, migration := range m.migrations {
+		if migration.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Migrator) logf(format string, v ...interface{}) {
+	if m.Logf != nil {
+		m.Logf(format, v...)
+	}
+}
+
+// locked runs fn on a connection holding the migration lock, creating the
+// version table first. The lock is a session lock, so it is taken and
+// released on the connection fn uses.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID)
+	if err != nil {
+		return fmt.Errorf("taking migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Conn
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func version(ctx context.Context, q queryer) (int64, bool, error) {
+	var (
+		v     int64
+		dirty bool
+	)
+
+	err := q.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&v, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NoVersion, false, nil
+	}
+	return v, dirty, err
+}
+
+// setVersion replaces the version row; NoVersion leaves the table empty
+func setVersion(ctx context.Context, conn *sql.Conn, v int64, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `TRUNCATE schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if v != NoVersion {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, v, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,331 @@
+// Package openapi serves an OpenAPI 3.1 document and validates requests
+// against it. Only the parts of the specification the services use are
+// understood: path, query and JSON body parameters described with a subset of
+// JSON Schema (see Schema).
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxBodyBytes is the largest request body the validator reads
+const maxBodyBytes = 1_048_576
+
+// Document is a parsed OpenAPI document
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+
+	raw       []byte
+	templates []*template
+	resolved  map[*Schema]bool
+}
+
+// PathItem holds the operations of a path, keyed by lower case method
+type PathItem map[string]*Operation
+
+// Operation describes the parameters and body one method of a path accepts
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *Schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// Parameter is a path or query parameter. Other locations are not validated.
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// template is a path split into segments, where parameters are the
+// segments written {name}
+type template struct {
+	path     string
+	segments []string
+	literals int
+}
+
+// Load parses the document and resolves every schema reference, so a
+// broken reference is found at startup rather than on a request
+func Load(data []byte) (*Document, error) {
+	var doc Document
+
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing openapi document: %w", err)
+	}
+
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported openapi version %q", doc.OpenAPI)
+	}
+
+	doc.raw = data
+	doc.resolved = map[*Schema]bool{}
+
+	for path, item := range doc.Paths {
+		t := &template{path: path, segments: strings.Split(strings.Trim(path, "/"), "/")}
+		for _, s := range t.segments {
+			if !isParam(s) {
+				t.literals++
+			}
+		}
+		doc.templates = append(doc.templates, t)
+
+		for method, op := range *item {
+			for _, p := range op.Parameters {
+				if err := doc.resolve(p.Schema); err != nil {
+					return nil, fmt.Errorf("%s %s parameter %s: %w", strings.ToUpper(method), path, p.Name, err)
+				}
+			}
+			if body := op.jsonBody(); body != nil {
+				if err := doc.resolve(body); err != nil {
+					return nil, fmt.Errorf("%s %s request body: %w", strings.ToUpper(method), path, err)
+				}
+			}
+		}
+	}
+
+	// the most specific template wins, as in the router
+	sort.Slice(doc.templates, func(i, j int) bool {
+		return doc.templates[i].literals > doc.templates[j].literals
+	})
+
+	return &doc, nil
+}
+
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// jsonBody returns the schema of the operation's JSON request body, if any
+func (op *Operation) jsonBody() *Schema {
+	if op.RequestBody == nil {
+		return nil
+	}
+	return op.RequestBody.Content["application/json"].Schema
+}
+
+// ServeHTTP serves the document as JSON
+func (d *Document) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d.raw)
+}
+
+// find returns the operation and path parameters matching the request
+func (d *Document) find(r *http.Request) (*Operation, map[string]string) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	for _, t := range d.templates {
+		if len(t.segments) != len(segments) {
+			continue
+		}
+
+		params := map[string]string{}
+		matched := true
+		for i, s := range t.segments {
+			switch {
+			case isParam(s):
+				params[strings.Trim(s, "{}")] = segments[i]
+			case s != segments[i]:
+				matched = false
+			}
+			if !matched {
+				break
+			}
+		}
+
+		if matched {
+			return (*d.Paths[t.path])[strings.ToLower(r.Method)], params
+		}
+	}
+
+	return nil, nil
+}
+
+// Validate returns middleware checking requests against the operation the
+// document describes for them. Malformed JSON bodies are reported with 400,
+// parameters and bodies not matching their schema with 422. Requests the
+// document does not describe are passed on for the router to answer.
+func (d *Document) Validate(onError func(w http.ResponseWriter, r *http.Request, status int, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			op, pathParams := d.find(r)
+			if op == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			status, err := d.validateRequest(w, r, op, pathParams)
+			if err != nil {
+				onError(w, r, status, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (d *Document) validateRequest(w http.ResponseWriter, r *http.Request, op *Operation, pathParams map[string]string) (int, error) {
+	query := r.URL.Query()
+
+	for _, p := range op.Parameters {
+		var (
+			value   string
+			present bool
+		)
+
+		switch p.In {
+		case "path":
+			value, present = pathParams[p.Name]
+		case "query":
+			present = query.Has(p.Name)
+			value = query.Get(p.Name)
+		default:
+			continue
+		}
+
+		if !present {
+			if p.Required {
+				return http.StatusUnprocessableEntity, fmt.Errorf("%s parameter %s must be provided", p.In, p.Name)
+			}
+			continue
+		}
+
+		err := p.Schema.validate(p.Name, p.Schema.coerce(value))
+		if err != nil {
+			return http.StatusUnprocessableEntity, err
+		}
+	}
+
+	schema := op.jsonBody()
+	if schema == nil || schema.empty() {
+		return 0, nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("body must not be larger than %d bytes", maxBodyBytes)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return http.StatusBadRequest, errors.New("body must not be empty")
+		}
+		return 0, nil
+	}
+
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+
+	err = dec.Decode(&v)
+	if err != nil {
+		return http.StatusBadRequest, errors.New("body contains badly formed JSON")
+	}
+
+	err = schema.validate("body", v)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+
+	return 0, nil
+}
+
+// CheckRoutes reports the routes of the router the document does not
+// describe and the operations it describes that the router lacks
+func (d *Document) CheckRoutes(routes chi.Routes) error {
+	documented := map[string]bool{}
+	for path, item := range d.Paths {
+		for method := range *item {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	var problems []string
+
+	err := chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if len(route) > 1 {
+			route = strings.TrimSuffix(route, "/")
+		}
+
+		key := method + " " + route
+		if !documented[key] {
+			problems = append(problems, key+" is not in the openapi document")
+		}
+		delete(documented, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key := range documented {
+		problems = append(problems, key+" is documented but not routed")
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("openapi document does not match the routes:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// The docs page loads this ReDoc release rather than the latest one, checked
+// against redocIntegrity, so a changed or compromised bundle on the CDN is
+// not run. redoc-sri.sh prints the hash of redocBundle; change both together.
+const (
+	redocBundle    = "https://cdn.jsdelivr.net/npm/redoc@2.1.5/bundles/redoc.standalone.js"
+	redocIntegrity = ""
+)
+
+// DocsHandler serves a page rendering the document at specURL
+func DocsHandler(title, specURL string) http.Handler {
+	script := fmt.Sprintf(`<script src="%s" crossorigin="anonymous"></script>`, redocBundle)
+	if redocIntegrity != "" {
+		script = fmt.Sprintf(`<script src="%s" integrity="%s" crossorigin="anonymous"></script>`, redocBundle, redocIntegrity)
+	}
+
+	page := fmt.Sprintf(docsPage, html.EscapeString(title), html.EscapeString(specURL), script)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	})
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>%s</title>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+</head>
+<body>
+<redoc spec-url="%s"></redoc>
+%s
+</body>
+</html>
+`
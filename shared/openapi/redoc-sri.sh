@@ -0,0 +1,12 @@
+#!/bin/sh
+# Prints the subresource integrity hash of the ReDoc bundle the docs page
+# loads, the value of redocIntegrity in openapi.go
+set -e
+
+cd "$(dirname "$0")"
+
+url=$(sed -n 's/^[[:space:]]*redocBundle *= "\(.*\)"$/\1/p' openapi.go)
+
+printf 'sha384-'
+curl -fsSL "$url" | openssl dgst -sha384 -binary | openssl base64 -A
+echo
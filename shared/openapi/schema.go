@@ -0,0 +1,263 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is the subset of JSON Schema 2020-12 the validator understands.
+// Other keywords are accepted in the document but not enforced.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 types              `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Format               string             `json:"format"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+
+	resolved *Schema
+}
+
+// types is a schema type, written either as a string or, for nullable
+// values, as a list such as ["string", "null"]
+type types []string
+
+func (t *types) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*t = types{one}
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(data, &many)
+	*t = many
+	return err
+}
+
+// resolve follows the $ref of the schema and its subschemas. Schemas are
+// visited once, so components referenced many times or recursively are fine.
+func (d *Document) resolve(s *Schema) error {
+	if s == nil || d.resolved[s] {
+		return nil
+	}
+	d.resolved[s] = true
+
+	if s.Ref != "" {
+		target, ok := d.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+		if !ok || !strings.HasPrefix(s.Ref, "#/components/schemas/") {
+			return fmt.Errorf("unknown schema reference %q", s.Ref)
+		}
+		s.resolved = target
+		return d.resolve(target)
+	}
+
+	for _, p := range s.Properties {
+		if err := d.resolve(p); err != nil {
+			return err
+		}
+	}
+	return d.resolve(s.Items)
+}
+
+// target returns the schema a reference points to
+func (s *Schema) target() *Schema {
+	if s.Ref != "" {
+		return s.resolved.target()
+	}
+	return s
+}
+
+// empty reports whether the schema accepts any value
+func (s *Schema) empty() bool {
+	s = s.target()
+	return len(s.Type) == 0 && len(s.Properties) == 0 && len(s.Required) == 0 && len(s.Enum) == 0
+}
+
+// coerce converts a parameter string to the type of the schema, leaving it
+// unchanged when it does not parse so the type check reports it
+func (s *Schema) coerce(value string) interface{} {
+	if s == nil {
+		return value
+	}
+
+	for _, t := range s.target().Type {
+		switch t {
+		case "integer", "number":
+			if _, err := strconv.ParseFloat(value, 64); err == nil {
+				return json.Number(value)
+			}
+		case "boolean":
+			if b, err := strconv.ParseBool(value); err == nil {
+				return b
+			}
+		}
+	}
+	return value
+}
+
+// validate checks the decoded JSON value, which must have been decoded with
+// UseNumber, and names the offending value by its path
+func (s *Schema) validate(path string, v interface{}) error {
+	if s == nil {
+		return nil
+	}
+	s = s.target()
+
+	if len(s.Type) > 0 && !s.hasType(v) {
+		return fmt.Errorf("%s must be of type %s", path, strings.Join(s.Type, " or "))
+	}
+
+	if len(s.Enum) > 0 && !s.inEnum(v) {
+		return fmt.Errorf("%s must be one of %s", path, s.enumList())
+	}
+
+	switch v := v.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			if *s.MinLength == 1 {
+				return fmt.Errorf("%s must not be empty", path)
+			}
+			return fmt.Errorf("%s must be at least %d characters long", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s must not be more than %d characters long", path, *s.MaxLength)
+		}
+		return s.validateFormat(path, v)
+
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", path, *s.Maximum)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s must contain at least %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s must not contain more than %d items", path, *s.MaxItems)
+		}
+		for i, item := range v {
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if item, ok := v[name]; !ok || item == nil {
+				return fmt.Errorf("%s.%s must be provided", path, name)
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s contains unknown field %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(path+"."+name, v[name]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	for _, t := range s.Type {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if _, err := strconv.ParseInt(string(v), 10, 64); err == nil && t == "integer" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Schema) inEnum(v interface{}) bool {
+	for _, e := range s.Enum {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) enumList() string {
+	values := make([]string, len(s.Enum))
+	for i, e := range s.Enum {
+		values[i] = fmt.Sprint(e)
+	}
+	return strings.Join(values, ", ")
+}
+
+func (s *Schema) validateFormat(path, v string) error {
+	switch s.Format {
+	case "email":
+		addr, err := mail.ParseAddress(v)
+		if err != nil || addr.Address != v {
+			return fmt.Errorf("%s must be a valid email address", path)
+		}
+
+	case "uri":
+		u, err := url.Parse(v)
+		if err != nil || !u.IsAbs() {
+			return fmt.Errorf("%s must be an absolute URI", path)
+		}
+	}
+
+	return nil
+}